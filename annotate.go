@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// annotationPresets are the annotators of the annotate-proto presets,
+// deriving a tag from the proto name of the field.
+var annotationPresets = map[string]func(field string) string{
+	"bson": func(field string) string { return fmt.Sprintf(`bson:"%s,omitempty"`, field) },
+	"db":   func(field string) string { return fmt.Sprintf(`db:"%s"`, field) },
+	"gorm": func(field string) string { return fmt.Sprintf(`gorm:"column:%s"`, field) },
+	"yaml": func(field string) string { return fmt.Sprintf(`yaml:"%s,omitempty"`, field) },
+}
+
+// presetNames returns the names of the annotate-proto presets, sorted.
+func presetNames() []string {
+	var names []string
+	for name := range annotationPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presetAnnotator returns an annotator tagging every field with the tags
+// of the comma separated presets.
+func presetAnnotator(presets string) (protoFieldAnnotator, error) {
+	var annotators []func(string) string
+	for _, name := range strings.Split(presets, ",") {
+		annotator, ok := annotationPresets[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid -preset entry %q, must be one of %s", name, strings.Join(presetNames(), ", "))
+		}
+		annotators = append(annotators, annotator)
+	}
+	return func(_, field string) string {
+		var tags []string
+		for _, annotator := range annotators {
+			tags = append(tags, annotator(field))
+		}
+		return strings.Join(tags, " ")
+	}, nil
+}
+
+// runAnnotateProto annotates every field of proto files with the tags of
+// presets.
+func runAnnotateProto(_ options, args []string) error {
+	fs := flag.NewFlagSet("annotate-proto", flag.ContinueOnError)
+	presets := fs.String("preset", "", "comma separated presets to annotate fields with: "+strings.Join(presetNames(), ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *presets == "" || fs.NArg() == 0 {
+		return errors.New("usage: annotate-proto -preset name[,name...] proto...")
+	}
+	annotate, err := presetAnnotator(*presets)
+	if err != nil {
+		return err
+	}
+	return annotateProtoFiles(fs.Args(), annotate)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// isArchive reports whether path names a zip or tar archive, by its
+// extension.
+func isArchive(path string) bool {
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEntry injects tags into an entry of an archive, named
+// archive!name in errors and events, returning its new contents.
+type archiveEntry func(name string, contents []byte) ([]byte, error)
+
+// rewriteZip returns the zip archive src with the contents of its Go
+// files replaced by inject, other entries and headers being kept.
+func rewriteZip(src []byte, inject archiveEntry) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	w.SetComment(r.Comment)
+	for _, file := range r.File {
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(file.Name, ".go") {
+			if contents, err = inject(file.Name, contents); err != nil {
+				return nil, err
+			}
+		}
+		header := file.FileHeader
+		header.CRC32, header.CompressedSize64, header.UncompressedSize64 = 0, 0, 0
+		fw, err := w.CreateHeader(&header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fw.Write(contents); err != nil {
+			return nil, err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteTar returns the tar archive src, gzip compressed if compressed
+// is true, with the contents of its Go files replaced by inject, other
+// entries and headers being kept.
+func rewriteTar(src []byte, compressed bool, inject archiveEntry) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(src)
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gw *gzip.Writer
+	if compressed {
+		gw = gzip.NewWriter(&buf)
+		out = gw
+	}
+	tr, tw := tar.NewReader(r), tar.NewWriter(out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && strings.HasSuffix(header.Name, ".go") {
+			if contents, err = inject(header.Name, contents); err != nil {
+				return nil, err
+			}
+			header.Size = int64(len(contents))
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(contents); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// injectArchive injects tags into the Go files of the zip or tar archive
+// at path, writing the resulting archive to output, or back to path if
+// output is empty.
+func (inj *injector) injectArchive(path, output string) (*transaction, error) {
+	tx := &transaction{observer: inj.opts.observer(), mode: inj.opts.FileMode, backup: inj.opts.Backup}
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tx, err
+	}
+	var injected bool
+	inject := func(name string, contents []byte) ([]byte, error) {
+		entry := path + "!" + name
+		if inj.opts.interrupted() {
+			return nil, inject.ErrInterrupted
+		}
+		result, err := inj.injectSource(entry, contents)
+		if err != nil {
+			return nil, err
+		}
+		injected = injected || !bytes.Equal(result, contents)
+		return result, nil
+	}
+	var contents []byte
+	if strings.HasSuffix(path, ".zip") {
+		contents, err = rewriteZip(original, inject)
+	} else {
+		contents, err = rewriteTar(original, !strings.HasSuffix(path, ".tar"), inject)
+	}
+	if err != nil {
+		return tx, fmt.Errorf("archive %q: %w", path, err)
+	}
+	existing := original
+	if output != "" && output != path {
+		if existing, err = ioutil.ReadFile(output); err != nil && !os.IsNotExist(err) {
+			return tx, err
+		}
+	} else if output = path; !injected {
+		// leave the archive byte for byte as it was rather than
+		// compressing it again
+		contents = original
+	}
+	tx.files = append(tx.files, stagedFile{path: output, original: existing, contents: contents, injected: injected})
+	return tx, tx.commit()
+}
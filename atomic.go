@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic writes contents to the local file path through a
+// temporary file in the same directory renamed over it, so a crash or a
+// concurrent reader such as go build never sees a truncated file: path
+// has either its old contents or the new ones. The file gets the
+// permission bits mode if it isn't 0; otherwise an existing file keeps
+// its own and a new one is created 0666 less the umask. A symbolic link
+// at path is followed, its target being replaced.
+func writeFileAtomic(path string, contents []byte, mode os.FileMode) (err error) {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if mode == 0 {
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	tmp, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(contents); err != nil {
+		return err
+	}
+	// the contents must be on disk before the rename makes them visible
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if mode != 0 {
+		if err = os.Chmod(tmp.Name(), mode); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// createTemp creates a new temporary file next to path, named after it
+// with a leading dot and a .tmp suffix so walks for *.pb.go files skip
+// it. It is created 0666 less the umask, as a new path would be.
+func createTemp(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for {
+		name := filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 36)+".tmp")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// casEntry maps a staged file to the object holding its contents in a
+// content-addressed output directory.
+type casEntry struct {
+	// Path is the path of the file, see reportPath.
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+	// Object is the path of the object, relative to the directory.
+	Object string `json:"object"`
+}
+
+// writeCAS writes the contents of files into dir as objects named by
+// their SHA-256 hash, sharded by its first two characters as in
+// ab/abcdef..., instead of writing them in place, and the mapping from
+// file paths to objects as a JSON array of casEntry to mapping. Objects
+// already in dir are left alone, so the directory can be shared by runs.
+// Files are written with mode, see writeContents.
+func writeCAS(files []stagedFile, dir, mapping string, mode os.FileMode) ([]casEntry, error) {
+	entries := []casEntry{}
+	for _, file := range files {
+		sum := sha256.Sum256(file.contents)
+		digest := hex.EncodeToString(sum[:])
+		object := filepath.Join(digest[:2], digest)
+		entries = append(entries, casEntry{Path: reportPath(file.path), SHA256: digest, Size: len(file.contents), Object: filepath.ToSlash(object)})
+		path := filepath.Join(dir, object)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		// written atomically, so an interrupted run never leaves an
+		// object with the wrong contents
+		if err := writeContents(path, file.contents, mode); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return entries, writeContents(mapping, append(encoded, '\n'), mode)
+}
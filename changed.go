@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs git with args in dir and returns its stdout.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// changedFiles returns the absolute paths of the files of the git work
+// tree containing dir which differ from ref, committed or not, and of
+// the untracked files which aren't ignored. With ref HEAD, these are the
+// uncommitted changes.
+func changedFiles(dir, ref string) (map[string]bool, error) {
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := git(dir, "diff", "--name-only", "-z", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(dir, "ls-files", "--others", "--exclude-standard", "--full-name", "-z")
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, name := range strings.Split(string(diff)+string(untracked), "\x00") {
+		if name != "" {
+			changed[filepath.Join(strings.TrimSpace(string(root)), filepath.FromSlash(name))] = true
+		}
+	}
+	return changed, nil
+}
+
+// filterChanged returns the paths among paths in changed, as returned by
+// changedFiles. Object store URLs are kept, git knowing nothing of them.
+func filterChanged(paths []string, changed map[string]bool) ([]string, error) {
+	var filtered []string
+	for _, path := range paths {
+		if isObjectURL(path) {
+			filtered = append(filtered, path)
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		// git reports paths with symbolic links resolved
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		if changed[abs] {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered, nil
+}
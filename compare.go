@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// parseRuleSet parses a rule set file: the flags configuring the rules,
+// one per line without shell quoting, e.g. `-enum_tag=validate:"oneof"`.
+// Blank lines and lines starting with # are ignored.
+func parseRuleSet(path string, contents []byte) (options, error) {
+	var args []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+	return parseFlagArgs(path, args)
+}
+
+// parseFlagArgs parses args as the command line flags and returns the
+// options they configure, with the same validation, errors being
+// prefixed with source.
+func parseFlagArgs(source string, args []string) (options, error) {
+	return parseFlagArgsWith(source, args, nil)
+}
+
+// parseFlagArgsWith is parseFlagArgs with the proto files described by
+// ds unless args set -descriptor_set, see cliFlags.descriptors.
+func parseFlagArgsWith(source string, args []string, ds *descriptorSet) (options, error) {
+	flags := cliFlags{descriptors: ds}
+	fs := flag.NewFlagSet(source, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flags.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return options{}, fmt.Errorf("%s: %v", source, err)
+	}
+	if fs.NArg() > 0 {
+		return options{}, fmt.Errorf("%s: %q is not a flag", source, fs.Arg(0))
+	}
+	opts, err := flags.options()
+	if err != nil {
+		return options{}, fmt.Errorf("%s: %v", source, err)
+	}
+	return opts, nil
+}
+
+// loadRuleSet reads the rule set file at path, see parseRuleSet.
+func loadRuleSet(path string) (options, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return options{}, err
+	}
+	return parseRuleSet(path, contents)
+}
+
+// compareRuleSets writes the unified diff between the files at paths
+// injected with oldRules and with newRules, returning the number of files
+// injected differently.
+func compareRuleSets(w io.Writer, oldRules, newRules options, paths []string) (int, error) {
+	oldRules.Observer, newRules.Observer = inject.NopObserver{}, inject.NopObserver{}
+	var files []stagedFile
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		before, err := newInjector(oldRules).injectSource(path, src)
+		if err != nil {
+			return 0, fmt.Errorf("old rules: %v", err)
+		}
+		after, err := newInjector(newRules).injectSource(path, src)
+		if err != nil {
+			return 0, fmt.Errorf("new rules: %v", err)
+		}
+		files = append(files, stagedFile{path: path, original: before, contents: after})
+	}
+	var changed int
+	for _, file := range files {
+		if file.changed() {
+			changed++
+		}
+	}
+	return changed, writeDiff(w, diffUnified, files)
+}
+
+// runCompare prints the delta between the tags two rule set files inject
+// into the given files, without writing them.
+func runCompare(_ options, args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	oldPath := fs.String("old", "", "rule set file of the current rules")
+	newPath := fs.String("new", "", "rule set file of the changed rules")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *oldPath == "" || *newPath == "" || fs.NArg() == 0 {
+		return errors.New("usage: compare -old rules -new rules file...")
+	}
+	oldRules, err := loadRuleSet(*oldPath)
+	if err != nil {
+		return err
+	}
+	newRules, err := loadRuleSet(*newPath)
+	if err != nil {
+		return err
+	}
+	changed, err := compareRuleSets(os.Stdout, oldRules, newRules, fs.Args())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d file(s) injected differently\n", changed)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completionShells are the shells the completion command writes scripts
+// for.
+var completionShells = []string{"bash", "fish", "zsh"}
+
+// completionWords returns the names of the commands and the flags of the
+// tool, sorted.
+func completionWords() (commandNames []string, flags []*flag.Flag) {
+	for name := range commands {
+		commandNames = append(commandNames, name)
+	}
+	commandNames = append(commandNames, "completion")
+	sort.Strings(commandNames)
+	var f cliFlags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	f.register(fs)
+	// VisitAll visits flags sorted by name
+	fs.VisitAll(func(flag *flag.Flag) {
+		flags = append(flags, flag)
+	})
+	return commandNames, flags
+}
+
+// writeCompletion writes the completion script of shell to w, completing
+// the commands as first argument, the flags and otherwise file names.
+func writeCompletion(w io.Writer, shell string) error {
+	commandNames, flags := completionWords()
+	var names []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+	}
+	switch shell {
+	case "bash":
+		_, err := fmt.Fprintf(w, `# bash completion of protoc-go-inject-tag, e.g. in ~/.bashrc:
+# source <(protoc-go-inject-tag completion bash)
+_protoc_go_inject_tag() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F _protoc_go_inject_tag protoc-go-inject-tag
+`, strings.Join(names, " "), strings.Join(commandNames, " "))
+		return err
+	case "zsh":
+		_, err := fmt.Fprintf(w, `#compdef protoc-go-inject-tag
+# zsh completion of protoc-go-inject-tag, e.g. in ~/.zshrc:
+# source <(protoc-go-inject-tag completion zsh)
+_protoc_go_inject_tag() {
+	if [[ $words[CURRENT] == -* ]]; then
+		compadd -- %s
+	elif (( CURRENT == 2 )); then
+		compadd -- %s
+		_files
+	else
+		_files
+	fi
+}
+compdef _protoc_go_inject_tag protoc-go-inject-tag
+`, strings.Join(names, " "), strings.Join(commandNames, " "))
+		return err
+	case "fish":
+		var b strings.Builder
+		b.WriteString("# fish completion of protoc-go-inject-tag, e.g.:\n")
+		b.WriteString("# protoc-go-inject-tag completion fish > ~/.config/fish/completions/protoc-go-inject-tag.fish\n")
+		fmt.Fprintf(&b, "complete -c protoc-go-inject-tag -n __fish_use_subcommand -a '%s'\n", strings.Join(commandNames, " "))
+		for _, f := range flags {
+			option := "-r"
+			if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+				option = "-f"
+			}
+			fmt.Fprintf(&b, "complete -c protoc-go-inject-tag -o %s %s -d '%s'\n", f.Name, option, fishQuoter.Replace(f.Usage))
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	return fmt.Errorf("unknown shell %q, must be one of %s", shell, strings.Join(completionShells, ", "))
+}
+
+// fishQuoter escapes strings in single quotes for fish.
+var fishQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// runCompletion writes the completion script of a shell to stdout.
+func runCompletion(_ options, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion " + strings.Join(completionShells, "|"))
+	}
+	return writeCompletion(os.Stdout, args[0])
+}
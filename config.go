@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lookupRuleFlag returns whether name is a rule flag and whether it can
+// be repeated.
+func lookupRuleFlag(name string) (known, repeatable bool) {
+	var flags cliFlags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.register(fs)
+	f := fs.Lookup(name)
+	if f == nil {
+		return false, false
+	}
+	switch f.Value.(type) {
+	case *tagTable, *inputList:
+		repeatable = true
+	}
+	return true, repeatable
+}
+
+// configKey returns the flag name of a line of a config file setting a
+// flag, ok is false for list items, blank and comment lines.
+func configKey(line string) (name string, ok bool) {
+	if line == "" || line != strings.TrimLeft(line, " \t") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+		return "", false
+	}
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return "", false
+	}
+	return strings.TrimSpace(line[:colon]), true
+}
+
+// configItem returns the value of a list item line of a config file, ok
+// is false for other lines.
+func configItem(line string) (value string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "- ") && trimmed != "-" {
+		return "", false
+	}
+	value, err := configScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+	return value, err == nil
+}
+
+// configInline returns the value given on the key line of a flag of a
+// config file, ok is false if its values are listed on the next lines.
+func configInline(line string) (value string, ok bool) {
+	rest := strings.TrimSpace(line[strings.Index(line, ":")+1:])
+	if rest == "" || strings.HasPrefix(rest, "#") {
+		return "", false
+	}
+	value, err := configScalar(rest)
+	return value, err == nil
+}
+
+// configValue returns value as a YAML scalar read back as is by
+// configScalar, quoted only if it has to be.
+func configValue(value string) string {
+	if value == "" || value != strings.TrimSpace(value) || strings.ContainsAny(value[:1], `"'[{#`) || strings.Contains(value, " #") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// editConfig applies a config subcommand to the lines of a config file,
+// see parseConfigFile: "set" sets the flag name to value, "add-rule"
+// adds value to the list of a repeatable flag and "remove-rule" removes
+// the flag, or only its value value if it isn't empty. Other lines,
+// comments included, are kept as is.
+func editConfig(lines []string, command, name, value string) ([]string, error) {
+	known, repeatable := lookupRuleFlag(name)
+	switch {
+	case !known || name == "config":
+		return nil, fmt.Errorf("unknown flag %q", name)
+	case command == "add-rule" && !repeatable:
+		return nil, fmt.Errorf("-%s can't be repeated, use config set", name)
+	case command == "set" && repeatable:
+		return nil, fmt.Errorf("-%s can be repeated, use config add-rule", name)
+	}
+	// the flag spans its key line and its list items, if any
+	start, end := -1, -1
+	for i, line := range lines {
+		if key, ok := configKey(line); ok && key == name {
+			start, end = i, i+1
+			for j := i + 1; j < len(lines); j++ {
+				if _, ok := configKey(lines[j]); ok {
+					break
+				}
+				if _, ok := configItem(lines[j]); ok {
+					end = j + 1
+				}
+			}
+			break
+		}
+	}
+	var block []string
+	switch command {
+	case "set":
+		block = []string{name + ": " + configValue(value)}
+	case "add-rule":
+		block = []string{name + ":"}
+		indent := "  "
+		if start >= 0 {
+			if current, ok := configInline(lines[start]); ok {
+				// a single value becomes the first item of the list
+				block = append(block, indent+"- "+configValue(current))
+			} else {
+				block = lines[start:end]
+			}
+			for _, line := range lines[start+1 : end] {
+				if _, ok := configItem(line); ok {
+					indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+				}
+			}
+		}
+		block = append(block[:len(block):len(block)], indent+"- "+configValue(value))
+	case "remove-rule":
+		if start < 0 {
+			return nil, fmt.Errorf("no -%s rule to remove", name)
+		}
+		if value == "" {
+			break
+		}
+		current, inline := configInline(lines[start])
+		removed := inline && current == value
+		var rest []string
+		var items bool
+		for _, line := range lines[start+1 : end] {
+			item, ok := configItem(line)
+			if ok && item == value {
+				removed = true
+				continue
+			}
+			rest, items = append(rest, line), items || ok
+		}
+		if !removed {
+			return nil, fmt.Errorf("no -%s rule %q to remove", name, value)
+		}
+		// a flag left without values is removed, it would be invalid
+		if items || inline && current != value {
+			block = append([]string{lines[start]}, rest...)
+		}
+	}
+	if start < 0 {
+		return append(append([]string{}, lines...), block...), nil
+	}
+	edited := append(append([]string{}, lines[:start]...), block...)
+	return append(edited, lines[end:]...), nil
+}
+
+// runConfig edits a config file, the default one if -file isn't given,
+// validating the result before writing it, so tools can manage rules
+// without templating the file.
+func runConfig(_ options, args []string) error {
+	usage := errors.New("usage: config set|add-rule|remove-rule [-file config] name [value]")
+	if len(args) == 0 {
+		return usage
+	}
+	command := args[0]
+	if command != "set" && command != "add-rule" && command != "remove-rule" {
+		return usage
+	}
+	fs := flag.NewFlagSet("config "+command, flag.ContinueOnError)
+	path := fs.String("file", defaultConfigFile, "config file to edit, created if missing")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *path == "" || fs.NArg() == 0 || fs.NArg() > 2 || command != "remove-rule" && fs.NArg() != 2 {
+		return usage
+	}
+	contents, err := ioutil.ReadFile(*path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(contents) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+	edited, err := editConfig(lines, command, strings.TrimLeft(fs.Arg(0), "-"), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	result := []byte(strings.Join(edited, "\n") + "\n")
+	if err = checkConfigFile(*path, result); err != nil {
+		return err
+	}
+	return writeFileAtomic(*path, result, 0)
+}
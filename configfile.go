@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultConfigFile is the config file read from the current directory
+// when -config is empty.
+const defaultConfigFile = ".protoc-go-inject-tag.yaml"
+
+// configEntry is a flag set by a config file, with its values if it is
+// given a list.
+type configEntry struct {
+	line   int
+	name   string
+	values []string
+	list   bool
+}
+
+// parseConfigFile parses a config file: a YAML mapping of flag names to
+// their value, or to a list of values for repeatable flags, e.g.
+//
+//	input:
+//	  - ./gen
+//	recursive: true
+//	field_tag:
+//	  - acme.v1.User.email=validate:"email"
+//
+// Only this subset of YAML is supported: plain, single and double quoted
+// scalars, block lists and comments.
+func parseConfigFile(path string, contents []byte) ([]configEntry, error) {
+	var entries []configEntry
+	for i, line := range strings.Split(string(contents), "\n") {
+		errorf := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, i+1, fmt.Sprintf(format, args...))
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if len(entries) == 0 || len(entries[len(entries)-1].values) > 0 && !entries[len(entries)-1].list {
+				return nil, errorf("list item outside of a list")
+			}
+			value, err := configScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			entry := &entries[len(entries)-1]
+			entry.values, entry.list = append(entry.values, value), true
+			continue
+		}
+		if line != trimmed {
+			return nil, errorf("unexpected indentation, only flags and lists of values are supported")
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, errorf("expected flag: value")
+		}
+		entry := configEntry{line: i + 1, name: strings.TrimSpace(line[:colon])}
+		if rest := strings.TrimSpace(line[colon+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			if strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "{") {
+				return nil, errorf("flow collections aren't supported, use a block list")
+			}
+			value, err := configScalar(rest)
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			entry.values = []string{value}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// configScalar returns the value of a YAML scalar, unquoting it and
+// removing its trailing comment.
+func configScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		var value strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				value.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				value.WriteByte('\'')
+				i++
+				continue
+			}
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after string", rest)
+			}
+			return value.String(), nil
+		}
+		return "", fmt.Errorf("unterminated string %s", s)
+	}
+	if comment := strings.Index(s, " #"); comment >= 0 {
+		s = s[:comment]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// applyConfigFile sets the flags of fs the config file at path sets,
+// unless they were given on the command line, which takes precedence. A
+// missing file is an error only if required, the default config file
+// being optional.
+func applyConfigFile(fs *flag.FlagSet, path string, required bool) error {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := parseConfigFile(path, contents)
+	if err != nil {
+		return err
+	}
+	return applyConfigEntries(fs, path, entries)
+}
+
+// applyConfigEntries sets the flags of fs to the entries of the config
+// file at path, skipping the flags given on the command line.
+func applyConfigEntries(fs *flag.FlagSet, path string, entries []configEntry) error {
+	set := setFlags(fs)
+	for _, entry := range entries {
+		known, repeatable := lookupRuleFlag(entry.name)
+		switch {
+		case !known || entry.name == "config":
+			return fmt.Errorf("%s:%d: unknown flag %q", path, entry.line, entry.name)
+		case entry.list && !repeatable:
+			return fmt.Errorf("%s:%d: -%s can't be repeated, give it a single value", path, entry.line, entry.name)
+		case len(entry.values) == 0:
+			return fmt.Errorf("%s:%d: -%s has no value", path, entry.line, entry.name)
+		case set[entry.name]:
+			continue
+		}
+		for _, value := range entry.values {
+			if err := fs.Set(entry.name, value); err != nil {
+				return fmt.Errorf("%s:%d: -%s: %v", path, entry.line, entry.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkConfigFile returns an error if contents, the contents of the
+// config file at path, don't parse or set invalid flags.
+func checkConfigFile(path string, contents []byte) error {
+	entries, err := parseConfigFile(path, contents)
+	if err != nil {
+		return err
+	}
+	var flags cliFlags
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flags.register(fs)
+	if err = applyConfigEntries(fs, path, entries); err != nil {
+		return err
+	}
+	if _, err = flags.options(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
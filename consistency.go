@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// messageCopy is the struct generated for a message in one file.
+type messageCopy struct {
+	path string
+	// tags are the field tags of the struct, keyed by field name.
+	tags map[string]string
+}
+
+// registeredMessages returns the structs of the Go source src whose
+// message full name is known, see registeredTypes, keyed by full name.
+// Files without any are never compared.
+func registeredMessages(path string, src []byte) (map[string]messageCopy, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, 0)
+	if err != nil {
+		return nil, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	structs := map[string]*ast.StructType{}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if typeSpec, ok := node.(*ast.TypeSpec); ok {
+			if structDecl, ok := typeSpec.Type.(*ast.StructType); ok {
+				structs[typeSpec.Name.Name] = structDecl
+			}
+		}
+		return true
+	})
+	messages := map[string]messageCopy{}
+	for typeName, fullName := range registeredTypes(f) {
+		structDecl, ok := structs[typeName]
+		if !ok {
+			continue
+		}
+		msg := messageCopy{path: path, tags: map[string]string{}}
+		for _, field := range structDecl.Fields.List {
+			msg.tags[fieldName(field)] = fieldTag(field)
+		}
+		messages[fullName] = msg
+	}
+	return messages, nil
+}
+
+// registeredTypes returns the message full names of f, keyed by Go type
+// name: the ones of the descriptor embedded by protoc-gen-go 1.20 and
+// later and the ones registered with proto.RegisterType by older
+// versions.
+func registeredTypes(f *ast.File) map[string]string {
+	registered := map[string]string{}
+	if fd := embeddedDescriptor(f); fd != nil {
+		for typeName, fullName := range fd.fullNames {
+			registered[typeName] = fullName
+		}
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok {
+			if typeName, fullName, ok := registerTypeCall(call); ok {
+				registered[typeName] = fullName
+			}
+		}
+		return true
+	})
+	return registered
+}
+
+// registerTypeCall matches `proto.RegisterType((*T)(nil), "full.Name")`,
+// returning T and the full name.
+func registerTypeCall(call *ast.CallExpr) (typeName, fullName string, ok bool) {
+	sel, isSel := call.Fun.(*ast.SelectorExpr)
+	if !isSel || sel.Sel.Name != "RegisterType" || len(call.Args) != 2 {
+		return
+	}
+	conv, isCall := call.Args[0].(*ast.CallExpr)
+	if !isCall {
+		return
+	}
+	paren, isParen := conv.Fun.(*ast.ParenExpr)
+	if !isParen {
+		return
+	}
+	star, isStar := paren.X.(*ast.StarExpr)
+	if !isStar {
+		return
+	}
+	ident, isIdent := star.X.(*ast.Ident)
+	lit, isLit := call.Args[1].(*ast.BasicLit)
+	if !isIdent || !isLit || lit.Kind != token.STRING {
+		return
+	}
+	fullName, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return
+	}
+	return ident.Name, fullName, true
+}
+
+// checkConsistency warns about messages generated in several of the
+// staged files, e.g. with multiple go_package splits, whose field tags
+// differ between copies once injected.
+func checkConsistency(files []stagedFile, obs observer) error {
+	copies := map[string][]messageCopy{}
+	for _, file := range files {
+		messages, err := registeredMessages(file.path, file.contents)
+		if err != nil {
+			return err
+		}
+		for fullName, msg := range messages {
+			copies[fullName] = append(copies[fullName], msg)
+		}
+	}
+	var fullNames []string
+	for fullName := range copies {
+		fullNames = append(fullNames, fullName)
+	}
+	sort.Strings(fullNames)
+	for _, fullName := range fullNames {
+		first := copies[fullName][0]
+		for _, other := range copies[fullName][1:] {
+			if drift := tagDrift(first.tags, other.tags); len(drift) > 0 {
+				obs.OnWarning(other.path, &inject.FieldError{File: other.path, Err: fmt.Errorf(
+					"message %s has different tags than in %q: %s", fullName, first.path, strings.Join(drift, ", "))})
+			}
+		}
+	}
+	return nil
+}
+
+// tagDrift returns the fields whose tags differ between two copies of a
+// message, sorted by name.
+func tagDrift(tags, other map[string]string) (fields []string) {
+	for name, tag := range tags {
+		if otherTag, ok := other[name]; !ok || otherTag != tag {
+			fields = append(fields, name)
+		}
+	}
+	for name := range other {
+		if _, ok := tags[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// optionalMessageTypes are well-known message types whose sole purpose is
+// to express optionality, so they are never inferred as required.
+var optionalMessageTypes = map[string]bool{
+	".google.protobuf.BoolValue":   true,
+	".google.protobuf.BytesValue":  true,
+	".google.protobuf.DoubleValue": true,
+	".google.protobuf.Empty":       true,
+	".google.protobuf.FieldMask":   true,
+	".google.protobuf.FloatValue":  true,
+	".google.protobuf.Int32Value":  true,
+	".google.protobuf.Int64Value":  true,
+	".google.protobuf.StringValue": true,
+	".google.protobuf.UInt32Value": true,
+	".google.protobuf.UInt64Value": true,
+}
+
+// eMoretags is the gogoproto.moretags field option, declaring extra tags
+// for gogo's generator.
+var eMoretags = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*string)(nil),
+	Field:         65006,
+	Name:          "gogoproto.moretags",
+	Tag:           "bytes,65006,opt,name=moretags",
+	Filename:      "gogo.proto",
+}
+
+// eFieldBehavior is the google.api.field_behavior field option of AIP
+// style APIs.
+var eFieldBehavior = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: ([]int32)(nil),
+	Field:         1052,
+	Name:          "google.api.field_behavior",
+	Tag:           "varint,1052,rep,name=field_behavior,enum=google.api.FieldBehavior",
+	Filename:      "google/api/field_behavior.proto",
+}
+
+// fieldBehaviorNames are the names of the google.api.FieldBehavior values.
+var fieldBehaviorNames = map[int32]string{
+	1: "OPTIONAL",
+	2: "REQUIRED",
+	3: "OUTPUT_ONLY",
+	4: "INPUT_ONLY",
+	5: "IMMUTABLE",
+	6: "UNORDERED_LIST",
+	7: "NON_EMPTY_DEFAULT",
+	8: "IDENTIFIER",
+}
+
+// defaultFieldBehaviorTags are the tags injected for field behaviors by
+// -field_behavior unless overridden with -field_behavior_tag.
+var defaultFieldBehaviorTags = map[string]string{
+	"REQUIRED":    `validate:"required"`,
+	"OUTPUT_ONLY": `json:",omitempty" readOnly:"true"`,
+	"IMMUTABLE":   `immutable:"true"`,
+}
+
+// behaviorTag returns tag, injected for a field behavior into a field
+// tagged current, with the json key of the field given to a json value
+// without one, such as the `json:",omitempty"` of OUTPUT_ONLY.
+func behaviorTag(tag, current string) string {
+	name := strings.Split(reflect.StructTag(current).Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return tag
+	}
+	items := newTagItems(tag)
+	for i, item := range items {
+		if item.key == "json" && strings.HasPrefix(item.value, `",`) {
+			items[i].value = `"` + name + item.value[1:]
+		}
+	}
+	return items.format()
+}
+
+// descriptorSet indexes a FileDescriptorSet by proto file name and by the
+// Go type names protoc-gen-go generates for its messages.
+type descriptorSet struct {
+	files map[string]*fileDescriptor
+	enums map[string]*descriptor.EnumDescriptorProto
+}
+
+type fileDescriptor struct {
+	desc     *descriptor.FileDescriptorProto
+	messages map[string]*descriptor.DescriptorProto
+	// fullNames are the full names of messages, keyed by Go type name.
+	fullNames map[string]string
+}
+
+// loadDescriptorSet reads a FileDescriptorSet as written by
+// `protoc --descriptor_set_out --include_imports`.
+func loadDescriptorSet(path string) (*descriptorSet, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fds descriptor.FileDescriptorSet
+	if err = proto.Unmarshal(contents, &fds); err != nil {
+		return nil, fmt.Errorf("parse descriptor set %q: %v", path, err)
+	}
+	return newDescriptorSet(&fds), nil
+}
+
+func newDescriptorSet(fds *descriptor.FileDescriptorSet) *descriptorSet {
+	ds := &descriptorSet{
+		files: map[string]*fileDescriptor{},
+		enums: map[string]*descriptor.EnumDescriptorProto{},
+	}
+	for _, fd := range fds.GetFile() {
+		prefix := "."
+		if fd.GetPackage() != "" {
+			prefix += fd.GetPackage() + "."
+		}
+		for _, enum := range fd.GetEnumType() {
+			ds.enums[prefix+enum.GetName()] = enum
+		}
+		f := &fileDescriptor{
+			desc:      fd,
+			messages:  map[string]*descriptor.DescriptorProto{},
+			fullNames: map[string]string{},
+		}
+		for _, msg := range fd.GetMessageType() {
+			f.addMessage(strings.TrimPrefix(prefix, "."), nil, msg)
+			ds.addNestedEnums(prefix+msg.GetName(), msg)
+		}
+		ds.files[fd.GetName()] = f
+	}
+	return ds
+}
+
+func (f *fileDescriptor) addMessage(pkg string, parents []string, msg *descriptor.DescriptorProto) {
+	names := append(append([]string{}, parents...), msg.GetName())
+	goName := camelCase(strings.Join(names, "_"))
+	f.messages[goName] = msg
+	f.fullNames[goName] = pkg + strings.Join(names, ".")
+	for _, nested := range msg.GetNestedType() {
+		f.addMessage(pkg, names, nested)
+	}
+}
+
+// fullName returns the full name of the message generated as Go type
+// typeName, or an empty string if f doesn't know about it.
+func (f *fileDescriptor) fullName(typeName string) string {
+	if f == nil {
+		return ""
+	}
+	return f.fullNames[typeName]
+}
+
+func (ds *descriptorSet) addNestedEnums(fullName string, msg *descriptor.DescriptorProto) {
+	for _, enum := range msg.GetEnumType() {
+		ds.enums[fullName+"."+enum.GetName()] = enum
+	}
+	for _, nested := range msg.GetNestedType() {
+		ds.addNestedEnums(fullName+"."+nested.GetName(), nested)
+	}
+}
+
+// enumValues returns the value names of the enum type of field, or nil if
+// field is not an enum.
+func (ds *descriptorSet) enumValues(field *descriptor.FieldDescriptorProto) []string {
+	if ds == nil || field.GetType() != descriptor.FieldDescriptorProto_TYPE_ENUM {
+		return nil
+	}
+	enum, ok := ds.enums[field.GetTypeName()]
+	if !ok {
+		return nil
+	}
+	var values []string
+	for _, value := range enum.GetValue() {
+		values = append(values, value.GetName())
+	}
+	return values
+}
+
+// file returns the descriptor of the proto file a generated Go file was
+// produced from, or nil if ds doesn't know about it.
+func (ds *descriptorSet) file(source string) *fileDescriptor {
+	if ds == nil || source == "" {
+		return nil
+	}
+	return ds.files[source]
+}
+
+// field returns the descriptor of the field named protoName in the
+// message generated as Go type typeName.
+func (f *fileDescriptor) field(typeName, protoName string) *descriptor.FieldDescriptorProto {
+	if f == nil {
+		return nil
+	}
+	msg, ok := f.messages[typeName]
+	if !ok {
+		return nil
+	}
+	for _, field := range msg.GetField() {
+		if field.GetName() == protoName {
+			return field
+		}
+	}
+	return nil
+}
+
+// inferRequired reports whether field can sensibly be tagged as required.
+// Only fields with explicit presence qualify: proto2 required fields and
+// singular proto3 message fields. Scalars with implicit presence can't
+// tell zero from unset, repeated fields may legitimately be empty, and
+// oneof members (including proto3 optional fields) are optional by
+// declaration.
+func (f *fileDescriptor) inferRequired(field *descriptor.FieldDescriptorProto) bool {
+	switch {
+	case field.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REQUIRED:
+		return true
+	case field.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED:
+		return false
+	case field.OneofIndex != nil:
+		return false
+	case field.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return false
+	case optionalMessageTypes[field.GetTypeName()]:
+		return false
+	}
+	return f.desc.GetSyntax() == "proto3"
+}
+
+// moretags returns the gogoproto.moretags option of field, if any.
+func moretags(field *descriptor.FieldDescriptorProto) (string, error) {
+	if !proto.HasExtension(field.GetOptions(), eMoretags) {
+		return "", nil
+	}
+	ext, err := proto.GetExtension(field.GetOptions(), eMoretags)
+	if err != nil {
+		return "", fmt.Errorf("invalid gogoproto.moretags option on field %q: %v", field.GetName(), err)
+	}
+	return *ext.(*string), nil
+}
+
+// fieldBehaviors returns the names of the google.api.field_behavior
+// options of field, in declaration order.
+func fieldBehaviors(field *descriptor.FieldDescriptorProto) ([]string, error) {
+	if !proto.HasExtension(field.GetOptions(), eFieldBehavior) {
+		return nil, nil
+	}
+	ext, err := proto.GetExtension(field.GetOptions(), eFieldBehavior)
+	if err != nil {
+		return nil, fmt.Errorf("invalid google.api.field_behavior option on field %q: %v", field.GetName(), err)
+	}
+	var names []string
+	for _, value := range ext.([]int32) {
+		name, ok := fieldBehaviorNames[value]
+		if !ok {
+			name = fmt.Sprint(value)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// camelCase converts a proto name to the Go name protoc-gen-go generates
+// for it.
+func camelCase(s string) string {
+	if s == "" {
+		return ""
+	}
+	t := make([]byte, 0, 32)
+	i := 0
+	if s[0] == '_' {
+		// need a capital letter; drop the '_'.
+		t = append(t, 'X')
+		i++
+	}
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '_' && i+1 < len(s) && isASCIILower(s[i+1]) {
+			continue
+		}
+		if isASCIIDigit(c) {
+			t = append(t, c)
+			continue
+		}
+		if isASCIILower(c) {
+			c ^= ' '
+		}
+		t = append(t, c)
+		for i+1 < len(s) && isASCIILower(s[i+1]) {
+			i++
+			t = append(t, s[i])
+		}
+	}
+	return string(t)
+}
+
+func isASCIILower(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+func isASCIIDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// embeddedDescriptor returns the file descriptor protoc-gen-go 1.20 and
+// later embed in the Go file f, in its file_*_rawDesc variable or
+// constant, nil if f has none. These versions don't register types with
+// proto.RegisterType, the descriptor being the only record of the full
+// names of the messages.
+func embeddedDescriptor(f *ast.File) *fileDescriptor {
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR && gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value, ok := spec.(*ast.ValueSpec)
+			if !ok || len(value.Names) != 1 || len(value.Values) != 1 ||
+				!strings.HasPrefix(value.Names[0].Name, "file_") || !strings.HasSuffix(value.Names[0].Name, "_rawDesc") {
+				continue
+			}
+			raw, ok := literalBytes(value.Values[0])
+			if !ok {
+				continue
+			}
+			var fd descriptor.FileDescriptorProto
+			if err := proto.Unmarshal(raw, &fd); err != nil {
+				continue
+			}
+			return newDescriptorSet(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{&fd}}).files[fd.GetName()]
+		}
+	}
+	return nil
+}
+
+// literalBytes evaluates the constant bytes of expr as generated for raw
+// descriptors: a []byte literal of integers, a string literal, their
+// concatenation with + or their conversion to []byte or string.
+func literalBytes(expr ast.Expr) ([]byte, bool) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return literalBytes(e.X)
+	case *ast.CallExpr:
+		if len(e.Args) != 1 {
+			return nil, false
+		}
+		return literalBytes(e.Args[0])
+	case *ast.BinaryExpr:
+		if e.Op != token.ADD {
+			return nil, false
+		}
+		x, ok := literalBytes(e.X)
+		if !ok {
+			return nil, false
+		}
+		y, ok := literalBytes(e.Y)
+		return append(x, y...), ok
+	case *ast.BasicLit:
+		if e.Kind != token.STRING {
+			return nil, false
+		}
+		s, err := strconv.Unquote(e.Value)
+		return []byte(s), err == nil
+	case *ast.CompositeLit:
+		raw := make([]byte, 0, len(e.Elts))
+		for _, elt := range e.Elts {
+			lit, ok := elt.(*ast.BasicLit)
+			if !ok || lit.Kind != token.INT {
+				return nil, false
+			}
+			b, err := strconv.ParseUint(lit.Value, 0, 8)
+			if err != nil {
+				return nil, false
+			}
+			raw = append(raw, byte(b))
+		}
+		return raw, true
+	}
+	return nil, false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diff formats, see writeDiff.
+const (
+	diffUnified  = "unified"
+	diffNameOnly = "name-only"
+	diffJSON     = "json"
+)
+
+// diffContext is the number of unchanged lines around changes in unified
+// diffs.
+const diffContext = 3
+
+// lineChange is a line changed by injection.
+type lineChange struct {
+	Line   int    `json:"line"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// fileChanges are the lines of a file changed by injection.
+type fileChanges struct {
+	File    string       `json:"file"`
+	Changes []lineChange `json:"changes"`
+}
+
+// splitLines splits contents into lines, without the empty line after a
+// final newline.
+func splitLines(contents []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+// lineChanges returns the lines changed between original and contents.
+// Injection only rewrites field lines in place, so lines are compared one
+// to one; the whole file is reported changed if line counts differ.
+func lineChanges(original, contents []byte) []lineChange {
+	before := splitLines(original)
+	after := splitLines(contents)
+	var changes []lineChange
+	if len(before) != len(after) {
+		for i := 0; i < len(before) || i < len(after); i++ {
+			var change lineChange
+			change.Line = i + 1
+			if i < len(before) {
+				change.Before = before[i]
+			}
+			if i < len(after) {
+				change.After = after[i]
+			}
+			changes = append(changes, change)
+		}
+		return changes
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			changes = append(changes, lineChange{Line: i + 1, Before: before[i], After: after[i]})
+		}
+	}
+	return changes
+}
+
+// diffPath returns path as named in unified diffs: slash separated,
+// cleaned and relative to the working directory when it is below it, so
+// `git apply` accepts the diff.
+func diffPath(path string) string {
+	if filepath.IsAbs(path) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// writeDiffLine writes line with its prefix, followed by the marker of
+// a missing final newline if it is the last line of contents and
+// contents doesn't end with one.
+func writeDiffLine(w io.Writer, prefix, line string, last bool, contents []byte) {
+	fmt.Fprintf(w, "%s%s\n", prefix, line)
+	if last && len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		fmt.Fprintln(w, "\\ No newline at end of file")
+	}
+}
+
+// unifiedDiff writes the changes of file as a unified diff, with
+// diffContext lines of context around each hunk, which `git apply`
+// accepts.
+func unifiedDiff(w io.Writer, file stagedFile) {
+	lines := splitLines(file.original)
+	changes := lineChanges(file.original, file.contents)
+	if len(changes) == 0 {
+		return
+	}
+	after := splitLines(file.contents)
+	path := diffPath(file.path)
+	if len(file.original) == 0 {
+		fmt.Fprintf(w, "--- /dev/null\n+++ b/%s\n@@ -0,0 +1,%d @@\n", path, len(after))
+		for i, line := range after {
+			writeDiffLine(w, "+", line, i == len(after)-1, file.contents)
+		}
+		return
+	}
+	fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", path, path)
+	if len(after) != len(lines) {
+		fmt.Fprintf(w, "@@ -1,%d +1,%d @@\n", len(lines), len(after))
+		for i, line := range lines {
+			writeDiffLine(w, "-", line, i == len(lines)-1, file.original)
+		}
+		for i, line := range after {
+			writeDiffLine(w, "+", line, i == len(after)-1, file.contents)
+		}
+		return
+	}
+	for start := 0; start < len(changes); {
+		// group changes whose contexts overlap into one hunk
+		end := start + 1
+		for end < len(changes) && changes[end].Line-changes[end-1].Line <= 2*diffContext+1 {
+			end++
+		}
+		first := changes[start].Line - diffContext
+		if first < 1 {
+			first = 1
+		}
+		last := changes[end-1].Line + diffContext
+		if last > len(lines) {
+			last = len(lines)
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", first, last-first+1, first, last-first+1)
+		next := start
+		for line := first; line <= last; line++ {
+			isLast := line == len(lines)
+			if next < end && changes[next].Line == line {
+				writeDiffLine(w, "-", changes[next].Before, isLast, file.original)
+				writeDiffLine(w, "+", changes[next].After, isLast, file.contents)
+				next++
+			} else {
+				writeDiffLine(w, " ", lines[line-1], isLast, file.original)
+			}
+		}
+		start = end
+	}
+}
+
+// writeDiff writes the changes injection makes to files in format:
+// diffUnified, diffNameOnly listing the paths of changed files, or
+// diffJSON, an array of fileChanges.
+func writeDiff(w io.Writer, format string, files []stagedFile) error {
+	var changed []fileChanges
+	for _, file := range files {
+		if !file.changed() {
+			continue
+		}
+		switch format {
+		case diffUnified:
+			unifiedDiff(w, file)
+		case diffNameOnly:
+			fmt.Fprintln(w, reportPath(file.path))
+		default:
+			changed = append(changed, fileChanges{File: reportPath(file.path), Changes: lineChanges(file.original, file.contents)})
+		}
+	}
+	if format != diffJSON {
+		return nil
+	}
+	if changed == nil {
+		changed = []fileChanges{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(changed)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+// rFieldTag matches the struct tag at the end of a field line, if any.
+var rFieldTag = regexp.MustCompile("`[^`]*`\\s*(?://.*)?$")
+
+// dryRunField returns the name and the tag of the field declared on line.
+func dryRunField(line string) (name, tag string) {
+	line = strings.TrimSpace(line)
+	if fields := strings.Fields(line); len(fields) > 0 {
+		name = fields[0]
+	}
+	if match := rFieldTag.FindString(line); match != "" {
+		tag = match[:strings.LastIndex(match, "`")+1]
+	}
+	return
+}
+
+// logDryRun logs the fields injection would change in files, one line
+// per field with its tag before and after injection, and returns the
+// number of files it would change.
+func logDryRun(logger *log.Logger, files []stagedFile) (changed int) {
+	for _, file := range files {
+		if !file.changed() {
+			continue
+		}
+		changed++
+		if file.original == nil {
+			logger.Printf("%s: would be written", file.path)
+			continue
+		}
+		for _, change := range lineChanges(file.original, file.contents) {
+			name, before := dryRunField(change.Before)
+			_, after := dryRunField(change.After)
+			if before == "" {
+				before = "no tag"
+			}
+			logger.Printf("%s:%d: %s: would change %s to %s", file.path, change.Line, name, before, after)
+		}
+	}
+	return changed
+}
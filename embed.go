@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jsonIndex models the JSON object encoding/json produces for the structs
+// of a file, with embedded structs flattened into their parent, so the
+// names an injected json tag makes collide can be reported.
+type jsonIndex struct {
+	structs map[string]*ast.StructType
+	// tag returns the tag of a field once injected.
+	tag func(field *ast.Field) string
+}
+
+// jsonCollision is a json name of a struct made ambiguous by embedding.
+type jsonCollision struct {
+	field *ast.Field
+	err   error
+}
+
+// embedded returns the name of the struct of the file embedded by field
+// without json name, which encoding/json flattens into its parent.
+func (idx jsonIndex) embedded(field *ast.Field) string {
+	if len(field.Names) > 0 {
+		return ""
+	}
+	typ := field.Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	ident, ok := typ.(*ast.Ident)
+	if !ok || idx.structs[ident.Name] == nil {
+		return ""
+	}
+	if name, _ := idx.jsonName(field); name != "" {
+		return ""
+	}
+	return ident.Name
+}
+
+// jsonName returns the name given to field by its json tag, or by its Go
+// name if the tag has none, and whether encoding/json skips field.
+func (idx jsonIndex) jsonName(field *ast.Field) (name string, skip bool) {
+	value := reflect.StructTag(idx.tag(field)).Get("json")
+	if value == "-" {
+		return "", true
+	}
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return value, false
+}
+
+// fields returns the json names declared directly by typeName, mapped to
+// their fields, and the names promoted from its embedded structs, mapped
+// to the embedded fields they come from.
+func (idx jsonIndex) fields(typeName string, visiting map[string]bool) (direct map[string]*ast.Field, promoted map[string][]*ast.Field) {
+	direct = map[string]*ast.Field{}
+	promoted = map[string][]*ast.Field{}
+	for _, field := range idx.structs[typeName].Fields.List {
+		name, skip := idx.jsonName(field)
+		if skip {
+			continue
+		}
+		if embedded := idx.embedded(field); embedded != "" {
+			if visiting[embedded] {
+				continue
+			}
+			visiting[embedded] = true
+			for promotedName := range idx.exposed(embedded, visiting) {
+				promoted[promotedName] = append(promoted[promotedName], field)
+			}
+			delete(visiting, embedded)
+			continue
+		}
+		// other embedded types are encoded as a field named after the type
+		goName := strings.TrimPrefix(fieldName(field), "*")
+		goName = goName[strings.LastIndex(goName, ".")+1:]
+		if !ast.IsExported(goName) {
+			continue
+		}
+		if name == "" {
+			name = goName
+		}
+		direct[name] = field
+	}
+	return
+}
+
+// exposed returns the json names of the object encoding typeName: its own
+// names, and the names promoted unambiguously from its embedded structs.
+func (idx jsonIndex) exposed(typeName string, visiting map[string]bool) map[string]bool {
+	direct, promoted := idx.fields(typeName, visiting)
+	names := map[string]bool{}
+	for name := range direct {
+		names[name] = true
+	}
+	for name, from := range promoted {
+		if direct[name] == nil && len(from) == 1 {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// collisions returns the json names of typeName hiding a name promoted
+// from an embedded struct, and the names promoted from several embedded
+// structs, which encoding/json silently drops.
+func (idx jsonIndex) collisions(typeName string) (collisions []jsonCollision) {
+	direct, promoted := idx.fields(typeName, map[string]bool{typeName: true})
+	var names []string
+	for name := range promoted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, field := range idx.structs[typeName].Fields.List {
+		for _, name := range names {
+			from := promoted[name]
+			switch {
+			case direct[name] == field:
+				collisions = append(collisions, jsonCollision{field, fmt.Errorf("json name %q hides the field promoted from embedded %s", name, fieldName(from[0]))})
+			case direct[name] == nil && len(from) > 1 && from[len(from)-1] == field:
+				var embedded []string
+				for _, f := range from {
+					embedded = append(embedded, fieldName(f))
+				}
+				collisions = append(collisions, jsonCollision{field, fmt.Errorf("json name %q is promoted from embedded %s, encoding/json drops it", name, strings.Join(embedded, " and "))})
+			}
+		}
+	}
+	return
+}
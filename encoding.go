@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"unicode/utf8"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// utf8BOM is the byte order mark some Windows toolchains start UTF-8
+// files with. go/parser skips it and positions count its bytes, so it is
+// kept unless -strip_bom is given.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// checkEncoding returns an error locating the first byte of src that
+// isn't valid UTF-8, the only encoding of Go sources, naming UTF-16 if src
+// starts with its byte order mark.
+func checkEncoding(filename string, src []byte) error {
+	if bytes.HasPrefix(src, []byte("\xfe\xff")) || bytes.HasPrefix(src, []byte("\xff\xfe")) {
+		return &inject.FieldError{File: filename, Err: fmt.Errorf("%w: file is UTF-16 encoded, convert it to UTF-8", inject.ErrEncoding)}
+	}
+	if utf8.Valid(src) {
+		return nil
+	}
+	pos := token.Position{Filename: filename, Line: 1, Column: 1}
+	for offset := 0; offset < len(src); {
+		r, size := utf8.DecodeRune(src[offset:])
+		if r == utf8.RuneError && size == 1 {
+			pos.Offset = offset
+			return &inject.FieldError{File: filename, Pos: pos, Err: fmt.Errorf("%w: invalid UTF-8 byte 0x%02x, convert the file to UTF-8", inject.ErrEncoding, src[offset])}
+		}
+		if r == '\n' {
+			pos.Line, pos.Column = pos.Line+1, 1
+		} else {
+			pos.Column += size
+		}
+		offset += size
+	}
+	return nil
+}
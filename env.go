@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables setting flags, the flag
+// name following it in upper case, e.g. INJECT_TAG_XXX_SKIP.
+const envPrefix = "INJECT_TAG_"
+
+// applyEnv sets the flags of fs the environment variables of environ, as
+// returned by os.Environ, set, unless they were given on the command line,
+// which takes precedence. Repeatable flags take a value per line. Empty
+// variables are ignored and unknown ones are an error, to catch typos.
+func applyEnv(fs *flag.FlagSet, environ []string) error {
+	flags := map[string]*flag.Flag{}
+	fs.VisitAll(func(f *flag.Flag) {
+		flags[envPrefix+strings.ToUpper(f.Name)] = f
+	})
+	set := setFlags(fs)
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, envPrefix) {
+			continue
+		}
+		name, value := variable, ""
+		if i := strings.Index(variable, "="); i >= 0 {
+			name, value = variable[:i], variable[i+1:]
+		}
+		f, ok := flags[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("unknown environment variable %s, no flag is named -%s", name, strings.ToLower(strings.TrimPrefix(name, envPrefix)))
+		case value == "" || set[f.Name]:
+			continue
+		}
+		values := []string{value}
+		switch f.Value.(type) {
+		case *tagTable, *inputList:
+			values = strings.Split(strings.TrimSpace(value), "\n")
+		}
+		for _, value := range values {
+			if err := fs.Set(f.Name, strings.TrimSpace(value)); err != nil {
+				return fmt.Errorf("%s: -%s: %v", name, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
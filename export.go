@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// tagRow is a key of the tag of a field, as exported for data catalogs.
+type tagRow struct {
+	File    string `json:"file"`
+	Message string `json:"message"`
+	Field   string `json:"field"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+}
+
+// exportRows returns the keys injected into the fields of the Go source
+// src once opts are applied, or the keys of every field tag if all is
+// true. Files are named by reportPath, messages by their registered full
+// name and fields by their proto name when known, by their Go names
+// otherwise.
+func exportRows(path string, src []byte, opts options, all bool) ([]tagRow, error) {
+	areas, err := parseSource(path, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	injected := map[int]textArea{}
+	for _, area := range areas {
+		injected[area.Start] = area
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, 0)
+	if err != nil {
+		return nil, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	registered := registeredTypes(f)
+	file := reportPath(path)
+	var rows []tagRow
+	ast.Inspect(f, func(node ast.Node) bool {
+		typeSpec, ok := node.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		structDecl, ok := typeSpec.Type.(*ast.StructType)
+		if !ok {
+			return true
+		}
+		message := typeSpec.Name.Name
+		if fullName, ok := registered[message]; ok {
+			message = fullName
+		}
+		for _, field := range structDecl.Fields.List {
+			name := fieldName(field)
+			if pf, ok := parseProtobufTag(fieldTag(field)); ok && pf.Name != "" {
+				name = pf.Name
+			}
+			area, ok := injected[int(field.Pos())]
+			if !ok && !all {
+				continue
+			}
+			items := newTagItems(fieldTag(field))
+			if ok {
+				items = mergeTags(area.CurrentTag, area.InjectTag, area.Normalize, nil)
+			}
+			keys := map[string]bool{}
+			for _, item := range newTagItems(area.InjectTag) {
+				keys[item.key] = true
+			}
+			for _, item := range items {
+				if !all && !keys[item.key] {
+					continue
+				}
+				value, err := strconv.Unquote(item.value)
+				if err != nil {
+					value = item.value
+				}
+				rows = append(rows, tagRow{File: file, Message: message, Field: name, Key: item.key, Value: value})
+			}
+		}
+		return true
+	})
+	return rows, nil
+}
+
+// writeRows writes rows as CSV with a header line, or as a JSON array.
+func writeRows(w io.Writer, format string, rows []tagRow) error {
+	if format == "json" {
+		if rows == nil {
+			rows = []tagRow{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"file", "message", "field", "key", "value"})
+	for _, row := range rows {
+		cw.Write([]string{row.File, row.Message, row.Field, row.Key, row.Value})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runExport writes the tags injected into the given files, or all their
+// tags, to stdout without writing the files.
+func runExport(opts options, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "output format: csv or json")
+	all := fs.Bool("all", false, "export every tag, not only injected ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *format != "csv" && *format != "json" {
+		return errors.New("usage: export [-format csv|json] [-all] file...")
+	}
+	opts.Observer = inject.NopObserver{}
+	var rows []tagRow
+	for _, path := range fs.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fileRows, err := exportRows(path, src, opts, *all)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, fileRows...)
+	}
+	return writeRows(os.Stdout, *format, rows)
+}
@@ -1,139 +1,931 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/favadi/protoc-go-inject-tag/grammar"
+	"github.com/favadi/protoc-go-inject-tag/inject"
 )
 
 var (
-	rComment = regexp.MustCompile(`^//\s*@inject_tag:\s*(.*)$`)
-	rInject  = regexp.MustCompile("`.+`$")
-	rTags    = regexp.MustCompile(`[\w_]+:"[^"]+"`)
+	rComment   = regexp.MustCompile(grammar.CommentPattern)
+	rDirective = regexp.MustCompile(grammar.DirectivePattern)
+	rGenerated = regexp.MustCompile(`^Code generated (?:by )?(.*?)[.,]? DO NOT EDIT\.$`)
+	rInject    = regexp.MustCompile("`.+`$")
+	rTags      = regexp.MustCompile(grammar.TagPattern)
+	rValidTag  = regexp.MustCompile(grammar.ValidTagPattern)
+)
+
+// tag length policies, see options.TagLengthPolicy.
+const (
+	tagLengthError    = "error"
+	tagLengthTruncate = "truncate"
+	tagLengthWarn     = "warn"
 )
 
-type textArea struct {
-	Start      int
-	End        int
-	CurrentTag string
-	InjectTag  string
+// deprecated policies, see options.Deprecated.
+const (
+	deprecatedSkip = "skip"
+	deprecatedHide = "hide"
+	deprecatedTag  = "tag"
+)
+
+// textArea is a tag to inject into a field, see inject.Area.
+type textArea = inject.Area
+
+// alreadyInjected reports whether the tag of area already has the keys
+// and values area injects, injecting it changing at most the spacing of
+// the tag: such areas are left as they are, so that running the tool
+// again on its output changes nothing.
+func alreadyInjected(area textArea) bool {
+	return mergeTags(area.CurrentTag, area.InjectTag, area.Normalize, nil).format() == newTagItems(area.CurrentTag).format()
 }
 
-func parseFile(inputPath string, xxxSkip []string) (areas []textArea, err error) {
-	log.Printf("parsing file %q for inject tag comments", inputPath)
-	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, inputPath, nil, parser.ParseComments)
+// tagLayer is a tag injected by a source, see inject.Layer.
+type tagLayer = inject.Layer
+
+// ruleTargetable reports whether global rules such as XXX_skip may
+// target field. Embedded fields, the blank identifier and unexported
+// fields (e.g. protoimpl state) are only touched by explicit comments.
+func ruleTargetable(field *ast.Field) bool {
+	if len(field.Names) == 0 {
+		return false
+	}
+	name := field.Names[0]
+	return name.Name != "_" && name.IsExported()
+}
+
+// fieldTag returns the tag of field without its quotes, or an empty
+// string if field is declared without a tag literal.
+func fieldTag(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	return field.Tag.Value[1 : len(field.Tag.Value)-1]
+}
+
+// fieldName returns the name of field, or its type if it is embedded.
+func fieldName(field *ast.Field) string {
+	if len(field.Names) > 0 {
+		return field.Names[0].Name
+	}
+	return types.ExprString(field.Type)
+}
+
+// isDeprecated reports whether the doc comment of field has the
+// "Deprecated:" paragraph protoc-gen-go writes for deprecated fields.
+func isDeprecated(field *ast.Field) bool {
+	if field.Doc == nil {
+		return false
+	}
+	for _, line := range strings.Split(field.Doc.Text(), "\n") {
+		if strings.HasPrefix(line, "Deprecated:") {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldComment returns the doc comment of field, the proto comment
+// protoc-gen-go copies, on one line and without annotations, escaped to
+// fit a quoted tag value, see commentEscaper.
+func fieldComment(field *ast.Field) string {
+	return commentEscaper.Replace(commentText(field))
+}
+
+// commentText returns the doc comment of field on one line, without
+// annotations.
+func commentText(field *ast.Field) string {
+	if field.Doc == nil {
+		return ""
+	}
+	var words []string
+	for _, comment := range field.Doc.List {
+		text := strings.TrimPrefix(comment.Text, "//")
+		if strings.HasPrefix(comment.Text, "/*") {
+			text = strings.TrimSuffix(strings.TrimPrefix(comment.Text, "/*"), "*/")
+		}
+		if trimmed := strings.TrimSpace(text); strings.HasPrefix(trimmed, "@inject") || strings.HasPrefix(trimmed, "inject:") {
+			continue
+		}
+		words = append(words, strings.Fields(text)...)
+	}
+	return strings.Join(words, " ")
+}
+
+// commentEscaper escapes comments to fit quoted tag values: backslashes
+// are escaped, and double quotes and backquotes, which tag values and
+// struct tags can't contain, become single quotes.
+var commentEscaper = strings.NewReplacer(`\`, `\\`, `"`, "'", "`", "'")
+
+// docTag returns the key:"value" tag of -doc_key for field, the value
+// being the first sentence of its doc comment, or an empty string if it
+// has none. A "Deprecated:" paragraph isn't a sentence of the doc.
+func docTag(key string, field *ast.Field) string {
+	text := commentText(field)
+	if i := strings.Index(text, "Deprecated:"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	for i := 0; i+1 < len(text); i++ {
+		if (text[i] == '.' || text[i] == '!' || text[i] == '?') && text[i+1] == ' ' {
+			text = text[:i+1]
+			break
+		}
+	}
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:\"%s\"", key, commentEscaper.Replace(text))
+}
+
+// newTextArea returns the area covering field.
+func newTextArea(field *ast.Field, injectTag string) textArea {
+	return textArea{
+		Start:      int(field.Pos()),
+		End:        int(field.End()),
+		CurrentTag: fieldTag(field),
+		InjectTag:  injectTag,
+	}
+}
+
+// options configures which tags are injected into a file.
+type options struct {
+	// XXXSkip lists tag keys set to "-" on XXX_* fields.
+	XXXSkip []string
+	// Descriptors describes the proto files inputs were generated from,
+	// nil if no descriptor set was given.
+	Descriptors *descriptorSet
+	// InferRequired tags fields with explicit presence as required,
+	// requires Descriptors.
+	InferRequired bool
+	// EnumTag is injected on every enum field, requires Descriptors.
+	EnumTag string
+	// AllowedKeys lists the keys annotations may inject, any key if
+	// empty; global rules aren't restricted.
+	AllowedKeys []string
+	// RuleOwners restricts the global rules to the messages they are
+	// granted on, any rule applying anywhere if nil.
+	RuleOwners ruleOwners
+	// DocKey is the key of the tag injected on every field with a doc
+	// comment, its value being the first sentence of the comment, see
+	// docTag.
+	DocKey string
+	// Moretags injects the gogoproto.moretags options of fields, requires
+	// Descriptors.
+	Moretags bool
+	// FieldBehaviorTags maps google.api.field_behavior names to the tag
+	// injected on fields with that behavior, requires Descriptors.
+	FieldBehaviorTags map[string]string
+	// FieldTags maps fields, by message full name and proto field name
+	// such as acme.v1.User.email, to the tag injected on them. Message
+	// full names are read from the descriptor embedded by protoc-gen-go
+	// or its proto.RegisterType calls, or from Descriptors.
+	FieldTags map[string]string
+	// FieldNumberTags maps fields, by message full name and field number
+	// such as acme.v1.User.3, to the tag injected on them, so renaming a
+	// proto field keeps its rule. Rules matching no field of a message
+	// found in a file are reported as warnings.
+	FieldNumberTags map[string]string
+	// NormalizeTags orders injected keys consistently, see
+	// tagItems.normalize.
+	NormalizeTags bool
+	// KeyPrefix is prepended to every injected key, so a new tag scheme
+	// can be tried without touching the keys in use.
+	KeyPrefix string
+	// MaxFileSize and MaxEdits are safety limits on the size of a file and
+	// the number of fields edited in it, 0 means no limit.
+	MaxFileSize int64
+	MaxEdits    int
+	// Force ignores the safety limits.
+	Force bool
+	// Mmap maps the files to parse into memory instead of reading them,
+	// see readMapped.
+	Mmap bool
+	// StripBOM removes the UTF-8 byte order mark of injected files.
+	StripBOM bool
+	// Strict fails the files with annotations or rules without effect,
+	// reported as inject.ErrNoMatch and inject.ErrNoTag warnings, instead
+	// of only warning about them, see strictAnnotations.
+	Strict bool
+	// Format gofmts the files injection changes.
+	Format bool
+	// Verify reads the written files back and checks they are valid
+	// UTF-8, parse and, with Format, are gofmt-stable, restoring the
+	// original contents of every file otherwise, see verifyWritten.
+	Verify bool
+	// Lenient falls back to a line-based parser for files go/parser
+	// can't parse, see lenientAreas.
+	Lenient bool
+	// Trace logs how the injected tag of each field is computed.
+	Trace bool
+	// MaxTagLengths limits the length in characters of the injected
+	// values of keys, as handled by TagLengthPolicy.
+	MaxTagLengths map[string]int
+	// TagLengthPolicy is what to do with values longer than
+	// MaxTagLengths: tagLengthError fails the file, tagLengthTruncate
+	// truncates them and tagLengthWarn reports them; failing if empty.
+	TagLengthPolicy string
+	// MaxLineLength is the line length above which a warning is logged
+	// for injected fields, 0 means no limit.
+	MaxLineLength int
+	// Deprecated is the policy for deprecated fields: deprecatedSkip
+	// doesn't apply global rules to them, deprecatedHide injects json:"-"
+	// and deprecatedTag injects deprecated:"true". Deprecated fields are
+	// treated like others if empty.
+	Deprecated string
+	// OneofMetadata is the path of the Go file describing the oneof cases
+	// of the injected files, see oneofMetadata; not written if empty.
+	OneofMetadata string
+	// OneofMarshalers is the path of the Go file with the JSON
+	// marshalers of the messages of the injected files with oneofs
+	// flattened into JSON, see oneofMarshalers; not written if empty.
+	OneofMarshalers string
+	// Opaque injects tags into the hidden fields of the messages generated
+	// with the opaque API, taking their annotations from the fields of
+	// their builders, see builderDocs.
+	Opaque bool
+	// OpaqueViews is the path of the Go file with the exported views of
+	// the opaque messages of the injected files, see opaqueViewsSource;
+	// not written if empty.
+	OpaqueViews string
+	// Outputs maps input paths to the path their injected contents are
+	// written to instead, see outputPaths; inputs are rewritten in place
+	// if missing.
+	Outputs map[string]string
+	// SoftFail lists the glob patterns of files whose failures are
+	// reported as warnings, the file being left as is, see matchesGlob.
+	SoftFail []string
+	// FileMode is the permission bits of the written files, existing
+	// files keep theirs and new ones follow the umask if 0.
+	FileMode os.FileMode
+	// Backup keeps the original contents of the rewritten files as
+	// <file>.orig.
+	Backup bool
+	// Jobs is the number of files staged concurrently, GOMAXPROCS if 0.
+	Jobs int
+	// Interrupt stops the run once closed, e.g. on SIGINT: the files
+	// not staged yet are skipped and nothing is written. A commit already
+	// started isn't interrupted, so files are never left half written.
+	Interrupt <-chan struct{}
+	// GeneratedBy restricts injection to files generated by a matching
+	// generator, any file is processed if empty.
+	GeneratedBy []*regexp.Regexp
+	// Observer is notified of the progress of the run, progress is logged
+	// to Logger if nil.
+	Observer observer
+	// LogLevel is how much of the progress inject.LogObserver logs: see
+	// inject.LogQuiet and inject.LogVerbose, the written files and
+	// warnings if empty.
+	LogLevel string
+	// LogFormat is logFormatJSON to log one JSON object per event, see
+	// jsonObserver, and text otherwise.
+	LogFormat string
+	// Logger logs progress and traces, a logger writing to stderr if nil.
+	Logger *log.Logger
+}
+
+// interrupted reports whether the run was interrupted, see Interrupt.
+func (opts options) interrupted() bool {
+	select {
+	case <-opts.Interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+func (opts options) logger() *log.Logger {
+	if opts.LogFormat == logFormatJSON {
+		return log.New(jsonLogWriter{w: opts.logWriter()}, "", 0)
+	}
+	if opts.Logger == nil {
+		return log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return opts.Logger
+}
+
+// logWriter returns the writer of Logger, or stderr if it is nil.
+func (opts options) logWriter() io.Writer {
+	if opts.Logger == nil {
+		return os.Stderr
+	}
+	return opts.Logger.Writer()
+}
+
+func (opts options) observer() observer {
+	if opts.Observer == nil && opts.LogFormat == logFormatJSON {
+		return jsonObserver{logger: log.New(opts.logWriter(), "", 0), level: opts.LogLevel}
+	}
+	if opts.Observer == nil {
+		return inject.LogObserver{Logger: opts.logger(), Level: opts.LogLevel}
+	}
+	return opts.Observer
+}
+
+// fieldData is the data available to templates in injected tags.
+type fieldData struct {
+	// EnumValues lists the value names of an enum field, space separated.
+	EnumValues string
+	// FieldNumber is the protobuf field number, 0 for non-protobuf fields.
+	FieldNumber int
+	// Comment is the doc comment of the field, see fieldComment.
+	Comment string
+}
+
+func parseFile(inputPath string, opts options) (areas []textArea, err error) {
+	src, release, err := readInput(inputPath, opts)
 	if err != nil {
 		return
 	}
+	// the areas hold copies of what they need of src
+	defer func() {
+		if releaseErr := release(); err == nil {
+			err = releaseErr
+		}
+	}()
+	return parseContents(inputPath, src, opts)
+}
+
+// readInput returns the contents of the file at inputPath once checked
+// against -max_file_size, mapped into memory with -mmap, and a function
+// releasing them once they aren't used anymore.
+func readInput(inputPath string, opts options) (src []byte, release func() error, err error) {
+	opts.observer().OnFileStart(inputPath)
+	if opts.MaxFileSize > 0 && !opts.Force {
+		var info os.FileInfo
+		if info, err = os.Stat(inputPath); err != nil {
+			return
+		}
+		if err = checkFileSize(inputPath, info.Size(), opts); err != nil {
+			return
+		}
+	}
+	if opts.Mmap {
+		return readMapped(inputPath)
+	}
+	src, err = ioutil.ReadFile(inputPath)
+	return src, func() error { return nil }, err
+}
 
+// parseContents returns the areas to inject of src, the contents of the
+// file at inputPath, once checked against -max_edits.
+func parseContents(inputPath string, src []byte, opts options) ([]textArea, error) {
+	areas, err := parseSource(inputPath, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.observer().OnFileParsed(inputPath, areas)
+	return areas, checkEdits(inputPath, areas, opts)
+}
+
+// checkFileSize returns an error if size is above -max_file_size.
+func checkFileSize(inputPath string, size int64, opts options) error {
+	if opts.MaxFileSize > 0 && size > opts.MaxFileSize && !opts.Force {
+		return fmt.Errorf("file %q is %d bytes, more than -max_file_size=%d, use -force to process it anyway",
+			inputPath, size, opts.MaxFileSize)
+	}
+	return nil
+}
+
+// checkEdits returns an error if areas are more than -max_edits.
+func checkEdits(inputPath string, areas []textArea, opts options) error {
+	if opts.MaxEdits > 0 && len(areas) > opts.MaxEdits && !opts.Force {
+		return fmt.Errorf("file %q has %d fields to inject, more than -max_edits=%d, use -force to process it anyway",
+			inputPath, len(areas), opts.MaxEdits)
+	}
+	return nil
+}
+
+// parseSource returns the areas to inject in the Go source src, or in
+// the file filename if src is nil.
+func parseSource(filename string, src []byte, opts options) (areas []textArea, err error) {
+	if opts.Strict {
+		strict := &strictObserver{observer: opts.observer()}
+		opts.Observer = strict
+		defer func() {
+			if err == nil && strict.unused > 0 {
+				areas, err = nil, &inject.FieldError{File: filename, Err: fmt.Errorf("%w: %d annotation(s) or rule(s) without effect (-strict)", inject.ErrNoMatch, strict.unused)}
+			}
+		}()
+	}
+	if src == nil {
+		if src, err = ioutil.ReadFile(filename); err != nil {
+			return
+		}
+	}
+	if err = checkEncoding(filename, src); err != nil {
+		return
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		err = &inject.FieldError{File: filename, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+		if !opts.Lenient {
+			return nil, err
+		}
+		opts.observer().OnWarning(filename, err)
+		return lenientAreas(filename, src, opts)
+	}
+	obs := opts.observer()
+	logger := opts.logger()
+	source := protoSource(f)
+	fd := opts.Descriptors.file(source)
+	if opts.Descriptors != nil && source != "" && fd == nil {
+		obs.OnWarning(filename, &inject.FieldError{File: filename, Err: fmt.Errorf("no descriptor found for proto file %q", source)})
+	}
+
+	if len(opts.GeneratedBy) > 0 {
+		generator := generatedBy(f)
+		if !matchAny(opts.GeneratedBy, generator) {
+			obs.OnWarning(filename, &inject.FieldError{File: filename, Err: fmt.Errorf("skipping file generated by %q, not matching -generated_by", generator)})
+			return
+		}
+	}
+
+	var typeSpecs []*ast.TypeSpec
 	for _, decl := range f.Decls {
 		// check if is generic declaration
 		genDecl, ok := decl.(*ast.GenDecl)
 		if !ok {
 			continue
 		}
-
-		var typeSpec *ast.TypeSpec
+		// grouped declarations, as generated by e.g. thrift, have several
 		for _, spec := range genDecl.Specs {
 			if ts, tsOK := spec.(*ast.TypeSpec); tsOK {
-				typeSpec = ts
-				break
+				typeSpecs = append(typeSpecs, ts)
 			}
 		}
+	}
 
-		// skip if can't get type spec
-		if typeSpec == nil {
-			continue
+	oneofs := collectOneofTags(f, typeSpecs)
+	owners := oneofOwners(f, typeSpecs)
+	macros, err := collectMacros(fset, filename, f)
+	if err != nil {
+		return
+	}
+	structs := map[string]*ast.StructType{}
+	for _, typeSpec := range typeSpecs {
+		if structDecl, ok := typeSpec.Type.(*ast.StructType); ok {
+			structs[typeSpec.Name.Name] = structDecl
 		}
+	}
+	injected := map[*ast.Field]string{}
+	var registered map[string]string
+	if len(opts.FieldTags) > 0 || len(opts.FieldNumberTags) > 0 || opts.RuleOwners != nil {
+		registered = registeredTypes(f)
+	}
+	// the rules -rule_owners denied on a message, reported once
+	denied := map[string]bool{}
+	var skipTags []string
+	for _, skip := range opts.XXXSkip {
+		skipTags = append(skipTags, fmt.Sprintf("%s:\"-\"", skip))
+	}
+	skipTag := strings.Join(skipTags, " ")
+	// the messages with -field_tag or -field_number_tag rules, so the
+	// fields of the others are skipped without building their paths
+	ruled := fieldRuleMessages(opts)
+	// the messages of the file and the -field_number_tag rules matched,
+	// to report the rules left orphaned by renumbered or removed fields
+	messages, numbered := map[string]bool{}, map[string]bool{}
+	var docs map[string]*ast.CommentGroup
+	if opts.Opaque {
+		docs = builderDocs(typeSpecs)
+	}
 
+	for _, typeSpec := range typeSpecs {
 		// not a struct, skip
 		structDecl, ok := typeSpec.Type.(*ast.StructType)
 		if !ok {
 			continue
 		}
 
-		builder := strings.Builder{}
-		if len(xxxSkip) > 0 {
-			for i, skip := range xxxSkip {
-				builder.WriteString(fmt.Sprintf("%s:\"-\"", skip))
-				if i > 0 {
-					builder.WriteString(",")
-				}
-			}
+		// the message whose descriptor describes the fields, the one
+		// declaring the oneof for the case field of a wrapper
+		message := typeSpec.Name.Name
+		if owner, ok := owners[message]; ok {
+			message = owner
+		}
+		fullName, ok := registered[message]
+		if !ok {
+			fullName = fd.fullName(message)
 		}
 
 		for _, field := range structDecl.Fields.List {
-			// skip if field has no doc
-			if len(field.Names) > 0 {
-				name := field.Names[0].Name
-				if len(xxxSkip) > 0 && strings.HasPrefix(name, "XXX") {
-					currentTag := field.Tag.Value
-					area := textArea{
-						Start:      int(field.Pos()),
-						End:        int(field.End()),
-						CurrentTag: currentTag[1 : len(currentTag)-1],
-						InjectTag:  builder.String(),
+			// the hidden fields of opaque messages are annotated on their
+			// builder and targeted by global rules
+			hidden, isHidden := hiddenField(field)
+			isHidden = isHidden && opts.Opaque
+			if doc := docs[typeSpec.Name.Name+"."+hidden]; isHidden && field.Doc == nil && doc != nil {
+				annotated := *field
+				annotated.Doc = doc
+				field = &annotated
+			}
+			name := typeSpec.Name.Name + "." + fieldName(field)
+			fieldErr := func(err error) *inject.FieldError {
+				return &inject.FieldError{File: filename, Field: name, Pos: fset.Position(field.Pos()), Err: err}
+			}
+			trace := func(format string, args ...interface{}) {}
+			if opts.Trace {
+				trace = func(format string, args ...interface{}) {
+					logger.Printf("trace: %s: %s", name, fmt.Sprintf(format, args...))
+				}
+			}
+
+			// tags are the tags to inject, by increasing precedence, and
+			// sources what each one comes from
+			var tags, sources []string
+			add := func(source, tag string) {
+				tags, sources = append(tags, tag), append(sources, source)
+			}
+			// addRule adds the tag of a global rule, unless -rule_owners
+			// doesn't grant it on the message
+			addRule := func(rule, tag string) {
+				if !opts.RuleOwners.grants(fullName, rule) {
+					trace("%s denied by -rule_owners: %s", rule, tag)
+					if key := fullName + " " + rule; !denied[key] {
+						denied[key] = true
+						obs.OnWarning(filename, fieldErr(fmt.Errorf("-%s isn't granted on %s by -rule_owners, skipped", rule, fullName)))
 					}
-					areas = append(areas, area)
+					return
 				}
+				add("-"+rule, tag)
+			}
+			pf, _ := parseProtobufTag(fieldTag(field))
+			data := fieldData{FieldNumber: pf.Number, Comment: fieldComment(field)}
+			fieldDesc := fd.field(message, pf.Name)
+			if fieldDesc != nil {
+				data.EnumValues = strings.Join(opts.Descriptors.enumValues(fieldDesc), " ")
 			}
-			if field.Doc == nil {
+			deprecated := isDeprecated(field)
+			// global rules only apply to exported, named fields
+			if deprecated && opts.Deprecated == deprecatedSkip {
+				trace("global rules skipped: field is deprecated")
+			} else if ruleTargetable(field) || isHidden {
+				if len(opts.XXXSkip) > 0 {
+					if strings.HasPrefix(field.Names[0].Name, "XXX") {
+						trace("XXX_skip matched: %s", skipTag)
+						addRule("XXX_skip", skipTag)
+					} else {
+						trace("XXX_skip not matched")
+					}
+				}
+				if opts.InferRequired {
+					switch {
+					case fieldDesc == nil:
+						trace("infer_required not matched: no descriptor for field")
+					case fd.inferRequired(fieldDesc):
+						trace(`infer_required matched: validate:"required"`)
+						addRule("infer_required", `validate:"required"`)
+					default:
+						trace("infer_required not matched: field has no explicit presence")
+					}
+				}
+				if opts.EnumTag != "" {
+					if data.EnumValues != "" {
+						trace("enum_tag matched: %s", opts.EnumTag)
+						addRule("enum_tag", opts.EnumTag)
+					} else {
+						trace("enum_tag not matched: not an enum field")
+					}
+				}
+				if opts.DocKey != "" {
+					if tag := docTag(opts.DocKey, field); tag != "" {
+						trace("doc_key matched: %s", tag)
+						addRule("doc_key", tag)
+					} else {
+						trace("doc_key not matched: field has no doc comment")
+					}
+				}
+				if len(opts.FieldBehaviorTags) > 0 && fieldDesc != nil {
+					behaviors, err := fieldBehaviors(fieldDesc)
+					if err != nil {
+						obs.OnWarning(filename, fieldErr(err))
+					}
+					for _, behavior := range behaviors {
+						if tag := behaviorTag(opts.FieldBehaviorTags[behavior], fieldTag(field)); tag != "" {
+							trace("field_behavior %s matched: %s", behavior, tag)
+							addRule("field_behavior", tag)
+						} else {
+							trace("field_behavior %s not matched: no tag configured", behavior)
+						}
+					}
+				}
+			} else {
+				trace("global rules skipped: field is embedded, blank or unexported")
+			}
+			if opts.Moretags && fieldDesc != nil {
+				tag, err := moretags(fieldDesc)
+				if err != nil {
+					obs.OnWarning(filename, fieldErr(err))
+				} else if tag != "" {
+					trace("gogoproto.moretags matched: %s", tag)
+					addRule("moretags", tag)
+				}
+			}
+			if fullName != "" && pf.Number > 0 && len(opts.FieldNumberTags) > 0 {
+				messages[fullName] = true
+			}
+			if ruled[fullName] {
+				fieldPath := fullName + "." + pf.Name
+				if tag, ok := opts.FieldTags[fieldPath]; ok && fullName != "" && pf.Name != "" {
+					trace("field_tag %s matched: %s", fieldPath, tag)
+					addRule("field_tag", tag)
+				}
+				if fullName != "" && pf.Number > 0 {
+					numberPath := fullName + "." + strconv.Itoa(pf.Number)
+					if tag, ok := opts.FieldNumberTags[numberPath]; ok {
+						trace("field_number_tag %s matched: %s", numberPath, tag)
+						addRule("field_number_tag", tag)
+						numbered[numberPath] = true
+					}
+				}
+			}
+			if deprecated {
+				switch opts.Deprecated {
+				case deprecatedHide:
+					trace(`deprecated matched: json:"-"`)
+					addRule("deprecated", `json:"-"`)
+				case deprecatedTag:
+					trace(`deprecated matched: deprecated:"true"`)
+					addRule("deprecated", `deprecated:"true"`)
+				}
+			}
+			if _, ok := reflect.StructTag(fieldTag(field)).Lookup("protobuf_oneof"); ok {
+				flat, err := flatJSON(field.Doc)
+				if err != nil {
+					return nil, fieldErr(err)
+				}
+				if flat != nil {
+					trace(`flat json oneof matched: json:"-"`)
+					add("@inject_flat_json", `json:"-"`)
+				}
+			}
+			if oneof, ok := oneofs[typeSpec.Name.Name]; ok {
+				if oneof.FlatJSON != nil && pf.Name != "" {
+					tag := oneof.FlatJSON.tag(pf)
+					trace("flat json oneof of %s matched: %s", oneof.Parent, tag)
+					add("@inject_flat_json of "+oneof.Parent, tag)
+				}
+				for _, tag := range oneof.Tags {
+					if tag, err = expandMacros(tag, macros); err != nil {
+						return nil, fieldErr(err)
+					}
+					if err = checkAllowedKeys(tag, opts.AllowedKeys); err != nil {
+						return nil, fieldErr(err)
+					}
+					trace("oneof comment of %s matched: %s", oneof.Parent, tag)
+					add("@inject_tag_oneof of "+oneof.Parent, tag)
+				}
+			}
+			// comments are applied last so they override global rules
+			if field.Doc != nil {
+				for _, comment := range field.Doc.List {
+					if tag := tagFromComment(comment.Text); tag != "" {
+						if tag, err = expandMacros(tag, macros); err != nil {
+							return nil, fieldErr(err)
+						}
+						if err = checkAllowedKeys(tag, opts.AllowedKeys); err != nil {
+							return nil, fieldErr(err)
+						}
+						trace("comment matched: %s", tag)
+						add("comment", tag)
+					} else if isTagComment(comment.Text) {
+						obs.OnWarning(filename, fieldErr(inject.ErrNoTag))
+					}
+				}
+			}
+			if len(tags) == 0 {
+				trace("no tag to inject")
 				continue
 			}
-			for _, comment := range field.Doc.List {
-				tag := tagFromComment(comment.Text)
-				if tag == "" {
-					continue
+			tag, err := renderTag(strings.Join(tags, " "), data)
+			if err != nil {
+				return nil, fieldErr(err)
+			}
+			if !rValidTag.MatchString(tag) {
+				return nil, fieldErr(fmt.Errorf("%w: %s", inject.ErrTagSyntax, tag))
+			}
+			if len(opts.MaxTagLengths) > 0 {
+				var tooLong []error
+				if tag, tooLong = limitTagLengths(tag, opts.MaxTagLengths, opts.TagLengthPolicy == tagLengthTruncate); len(tooLong) > 0 {
+					if opts.TagLengthPolicy == tagLengthWarn || opts.TagLengthPolicy == tagLengthTruncate {
+						for _, err := range tooLong {
+							obs.OnWarning(filename, fieldErr(err))
+						}
+					} else {
+						return nil, fieldErr(tooLong[0])
+					}
 				}
-				currentTag := field.Tag.Value
-				area := textArea{
-					Start:      int(field.Pos()),
-					End:        int(field.End()),
-					CurrentTag: currentTag[1 : len(currentTag)-1],
-					InjectTag:  tag,
+			}
+			if opts.KeyPrefix != "" {
+				tag = prefixKeys(tag, opts.KeyPrefix)
+				trace("key_prefix applied: %s", tag)
+			}
+			area := newTextArea(field, tag)
+			area.Normalize = opts.NormalizeTags
+			for i, layer := range tags {
+				if strings.Contains(layer, "{{") {
+					// renders as it did joined with the others
+					layer, _ = renderTag(layer, data)
 				}
-				areas = append(areas, area)
+				if opts.KeyPrefix != "" {
+					layer = prefixKeys(layer, opts.KeyPrefix)
+				}
+				area.Layers = append(area.Layers, tagLayer{Source: sources[i], Tag: layer})
+			}
+			injected[field] = mergeTags(area.CurrentTag, tag, area.Normalize, nil).format()
+			if opts.Trace {
+				trace("merging %s into %s", tag, area.CurrentTag)
+				merged := mergeTags(area.CurrentTag, tag, area.Normalize, func(item tagItem, replaced *tagItem) {
+					if replaced != nil {
+						trace("set %s:%s, replacing %s", item.key, item.value, replaced.value)
+					} else {
+						trace("add %s:%s", item.key, item.value)
+					}
+				})
+				trace("final tag: %s", merged.format())
 			}
+			if opts.MaxLineLength > 0 {
+				if length := injectedLineLength(src, area); length > opts.MaxLineLength {
+					obs.OnWarning(filename, fieldErr(fmt.Errorf("line is %d characters long after injection, more than -max_line_length=%d",
+						length, opts.MaxLineLength)))
+				}
+			}
+			areas = append(areas, area)
+		}
+	}
+
+	var orphans []string
+	for numberPath := range opts.FieldNumberTags {
+		if messages[numberPath[:strings.LastIndex(numberPath, ".")]] && !numbered[numberPath] {
+			orphans = append(orphans, numberPath)
+		}
+	}
+	sort.Strings(orphans)
+	for _, numberPath := range orphans {
+		obs.OnWarning(filename, &inject.FieldError{File: filename, Err: fmt.Errorf("%w: -field_number_tag %s matches no field, was it removed or renumbered?", inject.ErrNoMatch, numberPath)})
+	}
+
+	for _, comment := range strayAnnotations(f, structs) {
+		obs.OnWarning(filename, &inject.FieldError{File: filename, Pos: fset.Position(comment.Pos()),
+			Err: fmt.Errorf("%w: %s is not the doc comment of a field", inject.ErrNoMatch, comment.Text)})
+	}
+	if opts.Strict {
+		for _, unused := range strictAnnotations(f, typeSpecs) {
+			obs.OnWarning(filename, &inject.FieldError{File: filename, Pos: fset.Position(unused.comment.Pos()),
+				Err: fmt.Errorf("%w: %s %s", inject.ErrNoMatch, unused.comment.Text, unused.reason)})
+		}
+	}
+
+	// json names are compared once injected, embedded structs included
+	idx := jsonIndex{structs: structs, tag: func(field *ast.Field) string {
+		if tag, ok := injected[field]; ok {
+			return tag
+		}
+		return fieldTag(field)
+	}}
+	for _, typeSpec := range typeSpecs {
+		if structs[typeSpec.Name.Name] == nil {
+			continue
+		}
+		for _, collision := range idx.collisions(typeSpec.Name.Name) {
+			obs.OnWarning(filename, &inject.FieldError{
+				File:  filename,
+				Field: typeSpec.Name.Name + "." + fieldName(collision.field),
+				Pos:   fset.Position(collision.field.Pos()),
+				Err:   collision.err,
+			})
 		}
 	}
-	log.Printf("parsed file %q, number of fields to inject custom tags: %d", inputPath, len(areas))
 	return
 }
 
-func writeFile(inputPath string, areas []textArea) (err error) {
-	f, err := os.Open(inputPath)
-	if err != nil {
-		return
+// fieldRuleMessages returns the full names of the messages -field_tag
+// and -field_number_tag rules apply to.
+func fieldRuleMessages(opts options) map[string]bool {
+	ruled := map[string]bool{}
+	for _, rules := range []map[string]string{opts.FieldTags, opts.FieldNumberTags} {
+		for fieldPath := range rules {
+			if dot := strings.LastIndex(fieldPath, "."); dot > 0 {
+				ruled[fieldPath[:dot]] = true
+			}
+		}
 	}
+	return ruled
+}
 
-	contents, err := ioutil.ReadAll(f)
-	if err != nil {
-		return
+// strayAnnotations returns the inject tag comments of f which aren't in
+// the doc comment of a field of structs, as trailing comments, and so
+// inject nothing.
+func strayAnnotations(f *ast.File, structs map[string]*ast.StructType) []*ast.Comment {
+	docs := map[*ast.CommentGroup]bool{}
+	for _, structDecl := range structs {
+		for _, field := range structDecl.Fields.List {
+			if field.Doc != nil {
+				docs[field.Doc] = true
+			}
+		}
+	}
+	var stray []*ast.Comment
+	for _, cg := range f.Comments {
+		if docs[cg] {
+			continue
+		}
+		for _, comment := range cg.List {
+			if isTagComment(comment.Text) {
+				stray = append(stray, comment)
+			}
+		}
 	}
+	return stray
+}
 
-	if err = f.Close(); err != nil {
-		return
+// generatedBy returns the generator named in the standard
+// "// Code generated ... DO NOT EDIT." comment of f, or an empty string if
+// f has none.
+func generatedBy(f *ast.File) string {
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+		for _, line := range strings.Split(cg.Text(), "\n") {
+			if match := rGenerated.FindStringSubmatch(line); match != nil {
+				return match[1]
+			}
+		}
 	}
+	return ""
+}
 
-	// inject custom tags from tail of file first to preserve order
-	for i := range areas {
-		area := areas[len(areas)-i-1]
-		log.Printf("inject custom tag %q to expression %q", area.InjectTag, string(contents[area.Start-1:area.End-1]))
-		contents = injectTag(contents, area)
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// protoSource returns the proto file name recorded by protoc-gen-go and
+// twirp in the "// source:" header comment of f, or by connect-go in its
+// "// Source:" header comment, if any.
+func protoSource(f *ast.File) string {
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			for _, prefix := range []string{"// source: ", "// Source: "} {
+				if strings.HasPrefix(c.Text, prefix) {
+					return strings.TrimSpace(strings.TrimPrefix(c.Text, prefix))
+				}
+			}
+		}
 	}
-	if err = ioutil.WriteFile(inputPath, contents, 0644); err != nil {
+	return ""
+}
+
+func writeFile(inputPath string, areas []textArea) (err error) {
+	var tx transaction
+	if err = tx.stage(inputPath, areas); err != nil {
 		return
 	}
+	return tx.commit()
+}
 
-	if len(areas) > 0 {
-		log.Printf("file %q is injected with custom tags", inputPath)
+// injectedLineLength returns the length in characters of the line of
+// area in contents once its tag is injected.
+func injectedLineLength(contents []byte, area textArea) int {
+	lineStart := bytes.LastIndexByte(contents[:area.Start-1], '\n') + 1
+	lineEnd := len(contents)
+	if i := bytes.IndexByte(contents[area.End-1:], '\n'); i >= 0 {
+		lineEnd = area.End - 1 + i
 	}
-	return
+	area.Start -= lineStart
+	area.End -= lineStart
+	return utf8.RuneCount(injectTag(contents[lineStart:lineEnd], area))
+}
+
+// injectAreas injects the custom tags of areas into contents.
+func injectAreas(contents []byte, areas []textArea) []byte {
+	// inject custom tags from tail of file first to preserve order
+	for i := range areas {
+		contents = injectTag(contents, areas[len(areas)-i-1])
+	}
+	return contents
 }
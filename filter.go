@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// stdinInput is the -input reading the Go source from stdin and writing
+// the result to stdout.
+const stdinInput = "-"
+
+// runFilter reads a Go source from r and writes it to w with tags
+// injected, for pipelines and build systems that dislike files rewritten
+// in place.
+func runFilter(opts options, r io.Reader, w io.Writer) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err = checkFileSize("<stdin>", int64(len(src)), opts); err != nil {
+		return err
+	}
+	injected, err := newInjector(opts).injectSource("<stdin>", src)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(injected)
+	return err
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// cliFlags are the values of the command line flags, turned into options
+// once parsed.
+type cliFlags struct {
+	config            string
+	input             inputList
+	recursive         bool
+	changedOnly       string
+	exclude           inputList
+	includeIgnored    bool
+	skipTestdata      bool
+	output            string
+	lastRun           string
+	report            string
+	xxxTags           string
+	descriptorSetFile string
+	generatedBy       string
+	fieldBehavior     bool
+	fieldBehaviorTags tagTable
+	fieldTags         tagTable
+	fieldNumberTags   tagTable
+	maxTagLengths     tagTable
+	diff              bool
+	dryRun            bool
+	check             bool
+	apply             bool
+	diffFormat        string
+	patch             string
+	archiveOutput     string
+	casDir            string
+	casMapping        string
+	minVersion        string
+	maxVersion        string
+	syntaxVersion     int
+	versionPolicy     string
+	printVersion      bool
+	chmod             string
+	quiet             bool
+	verbose           bool
+	softFail          inputList
+	allowedKeys       inputList
+	ruleOwners        string
+	// descriptors describe the proto files without -descriptor_set, as
+	// the requests of protoc do in plugin mode
+	descriptors *descriptorSet
+	opts        options
+}
+
+// flagShorthands maps the shorthand flags to the flag they stand for.
+var flagShorthands = map[string]string{"r": "recursive"}
+
+// setFlags returns the names of the flags set on fs, explicitly or by a
+// shorthand, so environment variables and config files don't override
+// them.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for shorthand, name := range flagShorthands {
+		if set[shorthand] || set[name] {
+			set[shorthand], set[name] = true, true
+		}
+	}
+	return set
+}
+
+// register defines the flags on fs.
+func (f *cliFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "YAML file setting flags the command line doesn't, "+defaultConfigFile+" if present when empty")
+	fs.Var(&f.input, "input", "path to input file, can be repeated or a comma separated list, - to filter stdin to stdout")
+	fs.BoolVar(&f.recursive, "recursive", false, "if -input is a directory, inject every *.pb.go file under it")
+	fs.BoolVar(&f.recursive, "r", false, "shorthand for -recursive")
+	fs.Var(&f.exclude, "exclude", "glob matching the path or base name of input files or directories to skip, e.g. *_mock.pb.go, can be repeated or a comma separated list")
+	fs.BoolVar(&f.includeIgnored, "include_ignored", false, "also inject the files .gitignore files ignore in the walked directories, .injectignore files still applying")
+	fs.BoolVar(&f.skipTestdata, "skip_testdata", false, "skip the testdata directories with -recursive, as package patterns always do")
+	fs.StringVar(&f.changedOnly, "changed_only", "", "only inject the input files git reports changed since this ref or untracked, HEAD for the uncommitted changes")
+	fs.StringVar(&f.output, "output", "", "write injected files to this file, or under this directory, instead of rewriting -input in place")
+	fs.StringVar(&f.lastRun, "last_run", "", "path of the JSON report of the last run, logging what this run injects differently before replacing it")
+	fs.StringVar(&f.report, "report", "", "path of a JSON report of every field tag injected, with its file, struct, field, old and new tag, e.g. to archive per build")
+	fs.Var(&f.softFail, "soft_fail", "glob matching the path or base name of files whose failures are warnings, leaving them as is, can be repeated or a comma separated list")
+	fs.BoolVar(&f.opts.Backup, "backup", false, "write the original contents of each rewritten file to <file>.orig first")
+	fs.StringVar(&f.chmod, "chmod", "", "octal permission bits of the written files, e.g. 0640, ignoring the umask; existing files keep theirs and new files follow the umask if empty")
+	fs.StringVar(&f.archiveOutput, "archive_output", "", "path of the archive to write when -input is a zip or tar archive, -input if empty")
+	fs.StringVar(&f.casDir, "cas_dir", "", "write outputs into this directory as objects named by their SHA-256 hash instead of in place")
+	fs.StringVar(&f.casMapping, "cas_mapping", "", "path of the JSON file mapping inputs to their -cas_dir objects, mapping.json in -cas_dir if empty")
+	fs.StringVar(&f.xxxTags, "XXX_skip", "", "skip tags to inject on XXX fields")
+	fs.StringVar(&f.descriptorSetFile, "descriptor_set", "", "path to descriptor set of input proto files (protoc --descriptor_set_out)")
+	fs.BoolVar(&f.opts.InferRequired, "infer_required", false, `inject validate:"required" on fields with explicit presence, requires -descriptor_set`)
+	fs.StringVar(&f.opts.EnumTag, "enum_tag", "", `tag to inject on enum fields, e.g. validate:"oneof={{.EnumValues}}", requires -descriptor_set`)
+	fs.Var(&f.allowedKeys, "allowed_keys", "keys annotations may inject, e.g. json,db,validate, any key if empty, can be repeated or a comma separated list")
+	fs.StringVar(&f.ruleOwners, "rule_owners", "", "CODEOWNERS like file granting global rules on messages by full name pattern, e.g. acme.billing.* field_tag")
+	fs.StringVar(&f.opts.DocKey, "doc_key", "", `key of the tag injected on every field with a doc comment, with the first sentence of the comment, e.g. doc for doc:"Email of the user."`)
+	fs.BoolVar(&f.opts.Moretags, "moretags", false, "inject tags declared with the gogoproto.moretags field option, requires -descriptor_set")
+	fs.BoolVar(&f.fieldBehavior, "field_behavior", false, "inject tags for google.api.field_behavior field options, requires -descriptor_set")
+	fs.Var(&f.fieldBehaviorTags, "field_behavior_tag", `BEHAVIOR=tag injected by -field_behavior, e.g. OUTPUT_ONLY=readOnly:"true", can be repeated`)
+	fs.Var(&f.fieldTags, "field_tag", `FULL_NAME=tag injected on a field by the message full name and field name, e.g. acme.v1.User.email=validate:"email", can be repeated`)
+	fs.Var(&f.fieldNumberTags, "field_number_tag", `FULL_NAME=tag injected on a field by the message full name and field number, e.g. acme.v1.User.3=validate:"email", surviving field renames, can be repeated`)
+	fs.BoolVar(&f.opts.NormalizeTags, "normalize_tags", false, "place injected keys after protoc-gen-go keys, sorted by key")
+	fs.StringVar(&f.opts.KeyPrefix, "key_prefix", "", "prefix added to every injected key, e.g. x_ to inject x_db instead of db")
+	fs.Int64Var(&f.opts.MaxFileSize, "max_file_size", 64<<20, "refuse to process files larger than this many bytes, 0 for no limit")
+	fs.IntVar(&f.opts.MaxEdits, "max_edits", 10000, "refuse to inject tags into more than this many fields per file, 0 for no limit")
+	fs.BoolVar(&f.opts.Force, "force", false, "ignore -max_file_size and -max_edits")
+	fs.BoolVar(&f.opts.Mmap, "mmap", false, "map input files into memory to parse them instead of reading them, for large batch runs, files are read where mmap is unavailable")
+	fs.StringVar(&f.opts.Deprecated, "deprecated", "", `policy for fields marked "Deprecated:": skip global rules, hide with json:"-" or tag with deprecated:"true"`)
+	fs.StringVar(&f.generatedBy, "generated_by", "", "comma separated regexps, only process files whose \"Code generated by\" header matches one")
+	fs.Var(&f.maxTagLengths, "max_tag_length", "KEY=N maximum length in characters of the injected values of a key, can be repeated")
+	fs.StringVar(&f.opts.TagLengthPolicy, "tag_length_policy", tagLengthError, "policy for values longer than -max_tag_length: error, truncate or warn")
+	fs.IntVar(&f.opts.MaxLineLength, "max_line_length", 0, "warn about injected fields on lines longer than this many characters, 0 for no limit")
+	fs.StringVar(&f.opts.OneofMetadata, "oneof_metadata", "", "path of a Go file to write describing the oneof cases of the input and the tags of their fields")
+	fs.BoolVar(&f.opts.Opaque, "opaque", false, "inject tags into the hidden fields of messages generated with the opaque API, annotated on their builder fields")
+	fs.StringVar(&f.opts.OpaqueViews, "opaque_views", "", "path of a Go file to write with exported, tagged views of the opaque messages of the input and View methods filling them")
+	fs.StringVar(&f.opts.OneofMarshalers, "oneof_marshalers", "", "path of a Go file to write with MarshalJSON and UnmarshalJSON methods for the messages of the input with @inject_flat_json oneofs")
+	fs.BoolVar(&f.diff, "diff", false, "print the changes instead of writing them, exit status is 0 if there are none, 1 if there are and 2 on error")
+	fs.BoolVar(&f.check, "check", false, "list the files missing tags their annotations require instead of writing them, exit status is 0 if there are none, 1 if there are and 2 on error")
+	fs.BoolVar(&f.dryRun, "dry_run", false, "log the tag each field would get instead of writing files")
+	fs.StringVar(&f.diffFormat, "diff_format", diffUnified, "format of -diff: unified, name-only or json")
+	fs.BoolVar(&f.apply, "apply", false, "with -diff, also write the changes, exit status is then 0 unless there is an error")
+	fs.StringVar(&f.patch, "patch", "", "with -diff, also write the changes to this path as a patch file for git apply")
+	fs.BoolVar(&f.printVersion, "version", false, "print the tool version, commit and Go version, then exit")
+	fs.StringVar(&f.minVersion, "min_version", "", "refuse to run if the tool is older than this version, e.g. v1.4.0")
+	fs.StringVar(&f.maxVersion, "max_version", "", "refuse to run if the tool is newer than this version")
+	fs.IntVar(&f.syntaxVersion, "syntax_version", 0, "refuse to run if the tool doesn't understand this annotation syntax version")
+	fs.StringVar(&f.versionPolicy, "version_policy", versionError, "policy for -min_version, -max_version and -syntax_version mismatches: error or warn")
+	fs.IntVar(&f.opts.Jobs, "jobs", 0, "number of files processed concurrently, GOMAXPROCS if 0")
+	fs.BoolVar(&f.opts.Strict, "strict", false, "fail on annotations and rules without effect, such as annotations not on a field, without tag or not following the grammar")
+	fs.BoolVar(&f.opts.Format, "format", false, "gofmt the files injection changes")
+	fs.BoolVar(&f.opts.Verify, "verify", false, "read written files back and check they are valid UTF-8, parse and, with -format, are gofmt-stable, restoring every file otherwise")
+	fs.BoolVar(&f.opts.StripBOM, "strip_bom", false, "remove the UTF-8 byte order mark of injected files, kept by default")
+	fs.BoolVar(&f.opts.Lenient, "lenient", false, "inject the annotation comments of files go/parser can't parse line by line, reporting the syntax error")
+	fs.BoolVar(&f.quiet, "quiet", false, "only log errors")
+	fs.BoolVar(&f.verbose, "verbose", false, "also log the parsed files and every injected tag")
+	fs.StringVar(&f.opts.LogFormat, "log_format", logFormatText, "format of the logs: text, or json for one JSON object per event")
+	fs.BoolVar(&f.opts.Trace, "trace", false, "log the rules considered and the merge steps for each field")
+}
+
+// options validates the parsed flags and returns the options they
+// configure.
+func (f *cliFlags) options() (options, error) {
+	opts := f.opts
+	switch opts.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return opts, fmt.Errorf("invalid -log_format %q, must be text or json", opts.LogFormat)
+	}
+	switch f.versionPolicy {
+	case versionError, versionWarn:
+	default:
+		return opts, fmt.Errorf("invalid -version_policy %q, must be error or warn", f.versionPolicy)
+	}
+	for name, v := range map[string]string{"min_version": f.minVersion, "max_version": f.maxVersion} {
+		if _, err := parseVersion(v); v != "" && err != nil {
+			return opts, fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	warning, err := checkVersion(f.minVersion, f.maxVersion, f.syntaxVersion)
+	if err != nil {
+		if f.versionPolicy == versionError {
+			return opts, err
+		}
+		warning = err
+	}
+	if warning != nil {
+		opts.logger().Printf("warning: %v", warning)
+	}
+
+	switch {
+	case f.quiet && f.verbose:
+		return opts, errors.New("-quiet and -verbose are exclusive")
+	case f.quiet:
+		opts.LogLevel = inject.LogQuiet
+	case f.verbose:
+		opts.LogLevel = inject.LogVerbose
+	}
+
+	if len(f.xxxTags) > 0 {
+		opts.XXXSkip = strings.Split(f.xxxTags, ",")
+	}
+
+	switch f.diffFormat {
+	case diffUnified, diffNameOnly, diffJSON:
+	default:
+		return opts, fmt.Errorf("invalid -diff_format %q, must be unified, name-only or json", f.diffFormat)
+	}
+	if f.patch != "" && !f.diff {
+		return opts, errors.New("-patch requires -diff")
+	}
+	if f.apply && !f.diff {
+		return opts, errors.New("-apply requires -diff")
+	}
+	if f.check && (f.diff || f.dryRun || f.input.String() == stdinInput || f.casDir != "" || f.archive() != "") {
+		return opts, errors.New("-check can't be used with -diff, -dry_run, -input=-, -cas_dir or archives")
+	}
+	if f.dryRun && (f.diff || f.input.String() == stdinInput || f.casDir != "" || f.archive() != "") {
+		return opts, errors.New("-dry_run can't be used with -diff, -input=-, -cas_dir or archives")
+	}
+	for _, input := range f.input {
+		if input == stdinInput && (len(f.input) > 1 || f.diff || f.casDir != "" || opts.OneofMetadata != "" || opts.OneofMarshalers != "" || opts.OpaqueViews != "") {
+			return opts, errors.New("-input=- must be the only -input and can't be used with -diff, -cas_dir, -oneof_metadata, -oneof_marshalers or -opaque_views")
+		}
+		if isArchive(input) && len(f.input) > 1 {
+			return opts, fmt.Errorf("archive %q must be the only -input", input)
+		}
+	}
+	archive := f.archive()
+	if f.archiveOutput != "" && archive == "" {
+		return opts, errors.New("-archive_output requires -input to be a zip or tar archive")
+	}
+	if f.changedOnly != "" && (f.input.String() == stdinInput || archive != "") {
+		return opts, errors.New("-changed_only can't be used with -input=- or archives")
+	}
+	if len(f.exclude) > 0 && (f.input.String() == stdinInput || archive != "") {
+		return opts, errors.New("-exclude can't be used with -input=- or archives")
+	}
+	if f.output != "" && (f.input.String() == stdinInput || archive != "" || f.casDir != "") {
+		return opts, errors.New("-output can't be used with -input=-, archives or -cas_dir, use stdout, -archive_output or -cas_dir")
+	}
+	if f.lastRun != "" && (f.input.String() == stdinInput || archive != "" || f.casDir != "" || f.diff || f.check || f.dryRun) {
+		return opts, errors.New("-last_run can't be used with -input=-, archives, -cas_dir, -diff, -check or -dry_run")
+	}
+	if f.report != "" && (f.input.String() == stdinInput || archive != "" || f.casDir != "" || f.diff || f.check || f.dryRun) {
+		return opts, errors.New("-report can't be used with -input=-, archives, -cas_dir, -diff, -check or -dry_run")
+	}
+	if f.casMapping != "" && f.casDir == "" {
+		return opts, errors.New("-cas_mapping requires -cas_dir")
+	}
+	if f.casDir != "" && (f.diff || archive != "") {
+		return opts, errors.New("-cas_dir can't be used with -diff or archives")
+	}
+	if isObjectURL(archive) {
+		return opts, errors.New("archives in object stores aren't supported, copy them locally first")
+	}
+	if archive != "" && f.diff {
+		return opts, errors.New("-diff doesn't support archives, use -archive_output and compare the archives")
+	}
+
+	for _, key := range f.allowedKeys {
+		if !rValidTag.MatchString(key + `:"x"`) {
+			return opts, fmt.Errorf("invalid -allowed_keys entry %q, must be a tag key such as json", key)
+		}
+	}
+	opts.AllowedKeys = f.allowedKeys
+	if f.ruleOwners != "" {
+		owners, err := loadRuleOwners(f.ruleOwners)
+		if err != nil {
+			return opts, err
+		}
+		opts.RuleOwners = owners
+	}
+	if opts.Jobs < 0 {
+		return opts, fmt.Errorf("invalid -jobs %d, must be positive, or 0 for GOMAXPROCS", opts.Jobs)
+	}
+	if opts.DocKey != "" && !rValidTag.MatchString(opts.DocKey+`:"x"`) {
+		return opts, fmt.Errorf("invalid -doc_key %q, must be a tag key such as doc", opts.DocKey)
+	}
+	for _, pattern := range f.exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return opts, fmt.Errorf("invalid -exclude %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range f.softFail {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return opts, fmt.Errorf("invalid -soft_fail %q: %v", pattern, err)
+		}
+	}
+	opts.SoftFail = f.softFail
+
+	if f.chmod != "" {
+		mode, err := strconv.ParseUint(f.chmod, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return opts, fmt.Errorf("invalid -chmod %q, must be octal permission bits such as 0640", f.chmod)
+		}
+		opts.FileMode = os.FileMode(mode)
+	}
+
+	switch opts.Deprecated {
+	case "", deprecatedSkip, deprecatedHide, deprecatedTag:
+	default:
+		return opts, fmt.Errorf("invalid -deprecated %q, must be skip, hide or tag", opts.Deprecated)
+	}
+
+	switch opts.TagLengthPolicy {
+	case tagLengthError, tagLengthTruncate, tagLengthWarn:
+	case "wrap":
+		return opts, errors.New("invalid -tag_length_policy wrap, struct tags can't be wrapped across lines, use warn")
+	default:
+		return opts, fmt.Errorf("invalid -tag_length_policy %q, must be error, truncate or warn", opts.TagLengthPolicy)
+	}
+	for key, value := range f.maxTagLengths {
+		length, err := strconv.Atoi(value)
+		if err != nil || length <= 0 {
+			return opts, fmt.Errorf("invalid -max_tag_length %s=%s, must be a positive number", key, value)
+		}
+		if opts.MaxTagLengths == nil {
+			opts.MaxTagLengths = map[string]int{}
+		}
+		opts.MaxTagLengths[key] = length
+	}
+
+	if len(f.generatedBy) > 0 {
+		for _, pattern := range strings.Split(f.generatedBy, ",") {
+			rGeneratedBy, err := regexp.Compile(pattern)
+			if err != nil {
+				return opts, fmt.Errorf("invalid -generated_by: %v", err)
+			}
+			opts.GeneratedBy = append(opts.GeneratedBy, rGeneratedBy)
+		}
+	}
+
+	if f.fieldBehavior || len(f.fieldBehaviorTags) > 0 {
+		opts.FieldBehaviorTags = map[string]string{}
+		for behavior, tag := range defaultFieldBehaviorTags {
+			opts.FieldBehaviorTags[behavior] = tag
+		}
+		for behavior, tag := range f.fieldBehaviorTags {
+			opts.FieldBehaviorTags[behavior] = tag
+		}
+	}
+
+	if len(f.fieldTags) > 0 {
+		opts.FieldTags = f.fieldTags
+	}
+	for numberPath := range f.fieldNumberTags {
+		dot := strings.LastIndex(numberPath, ".")
+		if number, err := strconv.Atoi(numberPath[dot+1:]); dot <= 0 || err != nil || number <= 0 {
+			return opts, fmt.Errorf("invalid -field_number_tag %q, must be a message full name and a field number such as acme.v1.User.3", numberPath)
+		}
+	}
+	if len(f.fieldNumberTags) > 0 {
+		opts.FieldNumberTags = f.fieldNumberTags
+	}
+
+	if len(f.descriptorSetFile) > 0 {
+		ds, err := loadDescriptorSet(f.descriptorSetFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Descriptors = ds
+	} else if f.descriptors != nil {
+		opts.Descriptors = f.descriptors
+	} else if opts.InferRequired || opts.EnumTag != "" || opts.Moretags || opts.FieldBehaviorTags != nil {
+		return opts, errors.New("-infer_required, -enum_tag, -moretags and -field_behavior require -descriptor_set")
+	}
+	return opts, nil
+}
+
+// tagTable is a repeatable NAME=value flag, values being tags unless
+// stated otherwise.
+type tagTable map[string]string
+
+func (t tagTable) String() string {
+	var entries []string
+	for name, tag := range t {
+		entries = append(entries, name+"="+tag)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (t *tagTable) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q is not NAME=value", value)
+	}
+	if *t == nil {
+		*t = tagTable{}
+	}
+	(*t)[value[:i]] = value[i+1:]
+	return nil
+}
+
+// archive returns the archive given as -input, if any.
+func (f *cliFlags) archive() string {
+	if len(f.input) == 1 && isArchive(f.input[0]) {
+		return f.input[0]
+	}
+	return ""
+}
+
+// inputFilter returns the filter of the directories walked for -input.
+func (f *cliFlags) inputFilter() inputFilter {
+	return inputFilter{exclude: f.exclude, includeIgnored: f.includeIgnored, skipTestdata: f.skipTestdata}
+}
+
+// inputList is a repeatable flag of paths such as -input, each value
+// being a path or a comma separated list of paths.
+type inputList []string
+
+func (l inputList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *inputList) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path != "" {
+			*l = append(*l, path)
+		}
+	}
+	return nil
+}
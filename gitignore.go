@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// injectIgnoreFile is the ignore file of the tool, with the syntax of
+// .gitignore files, listing the paths walks skip whether git ignores
+// them or not, e.g. generated code checked in which mustn't be injected.
+const injectIgnoreFile = ".injectignore"
+
+// ignoreRule is a pattern of a .gitignore or .injectignore file.
+type ignoreRule struct {
+	// dir is the directory of the .gitignore file, the pattern matching
+	// the paths under it
+	dir string
+	re  *regexp.Regexp
+	// anchored patterns, with a slash before their end, match the path
+	// relative to dir, the others the base name at any depth
+	anchored, negated, dirOnly bool
+}
+
+// ignoreRules are the patterns of the ignore files applying to a
+// directory, from the outermost, the last matching one winning as for
+// git.
+type ignoreRules []ignoreRule
+
+// parseIgnoreRules returns the patterns of the ignore file in dir
+// with contents, skipping blank lines and comments.
+func parseIgnoreRules(dir string, contents []byte) ignoreRules {
+	var rules ignoreRules
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negated, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.anchored = strings.Contains(line, "/")
+		re, err := regexp.Compile(ignoreRegexp(strings.TrimPrefix(line, "/")))
+		if err != nil {
+			// git ignores the patterns it can't match too
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignoreRegexp returns the regular expression of the .gitignore pattern,
+// * and ? not matching slashes unlike **.
+func ignoreRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// ignored reports whether rules ignore path, a directory if dir is true.
+func (rules ignoreRules) ignored(path string, dir bool) bool {
+	var ignored bool
+	for _, rule := range rules {
+		if rule.dirOnly && !dir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.dir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if !rule.anchored {
+			rel = rel[strings.LastIndexByte(rel, '/')+1:]
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negated
+		}
+	}
+	return ignored
+}
+
+// readIgnoreRules returns the patterns of the ignore files names of dir,
+// in order, none for the files it doesn't have.
+func readIgnoreRules(dir string, names []string) (ignoreRules, error) {
+	var rules ignoreRules
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parseIgnoreRules(dir, contents)...)
+	}
+	return rules, nil
+}
+
+// workTreeTop returns the top directory of the git work tree dir, an
+// absolute path, is in, ok being false if it isn't in one.
+func workTreeTop(dir string) (top string, ok bool) {
+	for ; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, true
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
+
+// ignoreWalker tracks the ignore files applying to the directories of a
+// walk: the ones of the walked directories and, if the root of the walk
+// is in a git work tree, the ones of its parents up to the top of the
+// work tree. The root itself is walked even if ignored, as it is given
+// explicitly. A nil ignoreWalker ignores nothing.
+type ignoreWalker struct {
+	root string
+	// names are the names of the ignore files read in each directory,
+	// the patterns of the later ones winning
+	names []string
+	// rules are keyed by absolute directory
+	rules map[string]ignoreRules
+}
+
+// newIgnoreWalker returns the ignoreWalker of the walk of root, reading
+// the ignore files names.
+func newIgnoreWalker(root string, names ...string) (*ignoreWalker, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	var parents []string
+	if top, ok := workTreeTop(abs); ok && top != abs {
+		for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+			parents = append(parents, dir)
+			if dir == top {
+				break
+			}
+		}
+	}
+	var inherited ignoreRules
+	for i := len(parents) - 1; i >= 0; i-- {
+		rules, err := readIgnoreRules(parents[i], names)
+		if err != nil {
+			return nil, err
+		}
+		inherited = append(inherited, rules...)
+	}
+	return &ignoreWalker{root: abs, names: names, rules: map[string]ignoreRules{filepath.Dir(abs): inherited}}, nil
+}
+
+// skip reports whether the walk skips path, a directory if dir is true,
+// ignored by an ignore file, reading the ones of path if it is a
+// directory walked into.
+func (w *ignoreWalker) skip(path string, dir bool) (bool, error) {
+	if w == nil {
+		return false, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	rules := w.rules[filepath.Dir(abs)]
+	if abs != w.root && rules.ignored(abs, dir) {
+		return true, nil
+	}
+	if dir {
+		own, err := readIgnoreRules(abs, w.names)
+		if err != nil {
+			return false, err
+		}
+		w.rules[abs] = append(rules[:len(rules):len(rules)], own...)
+	}
+	return false, nil
+}
@@ -1,7 +1,10 @@
 module github.com/favadi/protoc-go-inject-tag
 
+go 1.27.1
+
+require github.com/golang/protobuf v1.1.0
+
 require (
-	github.com/golang/protobuf v1.1.0
 	golang.org/x/net v0.0.0-20180801234040-f4c29de78a2a // indirect
 	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
 )
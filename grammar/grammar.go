@@ -0,0 +1,180 @@
+// Package grammar describes the syntax of the annotation comments of
+// protoc-go-inject-tag, for linters and editor plugins validating them
+// without copying the patterns of the tool, which uses the same ones.
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// The patterns of annotation comments, as Go regexps. The first group of
+// CommentPattern, DirectivePattern and OneofCommentPattern is the tag,
+// DefinePattern has the macro name and its value.
+const (
+	CommentPattern      = `^//\s*@inject_tag:\s*(.*)$`
+	DirectivePattern    = `^//inject:tag\s+(.*)$`
+	OneofCommentPattern = `^//\s*@inject_tag_oneof:\s*(.*)$`
+	DefinePattern       = `^//\s*@define:\s*(\w+)\s*=\s*(.*?)\s*$`
+	// FlatJSONPattern matches the comments of oneofs flattened into JSON,
+	// the first group being the comma separated FlatJSONOptions.
+	FlatJSONPattern = `^//\s*@inject_flat_json(?::\s*(.*?))?\s*$`
+	// MacroPattern matches the $name references to macros in tags.
+	MacroPattern = `\$(\w+)`
+	// TagPattern matches a key:"value" pair of a tag.
+	TagPattern = `[\w_]+:"[^"]+"`
+	// ValidTagPattern matches the tags made of key:"value" pairs only,
+	// once directives are joined and macros and templates expanded.
+	ValidTagPattern = `^\s*(?:[\w_]+:"[^"]+"\s*)*$`
+)
+
+// FlatJSONOptions are the options of FlatJSONPattern comments.
+var FlatJSONOptions = []string{"omitempty", "json_name"}
+
+// EBNF is the grammar of annotation comments, in the notation of the Go
+// specification.
+const EBNF = `annotation = comment | directive | oneof | define | flatjson .
+comment    = "//" { space } "@inject_tag:" { space } tags .
+directive  = "//inject:tag" space { space } tags .
+oneof      = "//" { space } "@inject_tag_oneof:" { space } tags .
+define     = "//" { space } "@define:" { space } name { space } "=" { space } tags .
+flatjson   = "//" { space } "@inject_flat_json" [ ":" { space } option { "," option } ] .
+option     = "omitempty" | "json_name" .
+tags       = item { separator item } .
+separator  = space { space } | ";" | "@inject_tag:" .
+item       = key ":" '"' value '"' | "$" name .
+key        = word { word } .
+name       = word { word } .
+value      = char { char } .
+space      = " " | "\t" .
+word       = "A" … "Z" | "a" … "z" | "0" … "9" | "_" .
+char       = /* any character but '"', "{{" template "}}" actions and
+              "$" name macro references included */ .`
+
+var (
+	rComment      = regexp.MustCompile(CommentPattern)
+	rDirective    = regexp.MustCompile(DirectivePattern)
+	rOneofComment = regexp.MustCompile(OneofCommentPattern)
+	rDefine       = regexp.MustCompile(DefinePattern)
+	rFlatJSON     = regexp.MustCompile(FlatJSONPattern)
+	rMacroRef     = regexp.MustCompile("^" + MacroPattern)
+	rValidTag     = regexp.MustCompile(ValidTagPattern)
+)
+
+// JoinDirectives returns the tags of a comment cramming several
+// directives on one line, separated by semicolons or repeated
+// `@inject_tag:` markers, as one tag, e.g. `json:"x"; validate:"required"`
+// as `json:"x" validate:"required"`. Semicolons and markers in quoted
+// values, such as gorm:"column:id;primaryKey", are kept.
+func JoinDirectives(tag string) string {
+	const marker = "@inject_tag:"
+	if !strings.ContainsAny(tag, ";@") {
+		return tag
+	}
+	var joined []byte
+	space := func() {
+		if len(joined) > 0 && joined[len(joined)-1] != ' ' {
+			joined = append(joined, ' ')
+		}
+	}
+	var quoted bool
+	for i := 0; i < len(tag); i++ {
+		switch c := tag[i]; {
+		case c == '"':
+			quoted = !quoted
+			joined = append(joined, c)
+		case quoted:
+			joined = append(joined, c)
+		case c == ';' || c == ' ' || c == '\t':
+			space()
+		case strings.HasPrefix(tag[i:], marker):
+			space()
+			i += len(marker) - 1
+		default:
+			joined = append(joined, c)
+		}
+	}
+	return strings.TrimSpace(string(joined))
+}
+
+// Validate returns an error if comment, a single line comment starting
+// with //, isn't a well-formed annotation. Macro references and template
+// actions are only known when injecting, so they are checked for syntax
+// only: a macro reference stands for pairs outside of quotes and for
+// part of a value inside them.
+func Validate(comment string) error {
+	comment = strings.TrimSpace(comment)
+	if match := rDefine.FindStringSubmatch(comment); match != nil {
+		if match[2] == "" {
+			return fmt.Errorf("macro %q has no value", match[1])
+		}
+		return validateTag(match[2])
+	}
+	if match := rFlatJSON.FindStringSubmatch(comment); match != nil {
+		return ValidateFlatJSON(match[1])
+	}
+	for _, r := range []*regexp.Regexp{rComment, rDirective, rOneofComment} {
+		if match := r.FindStringSubmatch(comment); match != nil {
+			tag := JoinDirectives(match[1])
+			if strings.TrimSpace(tag) == "" {
+				return errors.New("annotation without tag")
+			}
+			return validateTag(tag)
+		}
+	}
+	return errors.New("not an annotation comment")
+}
+
+// ValidateFlatJSON returns an error if options, the comma separated
+// options of a FlatJSONPattern comment, has unknown options.
+func ValidateFlatJSON(options string) error {
+	if options == "" {
+		return nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		var known bool
+		for _, name := range FlatJSONOptions {
+			known = known || option == name
+		}
+		if !known {
+			return fmt.Errorf("unknown @inject_flat_json option %q, must be %s", option, strings.Join(FlatJSONOptions, " or "))
+		}
+	}
+	return nil
+}
+
+// validateTag checks the syntax of tag, see Validate.
+func validateTag(tag string) error {
+	if strings.Contains(tag, "{{") {
+		if _, err := template.New("tag").Parse(tag); err != nil {
+			return err
+		}
+	}
+	var placeheld []byte
+	var quoted bool
+	for i := 0; i < len(tag); i++ {
+		switch {
+		case strings.HasPrefix(tag[i:], "{{") && strings.Contains(tag[i:], "}}"):
+			i += strings.Index(tag[i:], "}}") + 1
+			placeheld = append(placeheld, 'x')
+		case rMacroRef.MatchString(tag[i:]):
+			i += len(rMacroRef.FindString(tag[i:])) - 1
+			if quoted {
+				placeheld = append(placeheld, 'x')
+			}
+		default:
+			if tag[i] == '"' {
+				quoted = !quoted
+			}
+			placeheld = append(placeheld, tag[i])
+		}
+	}
+	if !rValidTag.Match(placeheld) {
+		return fmt.Errorf("invalid tag syntax: %s", tag)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// sourceToken is a token of a Go source, and its position.
+type sourceToken struct {
+	tok token.Token
+	lit string
+	pos token.Position
+}
+
+// tokensWithoutTags returns the tokens of the Go source src, comments
+// included, without the tag literals of struct fields.
+func tokensWithoutTags(filename string, src []byte) ([]sourceToken, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[int]bool{}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if field, ok := node.(*ast.Field); ok && field.Tag != nil {
+			tags[fset.Position(field.Tag.Pos()).Offset] = true
+		}
+		return true
+	})
+	file := fset.AddFile(filename, -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	var tokens []sourceToken
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return tokens, nil
+		}
+		if tok == token.STRING && tags[file.Offset(pos)] {
+			continue
+		}
+		tokens = append(tokens, sourceToken{tok: tok, lit: lit, pos: file.Position(pos)})
+	}
+}
+
+// checkOnlyTagsChanged verifies that injected, the result of injecting
+// tags into original, differs from it by tag literals only, so an offset
+// bug can never corrupt code or comments.
+func checkOnlyTagsChanged(filename string, original, injected []byte) error {
+	before, err := tokensWithoutTags(filename, original)
+	var after []sourceToken
+	if err != nil {
+		// injected with -lenient, compare the tokens found by the scanner
+		before, after = lexicalTokens(filename, original), lexicalTokens(filename, injected)
+	} else if after, err = tokensWithoutTags(filename, injected); err != nil {
+		return &inject.FieldError{File: filename, Err: fmt.Errorf("%w: injected source doesn't parse: %v", inject.ErrUnsafeEdit, err)}
+	}
+	for i := range before {
+		if i >= len(after) {
+			return &inject.FieldError{File: filename, Pos: before[i].pos, Err: fmt.Errorf("%w: %s removed", inject.ErrUnsafeEdit, before[i].tok)}
+		}
+		if before[i].tok != after[i].tok || before[i].lit != after[i].lit {
+			return &inject.FieldError{File: filename, Pos: after[i].pos, Err: fmt.Errorf("%w: %s %q became %s %q",
+				inject.ErrUnsafeEdit, before[i].tok, before[i].lit, after[i].tok, after[i].lit)}
+		}
+	}
+	if len(after) > len(before) {
+		return &inject.FieldError{File: filename, Pos: after[len(before)].pos, Err: fmt.Errorf("%w: %s added", inject.ErrUnsafeEdit, after[len(before)].tok)}
+	}
+	return nil
+}
+
+// verifyWritten reads back the written file and checks the invariants of
+// injected files: it has the staged contents, is valid UTF-8, parses if
+// the original did and, if formatted, is gofmt-stable. Injection is
+// checked before anything is written, so a failure is a bug.
+func verifyWritten(file stagedFile, formatted bool) error {
+	broken := func(problem string, args ...interface{}) error {
+		return &inject.FieldError{File: file.path, Err: fmt.Errorf("%w: written file %s, restoring the original contents; this is a bug, please report it",
+			inject.ErrUnsafeEdit, fmt.Sprintf(problem, args...))}
+	}
+	// objects aren't read back, downloading them again being costly
+	written := file.contents
+	if !isObjectURL(file.path) {
+		var err error
+		if written, err = ioutil.ReadFile(file.path); err != nil {
+			return fmt.Errorf("%w: -verify: %v", inject.ErrWrite, err)
+		}
+		if !bytes.Equal(written, file.contents) {
+			return broken("differs from the injected contents")
+		}
+	}
+	if problem := injectedProblem(file, written, formatted); problem != "" {
+		return broken("%s", problem)
+	}
+	return nil
+}
+
+// injectedProblem returns how contents, the injected contents of file,
+// break the invariants of injected files, empty if they don't: they are
+// valid UTF-8, parse if the original did and, if formatted, are
+// gofmt-stable.
+func injectedProblem(file stagedFile, contents []byte, formatted bool) string {
+	if !utf8.Valid(contents) {
+		return "isn't valid UTF-8"
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), file.path, file.original, parser.ParseComments); err == nil || file.original == nil {
+		if _, err = parser.ParseFile(token.NewFileSet(), file.path, contents, parser.ParseComments); err != nil {
+			return fmt.Sprintf("doesn't parse: %v", err)
+		}
+	}
+	if formatted {
+		if gofmted, err := format.Source(contents); err != nil || !bytes.Equal(gofmted, contents) {
+			return "isn't gofmt-stable"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// starterConfig is the template of the config file written by init.
+//
+//go:embed init.yaml
+var starterConfig string
+
+// starterPreset is an annotate-proto preset listed by the starter config.
+type starterPreset struct {
+	Name, Tag string
+}
+
+// renderStarterConfig returns the starter config of init, injecting the
+// files under input.
+func renderStarterConfig(input string) ([]byte, error) {
+	tmpl, err := template.New("init").Parse(starterConfig)
+	if err != nil {
+		return nil, err
+	}
+	var presets []starterPreset
+	for _, name := range presetNames() {
+		presets = append(presets, starterPreset{Name: name, Tag: annotationPresets[name]("field_name")})
+	}
+	var buf strings.Builder
+	if err = tmpl.Execute(&buf, struct {
+		Input   string
+		Presets []starterPreset
+	}{configValue(input), presets}); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+
+// runInit writes a starter config file with commented examples to the
+// current directory.
+func runInit(_ options, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	input := fs.String("input", "./gen", "directory of the generated files the config injects tags into")
+	force := fs.Bool("force", false, "overwrite an existing config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: init [-input dir] [-force]")
+	}
+	if _, err := os.Stat(defaultConfigFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", defaultConfigFile)
+	}
+	contents, err := renderStarterConfig(*input)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(defaultConfigFile, contents, 0); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s, edit it then run protoc-go-inject-tag\n", defaultConfigFile)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Package inject exposes the errors and the progress events of
+// protoc-go-inject-tag to programs embedding it, so they can branch on
+// the cause of a failure with errors.Is and errors.As and report
+// progress in their own UI, rather than matching and scraping log
+// messages.
+package inject
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+)
+
+var (
+	// ErrParse reports a Go file that can't be parsed.
+	ErrParse = errors.New("parse error")
+	// ErrEncoding reports a file that isn't UTF-8 encoded.
+	ErrEncoding = errors.New("invalid encoding")
+	// ErrNoTag reports an inject tag comment without tag.
+	ErrNoTag = errors.New("comment has no tag")
+	// ErrTagSyntax reports a tag to inject that isn't a list of
+	// key:"value" pairs.
+	ErrTagSyntax = errors.New("invalid tag syntax")
+	// ErrOverlap reports areas to inject that overlap each other.
+	ErrOverlap = errors.New("overlapping areas")
+	// ErrKeyNotAllowed reports an annotation injecting a key missing from
+	// the allowed keys.
+	ErrKeyNotAllowed = errors.New("key not allowed")
+	// ErrNoMatch reports an annotation or rule which matches no field,
+	// leaving it without effect.
+	ErrNoMatch = errors.New("no match")
+	// ErrWrite reports a file that can't be written.
+	ErrWrite = errors.New("write error")
+	// ErrNoInput reports an -input without files to inject.
+	ErrNoInput = errors.New("no input file found")
+	// ErrUnsafeEdit reports an injection that would change more than tag
+	// literals, the file is left untouched.
+	ErrUnsafeEdit = errors.New("injection changes more than tags")
+	// ErrInterrupted reports a run interrupted before its files were
+	// written, nothing is written.
+	ErrInterrupted = errors.New("interrupted")
+)
+
+// FieldError wraps an error with the file and field it occurred in.
+// Errors.Is can be used on it to branch on the causes above.
+type FieldError struct {
+	File string
+	// Field is the field as Type.Field, empty for errors about the whole
+	// file.
+	Field string
+	// Pos is the position of the field, or of the error in the file.
+	Pos token.Position
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	location := e.File
+	if e.Pos.IsValid() {
+		location = e.Pos.String()
+	}
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s: %v", location, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", location, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
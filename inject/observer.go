@@ -0,0 +1,173 @@
+package inject
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// Area is a field tag to inject, found in a file: a tag literal or its
+// insertion point between the byte offsets Start and End, counted from 1.
+type Area struct {
+	Start      int
+	End        int
+	CurrentTag string
+	InjectTag  string
+	// Normalize moves injected keys after the keys generated by
+	// protoc-gen-go, sorted by key.
+	Normalize bool
+	// Layers are the tags making up InjectTag, by increasing precedence,
+	// and their sources, for the why command.
+	Layers []Layer
+}
+
+// Layer is a tag injected by a source: a global rule such as
+// -field_tag, a oneof comment or a comment on the field.
+type Layer struct {
+	Source string
+	Tag    string
+}
+
+// Observer is notified of the progress of a run. Embedders implement it
+// to report progress in their own UI instead of scraping log output.
+type Observer interface {
+	// OnFileStart is called before a file is parsed.
+	OnFileStart(path string)
+	// OnFileParsed is called with the areas to inject found in a file.
+	OnFileParsed(path string, areas []Area)
+	// OnInjection is called for each area injected into a file, with the
+	// field expression before injection.
+	OnInjection(path string, area Area, expr string)
+	// OnWarning is called for problems that don't stop the run, usually
+	// reported as a *FieldError.
+	OnWarning(path string, err error)
+	// OnFileDone is called once a file is written, or left as is if
+	// injection didn't change it.
+	OnFileDone(path string, changed bool)
+}
+
+// The log levels of LogObserver.
+const (
+	// LogQuiet logs nothing.
+	LogQuiet = "quiet"
+	// LogVerbose also logs the parsed files and the injected fields.
+	LogVerbose = "verbose"
+)
+
+// LogObserver logs the progress of a run, it is the default observer of
+// the tool. Written files and warnings are logged unless Level is
+// LogQuiet, everything if it is LogVerbose.
+type LogObserver struct {
+	Logger *log.Logger
+	Level  string
+}
+
+func (o LogObserver) OnFileStart(path string) {
+	if o.Level == LogVerbose {
+		o.Logger.Printf("parsing file %q for inject tag comments", path)
+	}
+}
+
+func (o LogObserver) OnFileParsed(path string, areas []Area) {
+	if o.Level == LogVerbose {
+		o.Logger.Printf("parsed file %q, number of fields to inject custom tags: %d", path, len(areas))
+	}
+}
+
+func (o LogObserver) OnInjection(path string, area Area, expr string) {
+	if o.Level == LogVerbose {
+		o.Logger.Printf("inject custom tag %q to expression %q", area.InjectTag, expr)
+	}
+}
+
+func (o LogObserver) OnWarning(path string, err error) {
+	if o.Level != LogQuiet {
+		o.Logger.Printf("warning: %v", err)
+	}
+}
+
+func (o LogObserver) OnFileDone(path string, changed bool) {
+	switch {
+	case o.Level == LogQuiet:
+	case changed:
+		o.Logger.Printf("file %q is injected with custom tags", path)
+	case o.Level == LogVerbose:
+		o.Logger.Printf("file %q is unchanged", path)
+	}
+}
+
+// StatsObserver counts the events of a run, forwarding them to Observer.
+type StatsObserver struct {
+	Observer
+	// Files counts the files scanned and Injected the fields injected.
+	Files, Injected int
+	// Skipped counts the annotations without effect, NoMatch the ones,
+	// and the rules, matching no field, see ErrNoMatch.
+	Skipped, NoMatch int
+}
+
+func (o *StatsObserver) OnFileStart(path string) {
+	o.Files++
+	o.Observer.OnFileStart(path)
+}
+
+func (o *StatsObserver) OnInjection(path string, area Area, expr string) {
+	o.Injected++
+	o.Observer.OnInjection(path, area, expr)
+}
+
+func (o *StatsObserver) OnWarning(path string, err error) {
+	if errors.Is(err, ErrNoMatch) {
+		o.NoMatch++
+	}
+	if errors.Is(err, ErrNoMatch) || errors.Is(err, ErrNoTag) {
+		o.Skipped++
+	}
+	o.Observer.OnWarning(path, err)
+}
+
+// SyncObserver serializes the events of concurrent workers to Observer.
+type SyncObserver struct {
+	mu       sync.Mutex
+	Observer Observer
+}
+
+func (o *SyncObserver) OnFileStart(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Observer.OnFileStart(path)
+}
+
+func (o *SyncObserver) OnFileParsed(path string, areas []Area) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Observer.OnFileParsed(path, areas)
+}
+
+func (o *SyncObserver) OnInjection(path string, area Area, expr string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Observer.OnInjection(path, area, expr)
+}
+
+func (o *SyncObserver) OnWarning(path string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Observer.OnWarning(path, err)
+}
+
+func (o *SyncObserver) OnFileDone(path string, changed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Observer.OnFileDone(path, changed)
+}
+
+// NopObserver ignores the progress of a run, for callers reporting it
+// themselves.
+type NopObserver struct{}
+
+func (NopObserver) OnFileStart(path string)                         {}
+func (NopObserver) OnFileParsed(path string, areas []Area)          {}
+func (NopObserver) OnInjection(path string, area Area, expr string) {}
+func (NopObserver) OnWarning(path string, err error)                {}
+func (NopObserver) OnFileDone(path string, changed bool)            {}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"runtime"
+	"sync"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// injector injects tags with its own options, observer and logger. It
+// holds no shared state, so injectors with different options can be used
+// concurrently in one process.
+type injector struct {
+	opts options
+}
+
+func newInjector(opts options) *injector {
+	return &injector{opts: opts}
+}
+
+// injectFiles injects tags into the files at paths, writing them together
+// once all of them are processed. The returned transaction describes the
+// files processed so far, even on error.
+func (inj *injector) injectFiles(paths ...string) (*transaction, error) {
+	tx, err := inj.stageFiles(paths...)
+	if err != nil {
+		return tx, err
+	}
+	return tx, tx.commit()
+}
+
+// stageFiles injects tags into the files at paths without writing them.
+func (inj *injector) stageFiles(paths ...string) (*transaction, error) {
+	tx := &transaction{observer: inj.opts.observer(), mode: inj.opts.FileMode, backup: inj.opts.Backup,
+		verify: inj.opts.Verify, formatted: inj.opts.Format}
+	staged := inj.stageEach(tx.observer, paths)
+	for i, path := range paths {
+		if err := staged[i].err; err != nil {
+			if errors.Is(err, inject.ErrInterrupted) {
+				done := 0
+				for _, s := range staged {
+					if s.err == nil {
+						done++
+					}
+				}
+				return tx, fmt.Errorf("%w after staging %d of %d file(s), nothing written", err, done, len(paths))
+			}
+			if !matchesGlob(inj.opts.SoftFail, path) {
+				return tx, err
+			}
+			tx.observer.OnWarning(path, fmt.Errorf("%w, file left as is (-soft_fail)", err))
+			continue
+		}
+		file, err := inj.finishFile(staged[i].file)
+		if err != nil {
+			return tx, err
+		}
+		tx.files = append(tx.files, file)
+	}
+	if len(tx.files) > 1 {
+		if err := checkConsistency(tx.files, tx.observer); err != nil {
+			return tx, err
+		}
+	}
+	for i := range tx.files {
+		if out, ok := inj.opts.Outputs[tx.files[i].path]; ok {
+			if err := redirectOutput(&tx.files[i], out); err != nil {
+				return tx, err
+			}
+		}
+	}
+	if inj.opts.OneofMarshalers != "" {
+		if err := stageOneofMarshalers(tx, inj.opts.OneofMarshalers); err != nil {
+			return tx, err
+		}
+	}
+	if inj.opts.OpaqueViews != "" {
+		if err := stageOpaqueViews(tx, inj.opts.OpaqueViews); err != nil {
+			return tx, err
+		}
+	}
+	if inj.opts.OneofMetadata != "" {
+		return tx, stageOneofMetadata(tx, inj.opts.OneofMetadata)
+	}
+	return tx, nil
+}
+
+// stagedPath is the result of staging a file of stageEach.
+type stagedPath struct {
+	file stagedFile
+	err  error
+}
+
+// stageEach stages the files at paths on their own, using -jobs workers,
+// and returns their results in the order of paths. Once a file fails,
+// the files not started yet are skipped with the same error, unless
+// -soft_fail patterns may let the run go on, and so are they once the run
+// is interrupted, with inject.ErrInterrupted.
+func (inj *injector) stageEach(obs observer, paths []string) []stagedPath {
+	staged := make([]stagedPath, len(paths))
+	jobs := inj.opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	if jobs > len(paths) {
+		jobs = len(paths)
+	}
+	worker := inj
+	if jobs > 1 {
+		// observers needn't be safe for concurrent use
+		opts := inj.opts
+		opts.Observer = &inject.SyncObserver{Observer: obs}
+		obs, worker = opts.Observer, newInjector(opts)
+	}
+	var (
+		mu     sync.Mutex
+		next   int
+		failed error
+		wg     sync.WaitGroup
+	)
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i, err := next, failed
+				next++
+				mu.Unlock()
+				if i >= len(paths) {
+					return
+				}
+				if err == nil && inj.opts.interrupted() {
+					err = inject.ErrInterrupted
+				}
+				if err != nil {
+					staged[i].err = err
+					continue
+				}
+				tx := &transaction{observer: obs}
+				if err = worker.stageFile(tx, paths[i]); err != nil {
+					staged[i].err = err
+					if len(inj.opts.SoftFail) == 0 {
+						mu.Lock()
+						failed = err
+						mu.Unlock()
+					}
+					continue
+				}
+				staged[i].file = tx.files[0]
+			}
+		}()
+	}
+	wg.Wait()
+	return staged
+}
+
+// stageFile injects tags into the file at path, a local file or an
+// object store URL, and stages it in tx.
+func (inj *injector) stageFile(tx *transaction, path string) (err error) {
+	if isObjectURL(path) {
+		return inj.stageObject(tx, path)
+	}
+	src, release, err := readInput(path, inj.opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := release(); err == nil {
+			err = releaseErr
+		}
+	}()
+	areas, err := parseContents(path, src, inj.opts)
+	if err != nil {
+		return err
+	}
+	if inj.opts.Mmap {
+		// the staged file outlives the mapping
+		src = append([]byte(nil), src...)
+	}
+	return tx.stageSource(path, src, areas)
+}
+
+// finishFile applies -strip_bom and -format to a staged file.
+func (inj *injector) finishFile(file stagedFile) (stagedFile, error) {
+	if inj.opts.StripBOM {
+		file.contents = bytes.TrimPrefix(file.contents, utf8BOM)
+	}
+	if inj.opts.Format && file.changed() {
+		formatted, err := format.Source(file.contents)
+		if err != nil {
+			return file, &inject.FieldError{File: file.path, Err: fmt.Errorf("%w: -format: %v", inject.ErrParse, err)}
+		}
+		file.contents = formatted
+	}
+	return file, nil
+}
+
+// injectSource returns the Go source src with tags injected, without
+// touching the filesystem, staged with the same checks as files: the
+// size and edit limits, -format and, with -verify, the invariants of
+// written files.
+func (inj *injector) injectSource(filename string, src []byte) ([]byte, error) {
+	inj.opts.observer().OnFileStart(filename)
+	if err := checkFileSize(filename, int64(len(src)), inj.opts); err != nil {
+		return nil, err
+	}
+	areas, err := parseContents(filename, src, inj.opts)
+	if err != nil {
+		return nil, err
+	}
+	tx := &transaction{observer: inj.opts.observer()}
+	if err = tx.stageSource(filename, src, areas); err != nil {
+		return nil, err
+	}
+	file, err := inj.finishFile(tx.files[0])
+	if err != nil {
+		return nil, err
+	}
+	if inj.opts.Verify && file.changed() {
+		if problem := injectedProblem(file, file.contents, inj.opts.Format); problem != "" {
+			return nil, &inject.FieldError{File: filename, Err: fmt.Errorf("%w: injected source %s; this is a bug, please report it",
+				inject.ErrUnsafeEdit, problem)}
+		}
+	}
+	return file.contents, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// inputPaths returns the files to inject for -input: input itself, with
+// recursive the *.pb.go files found under it if it is a directory, or the
+// files of the packages matching it if it is a package pattern, see
+// packagePaths.
+// Files and directories matching one of the exclude globs of filter, as
+// matched by matchesGlob, are skipped, and so are the vendor directories
+// and the paths ignored by .injectignore files and, unless filter
+// includes them, by .gitignore files.
+func inputPaths(input string, recursive bool, filter inputFilter) ([]string, error) {
+	exclude := filter.exclude
+	if isObjectURL(input) {
+		return []string{input}, nil
+	}
+	if matchesGlob(exclude, input) {
+		return nil, nil
+	}
+	if dir, ok := patternDir(input); ok {
+		return packagePaths(dir, filter)
+	}
+	info, err := os.Stat(input)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", inject.ErrNoInput, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{input}, nil
+	}
+	if !recursive {
+		return nil, fmt.Errorf("-input %q is a directory, use -recursive to inject the files under it", input)
+	}
+	ignore, err := filter.ignoreWalker(input)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	var excluded, ignored bool
+	err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		globbed := path != input && matchesGlob(exclude, path)
+		excluded = excluded || globbed
+		skipped := globbed || path != input && info.IsDir() && filter.skipDir(info.Name())
+		if !skipped {
+			if skipped, err = ignore.skip(path, info.IsDir()); err != nil {
+				return err
+			}
+			ignored = ignored || skipped
+		}
+		if skipped {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".pb.go") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && ignored {
+		return nil, fmt.Errorf("%w: no *.pb.go file under %q left by .gitignore or .injectignore files, see -include_ignored", inject.ErrNoInput, input)
+	}
+	if len(paths) == 0 && excluded {
+		return nil, fmt.Errorf("%w: no *.pb.go file under %q left by -exclude", inject.ErrNoInput, input)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no *.pb.go file under %q", inject.ErrNoInput, input)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// patternDir returns the directory of the package pattern input, such as
+// ./gen for ./gen/... or "" for ..., ok being false if input isn't a
+// package pattern.
+func patternDir(input string) (dir string, ok bool) {
+	if input != "..." && !strings.HasSuffix(input, "/...") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(input, "..."), "/"), true
+}
+
+// packagePaths returns the *.pb.go files of the packages matched by the
+// pattern dir/..., as the go command matches them: the packages in dir
+// and under it, except in vendor and testdata directories and in the ones
+// starting with . or _, with the files excluded by the build constraints
+// of the current platform left out, and so are the paths ignored by
+// .injectignore files and, unless filter includes them, by .gitignore
+// files.
+func packagePaths(dir string, filter inputFilter) ([]string, error) {
+	exclude := filter.exclude
+	pattern := dir + "/..."
+	if dir == "" {
+		dir, pattern = ".", "..."
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", inject.ErrNoInput, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("-input %q: %q is not a directory", pattern, dir)
+	}
+	ignore, err := filter.ignoreWalker(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir {
+			if name := info.Name(); name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || matchesGlob(exclude, path) {
+				return filepath.SkipDir
+			}
+		}
+		if skip, err := ignore.skip(path, true); err != nil || skip {
+			if err == nil {
+				err = filepath.SkipDir
+			}
+			return err
+		}
+		pkg, err := build.ImportDir(path, 0)
+		var noGo *build.NoGoError
+		if errors.As(err, &noGo) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("package %s: %v", path, err)
+		}
+		for _, name := range pkg.GoFiles {
+			file := filepath.Join(path, name)
+			if !strings.HasSuffix(name, ".pb.go") || matchesGlob(exclude, file) {
+				continue
+			}
+			if skip, err := ignore.skip(file, false); err != nil || skip {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			paths = append(paths, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no *.pb.go file in the packages matching %q", inject.ErrNoInput, pattern)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// inputFilter selects the files of the directories walked for -input.
+type inputFilter struct {
+	exclude []string
+	// includeIgnored includes the paths .gitignore files ignore, the
+	// .injectignore files still applying
+	includeIgnored bool
+	// skipTestdata skips the testdata directories with -recursive, as
+	// package patterns always do
+	skipTestdata bool
+}
+
+// skipDir reports whether the walks of -recursive skip the directories
+// named name: vendor directories, which hold third-party code the tool
+// must not rewrite, and testdata ones with skipTestdata.
+func (filter inputFilter) skipDir(name string) bool {
+	return name == "vendor" || filter.skipTestdata && name == "testdata"
+}
+
+// ignoreWalker returns the ignoreWalker of the walk of root, reading the
+// .injectignore files, and the .gitignore ones unless filter includes
+// the paths git ignores.
+func (filter inputFilter) ignoreWalker(root string) (*ignoreWalker, error) {
+	if filter.includeIgnored {
+		return newIgnoreWalker(root, injectIgnoreFile)
+	}
+	return newIgnoreWalker(root, ".gitignore", injectIgnoreFile)
+}
+
+// matchesGlob reports whether path matches one of patterns, globs matched
+// against the cleaned path or its base name.
+func matchesGlob(patterns []string, path string) bool {
+	path = filepath.Clean(path)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"regexp"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+var (
+	rStructStart = regexp.MustCompile(`^type\s+(\w+)\s+struct\s*\{\s*$`)
+	// rFieldLine matches a field line with an optional tag literal and
+	// trailing comment, the field spanning the first group.
+	rFieldLine = regexp.MustCompile("^\\s*(\\w+\\s+[^`/{}\\s][^`/{}]*?(?:\\s+`[^`]*`)?)\\s*(?://.*)?$")
+)
+
+// lenientAreas returns the areas to inject in the Go source src, which
+// go/parser can't parse, found line by line: only the annotation comments
+// right above field lines of top level struct declarations are honored,
+// global rules needing the syntax tree.
+func lenientAreas(filename string, src []byte, opts options) (areas []textArea, err error) {
+	obs := opts.observer()
+	// typeName is the struct declaration the line is in, if any
+	var typeName string
+	var tags []string
+	offset := 0
+	for i, line := range strings.SplitAfter(string(src), "\n") {
+		start := offset
+		offset += len(line)
+		line = strings.TrimRight(line, "\r\n")
+		trimmed := strings.TrimSpace(line)
+		if match := rStructStart.FindStringSubmatch(line); match != nil {
+			typeName, tags = match[1], nil
+			continue
+		}
+		switch {
+		case typeName == "":
+			continue
+		case trimmed == "}":
+			typeName, tags = "", nil
+			continue
+		case strings.HasPrefix(trimmed, "//"):
+			if tag := tagFromComment(trimmed); tag != "" {
+				tags = append(tags, tag)
+			}
+			continue
+		}
+		fieldTags := tags
+		tags = nil
+		match := rFieldLine.FindStringSubmatchIndex(line)
+		if match == nil || len(fieldTags) == 0 {
+			continue
+		}
+		fieldErr := func(err error) error {
+			return &inject.FieldError{File: filename, Pos: token.Position{Filename: filename, Line: i + 1}, Field: typeName + "." + strings.Fields(line)[0], Err: err}
+		}
+		tag := strings.Join(fieldTags, " ")
+		if !rValidTag.MatchString(tag) {
+			return nil, fieldErr(fmt.Errorf("%w: %s", inject.ErrTagSyntax, tag))
+		}
+		if err := checkAllowedKeys(tag, opts.AllowedKeys); err != nil {
+			return nil, fieldErr(err)
+		}
+		if opts.KeyPrefix != "" {
+			tag = prefixKeys(tag, opts.KeyPrefix)
+		}
+		field := line[match[2]:match[3]]
+		var current string
+		if j := strings.Index(field, "`"); j >= 0 {
+			current = strings.Trim(field[j:], "`")
+		}
+		areas = append(areas, textArea{
+			Start:      start + match[2] + 1,
+			End:        start + match[3] + 1,
+			CurrentTag: current,
+			InjectTag:  tag,
+			Normalize:  opts.NormalizeTags,
+		})
+	}
+	obs.OnWarning(filename, fmt.Errorf("parsed line by line with -lenient, %d field(s) to inject", len(areas)))
+	return areas, nil
+}
+
+// lexicalTokens returns the tokens of the Go source src, comments
+// included, without the raw strings ending lines, which are taken for
+// struct tags: checkOnlyTagsChanged falls back to it for sources that
+// don't parse.
+func lexicalTokens(filename string, src []byte) []sourceToken {
+	file := token.NewFileSet().AddFile(filename, -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, func(token.Position, string) {}, scanner.ScanComments)
+	var tokens []sourceToken
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		tokens = append(tokens, sourceToken{tok: tok, lit: lit, pos: file.Position(pos)})
+	}
+	var kept []sourceToken
+	for i, t := range tokens {
+		if t.tok == token.STRING && strings.HasPrefix(t.lit, "`") && i+1 < len(tokens) {
+			if next := tokens[i+1]; next.tok == token.SEMICOLON && next.lit == "\n" || next.tok == token.COMMENT || next.tok == token.RBRACE {
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
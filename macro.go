@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"regexp"
+
+	"github.com/favadi/protoc-go-inject-tag/grammar"
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+var (
+	rDefine = regexp.MustCompile(grammar.DefinePattern)
+	rMacro  = regexp.MustCompile(grammar.MacroPattern)
+)
+
+// collectMacros returns the macros defined by `// @define: name = tags`
+// comments anywhere in f, such as comments of the proto syntax statement
+// or of a message. A macro can refer to macros defined before it.
+func collectMacros(fset *token.FileSet, filename string, f *ast.File) (map[string]string, error) {
+	var macros map[string]string
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			match := rDefine.FindStringSubmatch(c.Text)
+			if match == nil {
+				continue
+			}
+			if macros == nil {
+				macros = map[string]string{}
+			}
+			name := match[1]
+			if _, ok := macros[name]; ok {
+				return nil, &inject.FieldError{File: filename, Pos: fset.Position(c.Pos()), Err: fmt.Errorf("macro %q is already defined", name)}
+			}
+			value, err := expandMacros(match[2], macros)
+			if err != nil {
+				return nil, &inject.FieldError{File: filename, Pos: fset.Position(c.Pos()), Err: err}
+			}
+			macros[name] = value
+		}
+	}
+	return macros, nil
+}
+
+// expandMacros replaces the $name references of tag with the macros they
+// name. Files without macros are left alone, so tags of files not using
+// macros can contain dollar signs.
+func expandMacros(tag string, macros map[string]string) (string, error) {
+	if macros == nil {
+		return tag, nil
+	}
+	var err error
+	expanded := rMacro.ReplaceAllStringFunc(tag, func(ref string) string {
+		value, ok := macros[ref[1:]]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined macro %s", ref)
+		}
+		return value
+	})
+	return expanded, err
+}
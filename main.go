@@ -1,33 +1,320 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
 )
 
-func main() {
-	var inputFile string
-	var xxxTags string
-	flag.StringVar(&inputFile, "input", "", "path to input file")
-	flag.StringVar(&xxxTags, "XXX_skip", "", "skip tags to inject on XXX fields")
+// commands are run instead of injecting tags into -input when their name
+// is given as first argument, with the rules configured by flags.
+var commands = map[string]func(opts options, args []string) error{
+	"annotate-proto":  runAnnotateProto,
+	"compare":         runCompare,
+	"config":          runConfig,
+	"export":          runExport,
+	"fmt-annotations": runFmtAnnotations,
+	"import-openapi":  runImportOpenAPI,
+	"import-schema":   runImportSchema,
+	"init":            runInit,
+	"lint-proto":      runLintProto,
+	"migrate":         runMigrate,
+	"rename-key":      runRenameKey,
+	"rewrite":         runRewrite,
+	"rules":           runRules,
+	"serve":           runServe,
+	"update":          runUpdate,
+	"why":             runWhy,
+}
 
+func main() {
+	start := time.Now()
+	if isPlugin(os.Args[0]) {
+		if err := runPlugin(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var flags cliFlags
+	flags.register(flag.CommandLine)
 	flag.Parse()
+	if flags.printVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+	if err := applyEnv(flag.CommandLine, os.Environ()); err != nil {
+		log.Fatal(err)
+	}
+	config, required := flags.config, true
+	if config == "" {
+		config, required = defaultConfigFile, false
+	}
+	if err := applyConfigFile(flag.CommandLine, config, required); err != nil {
+		log.Fatal(err)
+	}
 
-	var xxxSkipSlice []string
-	if len(xxxTags) > 0 {
-		xxxSkipSlice = strings.Split(xxxTags, ",")
+	opts, err := flags.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.LogFormat == logFormatJSON {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{w: os.Stderr})
 	}
 
-	if len(inputFile) == 0 {
+	if flag.NArg() > 0 {
+		// completion lists the commands, so it can't be one of them
+		if flag.Arg(0) == "completion" {
+			if err := runCompletion(opts, flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		if err := command(opts, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(flags.input) == 0 {
 		log.Fatal("input file is mandatory")
 	}
 
-	areas, err := parseFile(inputFile, xxxSkipSlice)
+	if len(flags.input) == 1 && flags.input[0] == stdinInput {
+		if err := runFilter(opts, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	stats := &inject.StatsObserver{Observer: opts.observer()}
+	opts.Observer = stats
+	opts.Interrupt = interruptOnSignal()
+
+	var paths []string
+	if flags.archive() == "" {
+		seen := map[string]bool{}
+		var inputs [][]string
+		for _, input := range flags.input {
+			files, err := inputPaths(input, flags.recursive, flags.inputFilter())
+			if err != nil {
+				fatal(err)
+			}
+			inputs = append(inputs, files)
+			for _, path := range files {
+				if !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+		if flags.changedOnly != "" {
+			changed, err := changedFiles(".", flags.changedOnly)
+			if err != nil {
+				log.Fatal(err)
+			}
+			all := len(paths)
+			if paths, err = filterChanged(paths, changed); err != nil {
+				log.Fatal(err)
+			}
+			if !flags.quiet {
+				log.Printf("%d of %d file(s) changed since %s", len(paths), all, flags.changedOnly)
+			}
+		}
+		if flags.output != "" {
+			if opts.Outputs, err = outputPaths(flags.output, flags.input, inputs); err != nil {
+				log.Fatal(err)
+			}
+			if !flags.diff && !flags.dryRun && !flags.check || flags.apply {
+				if err = makeOutputDirs(opts.Outputs); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if flags.diff {
+		os.Exit(runDiff(opts, flags.diffFormat, flags.patch, flags.apply, paths...))
+	}
+
+	if flags.check {
+		os.Exit(runCheck(opts, paths...))
+	}
+
+	if flags.dryRun {
+		tx, err := newInjector(opts).stageFiles(paths...)
+		if err != nil {
+			fatal(err)
+		}
+		changed := logDryRun(opts.logger(), tx.files)
+		log.Printf("dry run: %d file(s) would change, nothing written", changed)
+		os.Exit(runStatus(stats))
+	}
+
+	if flags.casDir != "" {
+		mapping := flags.casMapping
+		if mapping == "" {
+			mapping = filepath.Join(flags.casDir, "mapping.json")
+		}
+		tx, err := newInjector(opts).stageFiles(paths...)
+		if err == nil {
+			if _, err = writeCAS(tx.files, flags.casDir, mapping, opts.FileMode); err != nil {
+				err = fmt.Errorf("%w: %v", inject.ErrWrite, err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if !flags.quiet {
+			log.Printf("wrote %d file(s) to %q, mapping in %q", len(tx.files), flags.casDir, mapping)
+		}
+		os.Exit(runStatus(stats))
+	}
+
+	var tx *transaction
+	if archive := flags.archive(); archive != "" {
+		tx, err = newInjector(opts).injectArchive(archive, flags.archiveOutput)
+	} else {
+		tx, err = newInjector(opts).injectFiles(paths...)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	if err = writeFile(inputFile, areas); err != nil {
-		log.Fatal(err)
+	if flags.lastRun != "" {
+		if err = reportLastRun(flags.lastRun, tx.files, opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flags.report != "" {
+		if err = writeInjectionReport(flags.report, tx.files); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !flags.quiet {
+		log.Print(runSummary(stats, tx, time.Since(start)))
+	}
+	os.Exit(runStatus(stats))
+}
+
+// Exit statuses of failed runs, so wrappers can tell the causes apart;
+// other failures, such as invalid flags, exit with 1.
+const (
+	// exitParse reports a file or an annotation which can't be parsed.
+	exitParse = 3
+	// exitWrite reports a file which can't be written.
+	exitWrite = 4
+	// exitNoMatch reports an annotation or a rule matching no field, the
+	// other files being injected.
+	exitNoMatch = 5
+	// exitNoInput reports an -input without files to inject.
+	exitNoInput = 6
+	// exitInterrupted reports a run interrupted by SIGINT or SIGTERM,
+	// 128 plus SIGINT as shells do.
+	exitInterrupted = 130
+)
+
+// exitStatus returns the exit status of a run failing with err, fallback
+// if its cause has no status of its own.
+func exitStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, inject.ErrParse), errors.Is(err, inject.ErrEncoding), errors.Is(err, inject.ErrTagSyntax), errors.Is(err, inject.ErrNoTag):
+		return exitParse
+	case errors.Is(err, inject.ErrWrite):
+		return exitWrite
+	case errors.Is(err, inject.ErrNoInput):
+		return exitNoInput
+	case errors.Is(err, inject.ErrInterrupted):
+		return exitInterrupted
+	case errors.Is(err, inject.ErrNoMatch):
+		return exitNoMatch
+	}
+	return fallback
+}
+
+// fatal logs err and exits with its exit status.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(exitStatus(err, 1))
+}
+
+// interruptOnSignal returns a channel closed on SIGINT or SIGTERM, for
+// options.Interrupt. Signals are handled for the rest of the run, so a
+// second Ctrl-C can't kill it while it writes files.
+func interruptOnSignal() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	interrupt := make(chan struct{})
+	go func() {
+		<-signals
+		log.Print("interrupted: the run stops before writing any file, or finishes writing them if it started")
+		close(interrupt)
+		for range signals {
+		}
+	}()
+	return interrupt
+}
+
+// runCheck logs the files at paths missing tags their annotations
+// require, returning the exit status of -check: 0 if there are none, 1
+// if there are and 2 on error.
+func runCheck(opts options, paths ...string) int {
+	tx, err := newInjector(opts).stageFiles(paths...)
+	if err != nil {
+		log.Print(err)
+		return exitStatus(err, 2)
+	}
+	var stale int
+	for _, file := range tx.files {
+		if file.changed() {
+			stale++
+			log.Printf("file %q is out of date", file.path)
+		}
+	}
+	if stale > 0 {
+		log.Printf("%d file(s) out of date, run protoc-go-inject-tag without -check to inject their tags", stale)
+		return 1
+	}
+	return 0
+}
+
+// runDiff prints the changes injection would make to paths in format,
+// and writes them as a patch file to patch unless it is empty, returning
+// the exit status of -diff: 0 if there are none, 1 if there are and 2 on
+// error. With apply, the changes are also written and the exit status is
+// 0 unless there is an error.
+func runDiff(opts options, format, patch string, apply bool, paths ...string) int {
+	tx, err := newInjector(opts).stageFiles(paths...)
+	if err == nil {
+		err = writeDiff(os.Stdout, format, tx.files)
+	}
+	if err == nil && apply {
+		err = tx.commit()
+	}
+	if err == nil && patch != "" {
+		var buf bytes.Buffer
+		if err = writeDiff(&buf, diffUnified, tx.files); err == nil {
+			err = writeFileAtomic(patch, buf.Bytes(), 0)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		return exitStatus(err, 2)
+	}
+	if changed, _, _ := tx.summary(); changed > 0 && !apply {
+		return 1
 	}
+	return 0
 }
@@ -1,10 +1,39 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/favadi/protoc-go-inject-tag/grammar"
+	"github.com/favadi/protoc-go-inject-tag/inject"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
 )
 
 var (
@@ -23,6 +52,18 @@ func TestTagFromComment(t *testing.T) {
 		{comment: `// fdsafsa`, tag: ""},
 		{comment: `//@inject_tag:`, tag: ""},
 		{comment: `// @inject_tag: json:"abc" yaml:"abc`, tag: `json:"abc" yaml:"abc`},
+		{comment: `//inject:tag json:"x"`, tag: `json:"x"`},
+		{comment: `//inject:tag   valid:"ip" yaml:"ip"`, tag: `valid:"ip" yaml:"ip"`},
+		{comment: `// inject:tag json:"x"`, tag: ""},
+		{comment: `//inject:tag`, tag: ""},
+		{comment: `//inject:tag key:"v"`, tag: `key:"v"`},
+		{comment: `//inject:tagged`, tag: ""},
+		{comment: `//inject:tagkey:"v"`, tag: ""},
+		{comment: `// see //inject:tag key:"v"`, tag: ""},
+		{comment: `// @inject_tag: json:"x"; validate:"required"`, tag: `json:"x" validate:"required"`},
+		{comment: `// @inject_tag: json:"x";validate:"required";`, tag: `json:"x" validate:"required"`},
+		{comment: `// @inject_tag: json:"x" @inject_tag: db:"x"`, tag: `json:"x" db:"x"`},
+		{comment: `// @inject_tag: gorm:"column:id;primaryKey"; doc:"see @inject_tag: a;  b"`, tag: `gorm:"column:id;primaryKey" doc:"see @inject_tag: a;  b"`},
 	}
 	for _, test := range tests {
 		result := tagFromComment(test.comment)
@@ -30,12 +71,26 @@ func TestTagFromComment(t *testing.T) {
 			t.Errorf("expected tag: %q, got: %q", test.tag, result)
 		}
 	}
+
+	for comment, expected := range map[string]bool{
+		`//inject:tag json:"x"`:       true,
+		`//inject:tag`:                true,
+		`// @inject_tag:`:             true,
+		`//inject:tagging json:"x"`:   false,
+		`//inject:tags`:               false,
+		`//inject:tagkey:"v"`:         false,
+		`// see //inject:tag key:"v"`: false,
+	} {
+		if isTagComment(comment) != expected {
+			t.Errorf("%s: expected isTagComment to be %v", comment, expected)
+		}
+	}
 }
 
 func TestParseWriteFile(t *testing.T) {
 	expectedTag := `valid:"ip" yaml:"ip" json:"overrided"`
 
-	areas, err := parseFile(testInputFile, []string{})
+	areas, err := parseFile(testInputFile, options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,7 +163,7 @@ func TestNewTagItems(t *testing.T) {
 func TestContinueParsingWhenSkippingFields(t *testing.T) {
 	expectedTags := []string{`valid:"ip" yaml:"ip" json:"overrided"`, `xml:"-"`, `xml:"-"`, `xml:"-"`, `valid:"http|https"`, `valid:"nonzero"`, `xml:"-"`, `xml:"-"`, `xml:"-"`}
 
-	areas, err := parseFile(testInputFile, []string{"xml"})
+	areas, err := parseFile(testInputFile, options{XXXSkip: []string{"xml"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -160,3 +215,4397 @@ func TestContinueParsingWhenSkippingFields(t *testing.T) {
 		}
 	}
 }
+
+func TestSkipUnexportedAndBlankFields(t *testing.T) {
+	src := "package pb\n\ntype Opaque struct {\n" +
+		"\t_     struct{}\n" +
+		"\tstate int32\n" +
+		"\t// @inject_tag: json:\"-\"\n" +
+		"\tsizeCache int32\n" +
+		"\tXXX_unrecognized []byte `json:\"-\"`\n" +
+		"}\n"
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	areas, err := parseFile(testInputFileTemp, options{XXXSkip: []string{"xml"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 2 {
+		t.Fatalf("expected 2 areas to replace, got: %d", len(areas))
+	}
+	if err = writeFile(testInputFileTemp, areas); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"\t_     struct{}\n",
+		"\tstate int32\n",
+		"sizeCache int32 `json:\"-\"`",
+		"XXX_unrecognized []byte `json:\"-\" xml:\"-\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(contents), expr) {
+			t.Errorf("expected file to contain %q", expr)
+			t.Log(string(contents))
+		}
+	}
+}
+
+func TestInferRequired(t *testing.T) {
+	message := descriptor.FieldDescriptorProto_TYPE_MESSAGE
+	optional := descriptor.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptor.FieldDescriptorProto_LABEL_REPEATED
+	fds := &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:   proto.String("infer.proto"),
+		Syntax: proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("Request"),
+			Field: []*descriptor.FieldDescriptorProto{
+				{Name: proto.String("inner"), Label: &optional, Type: &message, TypeName: proto.String(".pb.Request.Inner")},
+				{Name: proto.String("name"), Label: &optional, Type: descriptor.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("nick"), Label: &optional, Type: &message, TypeName: proto.String(".google.protobuf.StringValue")},
+				{Name: proto.String("items"), Label: &repeated, Type: &message, TypeName: proto.String(".pb.Request.Inner")},
+				{Name: proto.String("choice"), Label: &optional, Type: &message, TypeName: proto.String(".pb.Request.Inner"), OneofIndex: proto.Int32(0)},
+			},
+			NestedType: []*descriptor.DescriptorProto{{
+				Name:  proto.String("Inner"),
+				Field: []*descriptor.FieldDescriptorProto{{Name: proto.String("outer"), Label: &optional, Type: &message, TypeName: proto.String(".pb.Request")}},
+			}},
+		}},
+	}}}
+	contents, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorFile := testInputFileTemp + ".pb"
+	if err = ioutil.WriteFile(descriptorFile, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(descriptorFile)
+	ds, err := loadDescriptorSet(descriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := "// source: infer.proto\n\npackage pb\n\ntype Request struct {\n" +
+		"\tInner *Request_Inner `protobuf:\"bytes,1,opt,name=inner\"`\n" +
+		"\tName string `protobuf:\"bytes,2,opt,name=name\"`\n" +
+		"\tNick *wrappers.StringValue `protobuf:\"bytes,3,opt,name=nick\"`\n" +
+		"\tItems []*Request_Inner `protobuf:\"bytes,4,rep,name=items\"`\n" +
+		"}\n\ntype Request_Inner struct {\n" +
+		"\t// @inject_tag: validate:\"omitempty\"\n" +
+		"\tOuter *Request `protobuf:\"bytes,1,opt,name=outer\"`\n" +
+		"}\n"
+	if err = ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	areas, err := parseFile(testInputFileTemp, options{Descriptors: ds, InferRequired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 2 {
+		t.Fatalf("expected 2 areas to replace, got: %d", len(areas))
+	}
+	if err = writeFile(testInputFileTemp, areas); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadFile(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"Inner *Request_Inner `protobuf:\"bytes,1,opt,name=inner\" validate:\"required\"`",
+		"Name string `protobuf:\"bytes,2,opt,name=name\"`",
+		"Nick *wrappers.StringValue `protobuf:\"bytes,3,opt,name=nick\"`",
+		"Items []*Request_Inner `protobuf:\"bytes,4,rep,name=items\"`",
+		"Outer *Request `protobuf:\"bytes,1,opt,name=outer\" validate:\"omitempty\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(contents), expr) {
+			t.Errorf("expected file to contain %q", expr)
+			t.Log(string(contents))
+		}
+	}
+}
+
+func TestEnumTag(t *testing.T) {
+	enum := descriptor.FieldDescriptorProto_TYPE_ENUM
+	ds := newDescriptorSet(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:    proto.String("enum.proto"),
+		Package: proto.String("pb"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptor.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptor.EnumValueDescriptorProto{
+				{Name: proto.String("ACTIVE"), Number: proto.Int32(0)},
+				{Name: proto.String("INACTIVE"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("User"),
+			Field: []*descriptor.FieldDescriptorProto{
+				{Name: proto.String("status"), Type: &enum, TypeName: proto.String(".pb.Status")},
+				{Name: proto.String("kind"), Type: &enum, TypeName: proto.String(".pb.User.Kind")},
+			},
+			EnumType: []*descriptor.EnumDescriptorProto{{
+				Name:  proto.String("Kind"),
+				Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("HUMAN"), Number: proto.Int32(0)}},
+			}},
+		}},
+	}}})
+
+	src := "// source: enum.proto\n\npackage pb\n\ntype User struct {\n" +
+		"\tStatus Status `protobuf:\"varint,1,opt,name=status,enum=pb.Status\"`\n" +
+		"\t// @inject_tag: enum:\"{{.EnumValues}}\"\n" +
+		"\tKind User_Kind `protobuf:\"varint,2,opt,name=kind,enum=pb.User_Kind\"`\n" +
+		"}\n"
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	areas, err := parseFile(testInputFileTemp, options{Descriptors: ds, EnumTag: `validate:"oneof={{.EnumValues}}"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := []string{`validate:"oneof=ACTIVE INACTIVE"`, `validate:"oneof=HUMAN" enum:"HUMAN"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+}
+
+func TestFieldNumberTemplate(t *testing.T) {
+	src := "package pb\n\ntype URL struct {\n" +
+		"\t// @inject_tag: msgp:\"{{.FieldNumber}}\"\n" +
+		"\tPort int32 `protobuf:\"varint,3,opt,name=port\" json:\"port,omitempty\"`\n" +
+		"\t// @inject_tag: msgp:\"{{.FieldNumber}}\"\n" +
+		"\tLocal bool\n" +
+		"}\n"
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	areas, err := parseFile(testInputFileTemp, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := []string{`msgp:"3"`, `msgp:"0"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+}
+
+func TestCommentTemplate(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// Email of the user, as \"name@host\",\n" +
+		"\t// see `RFC 5322`.\n" +
+		"\t// @inject_tag: description:\"{{.Comment}}\"\n" +
+		"\tEmail string `protobuf:\"bytes,1,opt,name=email\" json:\"email,omitempty\"`\n" +
+		"\t// @inject_tag: {{if .Comment}}description:\"{{.Comment}}\"{{end}} db:\"name\"\n" +
+		"\tName string\n" +
+		"}\n"
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: inject.NopObserver{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := []string{`description:"Email of the user, as 'name@host', see 'RFC 5322'."`, ` db:"name"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+	injected, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parser.ParseFile(token.NewFileSet(), "user.pb.go", injected, 0); err != nil {
+		t.Errorf("expected the injected source to parse, got: %v", err)
+	}
+}
+
+func TestInjectSourceGuards(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string `json:\"id\"`\n" +
+		"\t// @inject_tag: db:\"name\"\n" +
+		"\tName string `json:\"name\"`\n" +
+		"}\n"
+	// sources get the limits of files
+	if _, err := newInjector(options{Observer: inject.NopObserver{}, MaxEdits: 1}).injectSource("user.pb.go", []byte(src)); err == nil || !strings.Contains(err.Error(), "-max_edits=1") {
+		t.Errorf("expected a -max_edits error, got: %v", err)
+	}
+	if _, err := newInjector(options{Observer: inject.NopObserver{}, MaxFileSize: 10}).injectSource("user.pb.go", []byte(src)); err == nil || !strings.Contains(err.Error(), "-max_file_size=10") {
+		t.Errorf("expected a -max_file_size error, got: %v", err)
+	}
+	// and -format, checked by -verify
+	injected, err := newInjector(options{Observer: inject.NopObserver{}, Format: true, Verify: true}).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted, err := format.Source(injected); err != nil || !bytes.Equal(formatted, injected) {
+		t.Errorf("expected gofmt-ed source, got:\n%s", injected)
+	}
+
+	// including the Go files of archives
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("pb/user.pb.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(src))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := testInputFileTemp + ".zip"
+	if err := ioutil.WriteFile(path, zipped.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if _, err := newInjector(options{Observer: inject.NopObserver{}, MaxEdits: 1}).injectArchive(path, ""); err == nil || !strings.Contains(err.Error(), "-max_edits=1") {
+		t.Errorf("expected a -max_edits error for the archive, got: %v", err)
+	}
+	if _, err := newInjector(options{Observer: inject.NopObserver{}, Format: true, Verify: true}).injectArchive(path, ""); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if entry, _ := ioutil.ReadAll(rc); !bytes.Equal(entry, injected) {
+		t.Errorf("expected the archive entry to be injected like the source, got:\n%s", entry)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// @inject_tag: db:\"email\" validate:\"email\"\n" +
+		"\tEmail string `protobuf:\"bytes,1,opt,name=email\" json:\"email,omitempty\"`\n" +
+		"\t// @inject_tag: db:\"name\"\n" +
+		"\tName string `protobuf:\"bytes,2,opt,name=name\" json:\"name,omitempty\"  db:\"name\"`\n" +
+		"\t// @inject_tag: db:\"nick\"\n" +
+		"\tNick string `protobuf:\"bytes,3,opt,name=nick\" db:\"nick\" json:\"nick,omitempty\" db:\"nickname\"`\n" +
+		"}\n"
+	stats := &inject.StatsObserver{Observer: inject.NopObserver{}}
+	once, err := newInjector(options{Observer: stats}).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"`protobuf:\"bytes,1,opt,name=email\" json:\"email,omitempty\" db:\"email\" validate:\"email\"`",
+		// already injected, spacing included
+		"`protobuf:\"bytes,2,opt,name=name\" json:\"name,omitempty\"  db:\"name\"`",
+		// duplicated keys are only kept once
+		"`protobuf:\"bytes,3,opt,name=nick\" db:\"nick\" json:\"nick,omitempty\"`",
+	} {
+		if !strings.Contains(string(once), expected) {
+			t.Errorf("expected %s in:\n%s", expected, once)
+		}
+	}
+	if stats.Injected != 2 {
+		t.Errorf("expected 2 fields injected, got: %d", stats.Injected)
+	}
+	stats.Injected = 0
+	twice, err := newInjector(options{Observer: stats}).injectSource("user.pb.go", once)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(once, twice) {
+		t.Errorf("expected a second run to change nothing, got:\n%s", twice)
+	}
+	if stats.Injected != 0 {
+		t.Errorf("expected no field injected by a second run, got: %d", stats.Injected)
+	}
+
+	// normalized tags are stable too
+	opts := options{Observer: inject.NopObserver{}, NormalizeTags: true}
+	if once, err = newInjector(opts).injectSource("user.pb.go", []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	if twice, err = newInjector(opts).injectSource("user.pb.go", once); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(once, twice) {
+		t.Errorf("expected a second normalized run to change nothing, got:\n%s", twice)
+	}
+}
+
+func TestDocKey(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// Email of the user, as \"name@host\". Verified on sign up.\n" +
+		"\tEmail string `protobuf:\"bytes,1,opt,name=email\" json:\"email,omitempty\"`\n" +
+		"\t// Name of the user\n" +
+		"\t// @inject_tag: db:\"name\"\n" +
+		"\tName string `protobuf:\"bytes,2,opt,name=name\" json:\"name,omitempty\"`\n" +
+		"\t// Deprecated: Do not use.\n" +
+		"\tNick string `protobuf:\"bytes,3,opt,name=nick\" json:\"nick,omitempty\"`\n" +
+		"\t// @inject_tag: doc:\"Identifier.\"\n" +
+		"\tId string `protobuf:\"bytes,4,opt,name=id\" json:\"id,omitempty\"`\n" +
+		"\tAge int32 `protobuf:\"varint,5,opt,name=age\" json:\"age,omitempty\"`\n" +
+		"}\n"
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: inject.NopObserver{}, DocKey: "doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// comments take precedence, fields without doc are left alone
+	expectedTags := []string{`doc:"Email of the user, as 'name@host'."`, `doc:"Name of the user" db:"name"`, `doc:"Identifier."`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %+v", len(expectedTags), areas)
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+	flags := cliFlags{diffFormat: diffUnified, versionPolicy: versionError, opts: options{TagLengthPolicy: tagLengthError, DocKey: "my doc"}}
+	if _, err = flags.options(); err == nil || !strings.Contains(err.Error(), "-doc_key") {
+		t.Errorf("expected an error for an invalid -doc_key, got: %v", err)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	var tests = []struct {
+		current string
+		inject  string
+		tag     string
+	}{
+		{
+			current: `protobuf:"bytes,1,opt,name=Address" json:"Address,omitempty"`,
+			inject:  `yaml:"ip" valid:"ip" json:"overrided"`,
+			tag:     `protobuf:"bytes,1,opt,name=Address" json:"overrided" valid:"ip" yaml:"ip"`,
+		},
+		{
+			// protoc keys keep their generated order, even if unusual
+			current: `json:"port,omitempty" yaml:"port" protobuf:"varint,3,opt,name=port"`,
+			inject:  `db:"port"`,
+			tag:     `json:"port,omitempty" protobuf:"varint,3,opt,name=port" db:"port" yaml:"port"`,
+		},
+	}
+	for _, test := range tests {
+		expr := []byte("Field string `" + test.current + "`")
+		area := textArea{Start: 1, End: len(expr) + 1, CurrentTag: test.current, InjectTag: test.inject, Normalize: true}
+		expected := "Field string `" + test.tag + "`"
+		if result := string(injectTag(expr, area)); result != expected {
+			t.Errorf("expected: %q, got: %q", expected, result)
+		}
+	}
+}
+
+func TestSafetyLimits(t *testing.T) {
+	var tests = []struct {
+		opts options
+		err  bool
+	}{
+		{opts: options{XXXSkip: []string{"xml"}}},
+		{opts: options{XXXSkip: []string{"xml"}, MaxFileSize: 100}, err: true},
+		{opts: options{XXXSkip: []string{"xml"}, MaxEdits: 8}, err: true},
+		{opts: options{XXXSkip: []string{"xml"}, MaxEdits: 9}},
+		{opts: options{XXXSkip: []string{"xml"}, MaxFileSize: 100, MaxEdits: 8, Force: true}},
+	}
+	for _, test := range tests {
+		_, err := parseFile(testInputFile, test.opts)
+		if (err != nil) != test.err {
+			t.Errorf("options %+v: expected error: %v, got: %v", test.opts, test.err, err)
+		}
+	}
+}
+
+func TestRulesFixtures(t *testing.T) {
+	fixtures := "Rules for XXX fields.\n\n" +
+		"-- given: xxx fields --\n" +
+		"type IP struct {\n\tXXX_sizecache int32 `json:\"-\"`\n}\n" +
+		"-- expect --\n" +
+		"type IP struct {\n\tXXX_sizecache int32 `json:\"-\" xml:\"-\"`\n}\n" +
+		"-- given --\n" +
+		"type URL struct {\n\tXXX_sizecache int32 `json:\"-\"`\n}\n" +
+		"-- expect --\n" +
+		"type URL struct {\n\tXXX_sizecache int32 `json:\"-\"`\n}\n"
+	cases, err := parseFixtures([]byte(fixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 {
+		t.Fatalf("expected 2 cases, got: %d", len(cases))
+	}
+	if cases[0].Name != "xxx fields" || cases[1].Name != "case #2" {
+		t.Errorf("unexpected case names: %q, %q", cases[0].Name, cases[1].Name)
+	}
+
+	opts := options{XXXSkip: []string{"xml"}}
+	for i, c := range cases {
+		result, err := c.run("fixtures.txt", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if passed := result == c.Expect; passed != (i == 0) {
+			t.Errorf("%s: expected passed: %v, got result: %q", c.Name, i == 0, result)
+		}
+	}
+
+	if _, err = parseFixtures([]byte("-- expect --\n")); err == nil {
+		t.Error("expected error for expect section without given section")
+	}
+}
+
+func TestMergeTagsSteps(t *testing.T) {
+	var steps []string
+	ti := mergeTags(`json:"a" yaml:"a"`, `json:"b" db:"b" json:"c"`, false, func(item tagItem, replaced *tagItem) {
+		if replaced != nil {
+			steps = append(steps, "set "+item.key+":"+item.value+" replacing "+replaced.value)
+		} else {
+			steps = append(steps, "add "+item.key+":"+item.value)
+		}
+	})
+	expectedSteps := []string{`set json:"b" replacing "a"`, `add db:"b"`, `set json:"c" replacing "b"`}
+	if strings.Join(steps, "\n") != strings.Join(expectedSteps, "\n") {
+		t.Errorf("expected steps: %q, got: %q", expectedSteps, steps)
+	}
+	if expected := `json:"c" yaml:"a" db:"b"`; ti.format() != expected {
+		t.Errorf("expected tag: %q, got: %q", expected, ti.format())
+	}
+}
+
+func TestMigrateLine(t *testing.T) {
+	var tests = []struct {
+		line     string
+		migrated []string
+	}{
+		{
+			line:     `  // @gotags: valid:"ip"`,
+			migrated: []string{`  // @inject_tag: valid:"ip"`},
+		},
+		{
+			line:     `  string Address = 1 [(gogoproto.moretags) = "valid:\"ip\" yaml:\"ip\""];`,
+			migrated: []string{`  // @inject_tag: valid:"ip" yaml:"ip"`, `  string Address = 1;`},
+		},
+		{
+			line:     `  int32 port = 3 [deprecated = true, (tagger.tags) = "graphql:\"port,optional\""]; // trailing`,
+			migrated: []string{`  // @inject_tag: graphql:"port,optional"`, `  int32 port = 3 [deprecated = true]; // trailing`},
+		},
+		{
+			line:     `  string url = 2 [json_name = "u,rl"];`,
+			migrated: []string{`  string url = 2 [json_name = "u,rl"];`},
+		},
+	}
+	for _, test := range tests {
+		migrated, _, err := migrateLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(migrated, "\n") != strings.Join(test.migrated, "\n") {
+			t.Errorf("expected: %q, got: %q", test.migrated, migrated)
+		}
+	}
+}
+
+func TestMoretags(t *testing.T) {
+	fieldOptions := &descriptor.FieldOptions{}
+	if err := proto.SetExtension(fieldOptions, eMoretags, proto.String(`xml:"address" json:"addr"`)); err != nil {
+		t.Fatal(err)
+	}
+	fds := &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:   proto.String("moretags.proto"),
+		Syntax: proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("IP"),
+			Field: []*descriptor.FieldDescriptorProto{
+				{Name: proto.String("address"), Type: descriptor.FieldDescriptorProto_TYPE_STRING.Enum(), Options: fieldOptions},
+				{Name: proto.String("port"), Type: descriptor.FieldDescriptorProto_TYPE_INT32.Enum()},
+			},
+		}},
+	}}}
+	// round trip so the extension is decoded from its wire format
+	contents, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds = &descriptor.FileDescriptorSet{}
+	if err = proto.Unmarshal(contents, fds); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "// source: moretags.proto\n\npackage pb\n\ntype IP struct {\n" +
+		"\t// @inject_tag: json:\"address\"\n" +
+		"\tAddress string `protobuf:\"bytes,1,opt,name=address\" json:\"address,omitempty\"`\n" +
+		"\tPort int32 `protobuf:\"varint,2,opt,name=port\" json:\"port,omitempty\"`\n" +
+		"}\n"
+	areas, err := parseSource("moretags.pb.go", []byte(src), options{Descriptors: newDescriptorSet(fds), Moretags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 1 {
+		t.Fatalf("expected 1 area to replace, got: %d", len(areas))
+	}
+	result := string(injectAreas([]byte(src), areas))
+	expectedExpr := "Address string `protobuf:\"bytes,1,opt,name=address\" json:\"address\" xml:\"address\"`"
+	if !strings.Contains(result, expectedExpr) {
+		t.Errorf("expected file to contain %q", expectedExpr)
+		t.Log(result)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	original, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(testInputFileTemp, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	areas, err := parseFile(testInputFileTemp, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx transaction
+	if err = tx.stage(testInputFileTemp, areas); err != nil {
+		t.Fatal(err)
+	}
+	// stage a second file whose write fails
+	tx.files = append(tx.files, stagedFile{path: "./pb/missing/test.pb.go", contents: []byte("package pb\n")})
+	if err = tx.commit(); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	contents, err := ioutil.ReadFile(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != string(original) {
+		t.Error("expected file to be restored after failed commit")
+	}
+}
+
+func TestGeneratedBy(t *testing.T) {
+	src := "// Code generated by Thrift Compiler (0.14.1). DO NOT EDIT.\n\npackage thrift\n\ntype (\n" +
+		"\tAlias = int\n" +
+		"\tUser struct {\n" +
+		"\t\t// @inject_tag: valid:\"email\"\n" +
+		"\t\tEmail string `thrift:\"email,1\" json:\"email\"`\n" +
+		"\t}\n" +
+		"\tGroup struct {\n" +
+		"\t\t// @inject_tag: valid:\"alphanum\"\n" +
+		"\t\tName string `thrift:\"name,1\" json:\"name\"`\n" +
+		"\t}\n" +
+		")\n"
+	var tests = []struct {
+		generatedBy []*regexp.Regexp
+		areas       int
+	}{
+		{areas: 2},
+		{generatedBy: []*regexp.Regexp{regexp.MustCompile(`^protoc-gen-go$`)}, areas: 0},
+		{generatedBy: []*regexp.Regexp{regexp.MustCompile(`^protoc-gen-go$`), regexp.MustCompile(`^Thrift`)}, areas: 2},
+	}
+	for _, test := range tests {
+		areas, err := parseSource("user.go", []byte(src), options{GeneratedBy: test.generatedBy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(areas) != test.areas {
+			t.Errorf("-generated_by %v: expected %d areas to replace, got: %d", test.generatedBy, test.areas, len(areas))
+		}
+	}
+}
+
+func TestServiceGenerators(t *testing.T) {
+	var tests = []struct {
+		header    string
+		generator string
+	}{
+		{"// Code generated by protoc-gen-go. DO NOT EDIT.\n// versions:\n// \tprotoc-gen-go v1.28.1\n// \tprotoc        v3.21.12\n// source: acme/v1/user.proto\n",
+			"protoc-gen-go"},
+		{"// Code generated by protoc-gen-twirp v8.1.3, DO NOT EDIT.\n// source: acme/v1/user.proto\n",
+			"protoc-gen-twirp v8.1.3"},
+		{"// Code generated by protoc-gen-connect-go. DO NOT EDIT.\n//\n// Source: acme/v1/user.proto\n",
+			"protoc-gen-connect-go"},
+	}
+	for _, test := range tests {
+		src := test.header + "\npackage userv1\n\n" +
+			"type userServiceClient struct {\n\t// @inject_tag: json:\"-\"\n\tbaseURL string\n}\n"
+		f, err := parser.ParseFile(token.NewFileSet(), "user.go", src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if generator := generatedBy(f); generator != test.generator {
+			t.Errorf("expected generator %q, got: %q", test.generator, generator)
+		}
+		if source := protoSource(f); source != "acme/v1/user.proto" {
+			t.Errorf("%s: expected source acme/v1/user.proto, got: %q", test.generator, source)
+		}
+		opts := options{Observer: inject.NopObserver{}, GeneratedBy: []*regexp.Regexp{regexp.MustCompile(`^protoc-gen-(go|twirp|connect-go)\b`)}}
+		injected, err := newInjector(opts).injectSource("user.go", []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(injected), "\tbaseURL string `json:\"-\"`\n") {
+			t.Errorf("%s: expected the annotated field to be injected, got:\n%s", test.generator, injected)
+		}
+	}
+}
+
+var testOneofSource = "package pb\n\n" +
+	"type Msg struct {\n" +
+	"\t// *Important* cases are listed below.\n" +
+	"\t// @inject_tag_oneof: validate:\"required\"\n" +
+	"\t// Types that are valid to be assigned to Value:\n" +
+	"\t//\t*Msg_Name\n" +
+	"\t//\t*Msg_Id\n" +
+	"\tValue isMsg_Value `protobuf_oneof:\"value\"`\n" +
+	"}\n\n" +
+	"type Important struct {\n" +
+	"\tNote string `protobuf:\"bytes,1,opt,name=note\"`\n" +
+	"}\n\n" +
+	"type isMsg_Value interface {\n\tisMsg_Value()\n}\n\n" +
+	"type Msg_Name struct {\n" +
+	"\t// @inject_tag: validate:\"email\"\n" +
+	"\tName string `protobuf:\"bytes,1,opt,name=name,oneof\"`\n" +
+	"}\n\n" +
+	"type Msg_Id struct {\n" +
+	"\tId int32 `protobuf:\"varint,2,opt,name=id,oneof\"`\n" +
+	"}\n\n" +
+	"func (*Msg_Name) isMsg_Value() {}\n\n" +
+	"func (*Msg_Id) isMsg_Value() {}\n"
+
+func TestInjectTagOneof(t *testing.T) {
+	areas, err := parseSource("oneof.pb.go", []byte(testOneofSource), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := []string{`validate:"required" validate:"email"`, `validate:"required"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+
+	result := string(injectAreas([]byte(testOneofSource), areas))
+	expectedExprs := []string{
+		"Value isMsg_Value `protobuf_oneof:\"value\"`",
+		"Note string `protobuf:\"bytes,1,opt,name=note\"`",
+		"Name string `protobuf:\"bytes,1,opt,name=name,oneof\" validate:\"email\"`",
+		"Id int32 `protobuf:\"varint,2,opt,name=id,oneof\" validate:\"required\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(result, expr) {
+			t.Errorf("expected file to contain %q", expr)
+			t.Log(result)
+		}
+	}
+}
+
+func TestOneofWrappersIgnoreComments(t *testing.T) {
+	// comment lines looking like oneof case lists must not matter
+	src := "package pb\n\n" +
+		"type Msg struct {\n" +
+		"\t// @inject_tag_oneof: json:\"-\"\n" +
+		"\t//\t*Msg_Name\n" +
+		"\t// *Important\n" +
+		"\tValue isMsg_Value `protobuf_oneof:\"value\"`\n" +
+		"\t// *Msg_Name\n" +
+		"\tOther string `protobuf:\"bytes,3,opt,name=other\"`\n" +
+		"}\n\n" +
+		"type Important struct {\n\tNote string\n}\n\n" +
+		"type Msg_Name struct {\n\tName string\n}\n\n" +
+		"type isMsg_Value interface {\n\tisMsg_Value()\n}\n"
+	areas, err := parseSource("oneof.pb.go", []byte(src), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 0 {
+		t.Errorf("expected no area to replace, got: %v", areas)
+	}
+}
+
+func TestTransactionSummary(t *testing.T) {
+	contents, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(testInputFileTemp, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	var summaries [][3]int
+	for i := 0; i < 2; i++ {
+		areas, err := parseFile(testInputFileTemp, options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tx transaction
+		if err = tx.stage(testInputFileTemp, areas); err != nil {
+			t.Fatal(err)
+		}
+		if err = tx.stage(testInputFileTemp, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = tx.commit(); err != nil {
+			t.Fatal(err)
+		}
+		changed, unchanged, unannotated := tx.summary()
+		summaries = append(summaries, [3]int{changed, unchanged, unannotated})
+	}
+	// the second run finds the tags already injected by the first one
+	expected := [][3]int{{1, 0, 1}, {0, 1, 1}}
+	for i := range expected {
+		if summaries[i] != expected[i] {
+			t.Errorf("run #%d: expected changed, unchanged, unannotated: %v, got: %v", i+1, expected[i], summaries[i])
+		}
+	}
+}
+
+func TestInjectedLineLength(t *testing.T) {
+	src := []byte("package pb\n\ntype IP struct {\n\tAddress string `json:\"a\"` // é\n}\n")
+	start := strings.Index(string(src), "Address") + 1
+	end := strings.Index(string(src), " //") + 1
+	area := textArea{Start: start, End: end, CurrentTag: `json:"a"`, InjectTag: `valid:"ip"`}
+	expected := len("\tAddress string `json:\"a\" valid:\"ip\"` // é") - 1
+	if length := injectedLineLength(src, area); length != expected {
+		t.Errorf("expected line length: %d, got: %d", expected, length)
+	}
+}
+
+// recordingObserver records the events of a run.
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnFileStart(path string) {
+	o.events = append(o.events, "start")
+}
+
+func (o *recordingObserver) OnFileParsed(path string, areas []textArea) {
+	o.events = append(o.events, fmt.Sprintf("parsed %d", len(areas)))
+}
+
+func (o *recordingObserver) OnInjection(path string, area textArea, expr string) {
+	o.events = append(o.events, "inject "+area.InjectTag)
+}
+
+func (o *recordingObserver) OnWarning(path string, err error) {
+	o.events = append(o.events, "warning "+err.Error())
+}
+
+func (o *recordingObserver) OnFileDone(path string, changed bool) {
+	o.events = append(o.events, fmt.Sprintf("done %v", changed))
+}
+
+func TestObserver(t *testing.T) {
+	contents, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(testInputFileTemp, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	obs := &recordingObserver{}
+	areas, err := parseFile(testInputFileTemp, options{Observer: obs, MaxLineLength: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := transaction{observer: obs}
+	if err = tx.stage(testInputFileTemp, areas); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"start",
+		"warning ./pb/test.pb.go_tmp:33:2: IP.Address: line is 91 characters long after injection, more than -max_line_length=90",
+		"warning ./pb/test.pb.go_tmp:72:2: URL.Scheme: line is 94 characters long after injection, more than -max_line_length=90",
+		"parsed 3",
+		`inject valid:"ip" yaml:"ip" json:"overrided"`,
+		`inject valid:"http|https"`,
+		`inject valid:"nonzero"`,
+		"done true",
+	}
+	if strings.Join(obs.events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(obs.events, "\n"))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var tests = []struct {
+		src string
+		err error
+	}{
+		{src: "package pb\n\ntype IP struct {\n", err: inject.ErrParse},
+		{src: "package pb\n\ntype IP struct {\n\t// @inject_tag: json:\"abc\" yaml:\"abc\n\tAddress string\n}\n", err: inject.ErrTagSyntax},
+	}
+	for _, test := range tests {
+		_, err := parseSource("errors.go", []byte(test.src), options{})
+		if !errors.Is(err, test.err) {
+			t.Errorf("expected error %v, got: %v", test.err, err)
+		}
+		var fieldErr *inject.FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.File != "errors.go" {
+			t.Errorf("expected *inject.FieldError for file errors.go, got: %#v", err)
+		}
+	}
+
+	obs := &recordingObserver{}
+	src := "package pb\n\ntype IP struct {\n\t// @inject_tag:\n\tAddress string\n}\n"
+	if _, err := parseSource("errors.go", []byte(src), options{Observer: obs}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "warning errors.go:5:2: IP.Address: comment has no tag"; len(obs.events) != 1 || obs.events[0] != expected {
+		t.Errorf("expected events: %q, got: %q", expected, obs.events)
+	}
+
+	var tx transaction
+	overlapping := []textArea{{Start: 1, End: 10}, {Start: 5, End: 12}}
+	if err := tx.stage(testInputFile, overlapping); !errors.Is(err, inject.ErrOverlap) {
+		t.Errorf("expected error %v, got: %v", inject.ErrOverlap, err)
+	}
+}
+
+func TestConcurrentInjectors(t *testing.T) {
+	src, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skips := []string{"xml", "yaml", "toml", "bson"}
+	results := make([]string, len(skips))
+	logs := make([]bytes.Buffer, len(skips))
+	var wg sync.WaitGroup
+	for i := range skips {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inj := newInjector(options{XXXSkip: skips[i : i+1], LogLevel: inject.LogVerbose, Logger: log.New(&logs[i], "", 0)})
+			injected, err := inj.injectSource("test.pb.go", src)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = string(injected)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, skip := range skips {
+		expectedExpr := "XXX_sizecache        int32    `json:\"-\" " + skip + ":\"-\"`"
+		if !strings.Contains(results[i], expectedExpr) {
+			t.Errorf("expected result #%d to contain %q", i, expectedExpr)
+		}
+		if expectedLog := skip + `:\"-\"`; !strings.Contains(logs[i].String(), expectedLog) {
+			t.Errorf("expected log #%d to contain %q, got: %q", i, expectedLog, logs[i].String())
+		}
+	}
+}
+
+func TestOneofWrapperNameCollision(t *testing.T) {
+	// message Foo_Bar is declared by the user, so protoc-gen-go names the
+	// wrapper of case bar Foo_Bar_; Foo also has a second oneof.
+	src := "package pb\n\n" +
+		"type Foo struct {\n" +
+		"\t// @inject_tag_oneof: first:\"yes\"\n" +
+		"\t// Types that are valid to be assigned to First:\n" +
+		"\t//\t*Foo_Bar_\n" +
+		"\tFirst isFoo_First `protobuf_oneof:\"first\"`\n" +
+		"\t// @inject_tag_oneof: second:\"yes\"\n" +
+		"\t// Types that are valid to be assigned to Second:\n" +
+		"\t//\t*Foo_Baz\n" +
+		"\tSecond isFoo_Second `protobuf_oneof:\"second\"`\n" +
+		"}\n\n" +
+		"type Foo_Bar struct {\n\tName string `protobuf:\"bytes,1,opt,name=name\"`\n}\n\n" +
+		"type isFoo_First interface {\n\tisFoo_First()\n}\n\n" +
+		"type isFoo_Second interface {\n\tisFoo_Second()\n}\n\n" +
+		"type Foo_Bar_ struct {\n\tBar *Foo_Bar `protobuf:\"bytes,1,opt,name=bar,oneof\"`\n}\n\n" +
+		"type Foo_Baz struct {\n\tBaz string `protobuf:\"bytes,2,opt,name=baz,oneof\"`\n}\n\n" +
+		"func (*Foo_Bar_) isFoo_First() {}\n\n" +
+		"func (*Foo_Baz) isFoo_Second() {}\n"
+	injected, err := newInjector(options{}).injectSource("collision.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"Name string `protobuf:\"bytes,1,opt,name=name\"`",
+		"Bar *Foo_Bar `protobuf:\"bytes,1,opt,name=bar,oneof\" first:\"yes\"`",
+		"Baz string `protobuf:\"bytes,2,opt,name=baz,oneof\" second:\"yes\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(injected), expr) {
+			t.Errorf("expected file to contain %q", expr)
+			t.Log(string(injected))
+		}
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	enum := descriptor.FieldDescriptorProto_TYPE_ENUM
+	ds := newDescriptorSet(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:    proto.String("deprecated.proto"),
+		Package: proto.String("pb"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptor.EnumDescriptorProto{{
+			Name:  proto.String("Status"),
+			Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("ACTIVE"), Number: proto.Int32(0)}},
+		}},
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("User"),
+			Field: []*descriptor.FieldDescriptorProto{
+				{Name: proto.String("state"), Type: &enum, TypeName: proto.String(".pb.Status")},
+				{Name: proto.String("status"), Type: &enum, TypeName: proto.String(".pb.Status")},
+			},
+		}},
+	}}})
+
+	src := "// source: deprecated.proto\n\npackage pb\n\ntype User struct {\n" +
+		"\t// Deprecated: Do not use.\n" +
+		"\t// @inject_tag: db:\"state\"\n" +
+		"\tState Status `protobuf:\"varint,1,opt,name=state,enum=pb.Status\"`\n" +
+		"\t// Replaces the Deprecated: state field.\n" +
+		"\tStatus Status `protobuf:\"varint,2,opt,name=status,enum=pb.Status\"`\n" +
+		"}\n"
+	var tests = []struct {
+		policy string
+		tags   []string
+	}{
+		{"", []string{`validate:"oneof=ACTIVE" db:"state"`, `validate:"oneof=ACTIVE"`}},
+		{deprecatedSkip, []string{`db:"state"`, `validate:"oneof=ACTIVE"`}},
+		{deprecatedHide, []string{`validate:"oneof=ACTIVE" json:"-" db:"state"`, `validate:"oneof=ACTIVE"`}},
+		{deprecatedTag, []string{`validate:"oneof=ACTIVE" deprecated:"true" db:"state"`, `validate:"oneof=ACTIVE"`}},
+	}
+	for _, test := range tests {
+		opts := options{Descriptors: ds, EnumTag: `validate:"oneof={{.EnumValues}}"`, Deprecated: test.policy}
+		areas, err := parseSource("deprecated.pb.go", []byte(src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(areas) != len(test.tags) {
+			t.Fatalf("-deprecated=%s: expected %d areas to replace, got: %d", test.policy, len(test.tags), len(areas))
+		}
+		for i, a := range areas {
+			if a.InjectTag != test.tags[i] {
+				t.Errorf("-deprecated=%s: expected tag: %q, got: %q", test.policy, test.tags[i], a.InjectTag)
+			}
+		}
+	}
+}
+
+func TestFieldBehavior(t *testing.T) {
+	behaviorOptions := func(behaviors ...int32) *descriptor.FieldOptions {
+		fieldOptions := &descriptor.FieldOptions{}
+		if err := proto.SetExtension(fieldOptions, eFieldBehavior, behaviors); err != nil {
+			t.Fatal(err)
+		}
+		return fieldOptions
+	}
+	str := descriptor.FieldDescriptorProto_TYPE_STRING.Enum()
+	fds := &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:   proto.String("book.proto"),
+		Syntax: proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("Book"),
+			Field: []*descriptor.FieldDescriptorProto{
+				{Name: proto.String("name"), Type: str, Options: behaviorOptions(5, 2)},
+				{Name: proto.String("create_time"), Type: str, Options: behaviorOptions(3)},
+				{Name: proto.String("title"), Type: str, Options: behaviorOptions(1)},
+				{Name: proto.String("author"), Type: str},
+			},
+		}},
+	}}}
+	// round trip so the extension is decoded from its wire format
+	contents, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds = &descriptor.FileDescriptorSet{}
+	if err = proto.Unmarshal(contents, fds); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "// source: book.proto\n\npackage pb\n\ntype Book struct {\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name\" json:\"name,omitempty\"`\n" +
+		"\tCreateTime string `protobuf:\"bytes,2,opt,name=create_time\" json:\"create_time\"`\n" +
+		"\tTitle string `protobuf:\"bytes,3,opt,name=title\" json:\"title,omitempty\"`\n" +
+		"\tAuthor string `protobuf:\"bytes,4,opt,name=author\" json:\"author,omitempty\"`\n" +
+		"}\n"
+	if expected := `json:",omitempty" readOnly:"true"`; defaultFieldBehaviorTags["OUTPUT_ONLY"] != expected {
+		t.Errorf("expected the OUTPUT_ONLY tag %s, got: %s", expected, defaultFieldBehaviorTags["OUTPUT_ONLY"])
+	}
+	behaviorTags := map[string]string{}
+	for behavior, tag := range defaultFieldBehaviorTags {
+		behaviorTags[behavior] = tag
+	}
+	behaviorTags["OPTIONAL"] = `validate:"omitempty"`
+	areas, err := parseSource("book.pb.go", []byte(src), options{Descriptors: newDescriptorSet(fds), FieldBehaviorTags: behaviorTags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := []string{`immutable:"true" validate:"required"`, `json:"create_time,omitempty" readOnly:"true"`, `validate:"omitempty"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+	injected, err := newInjector(options{Observer: inject.NopObserver{}, Descriptors: newDescriptorSet(fds), FieldBehaviorTags: behaviorTags}).injectSource("book.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "`protobuf:\"bytes,2,opt,name=create_time\" json:\"create_time,omitempty\" readOnly:\"true\"`"; !strings.Contains(string(injected), expected) {
+		t.Errorf("expected the json key of the field to be kept, got:\n%s", injected)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// @inject_tag: db:\"id\" json:\"user_id\"\n" +
+		"\tId string `protobuf:\"bytes,1,opt,name=id\" json:\"id,omitempty\"`\n" +
+		"}\n"
+	injected, err := newInjector(options{KeyPrefix: "x_"}).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExpr := "Id string `protobuf:\"bytes,1,opt,name=id\" json:\"id,omitempty\" x_db:\"id\" x_json:\"user_id\"`"
+	if !strings.Contains(string(injected), expectedExpr) {
+		t.Errorf("expected file to contain %q", expectedExpr)
+		t.Log(string(injected))
+	}
+}
+
+func TestRenameKey(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// @inject_tag: db:\"id\" xdb:\"id\"\n" +
+		"\tId string `protobuf:\"bytes,1,opt,name=id\" json:\"id,omitempty\" db:\"id\" xdb:\"id\"`\n" +
+		"\t// db:\"name\" is only mentioned here\n" +
+		"\tName string `protobuf:\"bytes,2,opt,name=name\" json:\"name,omitempty\"`\n" +
+		"}\n"
+	edited, count, err := editGoSource("user.pb.go", []byte(src), renameKey("db", "gorm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 edits, got: %d", count)
+	}
+	expected := strings.Replace(src, "// @inject_tag: db:", "// @inject_tag: gorm:", 1)
+	expected = strings.Replace(expected, "\" db:\"id\" xdb", "\" gorm:\"id\" xdb", 1)
+	if string(edited) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, edited)
+	}
+
+	proto := "message User {\n  // @inject_tag: db:\"id\"\n  string id = 1; // db:\"id\" in a comment\n}\n"
+	edited, count, err = editProtoSource("user.proto", []byte(proto), renameKey("db", "gorm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(proto, "@inject_tag: db", "@inject_tag: gorm", 1); string(edited) != expected || count != 1 {
+		t.Errorf("expected 1 edit:\n%s\ngot %d:\n%s", expected, count, edited)
+	}
+
+	if _, _, err = editGoSource("user.pb.go", []byte(src), renameKey("db", "xdb")); err == nil {
+		t.Error("expected an error renaming to a key already in the tag")
+	}
+}
+
+func TestRewriteValues(t *testing.T) {
+	edit := rewriteValues("json", regexp.MustCompile(`^(.*)Id(,|$)`), "${1}_id$2")
+	var tests = []struct {
+		tag, expected string
+	}{
+		{`json:"userId,omitempty" db:"userId"`, `json:"user_id,omitempty" db:"userId"`},
+		{`// @inject_tag: json:"groupId"`, `// @inject_tag: json:"group_id"`},
+		{`xjson:"userId" json:"name"`, `xjson:"userId" json:"name"`},
+	}
+	for _, test := range tests {
+		edited, err := edit(test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edited != test.expected {
+			t.Errorf("expected: %s, got: %s", test.expected, edited)
+		}
+	}
+	if _, err := rewriteValues("json", regexp.MustCompile(`.*`), `"`)(`json:"id"`); err == nil {
+		t.Error("expected an error rewriting to an invalid value")
+	}
+}
+
+func TestJSONEmbeddingCollisions(t *testing.T) {
+	src := "package pb\n\n" +
+		"type Audit struct {\n" +
+		"\tCreatedBy string `json:\"created_by,omitempty\"`\n" +
+		"\tId string `json:\"id,omitempty\"`\n" +
+		"}\n\n" +
+		"type Owner struct {\n" +
+		"\t// @inject_tag: json:\"created_by\"\n" +
+		"\tName string `json:\"name,omitempty\"`\n" +
+		"}\n\n" +
+		"type User struct {\n" +
+		"\t*Audit\n" +
+		"\tOwner\n" +
+		"\t// @inject_tag: json:\"id\"\n" +
+		"\tUserId string `json:\"user_id,omitempty\"`\n" +
+		"\tNested Owner `json:\"nested\"`\n" +
+		"}\n"
+	obs := &recordingObserver{}
+	if _, err := parseSource("user.go", []byte(src), options{Observer: obs}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`warning user.go:15:2: User.Owner: json name "created_by" is promoted from embedded *Audit and Owner, encoding/json drops it`,
+		`warning user.go:17:2: User.UserId: json name "id" hides the field promoted from embedded *Audit`,
+	}
+	if !reflect.DeepEqual(obs.events, expected) {
+		t.Errorf("expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(obs.events, "\n"))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var src string
+	for i := 1; i <= 12; i++ {
+		src += fmt.Sprintf("// line %d\n", i)
+	}
+	src += "type User struct {\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string `json:\"id\"`\n" +
+		"}\n"
+	src = "package pb\n\n" + src
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+
+	tx, err := newInjector(options{Observer: inject.NopObserver{}}).stageFiles(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		format   string
+		expected string
+	}{
+		{diffUnified, "--- a/pb/test.pb.go_tmp\n+++ b/pb/test.pb.go_tmp\n" +
+			"@@ -14,5 +14,5 @@\n // line 12\n type User struct {\n \t// @inject_tag: db:\"id\"\n" +
+			"-\tId string `json:\"id\"`\n+\tId string `json:\"id\" db:\"id\"`\n }\n"},
+		{diffNameOnly, "pb/test.pb.go_tmp\n"},
+		{diffJSON, "[\n  {\n    \"file\": \"pb/test.pb.go_tmp\",\n    \"changes\": [\n      {\n        \"line\": 17,\n" +
+			"        \"before\": \"\\tId string `json:\\\"id\\\"`\",\n        \"after\": \"\\tId string `json:\\\"id\\\" db:\\\"id\\\"`\"\n" +
+			"      }\n    ]\n  }\n]\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err = writeDiff(&buf, test.format, tx.files); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("-diff_format=%s: expected:\n%s\ngot:\n%s", test.format, test.expected, buf.String())
+		}
+	}
+
+	// the file is left untouched, so -diff reports the same change again
+	opts := options{Observer: inject.NopObserver{}}
+	patch := testInputFileTemp + ".patch"
+	defer os.Remove(patch)
+	if status := runDiff(opts, diffNameOnly, patch, false, testInputFileTemp); status != 1 {
+		t.Errorf("expected exit status 1 with changes, got: %d", status)
+	}
+	if contents, err := ioutil.ReadFile(patch); err != nil || string(contents) != tests[0].expected {
+		t.Errorf("expected the patch file to contain the unified diff, got: %q (%v)", contents, err)
+	}
+	// -apply prints the changes and writes them
+	if status := runDiff(opts, diffNameOnly, "", true, testInputFileTemp); status != 0 {
+		t.Errorf("expected exit status 0 with -apply, got: %d", status)
+	}
+	if contents, err := ioutil.ReadFile(testInputFileTemp); err != nil || !bytes.Equal(contents, tx.files[0].contents) {
+		t.Errorf("expected -apply to write the changes, got: %v", err)
+	}
+	if status := runDiff(opts, diffNameOnly, "", false, testInputFileTemp); status != 0 {
+		t.Errorf("expected exit status 0 without changes, got: %d", status)
+	}
+	if status := runDiff(opts, diffNameOnly, "", false, "./pb/missing.pb.go"); status != 2 {
+		t.Errorf("expected exit status 2 on error, got: %d", status)
+	}
+}
+
+func TestUnifiedDiffEdgeCases(t *testing.T) {
+	var tests = []struct {
+		file     stagedFile
+		expected string
+	}{
+		{stagedFile{path: "new.go", contents: []byte("package pb\n")},
+			"--- /dev/null\n+++ b/new.go\n@@ -0,0 +1,1 @@\n+package pb\n"},
+		{stagedFile{path: "./pb/../x.go", original: []byte("a\nb"), contents: []byte("a\nc")},
+			"--- a/x.go\n+++ b/x.go\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		unifiedDiff(&buf, test.file)
+		if buf.String() != test.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.file.path, test.expected, buf.String())
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	src := "package pb\n\n" +
+		"// @define: pk = gorm:\"primaryKey\" json:\"id\"\n" +
+		"// @define: audited = $pk audit:\"true\"\n" +
+		"type User struct {\n" +
+		"\t// @inject_tag: $audited\n" +
+		"\tId string `json:\"id,omitempty\"`\n" +
+		"\t// @inject_tag: validate:\"regexp=^\\$[a-z]+$\"\n" +
+		"\tPrice string `json:\"price,omitempty\"`\n" +
+		"}\n"
+	injected, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"Id string `json:\"id\" gorm:\"primaryKey\" audit:\"true\"`",
+		"Price string `json:\"price,omitempty\" validate:\"regexp=^\\$[a-z]+$\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(injected), expr) {
+			t.Errorf("expected file to contain %q", expr)
+			t.Log(string(injected))
+		}
+	}
+
+	var tests = []struct {
+		comment string
+		err     string
+	}{
+		{"// @inject_tag: $pkey", "undefined macro $pkey"},
+		{"// @define: pk = json:\"pk\"", `macro "pk" is already defined`},
+	}
+	for _, test := range tests {
+		src := strings.Replace(src, "// @inject_tag: $audited", test.comment, 1)
+		_, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("user.pb.go", []byte(src))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got: %v", test.comment, test.err, err)
+		}
+	}
+
+	// without macros, dollar signs are injected as is
+	src = "package pb\n\ntype Price struct {\n" +
+		"\t// @inject_tag: validate:\"regexp=^$amount\"\n" +
+		"\tAmount string `json:\"amount,omitempty\"`\n" +
+		"}\n"
+	injected, err = newInjector(options{Observer: inject.NopObserver{}}).injectSource("price.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExpr := "Amount string `json:\"amount,omitempty\" validate:\"regexp=^$amount\"`"
+	if !strings.Contains(string(injected), expectedExpr) {
+		t.Errorf("expected file to contain %q", expectedExpr)
+		t.Log(string(injected))
+	}
+}
+
+func TestCrossFileConsistency(t *testing.T) {
+	src := "package %s\n\nimport proto \"github.com/golang/protobuf/proto\"\n\n" +
+		"type User struct {\n" +
+		"\t%s\n" +
+		"\tId string `protobuf:\"bytes,1,opt,name=id\" json:\"id,omitempty\"`\n" +
+		"\tName string `protobuf:\"bytes,2,opt,name=name\" json:\"name,omitempty\"`\n" +
+		"}\n\n" +
+		"func init() {\n\tproto.RegisterType((*User)(nil), \"pb.User\")\n}\n"
+	paths := []string{testInputFileTemp, testInputFileTemp + "2", testInputFileTemp + "3"}
+	comments := []string{`// @inject_tag: db:"id"`, `// @inject_tag: db:"id"`, `// @inject_tag: db:"user_id"`}
+	for i, path := range paths {
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(src, "pb", comments[i])), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+	}
+	obs := &recordingObserver{}
+	if _, err := newInjector(options{Observer: obs}).stageFiles(paths...); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, event := range obs.events {
+		if strings.HasPrefix(event, "warning ") {
+			warnings = append(warnings, event)
+		}
+	}
+	expected := []string{`warning ./pb/test.pb.go_tmp3: message pb.User has different tags than in "./pb/test.pb.go_tmp": Id`}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("expected warnings: %q, got: %q", expected, warnings)
+	}
+}
+
+func TestEmbeddedDescriptor(t *testing.T) {
+	raw, err := proto.Marshal(&descriptor.FileDescriptorProto{
+		Name:    proto.String("acme/v1/user.proto"),
+		Package: proto.String("acme.v1"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name:       proto.String("User"),
+			NestedType: []*descriptor.DescriptorProto{{Name: proto.String("Address")}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var byteLit, stringLit strings.Builder
+	for _, b := range raw {
+		fmt.Fprintf(&byteLit, "0x%02x, ", b)
+	}
+	// protoc-gen-go 1.36 splits the constant in concatenated strings
+	half := len(raw) / 2
+	fmt.Fprintf(&stringLit, "\"\" +\n\t%q +\n\t%q", raw[:half], raw[half:])
+	// protoc-gen-go 1.20 to 1.35 and 1.36 and later, without any
+	// proto.RegisterType call
+	decls := []string{
+		"var file_acme_v1_user_proto_rawDesc = []byte{\n\t" + byteLit.String() + "\n}\n",
+		"const file_acme_v1_user_proto_rawDesc = " + stringLit.String() + "\n",
+	}
+	src := "// source: acme/v1/user.proto\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tEmail string `protobuf:\"bytes,1,opt,name=email,proto3\" json:\"email,omitempty\"`\n" +
+		"}\n\n" +
+		"type User_Address struct {\n" +
+		"\tCity string `protobuf:\"bytes,1,opt,name=city,proto3\" json:\"city,omitempty\"`\n" +
+		"}\n\n%s"
+	for _, decl := range decls {
+		f, err := parser.ParseFile(token.NewFileSet(), "user.pb.go", fmt.Sprintf(src, decl), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"User": "acme.v1.User", "User_Address": "acme.v1.User.Address"}
+		if registered := registeredTypes(f); !reflect.DeepEqual(registered, expected) {
+			t.Errorf("expected full names: %v, got: %v", expected, registered)
+		}
+
+		fieldTags := map[string]string{"acme.v1.User.email": `db:"email"`, "acme.v1.User.Address.city": `db:"city"`}
+		areas, err := parseSource("user.pb.go", []byte(fmt.Sprintf(src, decl)), options{FieldTags: fieldTags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tags []string
+		for _, area := range areas {
+			tags = append(tags, area.InjectTag)
+		}
+		if expected := []string{`db:"email"`, `db:"city"`}; !reflect.DeepEqual(tags, expected) {
+			t.Errorf("expected -field_tag tags: %q, got: %q", expected, tags)
+		}
+
+		rows, err := exportRows("user.pb.go", []byte(fmt.Sprintf(src, decl)), options{Observer: inject.NopObserver{}}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages []string
+		for _, row := range rows {
+			if row.Key == "json" {
+				messages = append(messages, row.Message+"."+row.Field)
+			}
+		}
+		if expected := []string{"acme.v1.User.email", "acme.v1.User.Address.city"}; !reflect.DeepEqual(messages, expected) {
+			t.Errorf("expected exported fields: %q, got: %q", expected, messages)
+		}
+
+		files := []stagedFile{
+			{path: "a/user.pb.go", contents: []byte(fmt.Sprintf(src, decl))},
+			{path: "b/user.pb.go", contents: []byte(fmt.Sprintf(src, decl))},
+		}
+		files[1].contents = bytes.Replace(files[1].contents, []byte("json:\"email,omitempty\"`"), []byte("json:\"email,omitempty\" db:\"mail\"`"), 1)
+		obs := &recordingObserver{}
+		if err = checkConsistency(files, obs); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{`warning b/user.pb.go: message acme.v1.User has different tags than in "a/user.pb.go": Email`}; !reflect.DeepEqual(obs.events, expected) {
+			t.Errorf("expected events: %q, got: %q", expected, obs.events)
+		}
+	}
+}
+
+func TestServeTags(t *testing.T) {
+	server := httptest.NewServer(tagsHandler(options{Observer: inject.NopObserver{}}, []string{testInputFile}))
+	defer server.Close()
+	var tests = []struct {
+		query    string
+		status   int
+		expected string
+	}{
+		{"?message=pb.IP&field=Address", http.StatusOK,
+			`{"message":"pb.IP","fields":{"Address":{"json":"overrided","protobuf":"bytes,1,opt,name=Address","valid":"ip","yaml":"ip"}}}` + "\n"},
+		{"?message=pb.IP&field=Port", http.StatusNotFound, "message or field not found\n"},
+		{"?message=pb.Missing", http.StatusNotFound, "message or field not found\n"},
+		{"", http.StatusBadRequest, "message parameter is mandatory\n"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(server.URL + "/tags" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status || string(body) != test.expected {
+			t.Errorf("%s: expected %d %q, got: %d %q", test.query, test.status, test.expected, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	src, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := exportRows(testInputFile, src, options{Observer: inject.NopObserver{}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = writeRows(&buf, "csv", rows); err != nil {
+		t.Fatal(err)
+	}
+	expected := "file,message,field,key,value\n" +
+		"pb/test.pb.go,pb.IP,Address,json,overrided\n" +
+		"pb/test.pb.go,pb.IP,Address,valid,ip\n" +
+		"pb/test.pb.go,pb.IP,Address,yaml,ip\n" +
+		"pb/test.pb.go,pb.URL,scheme,valid,http|https\n" +
+		"pb/test.pb.go,pb.URL,port,valid,nonzero\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	rows, err = exportRows(testInputFile, src, options{Observer: inject.NopObserver{}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRow := tagRow{File: "pb/test.pb.go", Message: "pb.URL", Field: "url", Key: "json", Value: "url,omitempty"}
+	var found bool
+	for _, row := range rows {
+		found = found || row == expectedRow
+	}
+	if !found {
+		t.Errorf("expected -all rows to contain %+v, got: %+v", expectedRow, rows)
+	}
+}
+
+func TestImportSchema(t *testing.T) {
+	ddl := "CREATE TABLE IF NOT EXISTS public.user_accounts (\n" +
+		"  id bigint NOT NULL,\n" +
+		"  \"e_mail\" varchar(255) DEFAULT ('none'),\n" +
+		"  created_at timestamp,\n" +
+		"  PRIMARY KEY (id),\n" +
+		"  CONSTRAINT email_unique UNIQUE (e_mail)\n" +
+		");\n" +
+		"create table groups (gid serial primary key, name text);\n"
+	tables := parseDDL([]byte(ddl))
+	expectedTables := []schemaTable{
+		{Name: "user_accounts", Columns: []schemaColumn{{"id", true}, {"e_mail", false}, {"created_at", false}}},
+		{Name: "groups", Columns: []schemaColumn{{"gid", true}, {"name", false}}},
+	}
+	if !reflect.DeepEqual(tables, expectedTables) {
+		t.Fatalf("expected tables: %+v, got: %+v", expectedTables, tables)
+	}
+	csvTables, err := parseColumnsCSV([]byte("table_schema,table_name,column_name\npublic,groups,gid\npublic,groups,name\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []schemaTable{{Name: "groups", Columns: []schemaColumn{{Name: "gid"}, {Name: "name"}}}}; !reflect.DeepEqual(csvTables, expected) {
+		t.Errorf("expected tables: %+v, got: %+v", expected, csvTables)
+	}
+
+	proto := "syntax = \"proto3\";\n\n" +
+		"message UserAccount {\n" +
+		"  int64 id = 1;\n" +
+		"  string mail = 2; // not e_mail\n" +
+		"  string e_mail = 3;\n" +
+		"  message Group {\n" +
+		"    // @inject_tag: gorm:\"column:gid;primaryKey\"\n" +
+		"    int64 gid = 1;\n" +
+		"    map<string, string> name = 2;\n" +
+		"  }\n" +
+		"  oneof created {\n" +
+		"    string created_at = 4;\n" +
+		"  }\n" +
+		"}\n\n" +
+		"enum Groups {\n  NAME = 0;\n}\n"
+	annotated, count := annotateProtoSource([]byte(proto), schemaAnnotator(tables, "gorm"))
+	expected := "syntax = \"proto3\";\n\n" +
+		"message UserAccount {\n" +
+		"  // @inject_tag: gorm:\"column:id;primaryKey\"\n" +
+		"  int64 id = 1;\n" +
+		"  string mail = 2; // not e_mail\n" +
+		"  // @inject_tag: gorm:\"column:e_mail\"\n" +
+		"  string e_mail = 3;\n" +
+		"  message Group {\n" +
+		"    // @inject_tag: gorm:\"column:gid;primaryKey\"\n" +
+		"    int64 gid = 1;\n" +
+		"    // @inject_tag: gorm:\"column:name\"\n" +
+		"    map<string, string> name = 2;\n" +
+		"  }\n" +
+		"  oneof created {\n" +
+		"    // @inject_tag: gorm:\"column:created_at\"\n" +
+		"    string created_at = 4;\n" +
+		"  }\n" +
+		"}\n\n" +
+		"enum Groups {\n  NAME = 0;\n}\n"
+	if string(annotated) != expected || count != 4 {
+		t.Errorf("expected 4 annotations:\n%s\ngot %d:\n%s", expected, count, annotated)
+	}
+	if again, count := annotateProtoSource(annotated, schemaAnnotator(tables, "gorm")); string(again) != expected || count != 0 {
+		t.Errorf("expected annotating twice to change nothing, got %d annotation(s):\n%s", count, again)
+	}
+}
+
+func TestImportOpenAPI(t *testing.T) {
+	spec := `{
+  "openapi": "3.0.0",
+  "components": {"schemas": {
+    "v1User": {"properties": {
+      "userId": {"type": "string", "format": "uuid", "example": "5f0c"},
+      "name": {"type": "string", "example": "Jane \"JJ\" Doe"},
+      "age": {"type": "integer", "example": 42}
+    }},
+    "v1UserGroup": {"properties": {"title": {"type": "string", "example": "admins"}}}
+  }}
+}`
+	var doc openAPIDocument
+	if err := json.Unmarshal([]byte(spec), &doc); err != nil {
+		t.Fatal(err)
+	}
+	proto := "message User {\n" +
+		"  string user_id = 1;\n" +
+		"  string name = 2;\n" +
+		"  int32 age = 3;\n" +
+		"  message Group {\n    string title = 1;\n  }\n" +
+		"}\n"
+	annotated, count := annotateProtoSource([]byte(proto), openAPIAnnotator(doc, map[string]bool{"json": true, "format": true, "example": true}))
+	expected := "message User {\n" +
+		"  // @inject_tag: json:\"userId,omitempty\" format:\"uuid\" example:\"5f0c\"\n" +
+		"  string user_id = 1;\n" +
+		"  string name = 2;\n" +
+		"  // @inject_tag: example:\"42\"\n" +
+		"  int32 age = 3;\n" +
+		"  message Group {\n" +
+		"    // @inject_tag: example:\"admins\"\n" +
+		"    string title = 1;\n  }\n" +
+		"}\n"
+	if string(annotated) != expected || count != 3 {
+		t.Errorf("expected 3 annotations:\n%s\ngot %d:\n%s", expected, count, annotated)
+	}
+}
+
+func TestCompareRuleSets(t *testing.T) {
+	oldRules, err := parseRuleSet("old.rules", []byte("# current rules\n-XXX_skip=yaml\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRules, err := parseRuleSet("new.rules", []byte("-XXX_skip=yaml,xml\n\n-key_prefix=x_\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newRules.XXXSkip) != 2 || newRules.KeyPrefix != "x_" || newRules.MaxEdits != 10000 {
+		t.Errorf("expected rule set flags and defaults to be parsed, got: %+v", newRules)
+	}
+	if _, err = parseRuleSet("bad.rules", []byte("-XXX_skip=yaml\nmigrate\n")); err == nil {
+		t.Error("expected an error for a rule set line that is not a flag")
+	}
+
+	var buf bytes.Buffer
+	changed, err := compareRuleSets(&buf, oldRules, newRules, []string{testInputFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 1 {
+		t.Errorf("expected 1 file injected differently, got: %d", changed)
+	}
+	expectedLine := "+\tXXX_NoUnkeyedLiteral struct{} `json:\"-\" x_yaml:\"-\" x_xml:\"-\"`\n"
+	if !strings.Contains(buf.String(), "-\tXXX_NoUnkeyedLiteral struct{} `json:\"-\" yaml:\"-\"`\n") || !strings.Contains(buf.String(), expectedLine) {
+		t.Errorf("expected diff to contain %q, got:\n%s", expectedLine, buf.String())
+	}
+}
+
+func TestFieldTags(t *testing.T) {
+	src, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldTags := map[string]string{"pb.URL.url": `validate:"url"`, "pb.URL.port": `validate:"min=1"`, "pb.IP.port": `validate:"-"`}
+	areas, err := parseSource(testInputFile, src, options{FieldTags: fieldTags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// comments are applied after, so they take precedence
+	expectedTags := []string{`valid:"ip" yaml:"ip" json:"overrided"`, `valid:"http|https"`, `validate:"url"`, `validate:"min=1" valid:"nonzero"`}
+	if len(areas) != len(expectedTags) {
+		t.Fatalf("expected %d areas to replace, got: %d", len(expectedTags), len(areas))
+	}
+	for i, a := range areas {
+		if a.InjectTag != expectedTags[i] {
+			t.Errorf("expected tag: %q, got: %q", expectedTags[i], a.InjectTag)
+		}
+	}
+
+	// without registrations, full names are read from the descriptors
+	ds := newDescriptorSet(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:    proto.String("patch.proto"),
+		Package: proto.String("acme.v1"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("Patch"),
+			NestedType: []*descriptor.DescriptorProto{{
+				Name:  proto.String("Body"),
+				Field: []*descriptor.FieldDescriptorProto{{Name: proto.String("name"), Type: descriptor.FieldDescriptorProto_TYPE_STRING.Enum()}},
+			}},
+		}},
+	}}})
+	patchSrc := "// source: patch.proto\n\npackage pb\n\ntype Patch_Body struct {\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name,proto3\" json:\"name,omitempty\"`\n" +
+		"}\n"
+	areas, err = parseSource("patch.pb.go", []byte(patchSrc), options{Descriptors: ds, FieldTags: map[string]string{"acme.v1.Patch.Body.name": `patch:"name"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 1 || areas[0].InjectTag != `patch:"name"` {
+		t.Errorf("expected patch:\"name\" to be injected, got: %+v", areas)
+	}
+}
+
+func TestOnlyTagsChanged(t *testing.T) {
+	src := []byte("package pb\n\ntype IP struct {\n\t// the address\n\tAddress string\n}\n")
+	start := bytes.Index(src, []byte("Address")) + 1
+	var tests = []struct {
+		area textArea
+		err  error
+	}{
+		{textArea{Start: start, End: start + len("Address string"), InjectTag: `valid:"ip"`}, nil},
+		// an area ending inside the field name, as an offset bug would
+		{textArea{Start: start, End: start + len("Addr"), InjectTag: `valid:"ip"`}, inject.ErrUnsafeEdit},
+	}
+	for _, test := range tests {
+		injected := injectAreas(append([]byte{}, src...), []textArea{test.area})
+		err := checkOnlyTagsChanged("ip.go", src, injected)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: expected error %v, got: %v", injected, test.err, err)
+		}
+	}
+}
+
+func TestMaxTagLength(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n" +
+		"\t// @inject_tag: gorm:\"type:varchar(255);uniqueIndex\" db:\"name\"\n" +
+		"\tName string `json:\"name,omitempty\"`\n" +
+		"}\n"
+	limits := map[string]int{"gorm": 12, "db": 4}
+	var tests = []struct {
+		policy   string
+		tag      string
+		warnings int
+		err      bool
+	}{
+		{"", "", 0, true},
+		{tagLengthError, "", 0, true},
+		{tagLengthWarn, `gorm:"type:varchar(255);uniqueIndex" db:"name"`, 1, false},
+		{tagLengthTruncate, `gorm:"type:varchar" db:"name"`, 1, false},
+	}
+	for _, test := range tests {
+		obs := &recordingObserver{}
+		areas, err := parseSource("user.pb.go", []byte(src), options{Observer: obs, MaxTagLengths: limits, TagLengthPolicy: test.policy})
+		if test.err {
+			if err == nil || !strings.Contains(err.Error(), "user.pb.go:5:2: User.Name: value of gorm is 29 characters long") {
+				t.Errorf("-tag_length_policy=%s: expected an error with the field location, got: %v", test.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(areas) != 1 || areas[0].InjectTag != test.tag || len(obs.events) != test.warnings {
+			t.Errorf("-tag_length_policy=%s: expected tag %q with %d warning(s), got: %+v, %q", test.policy, test.tag, test.warnings, areas, obs.events)
+		}
+	}
+}
+
+func TestEditConfig(t *testing.T) {
+	lines := []string{"# rules", "XXX_skip: yaml", "field_tag:", `  - pb.IP.Address=valid:"ip"`, "recursive: true"}
+	var tests = []struct {
+		command, name, value string
+		expected             []string
+		err                  bool
+	}{
+		{"set", "XXX_skip", "yaml,xml", []string{"# rules", "XXX_skip: yaml,xml", "field_tag:", `  - pb.IP.Address=valid:"ip"`, "recursive: true"}, false},
+		{"set", "key_prefix", "#x_", append(append([]string{}, lines...), `key_prefix: "#x_"`), false},
+		{"add-rule", "field_tag", `pb.URL.port=valid:"port"`, []string{"# rules", "XXX_skip: yaml", "field_tag:", `  - pb.IP.Address=valid:"ip"`, `  - pb.URL.port=valid:"port"`, "recursive: true"}, false},
+		{"add-rule", "exclude", "*_mock.pb.go", append(append([]string{}, lines...), "exclude:", "  - *_mock.pb.go"), false},
+		{"remove-rule", "field_tag", `pb.IP.Address=valid:"ip"`, []string{"# rules", "XXX_skip: yaml", "recursive: true"}, false},
+		{"remove-rule", "XXX_skip", "", []string{"# rules", "field_tag:", `  - pb.IP.Address=valid:"ip"`, "recursive: true"}, false},
+		{"remove-rule", "field_tag", `pb.URL.port=valid:"port"`, nil, true},
+		{"add-rule", "XXX_skip", "xml", nil, true},
+		{"set", "field_tag", `pb.IP.Address=valid:"ip"`, nil, true},
+		{"set", "unknown", "1", nil, true},
+	}
+	for _, test := range tests {
+		edited, err := editConfig(lines, test.command, test.name, test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("config %s %s %s: expected an error", test.command, test.name, test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(edited, test.expected) {
+			t.Errorf("config %s %s %s: expected %q, got: %q", test.command, test.name, test.value, test.expected, edited)
+		}
+	}
+
+	// a single value becomes a list, and edits read back as they were made
+	edited, err := editConfig([]string{"exclude: a.pb.go # legacy"}, "add-rule", "exclude", "b.pb.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"exclude:", "  - a.pb.go", "  - b.pb.go"}; !reflect.DeepEqual(edited, expected) {
+		t.Errorf("expected %q, got: %q", expected, edited)
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultConfigFile)
+	for _, args := range [][]string{
+		{"set", "-file", path, "key_prefix", "x_"},
+		{"add-rule", "-file", path, "field_tag", `acme.v1.User.email=validate:"email"`},
+	} {
+		if err = runConfig(options{}, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = runConfig(options{}, []string{"set", "-file", path, "max_edits", "many"}); err == nil {
+		t.Error("expected an invalid value to be refused")
+	}
+	var flags cliFlags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.register(fs)
+	if err = applyConfigFile(fs, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if flags.opts.KeyPrefix != "x_" || flags.fieldTags.String() != `acme.v1.User.email=validate:"email"` {
+		t.Errorf("expected the edited flags, got: %q %q", flags.opts.KeyPrefix, flags.fieldTags.String())
+	}
+	// the edited file keeps its mode
+	if err = os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = runConfig(options{}, []string{"remove-rule", "-file", path, "field_tag", `acme.v1.User.email=validate:"email"`}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the config file to stay 0600, got: %v", info.Mode())
+	}
+}
+
+func TestAnnotateProtoPresets(t *testing.T) {
+	annotate, err := presetAnnotator("db,yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto := "message User {\n" +
+		"  // @inject_tag: db:\"id\" yaml:\"id\"\n" +
+		"  int64 id = 1;\n" +
+		"  string user_name = 2;\n" +
+		"}\n"
+	expected := "message User {\n" +
+		"  // @inject_tag: db:\"id\" yaml:\"id\"\n" +
+		"  int64 id = 1;\n" +
+		"  // @inject_tag: db:\"user_name\" yaml:\"user_name,omitempty\"\n" +
+		"  string user_name = 2;\n" +
+		"}\n"
+	annotated, count := annotateProtoSource([]byte(proto), annotate)
+	if string(annotated) != expected || count != 1 {
+		t.Fatalf("expected %d annotation(s):\n%s\ngot %d:\n%s", 1, expected, count, annotated)
+	}
+	if again, count := annotateProtoSource(annotated, annotate); string(again) != expected || count != 0 {
+		t.Errorf("expected annotating again to change nothing, got %d annotation(s):\n%s", count, again)
+	}
+	if _, err = presetAnnotator("db,xml"); err == nil {
+		t.Error("expected an error for an unknown preset")
+	}
+}
+
+func TestFormatAnnotations(t *testing.T) {
+	proto := "// @define: id = db:\"id\"\n" +
+		"message User {\n" +
+		"  //@inject_tag:   yaml:\"id\"   $id\n" +
+		"  // The user id.\n" +
+		"  //inject:tag yaml:\"uid\"\n" +
+		"  int64 id = 1;\n" +
+		"  // @inject_tag: validate:\"required\" db:\"name\"\n" +
+		"  string name = 2;\n" +
+		"  // @inject_tag:\n" +
+		"  // @inject_tag: db:\"mail\"\n" +
+		"  string mail = 3;\n" +
+		"}\n"
+	expected := "// @define: id = db:\"id\"\n" +
+		"message User {\n" +
+		"  // The user id.\n" +
+		"  // @inject_tag: db:\"id\" yaml:\"uid\"\n" +
+		"  int64 id = 1;\n" +
+		"  // @inject_tag: db:\"name\" validate:\"required\"\n" +
+		"  string name = 2;\n" +
+		"  // @inject_tag:\n" +
+		"  // @inject_tag: db:\"mail\"\n" +
+		"  string mail = 3;\n" +
+		"}\n"
+	formatted, count, err := formatAnnotations([]byte(proto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != expected || count != 2 {
+		t.Fatalf("expected 2 field(s) formatted:\n%s\ngot %d:\n%s", expected, count, formatted)
+	}
+	if again, count, _ := formatAnnotations(formatted); string(again) != expected || count != 0 {
+		t.Errorf("expected formatting again to change nothing, got %d field(s):\n%s", count, again)
+	}
+	if _, _, err = formatAnnotations([]byte("// @inject_tag: $undefined\n// @define: a = db:\"a\"\nint64 a = 1;\n")); err == nil {
+		t.Error("expected an error for an undefined macro")
+	}
+}
+
+func TestOneofMetadata(t *testing.T) {
+	src := "package pb\n\n" +
+		"type Msg struct {\n" +
+		"\t// @inject_tag_oneof: validate:\"required\"\n" +
+		"\tValue isMsg_Value `protobuf_oneof:\"value\"`\n" +
+		"}\n\n" +
+		"type isMsg_Value interface {\n\tisMsg_Value()\n}\n\n" +
+		"type Msg_Name struct {\n\tName string `protobuf:\"bytes,1,opt,name=name,oneof\"`\n}\n\n" +
+		"type Msg_Id struct {\n\tId int64 `protobuf:\"varint,2,opt,name=id,oneof\"`\n}\n\n" +
+		"func (*Msg_Name) isMsg_Value() {}\n\n" +
+		"func (*Msg_Id) isMsg_Value() {}\n"
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+	metadataPath := testInputFileTemp + "_oneof"
+	tx, err := newInjector(options{Observer: inject.NopObserver{}, OneofMetadata: metadataPath}).stageFiles(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.files) != 2 || tx.files[1].path != metadataPath {
+		t.Fatalf("expected the metadata file to be staged after the input, got: %v", tx.files)
+	}
+	metadata := string(tx.files[1].contents)
+	for _, expected := range []string{
+		"package pb\n",
+		"{\"Msg\", \"Value\", \"Msg_Id\", \"Id\", `protobuf:\"varint,2,opt,name=id,oneof\" validate:\"required\"`},\n",
+		"{\"Msg\", \"Value\", \"Msg_Name\", \"Name\", `protobuf:\"bytes,1,opt,name=name,oneof\" validate:\"required\"`},\n",
+		"case *Msg_Name:\n\t\treturn `protobuf:\"bytes,1,opt,name=name,oneof\" validate:\"required\"`, true\n",
+	} {
+		if !strings.Contains(metadata, expected) {
+			t.Errorf("expected metadata to contain %q, got:\n%s", expected, metadata)
+		}
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	// tests aren't built with -ldflags, the version is the build info's
+	if version != buildVersion() || version == "" {
+		t.Errorf("expected the build info version %q, got: %q", buildVersion(), version)
+	}
+	info := versionInfo()
+	if !strings.HasPrefix(info, "protoc-go-inject-tag "+version+" ") {
+		t.Errorf("expected the version first, got: %q", info)
+	}
+	if fields := strings.Fields(info); !strings.HasPrefix(fields[len(fields)-1], "go") {
+		t.Errorf("expected the Go version last, got: %q", info)
+	}
+}
+
+func TestVersionPinning(t *testing.T) {
+	saved := version
+	defer func() { version = saved }()
+	version = "v1.4.0"
+	var tests = []struct {
+		rules string
+		err   bool
+	}{
+		{"-min_version=v1.4.0-rc.1\n-max_version=v1.4.0\n-syntax_version=1", false},
+		{"-min_version=v1.4.1", true},
+		{"-max_version=v1.3.9", true},
+		{"-syntax_version=2", true},
+		{"-syntax_version=2\n-version_policy=warn", false},
+		{"-min_version=next\n-version_policy=warn", true},
+		{"-version_policy=ignore", true},
+	}
+	for _, test := range tests {
+		_, err := parseRuleSet("rules", []byte(test.rules))
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected error: %v, got: %v", test.rules, test.err, err)
+		}
+	}
+
+	// builds without a version only check the range when it is pinned,
+	// warning that they can't
+	version = "(devel)"
+	if warning, err := checkVersion("", "", 1); warning != nil || err != nil {
+		t.Errorf("expected no warning nor error without pins, got: %v, %v", warning, err)
+	}
+	if warning, err := checkVersion("v1.0.0", "", 1); warning == nil || err != nil {
+		t.Errorf("expected a warning for -min_version, got: %v, %v", warning, err)
+	}
+	if _, err := checkVersion("", "", 2); err == nil {
+		t.Error("expected an error for -syntax_version=2")
+	}
+}
+
+func TestInjectArchive(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1)
+	entries := []struct{ name, contents string }{{"pb/user.pb.go", src}, {"README", "not Go"}}
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.contents))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path, output := testInputFileTemp+".zip", testInputFileTemp+"_out.zip"
+	if err := ioutil.WriteFile(path, zipped.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(output)
+	stats := &inject.StatsObserver{Observer: inject.NopObserver{}}
+	if _, err := newInjector(options{Observer: stats}).injectArchive(path, output); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 1 {
+		t.Errorf("expected the Go entry to be counted once, got %d file(s)", stats.Files)
+	}
+	if contents, _ := ioutil.ReadFile(path); !bytes.Equal(contents, zipped.Bytes()) {
+		t.Error("expected the input archive to be left alone")
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for i, file := range zr.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		want := entries[i].contents
+		if i == 0 {
+			want = expected
+		}
+		if file.Name != entries[i].name || string(contents) != want {
+			t.Errorf("expected entry %s:\n%s\ngot %s:\n%s", entries[i].name, want, file.Name, contents)
+		}
+	}
+
+	var tarred bytes.Buffer
+	gw := gzip.NewWriter(&tarred)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.contents)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(entry.contents))
+	}
+	tw.Close()
+	gw.Close()
+	inject := func(name string, contents []byte) ([]byte, error) {
+		return newInjector(options{Observer: inject.NopObserver{}}).injectSource(name, contents)
+	}
+	rewritten, err := rewriteTar(tarred.Bytes(), true, inject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(rewritten))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for i := range entries {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(tr)
+		want := entries[i].contents
+		if i == 0 {
+			want = expected
+		}
+		if header.Name != entries[i].name || string(contents) != want || header.Size != int64(len(want)) {
+			t.Errorf("expected entry %s:\n%s\ngot %s:\n%s", entries[i].name, want, header.Name, contents)
+		}
+	}
+}
+
+func TestObjectStore(t *testing.T) {
+	// fake CLI copying s3://bucket/key from and to the files of a
+	// directory
+	dir, err := ioutil.TempDir("", "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := objectStoreCLIs["s3://"]
+	defer func() { objectStoreCLIs["s3://"] = saved }()
+	objectStoreCLIs["s3://"] = []string{"sh", "-c",
+		`if [ "$1" = - ]; then mkdir -p "$(dirname "$0/${2#s3://*/}")" && cat > "$0/${2#s3://*/}"; else cat "$0/${1#s3://*/}"; fi`, dir}
+
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	if err = ioutil.WriteFile(dir+"/user.pb.go", []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := newInjector(options{Observer: inject.NopObserver{}}).injectFiles("s3://bucket/user.pb.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, _, _ := tx.summary(); changed != 1 {
+		t.Errorf("expected 1 file changed, got: %d", changed)
+	}
+	contents, err := ioutil.ReadFile(dir + "/user.pb.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1); string(contents) != expected {
+		t.Errorf("expected object:\n%s\ngot:\n%s", expected, contents)
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}}).injectFiles("s3://bucket/missing.pb.go"); err == nil {
+		t.Error("expected an error for a missing object")
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}, MaxFileSize: 10}).injectFiles("s3://bucket/user.pb.go"); err == nil || !strings.Contains(err.Error(), "-max_file_size=10") {
+		t.Errorf("expected a -max_file_size error, got: %v", err)
+	}
+
+	// -output to a prefix of the store
+	if err = ioutil.WriteFile(dir+"/order.pb.go", []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := "s3://bucket/order.pb.go"
+	outputs, err := outputPaths("s3://bucket/out/", []string{input}, [][]string{{input}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := outputs[input]; out != "s3://bucket/out/order.pb.go" {
+		t.Fatalf("expected output s3://bucket/out/order.pb.go, got: %s", out)
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}, Outputs: outputs}).injectFiles(input); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err = ioutil.ReadFile(dir + "/out/order.pb.go"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1); string(contents) != expected {
+		t.Errorf("expected output object:\n%s\ngot:\n%s", expected, contents)
+	}
+	if contents, err = ioutil.ReadFile(dir + "/order.pb.go"); err != nil || string(contents) != src {
+		t.Errorf("expected the input object left as is, got: %s, %v", contents, err)
+	}
+}
+
+func TestWriteCAS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []stagedFile{
+		{path: "a.pb.go", original: []byte("old"), contents: []byte("package pb\n")},
+		{path: "b.pb.go", original: []byte("package pb\n"), contents: []byte("package pb\n")},
+	}
+	mapping := dir + "/mapping.json"
+	entries, err := writeCAS(files, dir, mapping, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := "9daffd4385df30fad3d57219288529e7068258c1943152b05859aaa12b6fd360"
+	var expected []casEntry
+	for _, file := range files {
+		expected = append(expected, casEntry{Path: file.path, SHA256: digest, Size: 11, Object: digest[:2] + "/" + digest})
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected entries: %+v, got: %+v", expected, entries)
+	}
+	if contents, err := ioutil.ReadFile(dir + "/" + expected[0].Object); err != nil || string(contents) != "package pb\n" {
+		t.Errorf("expected the object to hold the contents, got: %q (%v)", contents, err)
+	}
+	var written []casEntry
+	contents, err := ioutil.ReadFile(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(contents, &written); err != nil || !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected mapping: %+v, got: %s (%v)", expected, contents, err)
+	}
+}
+
+func TestLintProto(t *testing.T) {
+	proto := "message User {\n" +
+		"  // @inject_tag: db:\"id\"\n" +
+		"  int64 id = 1;\n" +
+		"  string name = 2; // @inject_tag: db:\"name\"\n" +
+		"  // @inject_tag: db:\"old\"\n" +
+		"\n" +
+		"  string mail = 3;\n" +
+		"  // @inject_tag: db:\"gone\"\n" +
+		"  reserved 4;\n" +
+		"  // @inject_tag: json:\"-\"\n" +
+		"  oneof contact {\n" +
+		"    // @inject_tag_oneof: validate:\"required\"\n" +
+		"    string phone = 5;\n" +
+		"  }\n" +
+		"  // @inject_tag_oneof: validate:\"required\"\n" +
+		"  oneof ok {\n" +
+		"    // @inject_tag:\n" +
+		"    string fax = 6;\n" +
+		"  }\n" +
+		"}\n" +
+		"// @inject_tag: db:\"users\"\n" +
+		"message Users {}\n"
+	expected := []protoLint{
+		{4, "trailing annotation, injection only reads the comments above fields"},
+		{5, "detached annotation, protoc drops comments separated from the field by a blank line"},
+		{8, "annotation on a reserved statement, reserved fields have no Go field"},
+		{10, "@inject_tag annotation on a oneof, use @inject_tag_oneof"},
+		{12, "@inject_tag_oneof annotation not on a oneof"},
+		{17, "annotation without tag"},
+		{21, "annotation not on a field"},
+	}
+	if lints := lintProtoSource([]byte(proto)); !reflect.DeepEqual(lints, expected) {
+		t.Errorf("expected lints: %+v, got: %+v", expected, lints)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	src := "package pb\n\n" +
+		"type User struct {\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string `json:\"id\"` // the id\n" +
+		"\t// @inject_tag: db:\"name\"\n" +
+		"\tName string\n" +
+		"\tMail string `json:\"mail\"`\n" +
+		"}\n\n" +
+		"func broken( {\n"
+	if _, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("broken.pb.go", []byte(src)); !errors.Is(err, inject.ErrParse) {
+		t.Fatalf("expected inject.ErrParse without -lenient, got: %v", err)
+	}
+	obs := &recordingObserver{}
+	injected, err := newInjector(options{Observer: obs, Lenient: true}).injectSource("broken.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1)
+	expected = strings.Replace(expected, "\tName string\n", "\tName string `db:\"name\"`\n", 1)
+	if string(injected) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, injected)
+	}
+	var warnings int
+	for _, event := range obs.events {
+		if strings.HasPrefix(event, "warning ") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("expected the syntax error and the fallback to be reported, got: %q", obs.events)
+	}
+}
+
+func TestInputPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a/v1/a.pb.go", "a/v1/a_grpc.go", "b.pb.go", "c/c.go"} {
+		path := dir + "/" + name
+		if err = os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte("package pb\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := inputPaths(dir, true, inputFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{dir + "/a/v1/a.pb.go", dir + "/b.pb.go"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths: %q, got: %q", expected, paths)
+	}
+	if _, err = inputPaths(dir, false, inputFilter{}); err == nil {
+		t.Error("expected an error for a directory without -recursive")
+	}
+	if _, err = inputPaths(dir+"/c", true, inputFilter{}); err == nil {
+		t.Error("expected an error for a directory without *.pb.go files")
+	}
+	if paths, err = inputPaths(dir+"/c/c.go", true, inputFilter{}); err != nil || !reflect.DeepEqual(paths, []string{dir + "/c/c.go"}) {
+		t.Errorf("expected a file to be its own input, got: %q (%v)", paths, err)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a/a.pb.go", "a/a_mock.pb.go", "third_party/t.pb.go", "b.pb.go"} {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte("package pb\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := inputPaths(dir, true, inputFilter{exclude: []string{"*_mock.pb.go", "third_party"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join(dir, "a/a.pb.go"), filepath.Join(dir, "b.pb.go")}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths: %q, got: %q", expected, paths)
+	}
+	if paths, err = inputPaths(filepath.Join(dir, "a/a_mock.pb.go"), false, inputFilter{exclude: []string{"*_mock.pb.go"}}); err != nil || len(paths) != 0 {
+		t.Errorf("expected an excluded file input to be skipped, got: %q (%v)", paths, err)
+	}
+	if _, err = inputPaths(filepath.Join(dir, "third_party"), true, inputFilter{exclude: []string{"*.pb.go"}}); err == nil || !strings.Contains(err.Error(), "-exclude") {
+		t.Errorf("expected an error for a directory left empty by -exclude, got: %v", err)
+	}
+	flags := cliFlags{input: inputList{dir}, exclude: inputList{"[a"}, diffFormat: diffUnified, versionPolicy: versionError, opts: options{TagLengthPolicy: tagLengthError}}
+	if _, err = flags.options(); err == nil || !strings.Contains(err.Error(), "-exclude") {
+		t.Errorf("expected an error for an invalid -exclude glob, got: %v", err)
+	}
+}
+
+func TestPluginParameter(t *testing.T) {
+	pieces := splitPluginParameter(`XXX_skip=yaml,xml,trace,field_tag=pb.IP.Address=json:"address,omitempty",key_prefix=x_`)
+	expected := []string{"XXX_skip=yaml,xml", "trace", `field_tag=pb.IP.Address=json:"address,omitempty"`, "key_prefix=x_"}
+	if !reflect.DeepEqual(pieces, expected) {
+		t.Fatalf("expected pieces: %q, got: %q", expected, pieces)
+	}
+	opts, err := parsePluginParameter(strings.Join(pieces, ","), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opts.XXXSkip, []string{"yaml", "xml"}) || !opts.Trace || opts.KeyPrefix != "x_" ||
+		opts.FieldTags["pb.IP.Address"] != `json:"address,omitempty"` {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	for _, parameter := range []string{"preset=gorm", "tag_length_policy=wrap"} {
+		if _, err = parsePluginParameter(parameter, nil); err == nil {
+			t.Errorf("%s: expected an error", parameter)
+		}
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "// source: acme/v1/user.proto\n\npackage v1\n\ntype User struct {\n" +
+		"\t// @inject_tag: db:\"status\"\n" +
+		"\tStatus User_Status `protobuf:\"varint,1,opt,name=status,enum=acme.v1.User_Status\"`\n" +
+		"}\n"
+	gen := filepath.Join(dir, "acme", "v1", "user.pb.go")
+	if err = os.MkdirAll(filepath.Dir(gen), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(gen, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	enum := descriptor.FieldDescriptorProto_TYPE_ENUM
+	req := &plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"acme/v1/user.proto"},
+		Parameter:      proto.String(`dir=` + dir + `,module=example.com,quiet,enum_tag=validate:"oneof={{.EnumValues}}"`),
+		ProtoFile: []*descriptor.FileDescriptorProto{{
+			Name:    proto.String("acme/v1/user.proto"),
+			Package: proto.String("acme.v1"),
+			Options: &descriptor.FileOptions{GoPackage: proto.String("example.com/acme/v1;v1")},
+			MessageType: []*descriptor.DescriptorProto{{
+				Name: proto.String("User"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{Name: proto.String("status"), Type: &enum, TypeName: proto.String(".acme.v1.User.Status")},
+				},
+				EnumType: []*descriptor.EnumDescriptorProto{{
+					Name: proto.String("Status"),
+					Value: []*descriptor.EnumValueDescriptorProto{
+						{Name: proto.String("ACTIVE"), Number: proto.Int32(0)},
+						{Name: proto.String("BANNED"), Number: proto.Int32(1)},
+					},
+				}},
+			}},
+		}},
+	}
+	in, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = runPlugin(bytes.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	var resp plugin.CodeGeneratorResponse
+	if err = proto.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetError() != "" || len(resp.GetFile()) != 1 {
+		t.Fatalf("expected a file, got: %q, %+v", resp.GetError(), resp.GetFile())
+	}
+	// the request describes the protos, without -descriptor_set
+	expected := strings.Replace(src, "enum=acme.v1.User_Status\"`", "enum=acme.v1.User_Status\" validate:\"oneof=ACTIVE BANNED\" db:\"status\"`", 1)
+	if file := resp.GetFile()[0]; file.GetName() != "acme/v1/user.pb.go" || file.GetContent() != expected {
+		t.Errorf("expected acme/v1/user.pb.go:\n%s\ngot %s:\n%s", expected, file.GetName(), file.GetContent())
+	}
+
+	req.Parameter = proto.String("dir=" + dir + ",quiet,paths=source_relative")
+	if err = os.Rename(gen, filepath.Join(dir, "acme", "v1", "moved.go")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := injectRequest(req); !strings.Contains(resp.GetError(), "run protoc-gen-go before") {
+		t.Errorf("expected an error for a missing generated file, got: %+v", resp)
+	}
+	req.Parameter = proto.String("paths=relative")
+	if resp := injectRequest(req); !strings.Contains(resp.GetError(), "paths=relative") {
+		t.Errorf("expected an error for an invalid paths, got: %+v", resp)
+	}
+	if !isPlugin("/usr/local/bin/protoc-gen-inject-tag") || isPlugin("/usr/local/bin/protoc-go-inject-tag") {
+		t.Error("expected only protoc-gen-* executables to run as plugins")
+	}
+}
+
+func TestMultipleInputs(t *testing.T) {
+	var flags cliFlags
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.register(fs)
+	if err := fs.Parse([]string{"-input=a.pb.go,b.pb.go", "-input", "c.pb.go"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (inputList{"a.pb.go", "b.pb.go", "c.pb.go"}); !reflect.DeepEqual(flags.input, expected) {
+		t.Errorf("expected inputs: %q, got: %q", expected, flags.input)
+	}
+	if _, err := parseFlagArgs("test", []string{"-input=a.pb.go", "-input=gen.zip"}); err == nil {
+		t.Error("expected an error for an archive among several inputs")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	src := "\xef\xbb\xbfpackage pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1)
+	for _, strip := range []bool{false, true} {
+		injected, err := newInjector(options{Observer: inject.NopObserver{}, StripBOM: strip}).injectSource("bom.pb.go", []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := expected
+		if strip {
+			want = strings.TrimPrefix(expected, "\xef\xbb\xbf")
+		}
+		if string(injected) != want {
+			t.Errorf("-strip_bom=%v: expected:\n%q\ngot:\n%q", strip, want, injected)
+		}
+	}
+
+	var tests = []struct {
+		src string
+		pos string
+	}{
+		{"package pb\n\n// caf\xe9\n", "3:7"},
+		{"\xff\xfep\x00", ""},
+	}
+	for _, test := range tests {
+		_, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("latin1.pb.go", []byte(test.src))
+		var fieldErr *inject.FieldError
+		if !errors.Is(err, inject.ErrEncoding) || !errors.As(err, &fieldErr) {
+			t.Fatalf("expected inject.ErrEncoding, got: %v", err)
+		}
+		if pos := fmt.Sprintf("%d:%d", fieldErr.Pos.Line, fieldErr.Pos.Column); test.pos != "" && pos != test.pos {
+			t.Errorf("expected the invalid byte at %s, got: %s", test.pos, pos)
+		}
+	}
+}
+
+// structTagView returns the values reflect.StructTag.Lookup returns for
+// keys in tag, missing keys being absent.
+func structTagView(tag string, keys []string) map[string]string {
+	view := map[string]string{}
+	for _, key := range keys {
+		if value, ok := reflect.StructTag(tag).Lookup(key); ok {
+			view[key] = value
+		}
+	}
+	return view
+}
+
+func TestMergeStructTagRoundTrip(t *testing.T) {
+	currents := []string{
+		"",
+		`json:"id,omitempty"`,
+		`protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`,
+		`protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty" db:"old" validate:"max=10"`,
+		`protobuf_oneof:"value"`,
+	}
+	injects := []string{
+		`db:"id"`,
+		`json:"-"`,
+		`db:"a" db:"b"`,
+		`validate:"required,email" gorm:"column:id;primaryKey" xml:"id,attr"`,
+		`doc:"a b: c" json:"id"`,
+	}
+	for _, current := range currents {
+		for _, inject := range injects {
+			for _, normalize := range []bool{false, true} {
+				keys := []string{"protobuf", "protobuf_oneof", "json", "db", "validate", "gorm", "xml", "doc"}
+				expected := structTagView(current, keys)
+				for _, item := range newTagItems(inject) {
+					expected[item.key] = item.value[1 : len(item.value)-1]
+				}
+				src := []byte("x int `" + current + "`")
+				if current == "" {
+					src = []byte("x int")
+				}
+				area := textArea{Start: 1, End: len(src) + 1, CurrentTag: current, InjectTag: inject, Normalize: normalize}
+				injected := string(injectTag(src, area))
+				tag := injected[strings.Index(injected, "`")+1 : len(injected)-1]
+				if view := structTagView(tag, keys); !reflect.DeepEqual(view, expected) {
+					t.Errorf("injecting %s into %q (normalize %v): expected %v, got %v from %q", inject, current, normalize, expected, view, tag)
+				}
+				if len(newTagItems(tag)) != len(expected) {
+					t.Errorf("injecting %s into %q: expected every key once, got %q", inject, current, tag)
+				}
+			}
+		}
+	}
+}
+
+func TestInjectStructTagRoundTrip(t *testing.T) {
+	src, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{Observer: inject.NopObserver{}, XXXSkip: []string{"xml"}}
+	areas, err := parseSource(testInputFile, src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected, err := newInjector(opts).injectSource(testInputFile, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fields keep their order, so fields before and after injection are
+	// matched by index
+	before, after := fieldTags(t, src), fieldTags(t, injected)
+	if len(before) != len(after) {
+		t.Fatalf("expected %d fields after injection, got: %d", len(before), len(after))
+	}
+	for _, area := range areas {
+		i := 0
+		for i < len(before) && before[i].pos != area.Start {
+			i++
+		}
+		if i == len(before) {
+			t.Fatalf("no field at %d", area.Start)
+		}
+		var keys []string
+		for _, item := range append(newTagItems(area.CurrentTag), newTagItems(area.InjectTag)...) {
+			keys = append(keys, item.key)
+		}
+		expected := structTagView(before[i].tag, keys)
+		for _, item := range newTagItems(area.InjectTag) {
+			expected[item.key] = item.value[1 : len(item.value)-1]
+		}
+		if view := structTagView(after[i].tag, keys); !reflect.DeepEqual(view, expected) {
+			t.Errorf("field at %d: expected %v, got %v", area.Start, expected, view)
+		}
+	}
+}
+
+// sourceField is the position and tag of a struct field.
+type sourceField struct {
+	pos int
+	tag string
+}
+
+// fieldTags returns the struct fields of the Go source src, in order.
+func fieldTags(t *testing.T, src []byte) (fields []sourceField) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if structDecl, ok := node.(*ast.StructType); ok {
+			for _, field := range structDecl.Fields.List {
+				fields = append(fields, sourceField{pos: int(field.Pos()), tag: fieldTag(field)})
+			}
+		}
+		return true
+	})
+	return
+}
+
+func TestFilter(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	var out bytes.Buffer
+	if err := runFilter(options{Observer: inject.NopObserver{}}, strings.NewReader(src), &out); err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1); out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	out.Reset()
+	if err := runFilter(options{Observer: inject.NopObserver{}}, strings.NewReader("package"), &out); !errors.Is(err, inject.ErrParse) || out.Len() > 0 {
+		t.Errorf("expected inject.ErrParse and no output, got: %v, %q", err, out.String())
+	}
+}
+
+func TestOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	injected := strings.Replace(src, "`json:\"id\"`", "`json:\"id\" db:\"id\"`", 1)
+	for _, name := range []string{"gen/a/a.pb.go", "gen/b.pb.go"} {
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gen, out := filepath.Join(dir, "gen"), filepath.Join(dir, "out")
+	paths, err := inputPaths(gen, true, inputFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := outputPaths(out, []string{gen}, [][]string{paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(out, "a", "a.pb.go"); outputs[paths[0]] != expected {
+		t.Errorf("expected output %q, got: %q", expected, outputs[paths[0]])
+	}
+	if err = makeOutputDirs(outputs); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{Observer: inject.NopObserver{}, Outputs: outputs}
+	for run := 0; run < 2; run++ {
+		tx, err := newInjector(opts).injectFiles(paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed, _, _ := tx.summary(); changed != 2-2*run {
+			t.Errorf("run %d: expected %d changed file(s), got: %d", run, 2-2*run, changed)
+		}
+	}
+	for _, path := range paths {
+		if contents, _ := ioutil.ReadFile(path); string(contents) != src {
+			t.Errorf("%s: expected the input to be left alone, got:\n%s", path, contents)
+		}
+		if contents, _ := ioutil.ReadFile(outputs[path]); string(contents) != injected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", outputs[path], injected, contents)
+		}
+	}
+
+	file := filepath.Join(dir, "tagged.pb.go")
+	if outputs, err = outputPaths(file, []string{paths[0]}, [][]string{{paths[0]}}); err != nil || outputs[paths[0]] != file {
+		t.Errorf("expected a single input to be written to %q, got: %q (%v)", file, outputs, err)
+	}
+	if _, err = outputPaths(out, []string{paths[0], paths[1]}, [][]string{{paths[0]}, {paths[1]}}); err != nil {
+		t.Error(err)
+	}
+	if _, err = outputPaths(out, []string{paths[1], gen}, [][]string{{paths[1]}, {paths[0]}}); err != nil {
+		t.Error(err)
+	}
+	twin := filepath.Join(dir, "twin", "b.pb.go")
+	if _, err = outputPaths(out, []string{paths[1], twin}, [][]string{{paths[1]}, {twin}}); err == nil {
+		t.Error("expected an error for inputs written to the same output")
+	}
+
+	// the files of package patterns keep their path under the pattern
+	pattern := gen + "/..."
+	if paths, err = inputPaths(pattern, false, inputFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if outputs, err = outputPaths(out+"/", []string{pattern}, [][]string{paths}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/a.pb.go", "b.pb.go"} {
+		path, expected := filepath.Join(gen, filepath.FromSlash(name)), filepath.Join(out, filepath.FromSlash(name))
+		if outputs[path] != expected {
+			t.Errorf("%s: expected output %q, got: %q", path, expected, outputs[path])
+		}
+	}
+	if _, err = outputPaths(out, []string{filepath.Join(gen, "a")}, [][]string{{paths[1]}, {twin}}); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("expected an error for a file outside of its input, got: %v", err)
+	}
+}
+
+func TestGrammarValidate(t *testing.T) {
+	for _, comment := range []string{
+		`// @inject_tag: json:"id" db:"id"`,
+		`//inject:tag validate:"required"`,
+		`// @inject_tag: json:"x"; validate:"required" @inject_tag: db:"x"`,
+		`// @inject_tag_oneof: json:"kind"`,
+		`// @define: id = json:"{{.Name}}" db:"$prefix_id"`,
+		`// @inject_tag: $id validate:"oneof={{.EnumValues}}"`,
+		`// @inject_tag: gorm:"column:id;primaryKey"`,
+	} {
+		if err := grammar.Validate(comment); err != nil {
+			t.Errorf("%s: %v", comment, err)
+		}
+		if !isTagComment(comment) && !rDefine.MatchString(comment) && !rOneofComment.MatchString(comment) {
+			t.Errorf("%s: valid comment not recognized by the injector", comment)
+		}
+	}
+	for _, comment := range []string{
+		`// inject_tag: json:"id"`,
+		`// @inject_tag:`,
+		`// @inject_tag: json:"id`,
+		`// @inject_tag: json:id`,
+		`// @inject_tag: json:"{{.Name"`,
+		`// @define: id =`,
+	} {
+		if err := grammar.Validate(comment); err == nil {
+			t.Errorf("%s: expected an error", comment)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n\t// @inject_tag: db:\"name\"\n\tName string\n\tAge int `json:\"age\"`\n}\n"
+	tx := &transaction{observer: inject.NopObserver{}}
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: inject.NopObserver{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.stageSource("user.pb.go", []byte(src), areas); err != nil {
+		t.Fatal(err)
+	}
+	tx.files = append(tx.files, stagedFile{path: "new.pb.go", contents: []byte(src)}, stagedFile{path: "same.pb.go", original: []byte(src), contents: []byte(src)})
+	var buf bytes.Buffer
+	if changed := logDryRun(log.New(&buf, "", 0), tx.files); changed != 2 {
+		t.Errorf("expected 2 changed files, got: %d", changed)
+	}
+	expected := "user.pb.go:5: Id: would change `json:\"id\"` to `json:\"id\" db:\"id\"`\n" +
+		"user.pb.go:7: Name: would change no tag to `db:\"name\"`\n" +
+		"new.pb.go: would be written\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existing := filepath.Join(dir, "existing.pb.go")
+	if err = ioutil.WriteFile(existing, []byte("package pb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(dir, "created.pb.go")
+	files := []stagedFile{
+		{path: existing, original: []byte("package pb\n"), contents: []byte("package pb // injected\n")},
+		{path: created, contents: []byte("package pb\n")},
+	}
+	tx := &transaction{observer: inject.NopObserver{}, files: files}
+	if err = tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(existing); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the existing file to keep its mode 0600, got: %v (%v)", info.Mode(), err)
+	}
+	tx = &transaction{observer: inject.NopObserver{}, files: files, mode: 0640}
+	if err = os.Remove(created); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{existing, created} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("%s: expected mode 0640, got: %v (%v)", path, info.Mode(), err)
+		}
+	}
+
+	for chmod, expected := range map[string]os.FileMode{"0640": 0640, "600": 0600, "0": 0, "1777": 0, "rw-r--r--": 0} {
+		flags := cliFlags{chmod: chmod, diffFormat: diffUnified, versionPolicy: versionError, opts: options{TagLengthPolicy: tagLengthError}}
+		opts, err := flags.options()
+		if (err == nil) != (expected != 0) || opts.FileMode != expected {
+			t.Errorf("-chmod=%s: expected mode %v, got: %v (%v)", chmod, expected, opts.FileMode, err)
+		}
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user.pb.go")
+	small, large := []byte("package pb\n"), bytes.Repeat([]byte("// line\n"), 1<<16)
+	if err = ioutil.WriteFile(path, small, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// readers see the old contents or the new ones, never a part of them
+	done := make(chan struct{})
+	torn := make(chan []byte, 1)
+	go func() {
+		defer close(torn)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if contents, err := ioutil.ReadFile(path); err == nil && !bytes.Equal(contents, small) && !bytes.Equal(contents, large) {
+				torn <- contents
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		contents := small
+		if i%2 == 0 {
+			contents = large
+		}
+		if err = writeContents(path, contents, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if contents, ok := <-torn; ok {
+		t.Errorf("expected readers to see whole files, got %d bytes", len(contents))
+	}
+
+	// links are followed, the link itself being kept
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(dir, "link.pb.go")
+		if err = os.Symlink(path, link); err != nil {
+			t.Fatal(err)
+		}
+		if err = writeContents(link, []byte("package link\n"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %s to still be a link, got: %v (%v)", link, info.Mode(), err)
+		}
+		if contents, err := ioutil.ReadFile(path); err != nil || string(contents) != "package link\n" {
+			t.Errorf("expected the target of the link to be written, got: %q (%v)", contents, err)
+		}
+	}
+
+	// failed writes leave no temporary file behind
+	if err = os.Mkdir(filepath.Join(dir, "gen"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeContents(filepath.Join(dir, "gen"), small, 0); err == nil {
+		t.Error("expected an error writing over a directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("expected no temporary file left, got %s", entry.Name())
+		}
+	}
+}
+
+// warningObserver records the warnings of a run.
+type warningObserver struct {
+	inject.NopObserver
+	warnings []error
+}
+
+func (o *warningObserver) OnWarning(path string, err error) {
+	o.warnings = append(o.warnings, err)
+}
+
+func TestSoftFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "softfail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.pb.go")
+	bad := filepath.Join(dir, "vendor", "bad.pb.go")
+	if err = os.MkdirAll(filepath.Dir(bad), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	if err = ioutil.WriteFile(good, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(bad, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}}).stageFiles(bad, good); !errors.Is(err, inject.ErrParse) {
+		t.Fatalf("expected inject.ErrParse without -soft_fail, got: %v", err)
+	}
+	for _, pattern := range []string{"bad.pb.go", filepath.Join(dir, "vendor", "*"), "*.pb.go"} {
+		obs := &warningObserver{}
+		tx, err := newInjector(options{Observer: obs, SoftFail: []string{pattern}}).injectFiles(bad, good)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		if len(tx.files) != 1 || tx.files[0].path != good || len(obs.warnings) != 1 || !errors.Is(obs.warnings[0], inject.ErrParse) {
+			t.Errorf("%s: expected %q staged and a warning for %q, got: %d file(s), %v", pattern, good, bad, len(tx.files), obs.warnings)
+		}
+	}
+	if matchesGlob([]string{"vendor/*"}, good) {
+		t.Errorf("expected %q not to match vendor/*", good)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user.pb.go")
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{Observer: inject.NopObserver{}}
+	if status := runCheck(opts, path); status != 1 {
+		t.Errorf("expected exit status 1 for a file missing tags, got: %d", status)
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != src {
+		t.Error("expected -check to leave the file alone")
+	}
+	if _, err = newInjector(opts).injectFiles(path); err != nil {
+		t.Fatal(err)
+	}
+	if status := runCheck(opts, path); status != 0 {
+		t.Errorf("expected exit status 0 for an injected file, got: %d", status)
+	}
+	if status := runCheck(opts, filepath.Join(dir, "missing.pb.go")); status != 2 {
+		t.Errorf("expected exit status 2 on error, got: %d", status)
+	}
+}
+
+func TestChangedOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	run := func(args ...string) {
+		if _, err := git(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("init", "-q")
+	committed := write("committed.pb.go", "package pb\n")
+	modified := write("modified.pb.go", "package pb\n")
+	write(".gitignore", "ignored.pb.go\n")
+	run("add", ".")
+	run("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-qm", "initial")
+	write("modified.pb.go", "package pb // changed\n")
+	untracked := write("untracked.pb.go", "package pb\n")
+	ignored := write("ignored.pb.go", "package pb\n")
+
+	changed, err := changedFiles(dir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filterChanged([]string{committed, modified, untracked, ignored, "s3://bucket/a.pb.go"}, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{modified, untracked, "s3://bucket/a.pb.go"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths: %q, got: %q", expected, paths)
+	}
+	if _, err = changedFiles(dir, "no-such-ref"); err == nil {
+		t.Error("expected an error for an unknown ref")
+	}
+}
+
+func TestNestedOneof(t *testing.T) {
+	// message Outer { message Inner { oneof choice { string name = 1;
+	// Deep deep = 2; } message Deep { oneof kind { int32 id = 1; } } } },
+	// the case deep colliding with the message Outer.Inner.Deep.
+	src := "package pb\n\n" +
+		"type Outer_Inner struct {\n" +
+		"\t// @inject_tag_oneof: json:\"choice\"\n" +
+		"\t// @inject_tag_oneof: validate:\"required\"\n" +
+		"\tChoice isOuter_Inner_Choice `protobuf_oneof:\"choice\"`\n" +
+		"}\n\n" +
+		"type Outer_Inner_Deep struct {\n" +
+		"\t// @inject_tag_oneof: kind:\"yes\"\n" +
+		"\tKind isOuter_Inner_Deep_Kind `protobuf_oneof:\"kind\"`\n" +
+		"}\n\n" +
+		"type isOuter_Inner_Choice interface {\n\tisOuter_Inner_Choice()\n}\n\n" +
+		"type Outer_Inner_Name struct {\n" +
+		"\t// @inject_tag: db:\"name\"\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name,proto3,oneof\"`\n" +
+		"}\n\n" +
+		"type Outer_Inner_Deep_ struct {\n\tDeep *Outer_Inner_Deep `protobuf:\"bytes,2,opt,name=deep,proto3,oneof\"`\n}\n\n" +
+		"func (*Outer_Inner_Name) isOuter_Inner_Choice() {}\n\n" +
+		"func (*Outer_Inner_Deep_) isOuter_Inner_Choice() {}\n\n" +
+		"type isOuter_Inner_Deep_Kind interface {\n\tisOuter_Inner_Deep_Kind()\n}\n\n" +
+		"type Outer_Inner_Deep_Id struct {\n\tId int32 `protobuf:\"varint,1,opt,name=id,proto3,oneof\"`\n}\n\n" +
+		"func (*Outer_Inner_Deep_Id) isOuter_Inner_Deep_Kind() {}\n\n" +
+		"func init() {\n" +
+		"\tproto.RegisterType((*Outer_Inner)(nil), \"pb.Outer.Inner\")\n" +
+		"\tproto.RegisterType((*Outer_Inner_Deep)(nil), \"pb.Outer.Inner.Deep\")\n" +
+		"}\n"
+	// case fields are matched as fields of the message declaring the oneof
+	fieldTags := map[string]string{"pb.Outer.Inner.deep": `deep:"yes"`, "pb.Outer.Inner.Deep.id": `id:"yes"`}
+	injected, err := newInjector(options{Observer: inject.NopObserver{}, FieldTags: fieldTags}).injectSource("nested.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"Choice isOuter_Inner_Choice `protobuf_oneof:\"choice\"`",
+		"Kind isOuter_Inner_Deep_Kind `protobuf_oneof:\"kind\"`",
+		"Name string `protobuf:\"bytes,1,opt,name=name,proto3,oneof\" json:\"choice\" validate:\"required\" db:\"name\"`",
+		"Deep *Outer_Inner_Deep `protobuf:\"bytes,2,opt,name=deep,proto3,oneof\" deep:\"yes\" json:\"choice\" validate:\"required\"`",
+		"Id int32 `protobuf:\"varint,1,opt,name=id,proto3,oneof\" id:\"yes\" kind:\"yes\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(injected), expr) {
+			t.Errorf("expected file to contain %q", expr)
+		}
+	}
+	if t.Failed() {
+		t.Log(string(injected))
+	}
+
+	_, cases, err := oneofCases("nested.pb.go", injected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range cases {
+		names = append(names, c.Message+"."+c.Oneof+"="+c.Wrapper+"."+c.Field)
+	}
+	expected := []string{"Outer_Inner.Choice=Outer_Inner_Name.Name", "Outer_Inner.Choice=Outer_Inner_Deep_.Deep", "Outer_Inner_Deep.Kind=Outer_Inner_Deep_Id.Id"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected cases: %q, got: %q", expected, names)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n\t// @inject_tag:\n\tName string\n}\n"
+	for _, test := range []struct {
+		level    string
+		expected []string
+	}{
+		{inject.LogQuiet, nil},
+		{"", []string{"is injected with custom tags", "warning: "}},
+		{inject.LogVerbose, []string{"parsing file", "parsed file", "inject custom tag", "warning: ", "is injected with custom tags"}},
+	} {
+		path := filepath.Join(dir, "user.pb.go")
+		if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		if _, err = newInjector(options{LogLevel: test.level, Logger: log.New(&logs, "", 0)}).injectFiles(path); err != nil {
+			t.Fatal(err)
+		}
+		lines := splitLines(logs.Bytes())
+		if logs.Len() == 0 {
+			lines = nil
+		}
+		if len(lines) != len(test.expected) {
+			t.Errorf("level %q: expected %d line(s), got:\n%s", test.level, len(test.expected), logs.String())
+			continue
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(logs.String(), expected) {
+				t.Errorf("level %q: expected logs to contain %q, got:\n%s", test.level, expected, logs.String())
+			}
+		}
+	}
+}
+
+func TestFlatJSONOneof(t *testing.T) {
+	src := "package pb\n\n" +
+		"type Msg struct {\n" +
+		"\tKind string `protobuf:\"bytes,1,opt,name=kind,proto3\" json:\"kind,omitempty\"`\n" +
+		"\t// @inject_flat_json\n" +
+		"\tValue isMsg_Value `protobuf_oneof:\"value\"`\n" +
+		"\t// @inject_flat_json: omitempty,json_name\n" +
+		"\t// @inject_tag_oneof: validate:\"required\"\n" +
+		"\tOwner isMsg_Owner `protobuf_oneof:\"owner\"`\n" +
+		"}\n\n" +
+		"type isMsg_Value interface {\n\tisMsg_Value()\n}\n\n" +
+		"type isMsg_Owner interface {\n\tisMsg_Owner()\n}\n\n" +
+		"type Msg_FirstName struct {\n\tFirstName string `protobuf:\"bytes,2,opt,name=first_name,json=firstName,proto3,oneof\"`\n}\n\n" +
+		"type Msg_Id struct {\n" +
+		"\t// @inject_tag: json:\"identifier\"\n" +
+		"\tId int32 `protobuf:\"varint,3,opt,name=id,proto3,oneof\"`\n" +
+		"}\n\n" +
+		"type Msg_UserId struct {\n\tUserId string `protobuf:\"bytes,4,opt,name=user_id,json=userId,proto3,oneof\"`\n}\n\n" +
+		"func (*Msg_FirstName) isMsg_Value() {}\n\n" +
+		"func (*Msg_Id) isMsg_Value() {}\n\n" +
+		"func (*Msg_UserId) isMsg_Owner() {}\n"
+	injected, err := newInjector(options{Observer: inject.NopObserver{}}).injectSource("flat.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExprs := []string{
+		"Kind string `protobuf:\"bytes,1,opt,name=kind,proto3\" json:\"kind,omitempty\"`",
+		"Value isMsg_Value `protobuf_oneof:\"value\" json:\"-\"`",
+		"Owner isMsg_Owner `protobuf_oneof:\"owner\" json:\"-\"`",
+		"FirstName string `protobuf:\"bytes,2,opt,name=first_name,json=firstName,proto3,oneof\" json:\"first_name\"`",
+		// comments on the case fields take precedence
+		"Id int32 `protobuf:\"varint,3,opt,name=id,proto3,oneof\" json:\"identifier\"`",
+		"UserId string `protobuf:\"bytes,4,opt,name=user_id,json=userId,proto3,oneof\" json:\"userId,omitempty\" validate:\"required\"`",
+	}
+	for _, expr := range expectedExprs {
+		if !strings.Contains(string(injected), expr) {
+			t.Errorf("expected file to contain %q", expr)
+		}
+	}
+	if t.Failed() {
+		t.Log(string(injected))
+	}
+
+	invalid := strings.Replace(src, "@inject_flat_json: omitempty,json_name", "@inject_flat_json: camel", 1)
+	if _, err = newInjector(options{Observer: inject.NopObserver{}}).injectSource("flat.pb.go", []byte(invalid)); err == nil || !strings.Contains(err.Error(), "camel") {
+		t.Errorf("expected an error for an unknown option, got: %v", err)
+	}
+	proto := "message Msg {\n  // @inject_flat_json\n  oneof value {\n    // @inject_flat_json\n    string name = 1;\n  }\n}\n"
+	if lints, expected := lintProtoSource([]byte(proto)), []protoLint{{4, "@inject_flat_json annotation not on a oneof"}}; !reflect.DeepEqual(lints, expected) {
+		t.Errorf("expected lints: %+v, got: %+v", expected, lints)
+	}
+	for comment, valid := range map[string]bool{"// @inject_flat_json": true, "// @inject_flat_json: omitempty": true, "// @inject_flat_json: camel": false} {
+		if err := grammar.Validate(comment); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got: %v", comment, valid, err)
+		}
+	}
+}
+
+func TestOneofMarshalers(t *testing.T) {
+	src := "package pb\n\n" +
+		"type Msg struct {\n" +
+		"\tKind string `protobuf:\"bytes,1,opt,name=kind,proto3\" json:\"kind,omitempty\"`\n" +
+		"\t// @inject_flat_json: json_name\n" +
+		"\tValue isMsg_Value `protobuf_oneof:\"value\"`\n" +
+		"\tOther isMsg_Other `protobuf_oneof:\"other\"`\n" +
+		"}\n\n" +
+		"type isMsg_Value interface {\n\tisMsg_Value()\n}\n\n" +
+		"type isMsg_Other interface {\n\tisMsg_Other()\n}\n\n" +
+		"type Msg_FirstName struct {\n\tFirstName string `protobuf:\"bytes,2,opt,name=first_name,json=firstName,proto3,oneof\"`\n}\n\n" +
+		"type Msg_Id struct {\n\tId int32 `protobuf:\"varint,3,opt,name=id,proto3,oneof\"`\n}\n\n" +
+		"type Msg_Other struct {\n\tOther string `protobuf:\"bytes,4,opt,name=other,proto3,oneof\"`\n}\n\n" +
+		"func (*Msg_FirstName) isMsg_Value() {}\n\n" +
+		"func (*Msg_Id) isMsg_Value() {}\n\n" +
+		"func (*Msg_Other) isMsg_Other() {}\n"
+	if err := ioutil.WriteFile(testInputFileTemp, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testInputFileTemp)
+	marshalersPath := testInputFileTemp + "_json"
+	tx, err := newInjector(options{Observer: inject.NopObserver{}, OneofMarshalers: marshalersPath}).stageFiles(testInputFileTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.files) != 2 || tx.files[1].path != marshalersPath {
+		t.Fatalf("expected the marshalers file to be staged after the input, got: %v", tx.files)
+	}
+	marshalers := string(tx.files[1].contents)
+	if _, err = parser.ParseFile(token.NewFileSet(), marshalersPath, marshalers, 0); err != nil {
+		t.Fatalf("expected valid Go source, got: %v\n%s", err, marshalers)
+	}
+	for _, expected := range []string{
+		"package pb\n",
+		"func (m *Msg) MarshalJSON() ([]byte, error) {\n",
+		"func (m *Msg) UnmarshalJSON(data []byte) error {\n",
+		"if fields[\"firstName\"], err = json.Marshal(v.FirstName); err != nil {\n",
+		"if raw, ok := fields[\"id\"]; ok {\n",
+		"\t\tm.Value = v\n",
+	} {
+		if !strings.Contains(marshalers, expected) {
+			t.Errorf("expected marshalers to contain %q, got:\n%s", expected, marshalers)
+		}
+	}
+	// oneofs without @inject_flat_json are left to encoding/json
+	if strings.Contains(marshalers, "m.Other") {
+		t.Errorf("expected no marshaling of the other oneof, got:\n%s", marshalers)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonlogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user.pb.go")
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n\t// @inject_tag:\n\tName string\n}\n"
+	if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	opts := options{LogFormat: logFormatJSON, LogLevel: inject.LogVerbose, Trace: true, Logger: log.New(&logs, "prefix ", log.LstdFlags)}
+	if _, err = newInjector(opts).injectFiles(path); err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range splitLines(logs.Bytes()) {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected a JSON object, got: %q (%v)", line, err)
+		}
+		if _, ok := event["time"].(string); !ok {
+			t.Errorf("expected a time, got: %q", line)
+		}
+		action, _ := event["action"].(string)
+		switch action {
+		case "log":
+			// traces
+			continue
+		case "inject":
+			if event["field"] != "Id" || event["tag"] != `db:"id"` {
+				t.Errorf("unexpected inject event: %q", line)
+			}
+		case "warning":
+			if event["field"] != "User.Name" || !strings.Contains(event["message"].(string), inject.ErrNoTag.Error()) {
+				t.Errorf("unexpected warning event: %q", line)
+			}
+		}
+		if event["file"] != path {
+			t.Errorf("expected file %q, got: %q", path, line)
+		}
+		actions = append(actions, action)
+	}
+	if expected := []string{"parse", "warning", "parsed", "inject", "write"}; !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected actions: %q, got: %q", expected, actions)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	changed, unchanged := filepath.Join(dir, "changed.pb.go"), filepath.Join(dir, "unchanged.pb.go")
+	for _, path := range []string{changed, unchanged} {
+		if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}}).injectFiles(unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newInjector(options{Observer: inject.NopObserver{}, Backup: true}).injectFiles(changed, unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(changed + ".orig"); err != nil || string(contents) != src {
+		t.Errorf("expected the backup to hold the original contents, got: %q (%v)", contents, err)
+	}
+	if _, err = os.Stat(unchanged + ".orig"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup of an unchanged file, got: %v", err)
+	}
+}
+
+func TestLastRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	user, group := filepath.Join(dir, "user.pb.go"), filepath.Join(dir, "group.pb.go")
+	report := filepath.Join(dir, "last_run.json")
+	run := func(sources map[string]string) string {
+		t.Helper()
+		var paths []string
+		for path, src := range sources {
+			if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+		var logs bytes.Buffer
+		opts := options{Observer: inject.NopObserver{}, Logger: log.New(&logs, "", 0)}
+		tx, err := newInjector(opts).injectFiles(paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = reportLastRun(report, tx.files, opts); err != nil {
+			t.Fatal(err)
+		}
+		return logs.String()
+	}
+
+	logs := run(map[string]string{
+		user:  "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string\n\t// @inject_tag: db:\"name\"\n\tName string\n}\n",
+		group: "package pb\n\ntype Group struct {\n\t// @inject_tag: db:\"id\"\n\tId string\n}\n",
+	})
+	if !strings.Contains(logs, "no last run") {
+		t.Errorf("expected the first run to be recorded, got:\n%s", logs)
+	}
+	os.Remove(group)
+	logs = run(map[string]string{
+		user: "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"user_id\"\n\tId string\n\tName string\n\t// @inject_tag: db:\"email\"\n\tEmail string\n}\n",
+	})
+	expected := "4 change(s) since the last run\n" +
+		group + ": file dropped\n" +
+		user + ": User.Email: new db:\"email\"\n" +
+		user + ": User.Id: db changed from \"id\" to \"user_id\"\n" +
+		user + ": User.Name: removed db:\"name\"\n"
+	if logs != expected {
+		t.Errorf("expected logs:\n%s\ngot:\n%s", expected, logs)
+	}
+	if logs = run(map[string]string{user: "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"user_id\"\n\tId string\n\tName string\n\t// @inject_tag: db:\"email\"\n\tEmail string\n}\n"}); logs != "0 change(s) since the last run\n" {
+		t.Errorf("expected no changes for the same run, got:\n%s", logs)
+	}
+}
+
+func TestFieldNumberTags(t *testing.T) {
+	src := "package pb\n\nimport proto \"github.com/golang/protobuf/proto\"\n\n" +
+		"type User struct {\n" +
+		"\tEmailAddress string `protobuf:\"bytes,3,opt,name=email_address,json=emailAddress,proto3\" json:\"email_address,omitempty\"`\n" +
+		"\tName string `protobuf:\"bytes,4,opt,name=name,proto3\" json:\"name,omitempty\"`\n" +
+		"}\n\n" +
+		"func init() {\n\tproto.RegisterType((*User)(nil), \"acme.v1.User\")\n}\n"
+	obs := &warningObserver{}
+	fieldNumberTags := map[string]string{"acme.v1.User.3": `validate:"email"`, "acme.v1.User.5": `db:"age"`, "acme.v1.Group.1": `db:"id"`}
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: obs, FieldNumberTags: fieldNumberTags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the field renamed from email keeps its rule
+	if len(areas) != 1 || areas[0].InjectTag != `validate:"email"` {
+		t.Errorf("expected validate:\"email\" to be injected by number, got: %+v", areas)
+	}
+	// rules of messages missing from the file may match elsewhere
+	if len(obs.warnings) != 1 || !strings.Contains(obs.warnings[0].Error(), "-field_number_tag acme.v1.User.5 matches no field") {
+		t.Errorf("expected the orphaned rule to be reported, got: %v", obs.warnings)
+	}
+	for _, invalid := range []string{"acme.v1.User.email", "acme.v1.User.0", "3"} {
+		flags := cliFlags{fieldNumberTags: tagTable{invalid: `db:"x"`}, diffFormat: diffUnified, versionPolicy: versionError, opts: options{TagLengthPolicy: tagLengthError}}
+		if _, err = flags.options(); err == nil || !strings.Contains(err.Error(), "-field_number_tag") {
+			t.Errorf("%s: expected an error for an invalid -field_number_tag, got: %v", invalid, err)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultConfigFile)
+	config := "# shared by the Makefile and CI\n" +
+		"input:\n" +
+		"  - ./gen\n" +
+		"  - './third_party/gen' # vendored\n" +
+		"recursive: true\n" +
+		"exclude:\n" +
+		"- \"*_mock.pb.go\"\n" +
+		"XXX_skip: yaml,xml\n" +
+		"field_tag:\n" +
+		"  - acme.v1.User.email=validate:\"email\"\n" +
+		"key_prefix: x_\n"
+	if err = ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var flags cliFlags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.register(fs)
+	if err = fs.Parse([]string{"-key_prefix=y_"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = applyConfigFile(fs, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (inputList{"./gen", "./third_party/gen"}); !reflect.DeepEqual(flags.input, expected) {
+		t.Errorf("expected inputs: %q, got: %q", expected, flags.input)
+	}
+	if expected := (inputList{"*_mock.pb.go"}); !flags.recursive || !reflect.DeepEqual(flags.exclude, expected) {
+		t.Errorf("expected -recursive and excludes %q, got: %v %q", expected, flags.recursive, flags.exclude)
+	}
+	if flags.xxxTags != "yaml,xml" || flags.fieldTags.String() != `acme.v1.User.email=validate:"email"` {
+		t.Errorf("expected XXX_skip and field_tag to be set, got: %q %q", flags.xxxTags, flags.fieldTags.String())
+	}
+	// the command line takes precedence
+	if value := fs.Lookup("key_prefix").Value.String(); value != "y_" {
+		t.Errorf("expected the command line -key_prefix, got: %q", value)
+	}
+	// even when given by a shorthand, or set by the environment
+	for _, args := range [][]string{{"-r"}, {"-recursive"}} {
+		var flags cliFlags
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		flags.register(fs)
+		if err = fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err = applyEnv(fs, []string{envPrefix + "R=false"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte("recursive: false\nr: false\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = applyConfigFile(fs, path, true); err != nil {
+			t.Fatal(err)
+		}
+		if !flags.recursive {
+			t.Errorf("%s: expected -recursive to be kept", args[0])
+		}
+	}
+
+	if err = applyConfigFile(flag.NewFlagSet("", flag.ContinueOnError), filepath.Join(dir, "missing.yaml"), false); err != nil {
+		t.Errorf("expected a missing optional config file to be ignored, got: %v", err)
+	}
+	if err = applyConfigFile(flag.NewFlagSet("", flag.ContinueOnError), filepath.Join(dir, "missing.yaml"), true); err == nil {
+		t.Error("expected an error for a missing -config file")
+	}
+	for _, invalid := range []string{"inputs: ./gen\n", "recursive:\n  - true\n", "input: [./gen]\n", "input:\n", "  recursive: true\n", "input: \"./gen\n"} {
+		var flags cliFlags
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		flags.register(fs)
+		if err = ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = applyConfigFile(fs, path, true); err == nil || !strings.HasPrefix(err.Error(), path+":") {
+			t.Errorf("%q: expected an error with its line, got: %v", invalid, err)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = parseSource("broken.pb.go", []byte("package pb\n\ntype User struct {\n"), options{Observer: inject.NopObserver{}})
+	if status := exitStatus(err, 1); status != exitParse {
+		t.Errorf("expected exit status %d for a parse error, got: %d (%v)", exitParse, status, err)
+	}
+	_, err = parseSource("user.pb.go", []byte("package pb\n\ntype User struct {\n\t// @inject_tag: db:id\n\tId string\n}\n"), options{Observer: inject.NopObserver{}})
+	if status := exitStatus(err, 1); status != exitParse {
+		t.Errorf("expected exit status %d for an invalid tag, got: %d (%v)", exitParse, status, err)
+	}
+	tx := &transaction{observer: inject.NopObserver{}, files: []stagedFile{{path: filepath.Join(dir, "missing", "user.pb.go"), contents: []byte("package pb\n")}}}
+	if err = tx.commit(); exitStatus(err, 1) != exitWrite {
+		t.Errorf("expected exit status %d for a write error, got: %d (%v)", exitWrite, exitStatus(err, 1), err)
+	}
+	for _, input := range []string{filepath.Join(dir, "missing"), dir} {
+		if _, err = inputPaths(input, true, inputFilter{}); exitStatus(err, 1) != exitNoInput {
+			t.Errorf("%s: expected exit status %d without input files, got: %d (%v)", input, exitNoInput, exitStatus(err, 1), err)
+		}
+	}
+	if status := exitStatus(errors.New("invalid flag"), 2); status != 2 {
+		t.Errorf("expected the fallback exit status for other errors, got: %d", status)
+	}
+
+	// annotations outside the doc comment of a field match nothing
+	src := "package pb\n\n" +
+		"// @inject_tag: db:\"users\"\n" +
+		"type User struct {\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string\n" +
+		"\tName string // @inject_tag: db:\"name\"\n" +
+		"}\n"
+	matches := &inject.StatsObserver{Observer: inject.NopObserver{}}
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: matches})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 1 || matches.NoMatch != 2 || runStatus(matches) != exitNoMatch {
+		t.Errorf("expected 1 area and 2 stray annotations, got: %d area(s), %d", len(areas), matches.NoMatch)
+	}
+	if matches = (&inject.StatsObserver{Observer: inject.NopObserver{}}); runStatus(matches) != 0 {
+		t.Errorf("expected exit status 0 when everything matched, got: %d", runStatus(matches))
+	}
+}
+
+func TestJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("m%02d.pb.go", i))
+		src := fmt.Sprintf("package pb\n\ntype M%d struct {\n\t// @inject_tag: db:\"id_%d\"\n\tId string\n}\n", i, i)
+		if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	serial, err := newInjector(options{Observer: inject.NopObserver{}, Jobs: 1}).stageFiles(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := &warningObserver{}
+	parallel, err := newInjector(options{Observer: obs, Jobs: 4}).stageFiles(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(serial.files, parallel.files) {
+		t.Error("expected the same files staged in the same order with -jobs")
+	}
+
+	// the files before the first failure are staged, as without -jobs
+	if err = ioutil.WriteFile(paths[10], []byte("package pb\n\ntype M struct {\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := newInjector(options{Observer: inject.NopObserver{}, Jobs: 4}).stageFiles(paths...)
+	if !errors.Is(err, inject.ErrParse) || !strings.Contains(err.Error(), "m10.pb.go") {
+		t.Errorf("expected the parse error of m10.pb.go, got: %v", err)
+	}
+	if len(tx.files) != 10 || tx.files[9].path != paths[9] {
+		t.Errorf("expected the 10 files before the failure to be staged, got: %d", len(tx.files))
+	}
+	flags := cliFlags{diffFormat: diffUnified, versionPolicy: versionError, opts: options{TagLengthPolicy: tagLengthError, Jobs: -1}}
+	if _, err = flags.options(); err == nil || !strings.Contains(err.Error(), "-jobs") {
+		t.Errorf("expected an error for a negative -jobs, got: %v", err)
+	}
+}
+
+func TestAllowedKeys(t *testing.T) {
+	src := "package pb\n\n" +
+		"type User struct {\n" +
+		"\t// @inject_tag: db:\"id\" validate:\"required\"\n" +
+		"\tId string\n" +
+		"\t// @inject_tag: xml:\"name\"\n" +
+		"\tName string\n" +
+		"}\n"
+	allowed := []string{"json", "db", "validate"}
+	_, err := parseSource("user.pb.go", []byte(src), options{Observer: inject.NopObserver{}, AllowedKeys: allowed})
+	if !errors.Is(err, inject.ErrKeyNotAllowed) || !strings.Contains(err.Error(), "User.Name") || !strings.Contains(err.Error(), "json, db, validate") {
+		t.Errorf("expected an error for the xml key listing the allowed keys, got: %v", err)
+	}
+	// global rules aren't restricted
+	valid := strings.Replace(src, "xml:\"name\"", "json:\"name\"", 1)
+	valid = strings.Replace(valid, "\tName string\n", "\tName string\n\tXXX_sizecache int32\n", 1)
+	areas, err := parseSource("user.pb.go", []byte(valid), options{Observer: inject.NopObserver{}, AllowedKeys: allowed, XXXSkip: []string{"xml"}})
+	if err != nil || len(areas) != 3 {
+		t.Errorf("expected allowed keys to be injected, got: %+v (%v)", areas, err)
+	}
+	if _, err = lenientAreas("user.pb.go", []byte(src), options{AllowedKeys: allowed}); !errors.Is(err, inject.ErrKeyNotAllowed) {
+		t.Errorf("expected -lenient to enforce allowed keys, got: %v", err)
+	}
+}
+
+func TestRuleOwners(t *testing.T) {
+	owners, err := parseRuleOwners("OWNERS", []byte("# platform rules apply anywhere unowned\n"+
+		"acme.billing.* field_tag\n"+
+		"acme.billing.v1.Invoice -XXX_skip\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := "package pb\n\nimport proto \"github.com/golang/protobuf/proto\"\n\n" +
+		"type Invoice struct {\n" +
+		"\tTotal int64 `protobuf:\"varint,1,opt,name=total,proto3\" json:\"total,omitempty\"`\n" +
+		"\tXXX_sizecache int32 `json:\"-\"`\n" +
+		"}\n\n" +
+		"type Refund struct {\n" +
+		"\tTotal int64 `protobuf:\"varint,1,opt,name=total,proto3\" json:\"total,omitempty\"`\n" +
+		"\tXXX_sizecache int32 `json:\"-\"`\n" +
+		"}\n\n" +
+		"type User struct {\n" +
+		"\tXXX_sizecache int32 `json:\"-\"`\n" +
+		"}\n\n" +
+		"func init() {\n" +
+		"\tproto.RegisterType((*Invoice)(nil), \"acme.billing.v1.Invoice\")\n" +
+		"\tproto.RegisterType((*Refund)(nil), \"acme.billing.v1.Refund\")\n" +
+		"\tproto.RegisterType((*User)(nil), \"acme.users.v1.User\")\n" +
+		"}\n"
+	obs := &warningObserver{}
+	opts := options{
+		Observer:   obs,
+		RuleOwners: owners,
+		XXXSkip:    []string{"yaml"},
+		FieldTags:  map[string]string{"acme.billing.v1.Invoice.total": `db:"total"`, "acme.billing.v1.Refund.total": `db:"total"`},
+	}
+	areas, err := parseSource("billing.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last matching line decides: Invoice only grants -XXX_skip,
+	// Refund only -field_tag and User is unowned
+	var injected []string
+	for _, area := range areas {
+		injected = append(injected, strings.Fields(src[area.Start-1:])[0]+" "+area.InjectTag)
+	}
+	expected := []string{"XXX_sizecache yaml:\"-\"", "Total db:\"total\"", "XXX_sizecache yaml:\"-\""}
+	if !reflect.DeepEqual(injected, expected) {
+		t.Errorf("expected injections: %q, got: %q", expected, injected)
+	}
+	if len(obs.warnings) != 2 || !strings.Contains(obs.warnings[0].Error(), "-field_tag isn't granted on acme.billing.v1.Invoice") ||
+		!strings.Contains(obs.warnings[1].Error(), "-XXX_skip isn't granted on acme.billing.v1.Refund") {
+		t.Errorf("expected the denied rules to be reported once, got: %v", obs.warnings)
+	}
+	if _, err = parseRuleOwners("OWNERS", []byte("acme.* json_tag\n")); err == nil || !strings.Contains(err.Error(), "OWNERS:1") {
+		t.Errorf("expected an error for an unknown rule, got: %v", err)
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sources := map[string]string{
+		"user.pb.go":  "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string\n\t// @inject_tag: db:\"name\"\n\tName string\n\t// @inject_tag:\n\tNick string\n}\n",
+		"group.pb.go": "package pb\n\ntype Group struct {\n\tId string\n}\n",
+	}
+	var paths []string
+	for name, src := range sources {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	stats := &inject.StatsObserver{Observer: inject.NopObserver{}}
+	tx, err := newInjector(options{Observer: stats}).injectFiles(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2 file(s) scanned in 1.5s: 1 changed, 0 annotated but unchanged, 1 without annotations; 2 field(s) injected, 1 annotation(s) skipped"
+	if summary := runSummary(stats, tx, 1500*time.Millisecond); summary != expected {
+		t.Errorf("expected summary:\n%s\ngot:\n%s", expected, summary)
+	}
+}
+
+func BenchmarkFieldRules(b *testing.B) {
+	var src strings.Builder
+	src.WriteString("package pb\n\nimport proto \"github.com/golang/protobuf/proto\"\n\n")
+	fieldTags := map[string]string{}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&src, "type M%d struct {\n", i)
+		for j := 1; j <= 10; j++ {
+			fmt.Fprintf(&src, "\t// @inject_tag: msgp:\"{{.FieldNumber}}\"\n\tF%d string `protobuf:\"bytes,%d,opt,name=f%d,proto3\"`\n", j, j, j)
+		}
+		src.WriteString("}\n\n")
+		fmt.Fprintf(&src, "func init() {\n\tproto.RegisterType((*M%d)(nil), \"acme.v1.M%d\")\n}\n\n", i, i)
+		// 400 rules, on half of the messages
+		if i%2 == 0 {
+			for j := 1; j <= 4; j++ {
+				fieldTags[fmt.Sprintf("acme.v1.M%d.f%d", i, j)] = `db:"f"`
+			}
+		}
+	}
+	opts := options{Observer: inject.NopObserver{}, FieldTags: fieldTags, XXXSkip: []string{"yaml"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseSource("bench.pb.go", []byte(src.String()), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRuleIndex(t *testing.T) {
+	ruled := fieldRuleMessages(options{
+		FieldTags:       map[string]string{"acme.v1.User.email": `validate:"email"`},
+		FieldNumberTags: map[string]string{"acme.v1.Order.3": `db:"total"`},
+	})
+	if !reflect.DeepEqual(ruled, map[string]bool{"acme.v1.User": true, "acme.v1.Order": true}) {
+		t.Errorf("fieldRuleMessages = %v", ruled)
+	}
+
+	const tag = `msgp:"{{.FieldNumber}}"`
+	for number, want := range map[int]string{1: `msgp:"1"`, 7: `msgp:"7"`} {
+		got, err := renderTag(tag, fieldData{FieldNumber: number})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("renderTag(%d) = %s, want %s", number, got, want)
+		}
+	}
+	tagTemplates.RLock()
+	_, ok := tagTemplates.m[tag]
+	tagTemplates.RUnlock()
+	if !ok {
+		t.Errorf("template %s not cached", tag)
+	}
+}
+
+func TestInjectionReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	user, group := filepath.Join(dir, "user.pb.go"), filepath.Join(dir, "group.pb.go")
+	sources := map[string]string{
+		user:  "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n\tName string\n\t// @inject_tag: db:\"email\"\n\tEmail string\n}\n",
+		group: "package pb\n\ntype Group struct {\n\tId string\n}\n",
+	}
+	for path, src := range sources {
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := newInjector(options{Observer: inject.NopObserver{}}).injectFiles(user, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "report.json")
+	if err = writeInjectionReport(path, tx.files); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report injectionReport
+	if err = json.Unmarshal(contents, &report); err != nil {
+		t.Fatal(err)
+	}
+	expected := []injectionRow{
+		{File: user, Struct: "User", Field: "Id", OldTag: `json:"id"`, NewTag: `json:"id" db:"id"`},
+		{File: user, Struct: "User", Field: "Email", OldTag: "", NewTag: `db:"email"`},
+	}
+	if !reflect.DeepEqual(report.Injections, expected) {
+		t.Errorf("expected injections %+v, got %+v", expected, report.Injections)
+	}
+
+	// with -output to a new directory, tags are compared to the inputs
+	for path, src := range sources {
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+	outputs, err := outputPaths(out, []string{user, group}, [][]string{{user}, {group}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = makeOutputDirs(outputs); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = newInjector(options{Observer: inject.NopObserver{}, Outputs: outputs}).injectFiles(user, group); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = newInjectionReport(tx.files); err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		expected[i].File = filepath.ToSlash(filepath.Join(out, "user.pb.go"))
+	}
+	if !reflect.DeepEqual(report.Injections, expected) {
+		t.Errorf("expected -output injections %+v, got %+v", expected, report.Injections)
+	}
+}
+
+func TestReportPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	repo, other := filepath.Join(dir, "repo"), filepath.Join(dir, "other")
+	for _, sub := range []string{filepath.Join(repo, ".git"), filepath.Join(repo, "api", "gen"), filepath.Join(other, "gen")} {
+		if err = os.MkdirAll(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// in a work tree, paths are relative to its top
+	if err = os.Chdir(filepath.Join(repo, "api")); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		filepath.Join("gen", "user.pb.go"):              "api/gen/user.pb.go",
+		"." + string(filepath.Separator) + "gen":        "api/gen",
+		filepath.Join(repo, "api", "gen", "user.pb.go"): "api/gen/user.pb.go",
+		filepath.Join(other, "gen", "user.pb.go"):       filepath.ToSlash(filepath.Join(other, "gen", "user.pb.go")),
+		"s3://bucket/gen/user.pb.go":                    "s3://bucket/gen/user.pb.go",
+		filepath.Join("..", "..", "other", "x.pb.go"):   filepath.ToSlash(filepath.Join(other, "x.pb.go")),
+	} {
+		if actual := reportPath(path); actual != expected {
+			t.Errorf("%s: expected %s, got: %s", path, expected, actual)
+		}
+	}
+
+	// elsewhere, relative to the current directory
+	if err = os.Chdir(other); err != nil {
+		t.Fatal(err)
+	}
+	if actual := reportPath(filepath.Join(other, "gen", "user.pb.go")); actual != "gen/user.pb.go" {
+		t.Errorf("expected gen/user.pb.go, got: %s", actual)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, empty := filepath.Join(dir, "user.pb.go"), filepath.Join(dir, "empty.pb.go")
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"`\n}\n"
+	if err = ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := parseFile(path, options{Observer: inject.NopObserver{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	areas, err := parseFile(path, options{Observer: inject.NopObserver{}, Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(areas, expected) {
+		t.Errorf("expected areas %+v, got %+v", expected, areas)
+	}
+
+	// the mapped contents are staged, copied as they outlive the mapping
+	tx, err := newInjector(options{Observer: inject.NopObserver{}, Mmap: true}).stageFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.files) != 1 || string(tx.files[0].original) != src || !tx.files[0].changed() {
+		t.Errorf("expected %s staged with its contents and changed, got: %+v", path, tx.files)
+	}
+
+	// empty files can't be mapped and are read instead
+	contents, release, err := readMapped(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != 0 {
+		t.Errorf("expected no contents, got %q", contents)
+	}
+	if err = release(); err != nil {
+		t.Error(err)
+	}
+}
+
+// interruptObserver interrupts the run when the first file is parsed.
+type interruptObserver struct {
+	inject.NopObserver
+	interrupt chan struct{}
+}
+
+func (o interruptObserver) OnFileParsed(path string, areas []textArea) {
+	select {
+	case <-o.interrupt:
+	default:
+		close(o.interrupt)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string\n}\n"
+	var paths []string
+	for _, name := range []string{"a.pb.go", "b.pb.go", "c.pb.go"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	interrupt := make(chan struct{})
+	opts := options{Observer: interruptObserver{interrupt: interrupt}, Jobs: 1, Interrupt: interrupt, SoftFail: []string{"*"}}
+	_, err = newInjector(opts).injectFiles(paths...)
+	if !errors.Is(err, inject.ErrInterrupted) {
+		t.Fatalf("expected inject.ErrInterrupted, got: %v", err)
+	}
+	if status := exitStatus(err, 1); status != exitInterrupted {
+		t.Errorf("expected exit status %d, got: %d", exitInterrupted, status)
+	}
+	if expected := "interrupted after staging 1 of 3 file(s), nothing written"; err.Error() != expected {
+		t.Errorf("expected error %q, got: %q", expected, err)
+	}
+	for _, path := range paths {
+		if contents, err := ioutil.ReadFile(path); err != nil || string(contents) != src {
+			t.Errorf("%s: expected the file untouched, got %q (%v)", path, contents, err)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	var flags cliFlags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.register(fs)
+	if err := fs.Parse([]string{"-key_prefix=y_"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"HOME=/root",
+		"INJECT_TAG_INPUT=./gen,./third_party/gen",
+		"INJECT_TAG_XXX_SKIP=yaml,xml",
+		"INJECT_TAG_FIELD_TAG=acme.v1.User.email=validate:\"email\"\nacme.v1.User.id=db:\"id\"",
+		"INJECT_TAG_RECURSIVE=true",
+		"INJECT_TAG_KEY_PREFIX=x_",
+		"INJECT_TAG_OUTPUT=",
+	}
+	if err := applyEnv(fs, environ); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (inputList{"./gen", "./third_party/gen"}); !reflect.DeepEqual(flags.input, expected) {
+		t.Errorf("expected inputs: %q, got: %q", expected, flags.input)
+	}
+	if expected := (tagTable{"acme.v1.User.email": `validate:"email"`, "acme.v1.User.id": `db:"id"`}); !reflect.DeepEqual(flags.fieldTags, expected) {
+		t.Errorf("expected field tags: %q, got: %q", expected, flags.fieldTags)
+	}
+	if !flags.recursive || flags.xxxTags != "yaml,xml" || flags.output != "" {
+		t.Errorf("expected -recursive and -XXX_skip to be set, got: %v %q %q", flags.recursive, flags.xxxTags, flags.output)
+	}
+	// the command line takes precedence
+	if flags.opts.KeyPrefix != "y_" {
+		t.Errorf("expected the -key_prefix of the command line, got: %q", flags.opts.KeyPrefix)
+	}
+	// and the environment over the config file
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultConfigFile)
+	if err = ioutil.WriteFile(path, []byte("XXX_skip: toml\nmax_edits: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = applyConfigFile(fs, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if flags.xxxTags != "yaml,xml" || flags.opts.MaxEdits != 5 {
+		t.Errorf("expected -XXX_skip of the environment and -max_edits of the config file, got: %q %d", flags.xxxTags, flags.opts.MaxEdits)
+	}
+
+	err = applyEnv(flag.NewFlagSet("", flag.ContinueOnError), []string{"INJECT_TAG_RECURSVE=true"})
+	if err == nil || !strings.Contains(err.Error(), "INJECT_TAG_RECURSVE") {
+		t.Errorf("expected an error for an unknown variable, got: %v", err)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	saved := version
+	defer func() { version = saved }()
+	version = "v1.4.0"
+	binary := []byte("#!/bin/sh\necho v1.5.0\n")
+	sum := sha256.Sum256(binary)
+	checksums := hex.EncodeToString(sum[:]) + "  " + binaryAsset(runtime.GOOS, runtime.GOARCH) + "\n"
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/releases", func(w http.ResponseWriter, r *http.Request) {
+		asset := func(name string) string {
+			return fmt.Sprintf(`{"name": %q, "browser_download_url": %q}`, name, server.URL+"/"+name)
+		}
+		fmt.Fprintf(w, `[
+			{"tag_name": "v2.0.0", "assets": []},
+			{"tag_name": "v1.6.0-rc.1", "prerelease": true, "assets": []},
+			{"tag_name": "v1.5.0", "assets": [%s, %s]},
+			{"tag_name": "v1.3.0", "assets": []}
+		]`, asset(binaryAsset(runtime.GOOS, runtime.GOARCH)), asset(checksumsAsset))
+	})
+	mux.HandleFunc("/"+binaryAsset(runtime.GOOS, runtime.GOARCH), func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+	mux.HandleFunc("/"+checksumsAsset, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, checksums)
+	})
+
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "protoc-go-inject-tag")
+	if err = ioutil.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err = selfUpdate(&out, server.URL+"/releases", exe, true); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "protoc-go-inject-tag v1.5.0 is available, " + version + " installed\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	// a binary not matching its checksum is refused
+	checksums = strings.Repeat("0", 64) + "  " + binaryAsset(runtime.GOOS, runtime.GOARCH) + "\n"
+	if err = selfUpdate(&out, server.URL+"/releases", exe, false); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum error, got: %v", err)
+	}
+	if contents, _ := ioutil.ReadFile(exe); string(contents) != "old" {
+		t.Errorf("expected the executable untouched, got %q", contents)
+	}
+
+	checksums = hex.EncodeToString(sum[:]) + " *" + binaryAsset(runtime.GOOS, runtime.GOARCH) + "\n"
+	if err = selfUpdate(&out, server.URL+"/releases", exe, false); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(exe); !bytes.Equal(contents, binary) {
+		t.Errorf("expected the executable replaced, got %q", contents)
+	}
+	if _, err = os.Stat(exe + ".new"); !os.IsNotExist(err) {
+		t.Errorf("expected no temporary file left, got: %v", err)
+	}
+
+	out.Reset()
+	defer func(v string) { version = v }(version)
+	version = "v1.5.0"
+	if err = selfUpdate(&out, server.URL+"/releases", exe, false); err != nil || out.String() != "protoc-go-inject-tag v1.5.0 is up to date\n" {
+		t.Errorf("expected v1.5.0 to be up to date, got %q (%v)", out.String(), err)
+	}
+}
+
+func TestStarterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents, err := renderStarterConfig("./api/gen: v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), `#   db: db:"field_name"`) {
+		t.Errorf("expected the presets to be listed, got:\n%s", contents)
+	}
+	// the config is valid, and so are its examples once uncommented
+	example := regexp.MustCompile(`^# ([A-Za-z_]+:( |$)|  - )`)
+	var uncommented []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if example.MatchString(line) {
+			line = strings.TrimPrefix(line, "# ")
+		}
+		uncommented = append(uncommented, line)
+	}
+	for name, config := range map[string]string{"starter": string(contents), "examples": strings.Join(uncommented, "\n")} {
+		path := filepath.Join(dir, name+".yaml")
+		if err = ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var flags cliFlags
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		flags.register(fs)
+		if err = applyConfigFile(fs, path, true); err != nil {
+			t.Errorf("%s: %v\n%s", name, err, config)
+			continue
+		}
+		if expected := (inputList{"./api/gen: v1"}); !reflect.DeepEqual(flags.input, expected) || !flags.recursive {
+			t.Errorf("%s: expected -recursive inputs %q, got: %v %q", name, expected, flags.recursive, flags.input)
+		}
+		if name == "examples" && (flags.xxxTags != "xml,yaml" || !flags.verbose) {
+			t.Errorf("expected the examples to be set, got: %q %v", flags.xxxTags, flags.verbose)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		var out bytes.Buffer
+		if err := writeCompletion(&out, shell); err != nil {
+			t.Fatal(err)
+		}
+		for _, word := range []string{"recursive", "XXX_skip", "annotate-proto", "completion", "update"} {
+			if !strings.Contains(out.String(), word) {
+				t.Errorf("%s: expected %s to be completed, got:\n%s", shell, word, out.String())
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := writeCompletion(&out, "fish"); err != nil {
+		t.Fatal(err)
+	}
+	if line := "complete -c protoc-go-inject-tag -o recursive -f "; !strings.Contains(out.String(), line) {
+		t.Errorf("expected boolean flags to take no value, got:\n%s", out.String())
+	}
+	if err := writeCompletion(&out, "powershell"); err == nil {
+		t.Error("expected an error for an unknown shell")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	user, group := filepath.Join(dir, "user.pb.go"), filepath.Join(dir, "group.pb.go")
+	sources := map[string]string{
+		user:  "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId string `json:\"id\"` // id\n\tName string `json:\"name\"` // name\n}\n",
+		group: "package pb\n\ntype Group struct {\n\t// @inject_tag: db:\"id\"\n\tId string\n}\n",
+	}
+	for path, src := range sources {
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// -format realigns the comments after the injected tag
+	if _, err = newInjector(options{Observer: inject.NopObserver{}, Format: true, Verify: true}).injectFiles(user, group); err != nil {
+		t.Fatal(err)
+	}
+	expected := "package pb\n\ntype User struct {\n\t// @inject_tag: db:\"id\"\n\tId   string `json:\"id\" db:\"id\"` // id\n\tName string `json:\"name\"`       // name\n}\n"
+	if contents, _ := ioutil.ReadFile(user); string(contents) != expected {
+		t.Errorf("expected the file gofmt'd:\n%s\ngot:\n%s", expected, contents)
+	}
+
+	// a broken injection restores every file
+	for path, src := range sources {
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx := &transaction{observer: inject.NopObserver{}, verify: true, files: []stagedFile{
+		{path: group, original: []byte(sources[group]), contents: []byte("package pb\n\ntype Group struct {\n\tId string `db:\"id\"`\n}\n")},
+		{path: user, original: []byte(sources[user]), contents: []byte("package pb\n\ntype User struct {\n")},
+	}}
+	if err = tx.commit(); !errors.Is(err, inject.ErrUnsafeEdit) || !strings.Contains(err.Error(), "doesn't parse") {
+		t.Errorf("expected an unsafe edit error, got: %v", err)
+	}
+	for path, src := range sources {
+		if contents, _ := ioutil.ReadFile(path); string(contents) != src {
+			t.Errorf("%s: expected the original contents, got:\n%s", path, contents)
+		}
+	}
+
+	tx.formatted = true
+	tx.files = []stagedFile{{path: group, original: []byte(sources[group]), contents: []byte("package pb\n\ntype Group struct {\n\tId string `db:\"id\"`\n}\n")}}
+	if err = tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.files = []stagedFile{{path: group, original: []byte(sources[group]), contents: []byte("package pb\n\ntype Group struct {\n    Id string\n}\n")}}
+	if err = tx.commit(); !errors.Is(err, inject.ErrUnsafeEdit) || !strings.Contains(err.Error(), "gofmt") {
+		t.Errorf("expected a gofmt error, got: %v", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	src := "package pb\n\n" +
+		"type User struct {\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string\n" +
+		"\t// @inject_tags: db:\"name\"\n" +
+		"\tName string\n" +
+		"\t// @inject_tag_oneof: json:\"contact\"\n" +
+		"\tEmail string\n" +
+		"}\n"
+	obs := &warningObserver{}
+	areas, err := parseSource("user.pb.go", []byte(src), options{Observer: obs})
+	if err != nil || len(areas) != 1 || len(obs.warnings) != 0 {
+		t.Fatalf("expected the typos to be ignored without -strict, got: %v %v %v", areas, obs.warnings, err)
+	}
+
+	obs = &warningObserver{}
+	_, err = parseSource("user.pb.go", []byte(src), options{Observer: obs, Strict: true})
+	if !errors.Is(err, inject.ErrNoMatch) || exitStatus(err, 1) != exitNoMatch {
+		t.Errorf("expected -strict to fail with inject.ErrNoMatch, got: %v", err)
+	}
+	var messages []string
+	for _, warning := range obs.warnings {
+		messages = append(messages, warning.Error())
+	}
+	expected := []string{
+		`user.pb.go:6:2: no match: // @inject_tags: db:"name" looks like an annotation but doesn't follow the grammar, e.g. // @inject_tag: key:"value"`,
+		`user.pb.go:8:2: no match: // @inject_tag_oneof: json:"contact" is not the doc comment of a oneof with wrappers in the file`,
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+
+	// annotations without tag fail too
+	_, err = parseSource("user.pb.go", []byte("package pb\n\ntype User struct {\n\t// @inject_tag:\n\tId string\n}\n"), options{Observer: inject.NopObserver{}, Strict: true})
+	if !errors.Is(err, inject.ErrNoMatch) {
+		t.Errorf("expected -strict to fail on an annotation without tag, got: %v", err)
+	}
+	if _, err = parseSource(testInputFile, nil, options{Observer: inject.NopObserver{}, Strict: true}); err != nil {
+		t.Errorf("expected the test file to pass -strict, got: %v", err)
+	}
+}
+
+func TestPackagePattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"gen/user.pb.go":            "package gen\n",
+		"gen/helpers.go":            "package gen\n",
+		"gen/ignored.pb.go":         "//go:build ignore\n\npackage gen\n",
+		"gen/v1/group.pb.go":        "package v1\n",
+		"gen/v1/group_mock.pb.go":   "package v1\n",
+		"gen/vendor/dep/dep.pb.go":  "package dep\n",
+		"gen/testdata/test.pb.go":   "package testdata\n",
+		"gen/_old/old.pb.go":        "package old\n",
+		"gen/.cache/cached.pb.go":   "package cached\n",
+		"gen/empty/README.md":       "no Go files\n",
+		"other/unrelated/x.pb.go":   "package unrelated\n",
+		"gen/v1/internal/db.pb.go":  "package internal\n",
+		"gen/v1/internal/db_gen.go": "package internal\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := inputPaths(filepath.Join(dir, "gen")+"/...", false, inputFilter{exclude: []string{"*_mock.pb.go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, name := range []string{"gen/user.pb.go", "gen/v1/group.pb.go", "gen/v1/internal/db.pb.go"} {
+		expected = append(expected, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected files:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(paths, "\n"))
+	}
+	if _, err = inputPaths(filepath.Join(dir, "gen", "empty")+"/...", false, inputFilter{}); !errors.Is(err, inject.ErrNoInput) {
+		t.Errorf("expected inject.ErrNoInput for packages without files, got: %v", err)
+	}
+}
+
+func TestIgnoredPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".git/HEAD":                 "ref: refs/heads/main\n",
+		".gitignore":                "# generated by old tools\n/gen/legacy/\n*.tmp.pb.go\n**/build/*.pb.go\n",
+		"gen/.gitignore":            "third_party/\n!keep.tmp.pb.go\n",
+		"gen/user.pb.go":            "package gen\n",
+		"gen/keep.tmp.pb.go":        "package gen\n",
+		"gen/scratch.tmp.pb.go":     "package gen\n",
+		"gen/legacy/old.pb.go":      "package legacy\n",
+		"gen/third_party/t.pb.go":   "package third_party\n",
+		"gen/v1/build/b.pb.go":      "package build\n",
+		"gen/vendor/dep/dep.pb.go":  "package dep\n",
+		"gen/testdata/test.pb.go":   "package testdata\n",
+		"gen/v1/legacy/group.pb.go": "package legacy\n",
+		"gen/v1/.injectignore":      "frozen/\n",
+		"gen/v1/frozen/f.pb.go":     "package frozen\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gen := filepath.Join(dir, "gen")
+	for _, test := range []struct {
+		input    string
+		filter   inputFilter
+		expected []string
+	}{
+		{gen, inputFilter{}, []string{"keep.tmp.pb.go", "testdata/test.pb.go", "user.pb.go", "v1/legacy/group.pb.go"}},
+		{gen, inputFilter{skipTestdata: true}, []string{"keep.tmp.pb.go", "user.pb.go", "v1/legacy/group.pb.go"}},
+		{gen, inputFilter{includeIgnored: true}, []string{
+			"keep.tmp.pb.go", "legacy/old.pb.go", "scratch.tmp.pb.go", "testdata/test.pb.go",
+			"third_party/t.pb.go", "user.pb.go", "v1/build/b.pb.go", "v1/legacy/group.pb.go",
+		}},
+		{gen + "/...", inputFilter{}, []string{"keep.tmp.pb.go", "user.pb.go", "v1/legacy/group.pb.go"}},
+		// .injectignore files apply with -include_ignored too
+		{filepath.Join(gen, "v1"), inputFilter{includeIgnored: true}, []string{"v1/build/b.pb.go", "v1/legacy/group.pb.go"}},
+		// an ignored directory given explicitly is still walked
+		{filepath.Join(gen, "legacy"), inputFilter{}, []string{"legacy/old.pb.go"}},
+	} {
+		paths, err := inputPaths(test.input, true, test.filter)
+		if err != nil {
+			t.Errorf("%s %+v: %v", test.input, test.filter, err)
+			continue
+		}
+		var expected []string
+		for _, name := range test.expected {
+			expected = append(expected, filepath.Join(gen, filepath.FromSlash(name)))
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%s %+v: expected files:\n%s\ngot:\n%s", test.input, test.filter, strings.Join(expected, "\n"), strings.Join(paths, "\n"))
+		}
+	}
+	if _, err = inputPaths(filepath.Join(gen, "v1"), true, inputFilter{exclude: []string{"legacy"}}); err == nil || !strings.Contains(err.Error(), "-include_ignored") {
+		t.Errorf("expected an error naming -include_ignored, got: %v", err)
+	}
+}
+
+func TestWhy(t *testing.T) {
+	src, err := ioutil.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		FieldTags: map[string]string{"pb.IP.Address": `json:"addr" db:"{{.FieldNumber}}"`},
+	}
+	lines, ok, err := explainTag(testInputFile, src, opts, "pb.IP.Address", "json")
+	if err != nil || !ok {
+		t.Fatalf("expected pb.IP.Address to be found, got: %v %v", ok, err)
+	}
+	expected := []string{
+		testInputFile + ": pb.IP.Address json:",
+		`  existing tag: json:"Address,omitempty"`,
+		`  -field_tag: json:"addr"`,
+		`  comment: json:"overrided"`,
+		`  final json:"overrided", from comment`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+	// Go names work too, and templates are rendered
+	if lines, _, _ = explainTag(testInputFile, src, opts, "IP.Address", "db"); len(lines) != 3 || lines[2] != `  final db:"1", from -field_tag` {
+		t.Errorf("expected db to come from -field_tag, got:\n%s", strings.Join(lines, "\n"))
+	}
+	if lines, _, _ = explainTag(testInputFile, src, options{}, "pb.URL.nope", "db"); len(lines) != 0 {
+		t.Errorf("expected no field, got:\n%s", strings.Join(lines, "\n"))
+	}
+	if lines, _, _ = explainTag(testInputFile, src, options{}, "IP.Address", "db"); len(lines) != 2 || lines[1] != "  no layer sets db" {
+		t.Errorf("expected db not to be set, got:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestOpaque(t *testing.T) {
+	src := "package pb\n\n" +
+		"import protoimpl \"google.golang.org/protobuf/runtime/protoimpl\"\n\n" +
+		"type User struct {\n" +
+		"\tstate                  protoimpl.MessageState `protogen:\"opaque.v1\"`\n" +
+		"\txxx_hidden_Id           string                 `protobuf:\"bytes,1,opt,name=id,proto3\"`\n" +
+		"\txxx_hidden_DisplayName  string                 `protobuf:\"bytes,2,opt,name=display_name,json=displayName,proto3\"`\n" +
+		"\tXXX_raceDetectHookData protoimpl.RaceDetectHookData\n" +
+		"\tXXX_presence           [1]uint32\n" +
+		"}\n\n" +
+		"func (x *User) GetId() string { return x.xxx_hidden_Id }\n\n" +
+		"func (x *User) GetDisplayName() string { return x.xxx_hidden_DisplayName }\n\n" +
+		"type User_builder struct {\n" +
+		"\t_ [0]func()\n\n" +
+		"\t// @inject_tag: db:\"id\"\n" +
+		"\tId string\n" +
+		"\t// Name shown to other users.\n" +
+		"\tDisplayName string\n" +
+		"}\n\n" +
+		"func init() {\n\tproto.RegisterType((*User)(nil), \"acme.v1.User\")\n}\n"
+	opts := options{Observer: inject.NopObserver{}, Opaque: true, DocKey: "doc", FieldTags: map[string]string{"acme.v1.User.display_name": `db:"name"`}}
+	injected, err := newInjector(opts).injectSource("user.pb.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{
+		"`protobuf:\"bytes,1,opt,name=id,proto3\" db:\"id\"`",
+		"`protobuf:\"bytes,2,opt,name=display_name,json=displayName,proto3\" doc:\"Name shown to other users.\" db:\"name\"`",
+	} {
+		if !strings.Contains(string(injected), tag) {
+			t.Errorf("expected the hidden field tagged %s, got:\n%s", tag, injected)
+		}
+	}
+	if !strings.Contains(string(injected), "\t// @inject_tag: db:\"id\"\n\tId string `db:\"id\"`\n") {
+		t.Errorf("expected the builder field tagged too, got:\n%s", injected)
+	}
+
+	views, err := opaqueViewsSource([]stagedFile{{path: "user.pb.go", contents: injected}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "// Code generated by protoc-go-inject-tag. DO NOT EDIT.\n\n" +
+		"package pb\n\n" +
+		"// UserView is the exported view of User, with the injected tags.\n" +
+		"type UserView struct {\n" +
+		"\tId          string `json:\"id,omitempty\" db:\"id\"`\n" +
+		"\tDisplayName string `json:\"displayName,omitempty\" doc:\"Name shown to other users.\" db:\"name\"`\n" +
+		"}\n\n" +
+		"// View returns the view of x, nil if x is nil.\n" +
+		"func (x *User) View() *UserView {\n" +
+		"\tif x == nil {\n\t\treturn nil\n\t}\n" +
+		"\treturn &UserView{\n" +
+		"\t\tId:          x.GetId(),\n" +
+		"\t\tDisplayName: x.GetDisplayName(),\n" +
+		"\t}\n}\n"
+	if string(views) != expected {
+		t.Errorf("expected views:\n%s\ngot:\n%s", expected, views)
+	}
+
+	// without -opaque, hidden fields are left alone
+	if injected, err = newInjector(options{Observer: inject.NopObserver{}}).injectSource("user.pb.go", []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(injected), "proto3\" db:") {
+		t.Errorf("expected the hidden fields untouched, got:\n%s", injected)
+	}
+}
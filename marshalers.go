@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// flatOneof is a oneof flattened into the JSON object of its message, its
+// field tagged json:"-" and the fields of its cases with json names.
+type flatOneof struct {
+	Oneof string
+	Cases []oneofCase
+	// Names are the JSON names of Cases.
+	Names []string
+}
+
+// caseJSONName returns the json name of the field of c, if any.
+func caseJSONName(c oneofCase) string {
+	return strings.Split(reflect.StructTag(c.Tag[1:len(c.Tag)-1]).Get("json"), ",")[0]
+}
+
+// flatOneofs returns the oneofs of cases flattened into JSON, keyed by
+// message, along with the messages in the order of cases. Oneofs with a
+// case without json name are left to encoding/json.
+func flatOneofs(cases []oneofCase) (messages []string, oneofs map[string][]flatOneof) {
+	skipped := map[string]bool{}
+	for _, c := range cases {
+		if name := caseJSONName(c); c.OneofTag.Get("json") != "-" || name == "" || name == "-" {
+			skipped[c.Message+"."+c.Oneof] = true
+		}
+	}
+	oneofs = map[string][]flatOneof{}
+	index := map[string]int{}
+	for _, c := range cases {
+		key := c.Message + "." + c.Oneof
+		if skipped[key] {
+			continue
+		}
+		i, ok := index[key]
+		if !ok {
+			if len(oneofs[c.Message]) == 0 {
+				messages = append(messages, c.Message)
+			}
+			i = len(oneofs[c.Message])
+			index[key] = i
+			oneofs[c.Message] = append(oneofs[c.Message], flatOneof{Oneof: c.Oneof})
+		}
+		oneofs[c.Message][i].Cases = append(oneofs[c.Message][i].Cases, c)
+		oneofs[c.Message][i].Names = append(oneofs[c.Message][i].Names, caseJSONName(c))
+	}
+	return messages, oneofs
+}
+
+// oneofMarshalers returns the Go source of MarshalJSON and UnmarshalJSON
+// methods for the messages of the staged files with oneofs flattened into
+// JSON, as tagged by @inject_flat_json: the other fields are marshaled by
+// encoding/json and the set case of each oneof is added to the object,
+// named after the json tag of its field.
+func oneofMarshalers(files []stagedFile) ([]byte, error) {
+	pkg, cases, err := packageOneofCases("oneof marshalers", files)
+	if err != nil {
+		return nil, err
+	}
+	messages, oneofs := flatOneofs(cases)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by protoc-go-inject-tag. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(messages) > 0 {
+		buf.WriteString("import \"encoding/json\"\n\n")
+	}
+	for _, message := range messages {
+		fmt.Fprintf(&buf, "// MarshalJSON marshals m with its oneof cases flattened into its object.\n"+
+			"func (m *%s) MarshalJSON() ([]byte, error) {\n"+
+			"\tif m == nil {\n\t\treturn []byte(\"null\"), nil\n\t}\n"+
+			"\ttype plain %[1]s\n"+
+			"\tdata, err := json.Marshal((*plain)(m))\n"+
+			"\tif err != nil {\n\t\treturn nil, err\n\t}\n"+
+			"\tvar fields map[string]json.RawMessage\n"+
+			"\tif err = json.Unmarshal(data, &fields); err != nil {\n\t\treturn nil, err\n\t}\n", message)
+		for _, oneof := range oneofs[message] {
+			fmt.Fprintf(&buf, "\tswitch v := m.%s.(type) {\n", oneof.Oneof)
+			for i, c := range oneof.Cases {
+				fmt.Fprintf(&buf, "\tcase *%s:\n"+
+					"\t\tif fields[%q], err = json.Marshal(v.%s); err != nil {\n\t\t\treturn nil, err\n\t\t}\n",
+					c.Wrapper, oneof.Names[i], c.Field)
+			}
+			buf.WriteString("\t}\n")
+		}
+		buf.WriteString("\treturn json.Marshal(fields)\n}\n\n")
+
+		fmt.Fprintf(&buf, "// UnmarshalJSON unmarshals data into m, reading its oneof cases from its\n"+
+			"// object.\n"+
+			"func (m *%s) UnmarshalJSON(data []byte) error {\n"+
+			"\ttype plain %[1]s\n"+
+			"\tif err := json.Unmarshal(data, (*plain)(m)); err != nil {\n\t\treturn err\n\t}\n"+
+			"\tvar fields map[string]json.RawMessage\n"+
+			"\tif err := json.Unmarshal(data, &fields); err != nil {\n\t\treturn err\n\t}\n", message)
+		for _, oneof := range oneofs[message] {
+			for i, c := range oneof.Cases {
+				fmt.Fprintf(&buf, "\tif raw, ok := fields[%q]; ok {\n"+
+					"\t\tv := &%s{}\n"+
+					"\t\tif err := json.Unmarshal(raw, &v.%s); err != nil {\n\t\t\treturn err\n\t\t}\n"+
+					"\t\tm.%s = v\n\t}\n",
+					oneof.Names[i], c.Wrapper, c.Field, oneof.Oneof)
+			}
+		}
+		buf.WriteString("\treturn nil\n}\n\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// stageOneofMarshalers stages the oneof marshalers file of the files
+// staged in tx at path.
+func stageOneofMarshalers(tx *transaction, path string) error {
+	contents, err := oneofMarshalers(tx.files)
+	if err != nil {
+		return err
+	}
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: true, generated: true})
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// oneofCase is a case of a oneof field: the wrapper struct assigned to
+// the oneof field of its message and the field of the wrapper.
+type oneofCase struct {
+	Message string
+	Oneof   string
+	Wrapper string
+	Field   string
+	// Tag is the tag literal of Field, with its quotes.
+	Tag string
+	// OneofTag is the tag of the oneof field of Message.
+	OneofTag reflect.StructTag
+}
+
+// oneofCases returns the oneof cases declared in the Go source src, with
+// the tags of their fields as in src.
+func oneofCases(path string, src []byte) (pkg string, cases []oneofCase, err error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, src, 0)
+	if err != nil {
+		return "", nil, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	var typeSpecs []*ast.TypeSpec
+	structs := map[string]*ast.StructType{}
+	for _, decl := range f.Decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok {
+			for _, spec := range genDecl.Specs {
+				if typeSpec, ok := spec.(*ast.TypeSpec); ok {
+					typeSpecs = append(typeSpecs, typeSpec)
+					if structDecl, ok := typeSpec.Type.(*ast.StructType); ok {
+						structs[typeSpec.Name.Name] = structDecl
+					}
+				}
+			}
+		}
+	}
+	wrappers := oneofWrappers(f, typeSpecs)
+	for _, typeSpec := range typeSpecs {
+		structDecl, ok := structs[typeSpec.Name.Name]
+		if !ok {
+			continue
+		}
+		for _, field := range structDecl.Fields.List {
+			iface, ok := field.Type.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			if _, ok := reflect.StructTag(fieldTag(field)).Lookup("protobuf_oneof"); !ok {
+				continue
+			}
+			for _, wrapper := range wrappers[iface.Name] {
+				wrapperDecl, ok := structs[wrapper]
+				if !ok || len(wrapperDecl.Fields.List) != 1 || wrapperDecl.Fields.List[0].Tag == nil {
+					continue
+				}
+				caseField := wrapperDecl.Fields.List[0]
+				cases = append(cases, oneofCase{
+					Message:  typeSpec.Name.Name,
+					Oneof:    fieldName(field),
+					Wrapper:  wrapper,
+					Field:    fieldName(caseField),
+					Tag:      caseField.Tag.Value,
+					OneofTag: reflect.StructTag(fieldTag(field)),
+				})
+			}
+		}
+	}
+	return f.Name.Name, cases, nil
+}
+
+// packageOneofCases returns the package and the oneof cases of the staged
+// files, which must be of the same package, errors being prefixed with
+// what.
+func packageOneofCases(what string, files []stagedFile) (pkg string, cases []oneofCase, err error) {
+	for _, file := range files {
+		filePkg, fileCases, err := oneofCases(file.path, file.contents)
+		if err != nil {
+			return "", nil, err
+		}
+		if pkg != "" && filePkg != pkg {
+			return "", nil, fmt.Errorf("%s: %q is in package %s, not %s", what, file.path, filePkg, pkg)
+		}
+		pkg = filePkg
+		cases = append(cases, fileCases...)
+	}
+	return pkg, cases, nil
+}
+
+// oneofMetadata returns the Go source of the oneof metadata file of the
+// staged files, which must be of the same package: the OneofCases table
+// and the OneofCaseTag function, giving custom marshalers the tags of
+// oneof cases without reflecting on each wrapper.
+func oneofMetadata(files []stagedFile) ([]byte, error) {
+	pkg, cases, err := packageOneofCases("oneof metadata", files)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(cases, func(i, j int) bool {
+		return cases[i].Wrapper < cases[j].Wrapper
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by protoc-go-inject-tag. DO NOT EDIT.\n\npackage %s\n\nimport \"reflect\"\n\n", pkg)
+	buf.WriteString("// OneofCases lists the oneof cases of the package: the wrapper struct\n" +
+		"// assigned to the oneof field of a message, and the tag of its field.\n" +
+		"var OneofCases = []struct {\n\tMessage, Oneof, Wrapper, Field string\n\tTag reflect.StructTag\n}{\n")
+	for _, c := range cases {
+		fmt.Fprintf(&buf, "\t{%q, %q, %q, %q, %s},\n", c.Message, c.Oneof, c.Wrapper, c.Field, c.Tag)
+	}
+	buf.WriteString("}\n\n" +
+		"// OneofCaseTag returns the tag of the field of the oneof case wrapper v,\n" +
+		"// ok is false if v isn't one.\n" +
+		"func OneofCaseTag(v interface{}) (tag reflect.StructTag, ok bool) {\n\tswitch v.(type) {\n")
+	for _, c := range cases {
+		fmt.Fprintf(&buf, "\tcase *%s:\n\t\treturn %s, true\n", c.Wrapper, c.Tag)
+	}
+	buf.WriteString("\t}\n\treturn \"\", false\n}\n")
+	return format.Source(buf.Bytes())
+}
+
+// stageOneofMetadata stages the oneof metadata file of the files staged in
+// tx at path.
+func stageOneofMetadata(tx *transaction, path string) error {
+	contents, err := oneofMetadata(tx.files)
+	if err != nil {
+		return err
+	}
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: true, generated: true})
+	return nil
+}
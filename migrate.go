@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// rGotags matches `// @gotags: tag` comments of protoc-gen-gotags.
+	rGotags = regexp.MustCompile(`^(\s*//\s*)@gotags:(\s*.*)$`)
+	// rFieldOptions matches the options of a proto field declaration.
+	rFieldOptions = regexp.MustCompile(`^(\s*)(.*?)\s*\[(.*)\]\s*;(.*)$`)
+	// rTagOption matches the field options of other tools declaring tags:
+	// gogoproto.moretags and protoc-gen-gotag's tagger.tags.
+	rTagOption = regexp.MustCompile(`^\(\s*(gogoproto\.moretags|tagger\.tags)\s*\)\s*=\s*("(?:[^"\\]|\\.)*")$`)
+)
+
+// migrateLine rewrites annotations of other tools on a line of a proto or
+// Go file to @inject_tag comments. It returns the rewritten lines, and
+// whether anything changed.
+func migrateLine(line string) ([]string, bool, error) {
+	if match := rGotags.FindStringSubmatch(line); match != nil {
+		return []string{match[1] + "@inject_tag:" + match[2]}, true, nil
+	}
+	match := rFieldOptions.FindStringSubmatch(line)
+	if match == nil {
+		return []string{line}, false, nil
+	}
+	indent, decl, trailing := match[1], match[2], match[4]
+	var kept, tags []string
+	for _, option := range splitOptions(match[3]) {
+		tagMatch := rTagOption.FindStringSubmatch(option)
+		if tagMatch == nil {
+			kept = append(kept, option)
+			continue
+		}
+		tag, err := strconv.Unquote(tagMatch[2])
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s value %s: %v", tagMatch[1], tagMatch[2], err)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return []string{line}, false, nil
+	}
+	field := indent + decl
+	if len(kept) > 0 {
+		field += " [" + strings.Join(kept, ", ") + "]"
+	}
+	field += ";" + trailing
+	return []string{indent + "// @inject_tag: " + strings.Join(tags, " "), field}, true, nil
+}
+
+// splitOptions splits a proto option list on commas outside of quoted
+// strings, trimming spaces around each option.
+func splitOptions(list string) (options []string) {
+	var quoted, escaped bool
+	start := 0
+	for i, c := range list {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = quoted
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			options = append(options, strings.TrimSpace(list[start:i]))
+			start = i + 1
+		}
+	}
+	return append(options, strings.TrimSpace(list[start:]))
+}
+
+// migrateFile rewrites the annotations of other tools in a proto or Go
+// file, returning the number of rewritten annotations.
+func migrateFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var migrated []string
+	var count int
+	for i, line := range strings.Split(string(contents), "\n") {
+		lines, changed, err := migrateLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		if changed {
+			count++
+		}
+		migrated = append(migrated, lines...)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, writeFileAtomic(path, []byte(strings.Join(migrated, "\n")), 0)
+}
+
+// runMigrate rewrites gotags comments, gogoproto.moretags and tagger.tags
+// field options in the given files to @inject_tag comments.
+func runMigrate(_ options, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: migrate file...")
+	}
+	for _, path := range paths {
+		count, err := migrateFile(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("migrated %d annotation(s) in file %q", count, path)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+)
+
+// errMmapUnsupported reports a platform without mmap.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// readMapped returns the contents of the file at path mapped read-only
+// into memory, and a function unmapping them once they aren't used
+// anymore. The file is read instead where it can't be mapped, e.g. if it
+// is empty or mmap isn't supported.
+func readMapped(path string) (contents []byte, release func() error, err error) {
+	contents, err = mmapFile(path)
+	if err == nil {
+		return contents, func() error { return munmap(contents) }, nil
+	}
+	contents, err = ioutil.ReadFile(path)
+	return contents, func() error { return nil }, err
+}
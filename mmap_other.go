@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+func mmapFile(path string) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(contents []byte) error {
+	return nil
+}
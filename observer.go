@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// observer is notified of the progress of a run, see inject.Observer.
+type observer = inject.Observer
+
+// runStatus returns the exit status of a run counted by stats which
+// succeeded otherwise: exitNoMatch if an annotation or rule matched
+// nothing, 0 if not.
+func runStatus(stats *inject.StatsObserver) int {
+	if stats.NoMatch > 0 {
+		return exitNoMatch
+	}
+	return 0
+}
+
+// runSummary describes a run counted by stats which staged the files of
+// tx in elapsed.
+func runSummary(stats *inject.StatsObserver, tx *transaction, elapsed time.Duration) string {
+	changed, unchanged, unannotated := tx.summary()
+	return fmt.Sprintf("%d file(s) scanned in %v: %d changed, %d annotated but unchanged, %d without annotations; %d field(s) injected, %d annotation(s) skipped",
+		stats.Files, elapsed.Round(time.Millisecond), changed, unchanged, unannotated, stats.Injected, stats.Skipped)
+}
+
+// orLog returns obs, or an inject.LogObserver writing to stderr if obs is
+// nil.
+func orLog(obs observer) observer {
+	if obs == nil {
+		return inject.LogObserver{Logger: log.New(os.Stderr, "", log.LstdFlags)}
+	}
+	return obs
+}
+
+// log formats, see options.LogFormat.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonObserver logs the progress of a run as one JSON object per event,
+// for log aggregators: the action, the file and, depending on the action,
+// the field, the tag or the message, along with the time.
+type jsonObserver struct {
+	logger *log.Logger
+	// level is the log level, see options.LogLevel.
+	level string
+}
+
+// event logs the JSON object of fields with action and the current time.
+func (o jsonObserver) event(action, path string, fields map[string]interface{}) {
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["action"], fields["file"] = action, path
+	logJSON(o.logger, fields)
+}
+
+func (o jsonObserver) OnFileStart(path string) {
+	if o.level == inject.LogVerbose {
+		o.event("parse", path, nil)
+	}
+}
+
+func (o jsonObserver) OnFileParsed(path string, areas []textArea) {
+	if o.level == inject.LogVerbose {
+		o.event("parsed", path, map[string]interface{}{"fields": len(areas)})
+	}
+}
+
+func (o jsonObserver) OnInjection(path string, area textArea, expr string) {
+	if o.level == inject.LogVerbose {
+		var field string
+		if words := strings.Fields(expr); len(words) > 0 {
+			field = words[0]
+		}
+		o.event("inject", path, map[string]interface{}{"field": field, "tag": area.InjectTag})
+	}
+}
+
+func (o jsonObserver) OnWarning(path string, err error) {
+	if o.level == inject.LogQuiet {
+		return
+	}
+	fields := map[string]interface{}{"message": err.Error()}
+	var fieldErr *inject.FieldError
+	if errors.As(err, &fieldErr) && fieldErr.Field != "" {
+		fields["field"] = fieldErr.Field
+	}
+	o.event("warning", path, fields)
+}
+
+func (o jsonObserver) OnFileDone(path string, changed bool) {
+	switch {
+	case o.level == inject.LogQuiet:
+	case changed:
+		o.event("write", path, nil)
+	case o.level == inject.LogVerbose:
+		o.event("unchanged", path, nil)
+	}
+}
+
+// logJSON logs fields as a JSON object with the current time.
+func logJSON(logger *log.Logger, fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	// the values are strings and numbers, which always marshal
+	line, _ := json.Marshal(fields)
+	logger.Print(string(line))
+}
+
+// jsonLogWriter turns the lines of a logger writing to it into JSON
+// objects with the log action written to w, so messages logged as text,
+// such as errors and summaries, end up in the JSON stream.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	logJSON(log.New(w.w, "", 0), map[string]interface{}{"action": "log", "message": strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/grammar"
+)
+
+var (
+	rOneofComment = regexp.MustCompile(grammar.OneofCommentPattern)
+	rFlatJSON     = regexp.MustCompile(grammar.FlatJSONPattern)
+)
+
+// oneofTags are the tags injected into the field of a oneof wrapper struct
+// by an @inject_tag_oneof comment on the oneof field of its parent.
+type oneofTags struct {
+	// Parent is the oneof field, as Type.Field.
+	Parent string
+	Tags   []string
+	// FlatJSON is set for oneofs flattened into JSON, see flatJSON.
+	FlatJSON *flatJSONOptions
+}
+
+// flatJSONOptions are the options of an `// @inject_flat_json` comment
+// on a oneof field, which injects json:"-" on it and a json tag named
+// after the case on the field of each wrapper struct, for marshalers
+// flattening oneofs into the JSON object of their message.
+type flatJSONOptions struct {
+	// OmitEmpty adds omitempty to the json tags of cases.
+	OmitEmpty bool
+	// JSONName names cases by their JSON name, lowerCamelCase, instead
+	// of their proto name.
+	JSONName bool
+}
+
+// flatJSON returns the options of the @inject_flat_json comment of doc,
+// nil if there is none.
+func flatJSON(doc *ast.CommentGroup) (*flatJSONOptions, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	for _, comment := range doc.List {
+		match := rFlatJSON.FindStringSubmatch(comment.Text)
+		if match == nil {
+			continue
+		}
+		if err := grammar.ValidateFlatJSON(match[1]); err != nil {
+			return nil, err
+		}
+		var opts flatJSONOptions
+		for _, option := range strings.Split(match[1], ",") {
+			switch strings.TrimSpace(option) {
+			case "omitempty":
+				opts.OmitEmpty = true
+			case "json_name":
+				opts.JSONName = true
+			}
+		}
+		return &opts, nil
+	}
+	return nil, nil
+}
+
+// tag returns the json tag of the case field of a wrapper struct.
+func (opts *flatJSONOptions) tag(pf protobufField) string {
+	name := pf.Name
+	if opts.JSONName && pf.JSON != "" {
+		name = pf.JSON
+	}
+	if opts.OmitEmpty {
+		name += ",omitempty"
+	}
+	return fmt.Sprintf(`json:"%s"`, name)
+}
+
+// oneofWrappers returns the wrapper struct names of each oneof interface
+// declared in f. protoc-gen-go declares the interface `isMsg_Field` with a
+// single method of the same name, implemented by `func (*Msg_Case)
+// isMsg_Field() {}` on each wrapper; only those declarations are used, so
+// comments can't produce false positives.
+func oneofWrappers(f *ast.File, typeSpecs []*ast.TypeSpec) map[string][]string {
+	interfaces := map[string]bool{}
+	for _, typeSpec := range typeSpecs {
+		iface, ok := typeSpec.Type.(*ast.InterfaceType)
+		if !ok || len(iface.Methods.List) != 1 {
+			continue
+		}
+		method := iface.Methods.List[0]
+		if len(method.Names) == 1 && method.Names[0].Name == typeSpec.Name.Name {
+			interfaces[typeSpec.Name.Name] = true
+		}
+	}
+
+	wrappers := map[string][]string{}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 || !interfaces[fn.Name.Name] {
+			continue
+		}
+		star, ok := fn.Recv.List[0].Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		if recv, ok := star.X.(*ast.Ident); ok {
+			wrappers[fn.Name.Name] = append(wrappers[fn.Name.Name], recv.Name)
+		}
+	}
+	return wrappers
+}
+
+// oneofOwners returns the Go type name of the message declaring each
+// oneof wrapper struct of f, keyed by wrapper name, so the case fields of
+// wrappers are matched as fields of that message, e.g. the wrapper
+// Outer_Inner_Name of a oneof of the nested message Outer.Inner as a
+// field of Outer_Inner.
+func oneofOwners(f *ast.File, typeSpecs []*ast.TypeSpec) map[string]string {
+	wrappers := oneofWrappers(f, typeSpecs)
+	owners := map[string]string{}
+	for _, typeSpec := range typeSpecs {
+		structDecl, ok := typeSpec.Type.(*ast.StructType)
+		if !ok {
+			continue
+		}
+		for _, field := range structDecl.Fields.List {
+			iface, ok := field.Type.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			if _, ok := reflect.StructTag(fieldTag(field)).Lookup("protobuf_oneof"); !ok {
+				continue
+			}
+			for _, wrapper := range wrappers[iface.Name] {
+				owners[wrapper] = typeSpec.Name.Name
+			}
+		}
+	}
+	return owners
+}
+
+// collectOneofTags returns the tags of @inject_tag_oneof comments on oneof
+// fields, keyed by the wrapper struct names they apply to.
+func collectOneofTags(f *ast.File, typeSpecs []*ast.TypeSpec) map[string]oneofTags {
+	wrappers := oneofWrappers(f, typeSpecs)
+	collected := map[string]oneofTags{}
+	for _, typeSpec := range typeSpecs {
+		structDecl, ok := typeSpec.Type.(*ast.StructType)
+		if !ok {
+			continue
+		}
+		for _, field := range structDecl.Fields.List {
+			if field.Doc == nil {
+				continue
+			}
+			if _, ok := reflect.StructTag(fieldTag(field)).Lookup("protobuf_oneof"); !ok {
+				continue
+			}
+			iface, ok := field.Type.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			var tags []string
+			for _, comment := range field.Doc.List {
+				if match := rOneofComment.FindStringSubmatch(comment.Text); match != nil && match[1] != "" {
+					tags = append(tags, grammar.JoinDirectives(match[1]))
+				}
+			}
+			// invalid options are reported with the oneof field
+			flat, _ := flatJSON(field.Doc)
+			if len(tags) == 0 && flat == nil {
+				continue
+			}
+			for _, wrapper := range wrappers[iface.Name] {
+				collected[wrapper] = oneofTags{
+					Parent:   typeSpec.Name.Name + "." + fieldName(field),
+					Tags:     tags,
+					FlatJSON: flat,
+				}
+			}
+		}
+	}
+	return collected
+}
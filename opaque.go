@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// hiddenPrefix prefixes the unexported fields of the messages generated
+// with the opaque API of protoc-gen-go, which are read and set through
+// accessors.
+const hiddenPrefix = "xxx_hidden_"
+
+// hiddenField returns the name of the accessors of field if it is a
+// hidden field of the opaque API, e.g. Name for xxx_hidden_Name.
+func hiddenField(field *ast.Field) (string, bool) {
+	if len(field.Names) == 0 || !strings.HasPrefix(field.Names[0].Name, hiddenPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(field.Names[0].Name, hiddenPrefix), true
+}
+
+// builderDocs returns the doc comments of the fields of the builders the
+// opaque API generates for messages, keyed by message and field, e.g.
+// User.Name for the Name field of User_builder. Opaque messages have no
+// comments on their hidden fields, the ones of the proto land on the
+// builders.
+func builderDocs(typeSpecs []*ast.TypeSpec) map[string]*ast.CommentGroup {
+	docs := map[string]*ast.CommentGroup{}
+	for _, typeSpec := range typeSpecs {
+		structDecl, ok := typeSpec.Type.(*ast.StructType)
+		if !ok || !strings.HasSuffix(typeSpec.Name.Name, "_builder") {
+			continue
+		}
+		message := strings.TrimSuffix(typeSpec.Name.Name, "_builder")
+		for _, field := range structDecl.Fields.List {
+			if field.Doc != nil && len(field.Names) > 0 {
+				docs[message+"."+field.Names[0].Name] = field.Doc
+			}
+		}
+	}
+	return docs
+}
+
+// opaqueView is the exported view of an opaque message: its hidden fields
+// with their tags and the types of their getters.
+type opaqueView struct {
+	Message string
+	Fields  []opaqueViewField
+}
+
+type opaqueViewField struct {
+	Name, Type, Tag string
+}
+
+// viewTag returns the tag of the view field of the hidden field tag:
+// tag without its protobuf keys, with the json name of the proto field
+// unless a json key is injected.
+func viewTag(tag string) string {
+	var items tagItems
+	for _, item := range newTagItems(tag) {
+		if !strings.HasPrefix(item.key, "protobuf") {
+			items = append(items, item)
+		}
+	}
+	if _, ok := reflect.StructTag(tag).Lookup("json"); !ok {
+		if pf, ok := parseProtobufTag(tag); ok && pf.Name != "" {
+			name := pf.Name
+			for _, option := range strings.Split(reflect.StructTag(tag).Get("protobuf"), ",") {
+				if strings.HasPrefix(option, "json=") {
+					name = strings.TrimPrefix(option, "json=")
+				}
+			}
+			items = append(tagItems{{key: "json", value: fmt.Sprintf("%q", name+",omitempty")}}, items...)
+		}
+	}
+	return items.format()
+}
+
+// opaqueViews returns the package and the views of the opaque messages of
+// the Go source src, the hidden fields without getter being left out.
+func opaqueViews(path string, src []byte) (string, []opaqueView, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, src, 0)
+	if err != nil {
+		return "", nil, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	getters := map[string]string{}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 || !strings.HasPrefix(fn.Name.Name, "Get") ||
+			len(fn.Type.Params.List) != 0 || fn.Type.Results == nil || len(fn.Type.Results.List) != 1 || len(fn.Type.Results.List[0].Names) > 1 {
+			continue
+		}
+		if recv, ok := fn.Recv.List[0].Type.(*ast.StarExpr); ok {
+			if ident, ok := recv.X.(*ast.Ident); ok {
+				getters[ident.Name+"."+strings.TrimPrefix(fn.Name.Name, "Get")] = types.ExprString(fn.Type.Results.List[0].Type)
+			}
+		}
+	}
+	var views []opaqueView
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec, ok := spec.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			structDecl, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			view := opaqueView{Message: typeSpec.Name.Name}
+			for _, field := range structDecl.Fields.List {
+				name, ok := hiddenField(field)
+				if !ok {
+					continue
+				}
+				getter, ok := getters[view.Message+"."+name]
+				if !ok {
+					continue
+				}
+				view.Fields = append(view.Fields, opaqueViewField{Name: name, Type: getter, Tag: viewTag(fieldTag(field))})
+			}
+			if len(view.Fields) > 0 {
+				views = append(views, view)
+			}
+		}
+	}
+	return f.Name.Name, views, nil
+}
+
+// opaqueViewsSource returns the Go source of the views of the opaque
+// messages of the staged files, which must be of the same package: a
+// <Message>View struct per message, with an exported field tagged as
+// injected per hidden field, and a View method filling it through the
+// getters, so tag-based integrations such as encoding/json or database
+// mappers keep working with the opaque API.
+func opaqueViewsSource(files []stagedFile) ([]byte, error) {
+	var pkg string
+	var views []opaqueView
+	for _, file := range files {
+		filePkg, fileViews, err := opaqueViews(file.path, file.contents)
+		if err != nil {
+			return nil, err
+		}
+		if pkg != "" && filePkg != pkg {
+			return nil, fmt.Errorf("opaque views: %q is in package %s, not %s", file.path, filePkg, pkg)
+		}
+		pkg = filePkg
+		views = append(views, fileViews...)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by protoc-go-inject-tag. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	for _, view := range views {
+		fmt.Fprintf(&buf, "// %sView is the exported view of %[1]s, with the injected tags.\n"+
+			"type %[1]sView struct {\n", view.Message)
+		for _, field := range view.Fields {
+			fmt.Fprintf(&buf, "\t%s %s `%s`\n", field.Name, field.Type, field.Tag)
+		}
+		fmt.Fprintf(&buf, "}\n\n"+
+			"// View returns the view of x, nil if x is nil.\n"+
+			"func (x *%s) View() *%[1]sView {\n"+
+			"\tif x == nil {\n\t\treturn nil\n\t}\n"+
+			"\treturn &%[1]sView{\n", view.Message)
+		for _, field := range view.Fields {
+			fmt.Fprintf(&buf, "\t\t%s: x.Get%[1]s(),\n", field.Name)
+		}
+		buf.WriteString("\t}\n}\n\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// stageOpaqueViews stages the opaque views file of the files staged in tx
+// at path.
+func stageOpaqueViews(tx *transaction, path string) error {
+	contents, err := opaqueViewsSource(tx.files)
+	if err != nil {
+		return err
+	}
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: true, generated: true})
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// openAPISchema is the part of an OpenAPI schema object used to derive
+// tags.
+type openAPISchema struct {
+	Properties map[string]openAPIProperty `json:"properties"`
+}
+
+type openAPIProperty struct {
+	Format  string      `json:"format"`
+	Example interface{} `json:"example"`
+}
+
+// openAPIDocument is an OpenAPI 3 or Swagger 2 document, in JSON.
+type openAPIDocument struct {
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+	Definitions map[string]openAPISchema `json:"definitions"`
+}
+
+// schemas returns the schemas of doc, keyed by name.
+func (doc openAPIDocument) schemas() map[string]openAPISchema {
+	schemas := map[string]openAPISchema{}
+	for name, schema := range doc.Definitions {
+		schemas[name] = schema
+	}
+	for name, schema := range doc.Components.Schemas {
+		schemas[name] = schema
+	}
+	return schemas
+}
+
+// openAPIAnnotator returns an annotator tagging the fields of messages
+// matching schemas of doc with the keys asked for: json for the property
+// name when it differs from the field name, and format and example from
+// the property. Messages match schemas by name ignoring case and
+// underscores, or by suffix for the package prefixed names of
+// grpc-gateway (v1User matches User, UserGroup matches User.Group), and
+// fields match properties the same way.
+func openAPIAnnotator(doc openAPIDocument, keys map[string]bool) protoFieldAnnotator {
+	schemas := map[string]openAPISchema{}
+	var names []string
+	for name, schema := range doc.schemas() {
+		schemas[normalizeName(name)] = schema
+		names = append(names, normalizeName(name))
+	}
+	sort.Strings(names)
+	find := func(message string) (openAPISchema, bool) {
+		candidates := []string{normalizeName(strings.Replace(message, ".", "", -1)), normalizeName(message[strings.LastIndex(message, ".")+1:])}
+		for _, candidate := range candidates {
+			if schema, ok := schemas[candidate]; ok {
+				return schema, true
+			}
+		}
+		for _, candidate := range candidates {
+			var found []string
+			for _, name := range names {
+				if strings.HasSuffix(name, candidate) {
+					found = append(found, name)
+				}
+			}
+			if len(found) == 1 {
+				return schemas[found[0]], true
+			}
+		}
+		return openAPISchema{}, false
+	}
+	return func(message, field string) string {
+		schema, ok := find(message)
+		if !ok {
+			return ""
+		}
+		for name, property := range schema.Properties {
+			if normalizeName(name) != normalizeName(field) {
+				continue
+			}
+			var tags []string
+			if keys["json"] && name != field {
+				tags = append(tags, fmt.Sprintf(`json:"%s,omitempty"`, name))
+			}
+			if keys["format"] && property.Format != "" {
+				tags = append(tags, fmt.Sprintf(`format:"%s"`, property.Format))
+			}
+			if example := fmt.Sprint(property.Example); keys["example"] && property.Example != nil && !strings.ContainsAny(example, "\"\n") {
+				tags = append(tags, fmt.Sprintf(`example:"%s"`, example))
+			}
+			return strings.Join(tags, " ")
+		}
+		return ""
+	}
+}
+
+// runImportOpenAPI annotates the fields of proto files matching the
+// properties of the schemas of an OpenAPI document.
+func runImportOpenAPI(_ options, args []string) error {
+	fs := flag.NewFlagSet("import-openapi", flag.ContinueOnError)
+	spec := fs.String("spec", "", "OpenAPI 3 or Swagger 2 document, in JSON")
+	keys := fs.String("keys", "json,format,example", "comma separated keys to annotate fields with: json, format and example")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *spec == "" || fs.NArg() == 0 {
+		return errors.New("usage: import-openapi -spec file [-keys json,format,example] proto...")
+	}
+	wanted := map[string]bool{}
+	for _, key := range strings.Split(*keys, ",") {
+		if key != "json" && key != "format" && key != "example" {
+			return fmt.Errorf("invalid -keys entry %q, must be json, format or example", key)
+		}
+		wanted[key] = true
+	}
+	contents, err := ioutil.ReadFile(*spec)
+	if err != nil {
+		return err
+	}
+	var doc openAPIDocument
+	if err = json.Unmarshal(contents, &doc); err != nil {
+		return fmt.Errorf("parse OpenAPI document %q: %v", *spec, err)
+	}
+	log.Printf("read %d schema(s) from %q", len(doc.schemas()), *spec)
+	return annotateProtoFiles(fs.Args(), openAPIAnnotator(doc, wanted))
+}
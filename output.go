@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputPaths maps the files of each input, as returned by inputPaths, to
+// the path -output writes them to. output is the file written if there is
+// a single file input, unless it is a directory or ends with a path
+// separator; otherwise files are written under it, at their path relative
+// to their input directory, or to the directory of their package pattern,
+// or by their base name for file inputs. Files are never written outside
+// of output. output may be an object store URL, its objects being named
+// with forward slashes.
+func outputPaths(output string, inputs []string, paths [][]string) (map[string]string, error) {
+	dir := strings.HasSuffix(output, "/") || strings.HasSuffix(output, string(filepath.Separator))
+	if info, err := os.Stat(output); err == nil && info.IsDir() {
+		dir = true
+	}
+	if len(paths) > 1 || len(paths) == 1 && (len(paths[0]) != 1 || paths[0][0] != inputs[0]) {
+		dir = true
+	}
+	outputs := map[string]string{}
+	sources := map[string]string{}
+	for i, input := range inputs {
+		for _, path := range paths[i] {
+			if _, ok := outputs[path]; ok {
+				continue
+			}
+			out := output
+			if dir {
+				rel := filepath.Base(path)
+				if path != input {
+					base := input
+					if pattern, ok := patternDir(input); ok {
+						// the files of package patterns are relative to
+						// the directory of the pattern
+						if base = pattern; base == "" {
+							base = "."
+						}
+					}
+					var err error
+					if rel, err = filepath.Rel(base, path); err != nil {
+						return nil, err
+					}
+					if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+						return nil, fmt.Errorf("-output: %q isn't under -input %q, it would be written outside of %q", path, input, output)
+					}
+				}
+				if isObjectURL(output) {
+					out = strings.TrimSuffix(output, "/") + "/" + filepath.ToSlash(rel)
+				} else {
+					out = filepath.Join(output, rel)
+				}
+			}
+			if source, ok := sources[out]; ok {
+				return nil, fmt.Errorf("-output: %q and %q would both be written to %q", source, path, out)
+			}
+			outputs[path], sources[out] = out, path
+		}
+	}
+	return outputs, nil
+}
+
+// makeOutputDirs creates the missing parent directories of outputs,
+// object stores having none.
+func makeOutputDirs(outputs map[string]string) error {
+	for _, out := range outputs {
+		if isObjectURL(out) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redirectOutput makes file write to out instead of its input path,
+// comparing it with the current contents of out, if any, so unchanged
+// outputs aren't rewritten. The CLIs of object stores not telling a
+// missing object from other failures, an object which can't be
+// downloaded is taken as missing, writing it failing if the store is
+// unreachable.
+func redirectOutput(file *stagedFile, out string) error {
+	var existing []byte
+	var err error
+	if isObjectURL(out) {
+		existing, _ = readObject(out, 0)
+	} else if existing, err = ioutil.ReadFile(out); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file.path, file.original, file.source = out, existing, file.input()
+	return nil
+}
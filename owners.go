@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// scopedRules are the global rules -rule_owners grants, by flag name.
+var scopedRules = []string{
+	"XXX_skip", "infer_required", "enum_tag", "doc_key", "field_behavior",
+	"moretags", "field_tag", "field_number_tag", "deprecated",
+}
+
+// ruleOwner is a line of a -rule_owners file: the messages a team owns,
+// by full name pattern, and the global rules granted on them.
+type ruleOwner struct {
+	pattern string
+	rules   map[string]bool
+}
+
+// ruleOwners scope the global rules to the messages they may affect, like
+// CODEOWNERS: the last line matching a message decides, and messages no
+// line matches aren't restricted.
+type ruleOwners []ruleOwner
+
+// parseRuleOwners parses a -rule_owners file, one message full name
+// pattern per line followed by the rules granted on the messages it
+// matches, e.g. "acme.billing.* field_tag enum_tag". Patterns are matched
+// with path.Match. Blank lines and lines starting with # are ignored.
+func parseRuleOwners(filename string, contents []byte) (ruleOwners, error) {
+	known := map[string]bool{}
+	for _, rule := range scopedRules {
+		known[rule] = true
+	}
+	var owners ruleOwners
+	for i, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", filename, i+1, fields[0], err)
+		}
+		owner := ruleOwner{pattern: fields[0], rules: map[string]bool{}}
+		for _, rule := range fields[1:] {
+			rule = strings.TrimLeft(rule, "-")
+			if !known[rule] {
+				return nil, fmt.Errorf("%s:%d: unknown rule %q, must be one of %s", filename, i+1, rule, strings.Join(scopedRules, ", "))
+			}
+			owner.rules[rule] = true
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// loadRuleOwners reads the -rule_owners file at filename.
+func loadRuleOwners(filename string) (ruleOwners, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleOwners(filename, contents)
+}
+
+// grants reports whether rule may affect the fields of the message
+// fullName.
+func (o ruleOwners) grants(fullName, rule string) bool {
+	for i := len(o) - 1; i >= 0; i-- {
+		if ok, _ := path.Match(o[i].pattern, fullName); ok {
+			return o[i].rules[rule]
+		}
+	}
+	return true
+}
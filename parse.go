@@ -1,18 +1,77 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/favadi/protoc-go-inject-tag/grammar"
+	"github.com/favadi/protoc-go-inject-tag/inject"
 )
 
+// tagFromComment returns the tag of an `// @inject_tag: tag` comment or of
+// an `//inject:tag tag` directive.
 func tagFromComment(comment string) (tag string) {
 	match := rComment.FindStringSubmatch(comment)
+	if match == nil {
+		match = rDirective.FindStringSubmatch(comment)
+	}
 	if len(match) == 2 {
-		tag = match[1]
+		tag = grammar.JoinDirectives(match[1])
 	}
 	return
 }
 
+// maxTagTemplates bounds tagTemplates, long running servers seeing
+// endless distinct templates.
+const maxTagTemplates = 1024
+
+// tagTemplates caches the parsed templates of renderTag by tag, a rule
+// applying the same template to many fields.
+var tagTemplates = struct {
+	sync.RWMutex
+	m map[string]*template.Template
+}{m: map[string]*template.Template{}}
+
+// renderTag executes tag as a text/template with data, tags without
+// actions are returned as is.
+func renderTag(tag string, data fieldData) (string, error) {
+	if !strings.Contains(tag, "{{") {
+		return tag, nil
+	}
+	tagTemplates.RLock()
+	tmpl, ok := tagTemplates.m[tag]
+	tagTemplates.RUnlock()
+	if !ok {
+		var err error
+		if tmpl, err = template.New("tag").Parse(tag); err != nil {
+			return "", err
+		}
+		tagTemplates.Lock()
+		if len(tagTemplates.m) < maxTagTemplates {
+			tagTemplates.m[tag] = tmpl
+		}
+		tagTemplates.Unlock()
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// isTagComment reports whether comment is an inject tag comment or
+// directive, even one without tag. Directives are followed by
+// whitespace, so e.g. //inject:tagging isn't one.
+func isTagComment(comment string) bool {
+	return rComment.MatchString(comment) || rDirective.MatchString(comment) || comment == "//inject:tag"
+}
+
 type tagItem struct {
 	key   string
 	value string
@@ -28,9 +87,44 @@ func (ti tagItems) format() string {
 	return strings.Join(tags, " ")
 }
 
+// protocKeys are the tag keys generated by protoc-gen-go.
+var protocKeys = map[string]bool{
+	"protobuf":       true,
+	"protobuf_key":   true,
+	"protobuf_val":   true,
+	"protobuf_oneof": true,
+	"json":           true,
+}
+
+// normalize keeps the keys generated by protoc-gen-go in their generated
+// order and moves all other keys after them, sorted by key, so injected
+// keys don't move when protoc-gen-go output changes.
+func (ti tagItems) normalize() tagItems {
+	var protoc, others tagItems
+	for _, item := range ti {
+		if protocKeys[item.key] {
+			protoc = append(protoc, item)
+		} else {
+			others = append(others, item)
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].key < others[j].key
+	})
+	return append(protoc, others...)
+}
+
+// override returns ti with the items of nti replacing the ones of ti
+// with the same key, in place, and the other items of nti appended. Keys
+// of nti duplicated in ti, as hand edits or other tools leave them, are
+// only kept once.
 func (ti tagItems) override(nti tagItems) tagItems {
 	overrided := []tagItem{}
+	overridden := map[string]bool{}
 	for i := range ti {
+		if overridden[ti[i].key] {
+			continue
+		}
 		var dup = -1
 		for j := range nti {
 			if ti[i].key == nti[j].key {
@@ -42,6 +136,7 @@ func (ti tagItems) override(nti tagItems) tagItems {
 			overrided = append(overrided, ti[i])
 		} else {
 			overrided = append(overrided, nti[dup])
+			overridden[ti[i].key] = true
 			nti = append(nti[:dup], nti[dup+1:]...)
 		}
 	}
@@ -62,13 +157,123 @@ func newTagItems(tag string) tagItems {
 	return items
 }
 
+// checkAllowedKeys returns an error if tag, from an annotation, injects a
+// key missing from allowed, any key being allowed if it is empty.
+func checkAllowedKeys(tag string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, item := range newTagItems(tag) {
+		var ok bool
+		for _, key := range allowed {
+			ok = ok || item.key == key
+		}
+		if !ok {
+			return fmt.Errorf("%w: %q, annotations may only inject %s; use a global rule or get the key added to -allowed_keys",
+				inject.ErrKeyNotAllowed, item.key, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// limitTagLengths returns errors for the values of tag longer than the
+// maximum length in characters of their key in limits. If truncate is
+// true, the values are truncated in the returned tag.
+func limitTagLengths(tag string, limits map[string]int, truncate bool) (string, []error) {
+	var tooLong []error
+	limited := rTags.ReplaceAllStringFunc(tag, func(pair string) string {
+		sepPos := strings.Index(pair, ":")
+		key, value := pair[:sepPos], []rune(pair[sepPos+2:len(pair)-1])
+		limit, ok := limits[key]
+		if !ok || len(value) <= limit {
+			return pair
+		}
+		if truncate {
+			tooLong = append(tooLong, fmt.Errorf("value of %s is %d characters long, truncated to -max_tag_length=%d", key, len(value), limit))
+			return fmt.Sprintf(`%s:"%s"`, key, string(value[:limit]))
+		}
+		tooLong = append(tooLong, fmt.Errorf("value of %s is %d characters long, more than -max_tag_length=%d", key, len(value), limit))
+		return pair
+	})
+	return limited, tooLong
+}
+
+// prefixKeys returns tag with prefix added to each of its keys.
+func prefixKeys(tag, prefix string) string {
+	items := newTagItems(tag)
+	for i := range items {
+		items[i].key = prefix + items[i].key
+	}
+	return items.format()
+}
+
+// protobufField is the field metadata protoc-gen-go records in the
+// protobuf struct tag, e.g. `protobuf:"bytes,1,opt,name=address,proto3"`.
+type protobufField struct {
+	Name   string
+	Number int
+	// JSON is the JSON name of the field, if it differs from Name.
+	JSON string
+}
+
+func parseProtobufTag(tag string) (pf protobufField, ok bool) {
+	value, ok := reflect.StructTag(tag).Lookup("protobuf")
+	if !ok {
+		return
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) > 1 {
+		pf.Number, _ = strconv.Atoi(parts[1])
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part, "name=") {
+			pf.Name = strings.TrimPrefix(part, "name=")
+		}
+		if strings.HasPrefix(part, "json=") {
+			pf.JSON = strings.TrimPrefix(part, "json=")
+		}
+	}
+	return
+}
+
+// mergeTags returns the items of current overridden by the items of
+// inject. Injected items are applied one by one so the last duplicated key
+// wins; step, if not nil, is called for each of them with the item it
+// replaces, if any.
+func mergeTags(current, inject string, normalize bool, step func(item tagItem, replaced *tagItem)) tagItems {
+	ti := newTagItems(current)
+	for _, item := range newTagItems(inject) {
+		if step != nil {
+			var replaced *tagItem
+			for i := range ti {
+				if ti[i].key == item.key {
+					replaced = &tagItem{key: ti[i].key, value: ti[i].value}
+					break
+				}
+			}
+			step(item, replaced)
+		}
+		ti = ti.override(tagItems{item})
+	}
+	if normalize {
+		ti = ti.normalize()
+	}
+	return ti
+}
+
 func injectTag(contents []byte, area textArea) (injected []byte) {
+	if alreadyInjected(area) {
+		return contents
+	}
 	expr := make([]byte, area.End-area.Start)
 	copy(expr, contents[area.Start-1:area.End-1])
-	cti := newTagItems(area.CurrentTag)
-	iti := newTagItems(area.InjectTag)
-	ti := cti.override(iti)
-	expr = rInject.ReplaceAll(expr, []byte(fmt.Sprintf("`%s`", ti.format())))
+	ti := mergeTags(area.CurrentTag, area.InjectTag, area.Normalize, nil)
+	if rInject.Match(expr) {
+		expr = rInject.ReplaceAllLiteral(expr, []byte(fmt.Sprintf("`%s`", ti.format())))
+	} else {
+		// field has no tag yet, append one
+		expr = append(expr, []byte(fmt.Sprintf(" `%s`", ti.format()))...)
+	}
 	injected = append(injected, contents[:area.Start-1]...)
 	injected = append(injected, expr...)
 	injected = append(injected, contents[area.End-1:]...)
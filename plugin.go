@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+)
+
+// pluginPrefix prefixes the names protoc looks plugins up by: run as
+// protoc-gen-inject-tag, e.g. through a symbolic link, the tool is the
+// plugin of protoc --inject-tag_out.
+const pluginPrefix = "protoc-gen-"
+
+// isPlugin reports whether the tool runs as a protoc plugin, named by
+// the executable path exe.
+func isPlugin(exe string) bool {
+	return strings.HasPrefix(filepath.Base(exe), pluginPrefix)
+}
+
+// splitPluginParameter splits the parameter protoc passes to plugins,
+// from --inject-tag_opt=a=1,b=2, on the commas outside of double quotes,
+// joining the pieces without = that aren't flag names to the previous
+// one, so values such as XXX_skip=yaml,xml survive.
+func splitPluginParameter(parameter string) []string {
+	var pieces []string
+	var quoted bool
+	start := 0
+	for i := 0; i <= len(parameter); i++ {
+		if i < len(parameter) && parameter[i] == '"' {
+			quoted = !quoted
+		}
+		if i < len(parameter) && (quoted || parameter[i] != ',') {
+			continue
+		}
+		piece := parameter[start:i]
+		start = i + 1
+		if known, _ := lookupRuleFlag(piece); len(pieces) > 0 && !known && !strings.Contains(piece, "=") {
+			pieces[len(pieces)-1] += "," + piece
+			continue
+		}
+		if piece != "" {
+			pieces = append(pieces, piece)
+		}
+	}
+	return pieces
+}
+
+// parsePluginParameter returns the options configured by the parameter
+// protoc passes to plugins, name=value options named like the command
+// line flags, e.g. XXX_skip=yaml,key_prefix=x_,trace, with the same
+// validation, so a plugin invocation behaves like the command line one.
+// ds describes the proto files of the request unless -descriptor_set is
+// given.
+func parsePluginParameter(parameter string, ds *descriptorSet) (options, error) {
+	var args []string
+	for _, piece := range splitPluginParameter(parameter) {
+		args = append(args, "-"+piece)
+	}
+	return parseFlagArgsWith("plugin parameter", args, ds)
+}
+
+// pluginOnlyParameters are the plugin parameters which aren't flags: dir,
+// the directory protoc-gen-go wrote the *.pb.go files to, and paths and
+// module naming them as protoc-gen-go's options of the same names do.
+var pluginOnlyParameters = []string{"dir", "paths", "module"}
+
+// generatedName returns the name of the file protoc-gen-go generates for
+// fd with its paths and module options.
+func generatedName(fd *descriptor.FileDescriptorProto, paths, module string) (string, error) {
+	name := strings.TrimSuffix(fd.GetName(), ".proto") + ".pb.go"
+	switch paths {
+	case "", "import":
+	case "source_relative":
+		return name, nil
+	default:
+		return "", fmt.Errorf("plugin parameter: paths=%s, must be import or source_relative", paths)
+	}
+	if importPath := strings.SplitN(fd.GetOptions().GetGoPackage(), ";", 2)[0]; importPath != "" {
+		name = path.Join(importPath, path.Base(name))
+	}
+	if module != "" {
+		if !strings.HasPrefix(name, module+"/") {
+			return "", fmt.Errorf("plugin parameter: %s isn't in module=%s", name, module)
+		}
+		name = strings.TrimPrefix(name, module+"/")
+	}
+	return name, nil
+}
+
+// injectRequest injects the *.pb.go files protoc-gen-go generated for the
+// files of req, read under the dir parameter, returning them in the
+// response so protoc writes them to the output directory of the plugin.
+// The other parameters are parsed by parsePluginParameter, and the proto
+// files of req stand for -descriptor_set unless it is given. Errors are
+// reported in the response, as protoc expects from plugins.
+func injectRequest(req *plugin.CodeGeneratorRequest) *plugin.CodeGeneratorResponse {
+	resp, err := injectRequestFiles(req)
+	if err != nil {
+		return &plugin.CodeGeneratorResponse{Error: proto.String(err.Error())}
+	}
+	return resp
+}
+
+func injectRequestFiles(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+	own := map[string]string{}
+	var flags []string
+	for _, piece := range splitPluginParameter(req.GetParameter()) {
+		var isOwn bool
+		for _, name := range pluginOnlyParameters {
+			if strings.HasPrefix(piece, name+"=") {
+				own[name], isOwn = strings.TrimPrefix(piece, name+"="), true
+			}
+		}
+		if !isOwn {
+			flags = append(flags, piece)
+		}
+	}
+	opts, err := parsePluginParameter(strings.Join(flags, ","), newDescriptorSet(&descriptor.FileDescriptorSet{File: req.GetProtoFile()}))
+	if err != nil {
+		return nil, err
+	}
+	protoFiles := map[string]*descriptor.FileDescriptorProto{}
+	for _, fd := range req.GetProtoFile() {
+		protoFiles[fd.GetName()] = fd
+	}
+	dir := own["dir"]
+	if dir == "" {
+		dir = "."
+	}
+	inj := newInjector(opts)
+	resp := &plugin.CodeGeneratorResponse{}
+	for _, file := range req.GetFileToGenerate() {
+		fd, ok := protoFiles[file]
+		if !ok {
+			return nil, fmt.Errorf("%s: no descriptor in the request", file)
+		}
+		name, err := generatedName(fd, own["paths"], own["module"])
+		if err != nil {
+			return nil, err
+		}
+		src, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, fmt.Errorf("%v, run protoc-gen-go before the plugin and set dir to its output directory", err)
+		}
+		injected, err := inj.injectSource(name, src)
+		if err != nil {
+			return nil, err
+		}
+		resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{Name: proto.String(name), Content: proto.String(string(injected))})
+	}
+	return resp, nil
+}
+
+// runPlugin reads a CodeGeneratorRequest from r and writes the response
+// of injectRequest to w, as protoc runs plugins.
+func runPlugin(r io.Reader, w io.Writer) error {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var req plugin.CodeGeneratorRequest
+	if err = proto.Unmarshal(in, &req); err != nil {
+		return fmt.Errorf("parse code generator request: %v", err)
+	}
+	out, err := proto.Marshal(injectRequest(&req))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// rProtoBlock matches the start of a message, enum, oneof, service or
+	// extend block of a proto file.
+	rProtoBlock = regexp.MustCompile(`^\s*(message|enum|oneof|service|extend)\s+([\w.]+)\s*\{`)
+	// rProtoField matches a field declaration of a proto message.
+	rProtoField = regexp.MustCompile(`^(\s*)(?:(?:repeated|optional|required)\s+)?(?:map\s*<[^>]*>|[\w.]+)\s+(\w+)\s*=\s*\d+`)
+)
+
+// protoFieldAnnotator returns the tag to annotate the field of a message
+// with, or an empty string to leave it alone. Nested messages are named
+// Outer.Inner.
+type protoFieldAnnotator func(message, field string) string
+
+// annotateProtoSource inserts `// @inject_tag:` comments above the fields
+// of the proto source src for which annotate returns a tag, returning the
+// annotated source and the number of comments inserted. Fields whose
+// comments already declare all the keys of their tag are left alone, so
+// annotating is idempotent.
+func annotateProtoSource(src []byte, annotate protoFieldAnnotator) ([]byte, int) {
+	lines := strings.Split(string(src), "\n")
+	var annotated []string
+	// blocks are the kinds of the enclosing blocks, messages the names of
+	// the enclosing messages
+	var blocks, messages []string
+	var count int
+	for i, line := range lines {
+		code := line
+		if j := strings.Index(code, "//"); j >= 0 {
+			code = code[:j]
+		}
+		opens := strings.Count(code, "{")
+		if match := rProtoBlock.FindStringSubmatch(code); match != nil {
+			blocks = append(blocks, match[1])
+			if match[1] == "message" {
+				messages = append(messages, match[2])
+			}
+			opens--
+		} else if match := rProtoField.FindStringSubmatch(code); match != nil && len(blocks) > 0 {
+			if kind := blocks[len(blocks)-1]; kind == "message" || kind == "oneof" {
+				if tag := annotate(strings.Join(messages, "."), match[2]); tag != "" && !commentsHaveKeys(lines[:i], tag) {
+					annotated = append(annotated, match[1]+"// @inject_tag: "+tag)
+					count++
+				}
+			}
+		}
+		for ; opens > 0; opens-- {
+			blocks = append(blocks, "")
+		}
+		for closes := strings.Count(code, "}"); closes > 0 && len(blocks) > 0; closes-- {
+			if blocks[len(blocks)-1] == "message" {
+				messages = messages[:len(messages)-1]
+			}
+			blocks = blocks[:len(blocks)-1]
+		}
+		annotated = append(annotated, line)
+	}
+	return []byte(strings.Join(annotated, "\n")), count
+}
+
+// commentsHaveKeys reports whether the comment lines ending lines declare
+// every key of tag in annotation comments.
+func commentsHaveKeys(lines []string, tag string) bool {
+	keys := map[string]bool{}
+	for i := len(lines) - 1; i >= 0; i-- {
+		comment := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(comment, "//") {
+			break
+		}
+		for _, item := range newTagItems(tagFromComment(comment)) {
+			keys[item.key] = true
+		}
+	}
+	for _, item := range newTagItems(tag) {
+		if !keys[item.key] {
+			return false
+		}
+	}
+	return true
+}
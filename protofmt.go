@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// collectProtoMacros returns the macros defined by `// @define:` comments
+// of the proto source lines, see collectMacros.
+func collectProtoMacros(lines []string) (map[string]string, error) {
+	var macros map[string]string
+	for i, line := range lines {
+		match := rDefine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		if macros == nil {
+			macros = map[string]string{}
+		}
+		if _, ok := macros[match[1]]; ok {
+			return nil, fmt.Errorf("line %d: macro %q is already defined", i+1, match[1])
+		}
+		value, err := expandMacros(match[2], macros)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		macros[match[1]] = value
+	}
+	return macros, nil
+}
+
+// formatAnnotations merges the annotation comments above each field with
+// macros expanded into a single `// @inject_tag:` comment, in place of the
+// last of them, with the keys deduplicated the way injection does and
+// sorted. Comments with tags that can't be parsed, such as empty
+// annotations, are left alone and so are the others above their field.
+// It returns the formatted proto source and the number of fields whose
+// annotations changed.
+func formatAnnotations(src []byte) ([]byte, int, error) {
+	lines := strings.Split(string(src), "\n")
+	macros, err := collectProtoMacros(lines)
+	if err != nil {
+		return nil, 0, err
+	}
+	var formatted []string
+	var count int
+	for start := 0; start < len(lines); {
+		end := start
+		for end < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[end]), "//") {
+			end++
+		}
+		if end == start {
+			formatted = append(formatted, lines[start])
+			start++
+			continue
+		}
+		block := lines[start:end]
+		if end < len(lines) && rProtoField.MatchString(lines[end]) {
+			merged, ok, err := mergeAnnotations(block, macros)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: %v", start+1, err)
+			}
+			if ok {
+				if strings.Join(merged, "\n") != strings.Join(block, "\n") {
+					count++
+				}
+				block = merged
+			}
+		}
+		formatted = append(formatted, block...)
+		start = end
+	}
+	return []byte(strings.Join(formatted, "\n")), count, nil
+}
+
+// mergeAnnotations returns the comment lines with their annotations
+// merged, ok is false if they have none or one can't be parsed.
+func mergeAnnotations(comments []string, macros map[string]string) (merged []string, ok bool, err error) {
+	var tag, indent string
+	last := -1
+	for i, line := range comments {
+		comment := strings.TrimSpace(line)
+		if !isTagComment(comment) {
+			continue
+		}
+		expanded, err := expandMacros(tagFromComment(comment), macros)
+		if err != nil {
+			return nil, false, err
+		}
+		if strings.TrimSpace(expanded) == "" || !rValidTag.MatchString(expanded) {
+			return nil, false, nil
+		}
+		tag = mergeTags(tag, expanded, false, nil).format()
+		indent, last = line[:strings.Index(line, "//")], i
+	}
+	if last < 0 {
+		return nil, false, nil
+	}
+	for i, line := range comments {
+		switch {
+		case i == last:
+			merged = append(merged, indent+"// @inject_tag: "+newTagItems(tag).normalize().format())
+		case !isTagComment(strings.TrimSpace(line)):
+			merged = append(merged, line)
+		}
+	}
+	return merged, true, nil
+}
+
+// runFmtAnnotations formats the annotation comments of proto files, or
+// lists the files whose annotations aren't formatted with -l.
+func runFmtAnnotations(_ options, args []string) error {
+	fs := flag.NewFlagSet("fmt-annotations", flag.ContinueOnError)
+	list := fs.Bool("l", false, "list the files whose annotations aren't formatted instead of formatting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: fmt-annotations [-l] proto...")
+	}
+	tx := &transaction{observer: inject.NopObserver{}}
+	for _, path := range fs.Args() {
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents, count, err := formatAnnotations(original)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if *list && count > 0 {
+			fmt.Println(path)
+		}
+		tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: count > 0})
+	}
+	if *list {
+		return nil
+	}
+	return tx.commit()
+}
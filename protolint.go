@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	rProtoReserved = regexp.MustCompile(`^\s*reserved\s`)
+	rProtoOneof    = regexp.MustCompile(`^\s*oneof\s+\w+\s*\{`)
+)
+
+// protoLint is an annotation of a proto file that won't reach the Go
+// output.
+type protoLint struct {
+	Line    int
+	Message string
+}
+
+// lintProtoSource returns the annotations of the proto source src that
+// protoc won't carry into the Go output, or that injection ignores.
+func lintProtoSource(src []byte) (lints []protoLint) {
+	lines := strings.Split(string(src), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		j := strings.Index(line, "//")
+		if j < 0 {
+			continue
+		}
+		comment := strings.TrimSpace(line[j:])
+		isFlatJSON := rFlatJSON.MatchString(comment)
+		isOneofComment := isFlatJSON || rOneofComment.MatchString(comment)
+		if !isTagComment(comment) && !isOneofComment {
+			continue
+		}
+		lint := func(message string) {
+			lints = append(lints, protoLint{Line: i + 1, Message: message})
+		}
+		if !strings.HasPrefix(trimmed, "//") {
+			lint("trailing annotation, injection only reads the comments above fields")
+			continue
+		}
+		if !isOneofComment && tagFromComment(comment) == "" {
+			lint("annotation without tag")
+		}
+		next := i + 1
+		for next < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[next]), "//") {
+			next++
+		}
+		var decl string
+		if next < len(lines) {
+			decl = lines[next]
+		}
+		switch {
+		case strings.TrimSpace(decl) == "":
+			lint("detached annotation, protoc drops comments separated from the field by a blank line")
+		case rProtoReserved.MatchString(decl):
+			lint("annotation on a reserved statement, reserved fields have no Go field")
+		case rProtoOneof.MatchString(decl) && !isOneofComment:
+			lint("@inject_tag annotation on a oneof, use @inject_tag_oneof")
+		case rProtoOneof.MatchString(decl):
+		case isFlatJSON:
+			lint("@inject_flat_json annotation not on a oneof")
+		case isOneofComment:
+			lint("@inject_tag_oneof annotation not on a oneof")
+		case !rProtoField.MatchString(decl):
+			lint("annotation not on a field")
+		}
+	}
+	return
+}
+
+// runLintProto reports the annotations of proto files that won't reach
+// the Go output, failing if there are any.
+func runLintProto(_ options, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lint-proto proto...")
+	}
+	var count int
+	for _, path := range args {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, lint := range lintProtoSource(src) {
+			fmt.Printf("%s:%d: %s\n", path, lint.Line, lint.Message)
+			count++
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("%d misplaced annotation(s)", count)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// objectStoreCLIs are the commands copying objects of each object store
+// URL scheme from and to stdin and stdout, given the source and the
+// destination, "-" standing for stdin or stdout. The stores are reached
+// through the CLIs of their providers, which handle credentials, since
+// the tool doesn't depend on their SDKs.
+var objectStoreCLIs = map[string][]string{
+	"s3://": {"aws", "s3", "cp", "--only-show-errors"},
+	"gs://": {"gcloud", "storage", "cp"},
+}
+
+// objectStoreCLI returns the command copying the object at url, nil if
+// url isn't an object store URL.
+func objectStoreCLI(url string) []string {
+	for scheme, cli := range objectStoreCLIs {
+		if strings.HasPrefix(url, scheme) {
+			return cli
+		}
+	}
+	return nil
+}
+
+// isObjectURL reports whether path is an object store URL, such as
+// s3://bucket/key or gs://bucket/object.
+func isObjectURL(path string) bool {
+	return objectStoreCLI(path) != nil
+}
+
+// objectCopy is a run of the CLI copying src to dst, one of them being
+// "-" for the stdin or stdout pipe the object is streamed through, so it
+// is never held in memory by the CLI's output buffer.
+type objectCopy struct {
+	cmd      *exec.Cmd
+	stderr   bytes.Buffer
+	src, dst string
+}
+
+// newObjectCopy returns the copy of src to dst, not started yet.
+func newObjectCopy(src, dst string) *objectCopy {
+	url := src
+	if url == "-" {
+		url = dst
+	}
+	cli := objectStoreCLI(url)
+	c := &objectCopy{cmd: exec.Command(cli[0], append(cli[1:], src, dst)...), src: src, dst: dst}
+	c.cmd.Stderr = &c.stderr
+	return c
+}
+
+// wait waits for the copy to exit, returning its error output on failure.
+func (c *objectCopy) wait() error {
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("copy %s to %s: %v: %s", c.src, c.dst, err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// objectReader streams an object from the stdout of its copy, closing it
+// waiting for the copy.
+type objectReader struct {
+	io.ReadCloser
+	copy *objectCopy
+}
+
+func (r objectReader) Close() error {
+	r.ReadCloser.Close()
+	return r.copy.wait()
+}
+
+// objectWriter streams an object to the stdin of its copy, closing it
+// waiting for the upload to complete.
+type objectWriter struct {
+	io.WriteCloser
+	copy *objectCopy
+}
+
+func (w objectWriter) Close() error {
+	w.WriteCloser.Close()
+	return w.copy.wait()
+}
+
+// openObject starts downloading the object at url, read from the
+// returned reader. Closing it before the end aborts the download.
+func openObject(url string) (io.ReadCloser, error) {
+	c := newObjectCopy(url, "-")
+	out, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("copy %s to -: %v", url, err)
+	}
+	return objectReader{out, c}, nil
+}
+
+// createObject starts uploading the object at url, written to the
+// returned writer, the object being complete once it is closed without
+// error.
+func createObject(url string) (io.WriteCloser, error) {
+	c := newObjectCopy("-", url)
+	in, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("copy - to %s: %v", url, err)
+	}
+	return objectWriter{in, c}, nil
+}
+
+// readObject downloads the object at url, failing with errObjectTooLarge
+// once it is more than limit bytes if limit isn't 0.
+func readObject(url string, limit int64) ([]byte, error) {
+	r, err := openObject(url)
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	contents, err := ioutil.ReadAll(src)
+	if err == nil && limit > 0 && int64(len(contents)) > limit {
+		err = errObjectTooLarge
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return contents, r.Close()
+}
+
+// errObjectTooLarge is returned by readObject for objects over its limit.
+var errObjectTooLarge = errors.New("object too large")
+
+// writeContents writes contents to path, a local file or an object store
+// URL. Local files are replaced atomically and get the permission bits
+// mode if it isn't 0, whatever the umask; otherwise existing files keep
+// theirs and new files are created 0666 less the umask, see
+// writeFileAtomic.
+func writeContents(path string, contents []byte, mode os.FileMode) error {
+	if isObjectURL(path) {
+		w, err := createObject(path)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(contents); err != nil {
+			// the copy failing is the cause of the broken pipe
+			if cerr := w.Close(); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		return w.Close()
+	}
+	return writeFileAtomic(path, contents, mode)
+}
+
+// stageObject downloads the object at url and stages it in tx with tags
+// injected, with the same checks as local files. Downloads over
+// -max_file_size are stopped once the limit is reached.
+func (inj *injector) stageObject(tx *transaction, url string) error {
+	obs := inj.opts.observer()
+	obs.OnFileStart(url)
+	var limit int64
+	if !inj.opts.Force {
+		limit = inj.opts.MaxFileSize
+	}
+	original, err := readObject(url, limit)
+	if errors.Is(err, errObjectTooLarge) {
+		return fmt.Errorf("object %q is more than -max_file_size=%d bytes, use -force to process it anyway", url, limit)
+	}
+	if err != nil {
+		return err
+	}
+	areas, err := parseSource(url, original, inj.opts)
+	if err != nil {
+		return err
+	}
+	obs.OnFileParsed(url, areas)
+	if err = checkEdits(url, areas, inj.opts); err != nil {
+		return err
+	}
+	return tx.stageSource(url, original, areas)
+}
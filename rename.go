@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// renameKey returns an edit renaming the key from to to in tags. Tags
+// already having both keys are refused rather than merged.
+func renameKey(from, to string) tagEdit {
+	return func(tag string) (string, error) {
+		var hasFrom, hasTo bool
+		for _, item := range newTagItems(tag) {
+			hasFrom = hasFrom || item.key == from
+			hasTo = hasTo || item.key == to
+		}
+		if !hasFrom {
+			return tag, nil
+		}
+		if hasTo {
+			return "", fmt.Errorf("tag %s already has key %q", tag, to)
+		}
+		return rTags.ReplaceAllStringFunc(tag, func(pair string) string {
+			if strings.HasPrefix(pair, from+":") {
+				return to + pair[len(from):]
+			}
+			return pair
+		}), nil
+	}
+}
+
+// runRenameKey renames a tag key in the struct tags and annotation
+// comments of Go files, and in the annotation comments of proto files.
+func runRenameKey(_ options, args []string) error {
+	fs := flag.NewFlagSet("rename-key", flag.ContinueOnError)
+	from := fs.String("from", "", "key to rename")
+	to := fs.String("to", "", "new name of the key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" || fs.NArg() == 0 {
+		return errors.New("usage: rename-key -from key -to key file...")
+	}
+	if !rValidTag.MatchString(*to + `:"x"`) {
+		return fmt.Errorf("invalid key %q", *to)
+	}
+	return editFiles(fs.Args(), renameKey(*from, *to))
+}
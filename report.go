@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// injectionRow is a field tag a run changed, see -report.
+type injectionRow struct {
+	File   string `json:"file"`
+	Struct string `json:"struct"`
+	Field  string `json:"field"`
+	OldTag string `json:"old_tag"`
+	NewTag string `json:"new_tag"`
+}
+
+// injectionReport is the JSON report of -report.
+type injectionReport struct {
+	Injections []injectionRow `json:"injections"`
+}
+
+// reportPath returns path as written in reports and manifests: relative
+// to the top of its git work tree, or to the current directory outside
+// of one, with forward slashes whatever the OS, so reports of the same
+// run compare equal across machines. Paths outside of that directory are
+// kept absolute, and object URLs as they are.
+func reportPath(path string) string {
+	if isObjectURL(path) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	root, ok := workTreeTop(filepath.Dir(abs))
+	if !ok {
+		if root, err = os.Getwd(); err != nil {
+			return filepath.ToSlash(path)
+		}
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(abs)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// structFields returns the fields of the structs declared in the Go
+// source src, with their struct, in source order.
+func structFields(path string, src []byte) (structs []string, fields []*ast.Field, err error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, src, 0)
+	if err != nil {
+		return nil, nil, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		typeSpec, ok := node.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		if structDecl, ok := typeSpec.Type.(*ast.StructType); ok {
+			for _, field := range structDecl.Fields.List {
+				structs, fields = append(structs, typeSpec.Name.Name), append(fields, field)
+			}
+		}
+		return true
+	})
+	return structs, fields, nil
+}
+
+// newInjectionReport returns the report of the field tags injection
+// changed in files, by file then field in source order, the files named
+// by reportPath. Tags are compared to the ones of the input of each file,
+// which differs from the file written with -output, and generated files
+// are left out.
+func newInjectionReport(files []stagedFile) (injectionReport, error) {
+	report := injectionReport{Injections: []injectionRow{}}
+	for _, file := range files {
+		if !file.changed() || file.generated {
+			continue
+		}
+		structs, before, err := structFields(file.path, file.input())
+		if err != nil {
+			return injectionReport{}, err
+		}
+		_, after, err := structFields(file.path, file.contents)
+		if err != nil {
+			return injectionReport{}, err
+		}
+		// injection only changes tags, checkOnlyTagsChanged makes sure of
+		// it, so the fields are the same in both
+		if len(before) != len(after) {
+			return injectionReport{}, &inject.FieldError{File: file.path, Err: fmt.Errorf("%w: fields changed", inject.ErrUnsafeEdit)}
+		}
+		path := reportPath(file.path)
+		for i := range before {
+			if oldTag, newTag := fieldTag(before[i]), fieldTag(after[i]); oldTag != newTag {
+				report.Injections = append(report.Injections, injectionRow{
+					File: path, Struct: structs[i], Field: fieldName(before[i]), OldTag: oldTag, NewTag: newTag,
+				})
+			}
+		}
+	}
+	return report, nil
+}
+
+// writeInjectionReport writes the report of the injections into files
+// to path.
+func writeInjectionReport(path string, files []stagedFile) error {
+	report, err := newInjectionReport(files)
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(contents, '\n'), 0)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rewriteValues returns an edit replacing the matches of pattern in the
+// values of key with replace, as regexp.ReplaceAllString does.
+func rewriteValues(key string, pattern *regexp.Regexp, replace string) tagEdit {
+	return func(tag string) (string, error) {
+		var err error
+		edited := rTags.ReplaceAllStringFunc(tag, func(pair string) string {
+			if !strings.HasPrefix(pair, key+":") || err != nil {
+				return pair
+			}
+			value := pair[len(key)+2 : len(pair)-1]
+			rewritten := pattern.ReplaceAllString(value, replace)
+			if rewritten == "" || strings.Contains(rewritten, `"`) {
+				err = fmt.Errorf("rewriting %s gives invalid value %q", pair, rewritten)
+			}
+			return key + `:"` + rewritten + `"`
+		})
+		return edited, err
+	}
+}
+
+// runRewrite rewrites the values of a tag key in the struct tags and
+// annotation comments of Go files, and in the annotation comments of
+// proto files.
+func runRewrite(_ options, args []string) error {
+	fs := flag.NewFlagSet("rewrite", flag.ContinueOnError)
+	key := fs.String("key", "", "key whose values are rewritten")
+	pattern := fs.String("pattern", "", "regexp matched against the values")
+	replace := fs.String("replace", "", "replacement of the matches, can refer to submatches as ${1}")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" || *pattern == "" || fs.NArg() == 0 {
+		return errors.New("usage: rewrite -key key -pattern regexp -replace replacement file...")
+	}
+	rPattern, err := regexp.Compile(*pattern)
+	if err != nil {
+		return fmt.Errorf("invalid -pattern: %v", err)
+	}
+	return editFiles(fs.Args(), rewriteValues(*key, rPattern, *replace))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var rFixtureHeader = regexp.MustCompile(`^-- (given|expect)(?::\s*(.*?))? --$`)
+
+// fixtureCase is a rule test case: the struct text given to the injection
+// rules and the text they are expected to produce.
+type fixtureCase struct {
+	Name   string
+	Line   int
+	Given  string
+	Expect string
+}
+
+// parseFixtures reads test cases from a fixture file. Each case starts
+// with a "-- given: name --" line followed by the input struct text, then
+// an "-- expect --" line followed by the expected output. Lines before the
+// first case are ignored and can be used for comments.
+func parseFixtures(contents []byte) (cases []fixtureCase, err error) {
+	var inExpect bool
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		match := rFixtureHeader.FindStringSubmatch(text)
+		switch {
+		case match == nil:
+			if len(cases) == 0 {
+				continue
+			}
+			if c := &cases[len(cases)-1]; inExpect {
+				c.Expect += text + "\n"
+			} else {
+				c.Given += text + "\n"
+			}
+		case match[1] == "given":
+			name := match[2]
+			if name == "" {
+				name = fmt.Sprintf("case #%d", len(cases)+1)
+			}
+			cases = append(cases, fixtureCase{Name: name, Line: line})
+			inExpect = false
+		case len(cases) == 0 || inExpect:
+			return nil, fmt.Errorf("line %d: expect section without given section", line)
+		default:
+			inExpect = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	for _, c := range cases {
+		if strings.TrimSpace(c.Expect) == "" {
+			return nil, fmt.Errorf("line %d: %s has no expect section", c.Line, c.Name)
+		}
+	}
+	return
+}
+
+// run injects tags into the given text of c and returns the result with
+// the package clause added for parsing removed.
+func (c fixtureCase) run(filename string, opts options) (string, error) {
+	src := c.Given
+	var prefix string
+	if !strings.Contains(src, "package ") {
+		prefix = "package fixture\n\n"
+		src = prefix + src
+	}
+	injected, err := newInjector(opts).injectSource(filename, []byte(src))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(string(injected), prefix), nil
+}
+
+// runRulesTest runs the rules configured by opts against the cases of
+// each fixture file, reporting failures with the expected and actual text.
+func runRulesTest(opts options, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: rules test fixture...")
+	}
+	var failed int
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		cases, err := parseFixtures(contents)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, c := range cases {
+			result, err := c.run(path, opts)
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("FAIL %s:%d: %s\n\t%v\n", path, c.Line, c.Name, err)
+			case strings.TrimSpace(result) != strings.TrimSpace(c.Expect):
+				failed++
+				fmt.Printf("FAIL %s:%d: %s\n--- expect\n%s--- got\n%s", path, c.Line, c.Name, c.Expect, result)
+			default:
+				fmt.Printf("ok   %s:%d: %s\n", path, c.Line, c.Name)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d rule test case(s) failed", failed)
+	}
+	return nil
+}
+
+// runRules dispatches the rules subcommands.
+func runRules(opts options, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errors.New("usage: rules test fixture...")
+	}
+	return runRulesTest(opts, args[1:])
+}
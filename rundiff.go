@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// runReport is what a run injected, persisted by -last_run to describe
+// the next run relative to it.
+type runReport struct {
+	Files []string `json:"files"`
+	Tags  []tagRow `json:"tags"`
+}
+
+// newRunReport returns the report of a run which staged files, their
+// injected keys being listed as by export, named by reportPath.
+func newRunReport(files []stagedFile, opts options) (runReport, error) {
+	opts.Observer = inject.NopObserver{}
+	report := runReport{Files: []string{}, Tags: []tagRow{}}
+	for _, file := range files {
+		rows, err := exportRows(file.path, file.contents, opts, false)
+		if err != nil {
+			return runReport{}, err
+		}
+		report.Files = append(report.Files, reportPath(file.path))
+		report.Tags = append(report.Tags, rows...)
+	}
+	sort.Strings(report.Files)
+	return report, nil
+}
+
+// loadRunReport reads the report at path, ok is false if there is none
+// yet.
+func loadRunReport(path string) (report runReport, ok bool, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return runReport{}, false, nil
+	}
+	if err != nil {
+		return runReport{}, false, err
+	}
+	if err = json.Unmarshal(contents, &report); err != nil {
+		return runReport{}, false, fmt.Errorf("%s: %v", path, err)
+	}
+	return report, true, nil
+}
+
+// writeRunReport writes report to path.
+func writeRunReport(path string, report runReport) error {
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(contents, '\n'), 0)
+}
+
+// diffRunReports describes what changed from the last run to this one,
+// one line per file added or dropped and per injected key added, removed
+// or changed, sorted by file and field.
+func diffRunReports(last, this runReport) []string {
+	type key struct{ file, message, field, key string }
+	values := func(report runReport) map[key]string {
+		m := map[key]string{}
+		for _, row := range report.Tags {
+			m[key{row.File, row.Message, row.Field, row.Key}] = row.Value
+		}
+		return m
+	}
+	lastTags, thisTags := values(last), values(this)
+	lastFiles, thisFiles := map[string]bool{}, map[string]bool{}
+	for _, file := range last.Files {
+		lastFiles[file] = true
+	}
+	for _, file := range this.Files {
+		thisFiles[file] = true
+	}
+
+	type change struct {
+		key
+		line string
+	}
+	var changes []change
+	for file := range thisFiles {
+		if !lastFiles[file] {
+			changes = append(changes, change{key{file: file}, fmt.Sprintf("%s: new file", file)})
+		}
+	}
+	for file := range lastFiles {
+		if !thisFiles[file] {
+			changes = append(changes, change{key{file: file}, fmt.Sprintf("%s: file dropped", file)})
+		}
+	}
+	for k, value := range thisTags {
+		lastValue, ok := lastTags[k]
+		switch {
+		case !ok:
+			changes = append(changes, change{k, fmt.Sprintf("%s: %s.%s: new %s:%q", k.file, k.message, k.field, k.key, value)})
+		case lastValue != value:
+			changes = append(changes, change{k, fmt.Sprintf("%s: %s.%s: %s changed from %q to %q", k.file, k.message, k.field, k.key, lastValue, value)})
+		}
+	}
+	for k, value := range lastTags {
+		// the keys of dropped files are covered by their file line
+		if _, ok := thisTags[k]; !ok && thisFiles[k.file] {
+			changes = append(changes, change{k, fmt.Sprintf("%s: %s.%s: removed %s:%q", k.file, k.message, k.field, k.key, value)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i].key, changes[j].key
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		if a.message != b.message {
+			return a.message < b.message
+		}
+		if a.field != b.field {
+			return a.field < b.field
+		}
+		return a.key < b.key
+	})
+	lines := make([]string, len(changes))
+	for i, c := range changes {
+		lines[i] = c.line
+	}
+	return lines
+}
+
+// reportLastRun logs what changed since the run whose report is at path,
+// if any, then replaces it with the report of files.
+func reportLastRun(path string, files []stagedFile, opts options) error {
+	this, err := newRunReport(files, opts)
+	if err != nil {
+		return err
+	}
+	last, ok, err := loadRunReport(path)
+	if err != nil {
+		return err
+	}
+	if opts.LogLevel != inject.LogQuiet {
+		logger := opts.logger()
+		if !ok {
+			logger.Printf("no last run in %q, recording this one", path)
+		} else {
+			lines := diffRunReports(last, this)
+			logger.Printf("%d change(s) since the last run", len(lines))
+			for _, line := range lines {
+				logger.Print(line)
+			}
+		}
+	}
+	return writeRunReport(path, this)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+var (
+	rCreateTable = regexp.MustCompile(`(?i)create\s+table\s+(?:if\s+not\s+exists\s+)?([\w."` + "`" + `\[\]]+)\s*\(`)
+	rPrimaryKey  = regexp.MustCompile(`(?i)^primary\s+key\s*\((.*)\)`)
+	rConstraint  = regexp.MustCompile(`(?i)^(?:constraint|primary|unique|key|index|foreign|check|exclude)\b`)
+)
+
+// schemaColumn is a column of a database table.
+type schemaColumn struct {
+	Name       string
+	PrimaryKey bool
+}
+
+// schemaTable is a database table, with its columns in declaration order.
+type schemaTable struct {
+	Name    string
+	Columns []schemaColumn
+}
+
+// unquoteIdent strips the quotes of a SQL identifier and its schema
+// qualifier, if any.
+func unquoteIdent(ident string) string {
+	ident = strings.Trim(ident, "\"`[]")
+	if i := strings.LastIndex(ident, "."); i >= 0 {
+		ident = strings.Trim(ident[i+1:], "\"`[]")
+	}
+	return ident
+}
+
+// splitColumns splits the body of a CREATE TABLE statement, starting
+// after its opening parenthesis, on commas outside of parentheses up to
+// its closing parenthesis.
+func splitColumns(body string) (defs []string) {
+	var depth, start int
+	for i, c := range body {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth == 0:
+			return append(defs, strings.TrimSpace(body[start:i]))
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, strings.TrimSpace(body[start:i]))
+			start = i + 1
+		}
+	}
+	return append(defs, strings.TrimSpace(body[start:]))
+}
+
+// parseDDL returns the tables created by the CREATE TABLE statements of
+// a SQL DDL script.
+func parseDDL(ddl []byte) (tables []schemaTable) {
+	for _, match := range rCreateTable.FindAllSubmatchIndex(ddl, -1) {
+		table := schemaTable{Name: unquoteIdent(string(ddl[match[2]:match[3]]))}
+		primaryKeys := map[string]bool{}
+		for _, def := range splitColumns(string(ddl[match[1]:])) {
+			if pk := rPrimaryKey.FindStringSubmatch(def); pk != nil {
+				for _, name := range strings.Split(pk[1], ",") {
+					primaryKeys[unquoteIdent(strings.TrimSpace(name))] = true
+				}
+				continue
+			}
+			fields := strings.Fields(def)
+			if len(fields) == 0 || rConstraint.MatchString(def) {
+				continue
+			}
+			table.Columns = append(table.Columns, schemaColumn{
+				Name:       unquoteIdent(fields[0]),
+				PrimaryKey: strings.Contains(strings.ToLower(def), "primary key"),
+			})
+		}
+		for i := range table.Columns {
+			table.Columns[i].PrimaryKey = table.Columns[i].PrimaryKey || primaryKeys[table.Columns[i].Name]
+		}
+		tables = append(tables, table)
+	}
+	return
+}
+
+// parseColumnsCSV returns the tables of an information_schema.columns CSV
+// dump, which must have table_name and column_name header columns.
+func parseColumnsCSV(contents []byte) ([]schemaTable, error) {
+	records, err := csv.NewReader(bytes.NewReader(contents)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	tableIndex, columnIndex := -1, -1
+	for i, name := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "table_name":
+			tableIndex = i
+		case "column_name":
+			columnIndex = i
+		}
+	}
+	if tableIndex < 0 || columnIndex < 0 {
+		return nil, errors.New("missing table_name or column_name header")
+	}
+	var tables []schemaTable
+	indexes := map[string]int{}
+	for _, record := range records[1:] {
+		name := record[tableIndex]
+		i, ok := indexes[name]
+		if !ok {
+			i = len(tables)
+			indexes[name] = i
+			tables = append(tables, schemaTable{Name: name})
+		}
+		tables[i].Columns = append(tables[i].Columns, schemaColumn{Name: record[columnIndex]})
+	}
+	return tables, nil
+}
+
+// normalizeName folds a table, column, message or field name for
+// matching: case and underscores are ignored, so user_accounts matches
+// UserAccount.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// schemaAnnotator returns an annotator tagging the fields of messages
+// matching tables with the column they match, using the db key or gorm's
+// column setting. Tables match messages by name or plural name, ignoring
+// case and underscores, and nested messages by their innermost name.
+func schemaAnnotator(tables []schemaTable, key string) protoFieldAnnotator {
+	columns := map[string]map[string]schemaColumn{}
+	for _, table := range tables {
+		byName := map[string]schemaColumn{}
+		for _, column := range table.Columns {
+			byName[normalizeName(column.Name)] = column
+		}
+		name := normalizeName(table.Name)
+		columns[name] = byName
+		if strings.HasSuffix(name, "s") {
+			if _, ok := columns[strings.TrimSuffix(name, "s")]; !ok {
+				columns[strings.TrimSuffix(name, "s")] = byName
+			}
+		}
+	}
+	return func(message, field string) string {
+		message = message[strings.LastIndex(message, ".")+1:]
+		column, ok := columns[normalizeName(message)][normalizeName(field)]
+		if !ok {
+			return ""
+		}
+		if key == "gorm" {
+			setting := "column:" + column.Name
+			if column.PrimaryKey {
+				setting += ";primaryKey"
+			}
+			return fmt.Sprintf(`gorm:"%s"`, setting)
+		}
+		return fmt.Sprintf(`db:"%s"`, column.Name)
+	}
+}
+
+// annotateProtoFiles annotates the fields of proto files with annotate,
+// writing them together once all of them are annotated.
+func annotateProtoFiles(paths []string, annotate protoFieldAnnotator) error {
+	tx := &transaction{observer: inject.NopObserver{}}
+	for _, path := range paths {
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents, count := annotateProtoSource(original, annotate)
+		tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: count > 0})
+		log.Printf("added %d annotation(s) to file %q", count, path)
+	}
+	return tx.commit()
+}
+
+// runImportSchema annotates the fields of proto files matching the
+// columns of a database schema, read from a SQL DDL script or an
+// information_schema.columns CSV dump.
+func runImportSchema(_ options, args []string) error {
+	fs := flag.NewFlagSet("import-schema", flag.ContinueOnError)
+	schema := fs.String("schema", "", "SQL DDL script, or information_schema.columns dump if it ends with .csv")
+	key := fs.String("key", "db", "tag key to annotate fields with: db or gorm")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *schema == "" || fs.NArg() == 0 || *key != "db" && *key != "gorm" {
+		return errors.New("usage: import-schema -schema file [-key db|gorm] proto...")
+	}
+	contents, err := ioutil.ReadFile(*schema)
+	if err != nil {
+		return err
+	}
+	var tables []schemaTable
+	if strings.HasSuffix(*schema, ".csv") {
+		if tables, err = parseColumnsCSV(contents); err != nil {
+			return fmt.Errorf("%s: %v", *schema, err)
+		}
+	} else {
+		tables = parseDDL(contents)
+	}
+	log.Printf("read %d table(s) from %q", len(tables), *schema)
+	return annotateProtoFiles(fs.Args(), schemaAnnotator(tables, *key))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// messageTags are the tags of the fields of a message once injected,
+// keyed by proto field name, then by tag key.
+type messageTags struct {
+	Message string                       `json:"message"`
+	Fields  map[string]map[string]string `json:"fields"`
+}
+
+// lookupTags returns the tags of the message fullName in files, or nil if
+// no file registers it. If field isn't empty, only that field is returned.
+func lookupTags(files []stagedFile, fullName, field string) (*messageTags, error) {
+	for _, file := range files {
+		messages, err := registeredMessages(file.path, file.contents)
+		if err != nil {
+			return nil, err
+		}
+		msg, ok := messages[fullName]
+		if !ok {
+			continue
+		}
+		result := &messageTags{Message: fullName, Fields: map[string]map[string]string{}}
+		var names []string
+		for name := range msg.tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tag := msg.tags[name]
+			pf, ok := parseProtobufTag(tag)
+			if !ok || field != "" && pf.Name != field {
+				continue
+			}
+			keys := map[string]string{}
+			for _, item := range newTagItems(tag) {
+				if value, err := strconv.Unquote(item.value); err == nil {
+					keys[item.key] = value
+				}
+			}
+			result.Fields[pf.Name] = keys
+		}
+		if field != "" && len(result.Fields) == 0 {
+			return nil, nil
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// tagsHandler serves the tags of a message, as processed from paths on
+// each request: GET /tags?message=acme.v1.User&field=email, the field
+// being optional.
+func tagsHandler(opts options, paths []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message := r.URL.Query().Get("message")
+		if message == "" {
+			http.Error(w, "message parameter is mandatory", http.StatusBadRequest)
+			return
+		}
+		tx, err := newInjector(opts).stageFiles(paths...)
+		var tags *messageTags
+		if err == nil {
+			tags, err = lookupTags(tx.files, message, r.URL.Query().Get("field"))
+		}
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case tags == nil:
+			http.Error(w, "message or field not found", http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tags)
+		}
+	})
+}
+
+// runServe serves the tags of the messages of the given files after
+// injection, without writing the files.
+func runServe(opts options, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: serve [-addr host:port] file...")
+	}
+	opts.Observer = inject.NopObserver{}
+	mux := http.NewServeMux()
+	mux.Handle("/tags", tagsHandler(opts, fs.Args()))
+	log.Printf("serving tags of %d file(s) on http://%s/tags", fs.NArg(), *addr)
+	return http.ListenAndServe(*addr, mux)
+}
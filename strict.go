@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"reflect"
+	"regexp"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// rNearMiss matches comments meant as annotations, starting with
+// @inject or inject_tag, which may not follow the grammar.
+var rNearMiss = regexp.MustCompile(`(?i)^//\s*(@\s*inject|inject[_:-]?tag)`)
+
+// unusedAnnotation is an annotation of a file which can't have any
+// effect, see strictAnnotations.
+type unusedAnnotation struct {
+	comment *ast.Comment
+	reason  string
+}
+
+// strictAnnotations returns the annotations -strict fails on besides the
+// ones reported anyway: @inject_tag_oneof comments which aren't on a
+// oneof with wrappers in the file, and comments which look like
+// annotations but don't follow the grammar, such as `// @inject_tags:`.
+func strictAnnotations(f *ast.File, typeSpecs []*ast.TypeSpec) []unusedAnnotation {
+	wrappers := oneofWrappers(f, typeSpecs)
+	oneofDocs := map[*ast.CommentGroup]bool{}
+	for _, typeSpec := range typeSpecs {
+		structDecl, ok := typeSpec.Type.(*ast.StructType)
+		if !ok {
+			continue
+		}
+		for _, field := range structDecl.Fields.List {
+			if _, ok := reflect.StructTag(fieldTag(field)).Lookup("protobuf_oneof"); !ok || field.Doc == nil {
+				continue
+			}
+			if iface, ok := field.Type.(*ast.Ident); ok && len(wrappers[iface.Name]) > 0 {
+				oneofDocs[field.Doc] = true
+			}
+		}
+	}
+	var unused []unusedAnnotation
+	for _, cg := range f.Comments {
+		for _, comment := range cg.List {
+			switch {
+			case rOneofComment.MatchString(comment.Text):
+				if !oneofDocs[cg] {
+					unused = append(unused, unusedAnnotation{comment, "is not the doc comment of a oneof with wrappers in the file"})
+				}
+			case isTagComment(comment.Text) || rDefine.MatchString(comment.Text) || rFlatJSON.MatchString(comment.Text):
+			case rNearMiss.MatchString(comment.Text):
+				unused = append(unused, unusedAnnotation{comment, "looks like an annotation but doesn't follow the grammar, e.g. // @inject_tag: key:\"value\""})
+			}
+		}
+	}
+	return unused
+}
+
+// strictObserver counts the annotations and rules without effect of a
+// file, reported as warnings wrapping inject.ErrNoMatch or
+// inject.ErrNoTag, for -strict to fail it.
+type strictObserver struct {
+	observer
+	unused int
+}
+
+func (o *strictObserver) OnWarning(path string, err error) {
+	if errors.Is(err, inject.ErrNoMatch) || errors.Is(err, inject.ErrNoTag) {
+		o.unused++
+	}
+	o.observer.OnWarning(path, err)
+}
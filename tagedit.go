@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// tagEdit rewrites the key:"value" pairs of a struct tag or annotation
+// comment, returning it unchanged if it doesn't apply.
+type tagEdit func(tag string) (string, error)
+
+// isAnnotation reports whether comment is an inject tag comment, directive
+// or oneof comment whose tags can be edited.
+func isAnnotation(comment string) bool {
+	return isTagComment(comment) || rOneofComment.MatchString(comment)
+}
+
+// editGoSource applies edit to the struct tags and annotation comments of
+// the Go source src, returning the edited source and the number of tags
+// and comments changed.
+func editGoSource(filename string, src []byte, edit tagEdit) ([]byte, int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, 0, &inject.FieldError{File: filename, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var replacements []replacement
+	replace := func(node ast.Node, text, quote string) error {
+		edited, err := edit(text)
+		if err != nil {
+			return &inject.FieldError{File: filename, Pos: fset.Position(node.Pos()), Err: err}
+		}
+		if edited != text {
+			replacements = append(replacements, replacement{
+				start: fset.Position(node.Pos()).Offset,
+				end:   fset.Position(node.End()).Offset,
+				text:  quote + edited + quote,
+			})
+		}
+		return nil
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		// only raw string tags, as generated, are edited
+		if field, ok := node.(*ast.Field); ok && field.Tag != nil && strings.HasPrefix(field.Tag.Value, "`") {
+			err = replace(field.Tag, fieldTag(field), "`")
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if !isAnnotation(c.Text) {
+				continue
+			}
+			if err = replace(c, c.Text, ""); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+	var edited []byte
+	last := 0
+	for _, r := range replacements {
+		edited = append(edited, src[last:r.start]...)
+		edited = append(edited, r.text...)
+		last = r.end
+	}
+	return append(edited, src[last:]...), len(replacements), nil
+}
+
+// editProtoSource applies edit to the annotation comments of the proto
+// source src, returning the edited source and the number of comments
+// changed.
+func editProtoSource(filename string, src []byte, edit tagEdit) ([]byte, int, error) {
+	lines := strings.Split(string(src), "\n")
+	var count int
+	for i, line := range lines {
+		start := strings.Index(line, "//")
+		if start < 0 || !isAnnotation(line[start:]) {
+			continue
+		}
+		edited, err := edit(line[start:])
+		if err != nil {
+			return nil, 0, &inject.FieldError{File: filename, Pos: token.Position{Filename: filename, Line: i + 1, Column: start + 1}, Err: err}
+		}
+		if edited != line[start:] {
+			lines[i] = line[:start] + edited
+			count++
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), count, nil
+}
+
+// editFiles applies edit to Go files, and to the annotation comments of
+// other files such as protos, writing them together once all of them are
+// edited.
+func editFiles(paths []string, edit tagEdit) error {
+	tx := &transaction{observer: inject.NopObserver{}}
+	for _, path := range paths {
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		editSource := editProtoSource
+		if strings.HasSuffix(path, ".go") {
+			editSource = editGoSource
+		}
+		contents, count, err := editSource(path, original, edit)
+		if err != nil {
+			return err
+		}
+		tx.files = append(tx.files, stagedFile{path: path, original: original, contents: contents, injected: count > 0})
+		log.Printf("edited %d tag(s) in file %q", count, path)
+	}
+	return tx.commit()
+}
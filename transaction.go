@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// transaction stages the rewrites of several files and writes them
+// together, so a failing file never leaves the others half injected.
+type transaction struct {
+	files []stagedFile
+	// observer is notified of injections and written files, progress is
+	// logged if nil.
+	observer observer
+	// mode is the permission bits of the written files, see
+	// writeContents.
+	mode os.FileMode
+	// backup writes the original contents of changed files to
+	// <file>.orig before they are written.
+	backup bool
+	// verify checks the written files with verifyWritten, formatted
+	// telling whether they were gofmt'd.
+	verify, formatted bool
+}
+
+type stagedFile struct {
+	path     string
+	original []byte
+	contents []byte
+	injected bool
+	// source is the input contents were injected from when they are
+	// written elsewhere, see redirectOutput, original holding the current
+	// contents of path then; nil if it is original.
+	source []byte
+	// generated files, such as -oneof_marshalers, are written whole
+	// rather than injected.
+	generated bool
+}
+
+// input returns the contents file was injected from.
+func (file stagedFile) input() []byte {
+	if file.source != nil {
+		return file.source
+	}
+	return file.original
+}
+
+// stage reads inputPath and stages its contents with areas injected.
+func (tx *transaction) stage(inputPath string, areas []textArea) (err error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return
+	}
+
+	original, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		return
+	}
+	return tx.stageSource(inputPath, original, areas)
+}
+
+// stageSource stages original, the contents of inputPath, with areas
+// injected.
+func (tx *transaction) stageSource(inputPath string, original []byte, areas []textArea) (err error) {
+	for i := 1; i < len(areas); i++ {
+		if areas[i].Start < areas[i-1].End {
+			return &inject.FieldError{File: inputPath, Err: fmt.Errorf("%w: %q and %q",
+				inject.ErrOverlap, original[areas[i-1].Start-1:areas[i-1].End-1], original[areas[i].Start-1:areas[i].End-1])}
+		}
+	}
+	obs := orLog(tx.observer)
+	for _, area := range areas {
+		if alreadyInjected(area) {
+			continue
+		}
+		obs.OnInjection(inputPath, area, string(original[area.Start-1:area.End-1]))
+	}
+	contents := make([]byte, len(original))
+	copy(contents, original)
+	contents = injectAreas(contents, areas)
+	if len(areas) > 0 {
+		if err = checkOnlyTagsChanged(inputPath, original, contents); err != nil {
+			return
+		}
+	}
+	tx.files = append(tx.files, stagedFile{
+		path:     inputPath,
+		original: original,
+		contents: contents,
+		injected: len(areas) > 0,
+	})
+	return
+}
+
+// changed reports whether injection changed the contents of file.
+func (file stagedFile) changed() bool {
+	return !bytes.Equal(file.original, file.contents)
+}
+
+// commit writes all changed staged files, after their backups if
+// enabled. If a write fails, the files written so far are restored to
+// their original contents.
+func (tx *transaction) commit() error {
+	if tx.backup {
+		for _, file := range tx.files {
+			if file.changed() && file.original != nil {
+				if err := writeContents(file.path+".orig", file.original, tx.mode); err != nil {
+					return fmt.Errorf("%w: backup: %v", inject.ErrWrite, err)
+				}
+			}
+		}
+	}
+	for i, file := range tx.files {
+		if !file.changed() {
+			continue
+		}
+		if err := writeContents(file.path, file.contents, tx.mode); err != nil {
+			return fmt.Errorf("%w: %v%s", inject.ErrWrite, err, tx.rollback(tx.files[:i+1]))
+		}
+	}
+	if tx.verify {
+		for _, file := range tx.files {
+			if !file.changed() {
+				continue
+			}
+			if err := verifyWritten(file, tx.formatted); err != nil {
+				return fmt.Errorf("%w%s", err, tx.rollback(tx.files))
+			}
+		}
+	}
+	obs := orLog(tx.observer)
+	for _, file := range tx.files {
+		obs.OnFileDone(file.path, file.changed())
+	}
+	return nil
+}
+
+// summary counts the staged files changed by injection, the files with
+// annotations already satisfied and the files without annotations.
+func (tx *transaction) summary() (changed, unchanged, unannotated int) {
+	for _, file := range tx.files {
+		switch {
+		case file.changed():
+			changed++
+		case file.injected:
+			unchanged++
+		default:
+			unannotated++
+		}
+	}
+	return
+}
+
+// rollback restores files to their original contents, removing the ones
+// which didn't exist, returning a description of the files it failed to
+// restore, if any.
+func (tx *transaction) rollback(files []stagedFile) (failed string) {
+	for _, file := range files {
+		if !file.changed() {
+			continue
+		}
+		var err error
+		switch {
+		case file.original == nil && isObjectURL(file.path):
+			// the CLIs copy objects but don't delete them
+			failed += fmt.Sprintf("; failed to remove the new object %q", file.path)
+			continue
+		case file.original == nil:
+			err = os.Remove(file.path)
+		default:
+			err = writeContents(file.path, file.original, 0)
+		}
+		if err != nil {
+			failed += fmt.Sprintf("; failed to restore %q: %v", file.path, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// releasesURL lists the releases of the tool, as GitHub's API does.
+const releasesURL = "https://api.github.com/repos/favadi/protoc-go-inject-tag/releases"
+
+// checksumsAsset is the release asset listing the SHA-256 checksums of
+// the other assets, one "checksum  name" line per asset as sha256sum
+// writes them.
+const checksumsAsset = "checksums.txt"
+
+// release is a release of the tool as listed by releasesURL.
+type release struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the asset name of r, if any.
+func (r release) assetURL(name string) (string, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, true
+		}
+	}
+	return "", false
+}
+
+// binaryAsset returns the name of the release asset of the binary for
+// goos and goarch, e.g. protoc-go-inject-tag_linux_amd64.
+func binaryAsset(goos, goarch string) string {
+	name := "protoc-go-inject-tag_" + goos + "_" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// httpGet returns the body of url, failing on statuses other than 200.
+func httpGet(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// latestRelease returns the newest release of the releases at url with
+// the major version of current, skipping drafts and pre-releases, ok
+// being false if none is newer than current.
+func latestRelease(url, current string) (latest release, ok bool, err error) {
+	body, err := httpGet(url)
+	if err != nil {
+		return release{}, false, err
+	}
+	var releases []release
+	if err = json.Unmarshal(body, &releases); err != nil {
+		return release{}, false, fmt.Errorf("%s: %v", url, err)
+	}
+	newest, err := parseVersion(current)
+	if err != nil {
+		return release{}, false, fmt.Errorf("version %s is unknown, install a release to update it", current)
+	}
+	major := newest[0]
+	for _, r := range releases {
+		v, err := parseVersion(r.TagName)
+		if err != nil || r.Draft || r.Prerelease || v[0] != major {
+			continue
+		}
+		if compareVersions(v, newest) > 0 {
+			latest, newest, ok = r, v, true
+		}
+	}
+	return latest, ok, nil
+}
+
+// downloadAsset downloads the asset name of r and checks it against its
+// checksum in the checksums asset of r.
+func downloadAsset(r release, name string) ([]byte, error) {
+	url, ok := r.assetURL(name)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s asset", r.TagName, name)
+	}
+	checksumsURL, ok := r.assetURL(checksumsAsset)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s asset, can't verify %s", r.TagName, checksumsAsset, name)
+	}
+	checksums, err := httpGet(checksumsURL)
+	if err != nil {
+		return nil, err
+	}
+	var expected string
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		// sha256sum marks binary files with a * before their name
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			expected = strings.ToLower(fields[0])
+		}
+	}
+	if expected == "" {
+		return nil, fmt.Errorf("%s of release %s has no checksum for %s", checksumsAsset, r.TagName, name)
+	}
+	contents, err := httpGet(url)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return nil, fmt.Errorf("%s of release %s has checksum %s, expected %s", name, r.TagName, actual, expected)
+	}
+	return contents, nil
+}
+
+// replaceExecutable replaces the executable at path with contents, the
+// new binary being written next to it first so a failed update never
+// leaves a truncated one.
+func replaceExecutable(path string, contents []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".new"
+	if err = ioutil.WriteFile(tmp, contents, info.Mode().Perm()|0111); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// a running executable can't be replaced, but can be renamed
+		old := path + ".old"
+		os.Remove(old)
+		if err = os.Rename(path, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// selfUpdate replaces the executable at exe with the newest release at
+// url of the major version of the tool, unless check is true, describing
+// what it does to w.
+func selfUpdate(w io.Writer, url, exe string, check bool) error {
+	latest, ok, err := latestRelease(url, version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintf(w, "protoc-go-inject-tag %s is up to date\n", version)
+		return nil
+	}
+	if check {
+		fmt.Fprintf(w, "protoc-go-inject-tag %s is available, %s installed\n", latest.TagName, version)
+		return nil
+	}
+	contents, err := downloadAsset(latest, binaryAsset(runtime.GOOS, runtime.GOARCH))
+	if err != nil {
+		return err
+	}
+	if err = replaceExecutable(exe, contents); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "updated %s from %s to %s\n", exe, version, latest.TagName)
+	return nil
+}
+
+// runUpdate replaces the running binary with the newest release of its
+// major version.
+func runUpdate(_ options, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "only report whether a newer release is available")
+	url := fs.String("releases", releasesURL, "URL listing the releases, as GitHub's releases API does")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: update [-check] [-releases url]")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	return selfUpdate(os.Stdout, *url, exe, *check)
+}
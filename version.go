@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// version is the version of the tool, releases set it with
+// -ldflags "-X main.version=vX.Y.Z". Otherwise it is the module version
+// recorded in the build info, e.g. by go install ...@v1.4.0, or
+// "(devel)" for builds of a checkout.
+var version string
+
+func init() {
+	if version == "" {
+		version = buildVersion()
+	}
+}
+
+// buildVersion returns the module version of the build info of the
+// tool, "(devel)" if there is none.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// versionInfo returns the tool version, with the commit and the Go
+// version it was built from as recorded in its build info, for -version:
+// e.g. "protoc-go-inject-tag v1.4.0 commit 1a2b3c4d5e6f go1.21.0". The
+// commit is suffixed with "-dirty" if the work tree had changes, and
+// missing if it wasn't built from a VCS checkout.
+func versionInfo() string {
+	goVersion := runtime.Version()
+	var commit string
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.GoVersion != "" {
+			goVersion = info.GoVersion
+		}
+		var modified bool
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				commit = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if commit != "" && modified {
+			commit += "-dirty"
+		}
+	}
+	if commit == "" {
+		return fmt.Sprintf("protoc-go-inject-tag %s %s", version, goVersion)
+	}
+	return fmt.Sprintf("protoc-go-inject-tag %s commit %s %s", version, commit, goVersion)
+}
+
+// syntaxVersion is the version of the annotation syntax the tool
+// understands, increased when annotations change meaning.
+const syntaxVersion = 1
+
+// version pin policies, see cliFlags.versionPolicy.
+const (
+	versionError = "error"
+	versionWarn  = "warn"
+)
+
+// parseVersion returns the numbers of a vX.Y.Z version, missing numbers
+// being 0 and pre-release and build suffixes being ignored.
+func parseVersion(v string) ([3]int, error) {
+	var numbers [3]int
+	trimmed := strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	parts := strings.Split(trimmed, ".")
+	if len(parts) > 3 {
+		return numbers, fmt.Errorf("invalid version %q", v)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, fmt.Errorf("invalid version %q", v)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkVersion returns an error if the tool version is outside of the
+// pinned range, an empty bound meaning no bound, or if the annotations
+// are written for a newer syntax than the tool understands. The bounds
+// must be valid versions. The version of builds which don't record one,
+// such as "(devel)", is unknown: the range isn't checked then, which is
+// returned as a warning.
+func checkVersion(min, max string, syntax int) (warning, err error) {
+	if syntax > syntaxVersion {
+		return nil, fmt.Errorf("-syntax_version=%d is newer than the annotation syntax %d of version %s", syntax, syntaxVersion, version)
+	}
+	if min == "" && max == "" {
+		return nil, nil
+	}
+	current, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("version %s is unknown, -min_version and -max_version aren't checked", version), nil
+	}
+	if min != "" {
+		if v, _ := parseVersion(min); compareVersions(current, v) < 0 {
+			return nil, fmt.Errorf("version %s is older than -min_version=%s", version, min)
+		}
+	}
+	if max != "" {
+		if v, _ := parseVersion(max); compareVersions(current, v) > 0 {
+			return nil, fmt.Errorf("version %s is newer than -max_version=%s", version, max)
+		}
+	}
+	return nil, nil
+}
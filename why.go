@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/favadi/protoc-go-inject-tag/inject"
+)
+
+// explainTag describes the layers setting key on the fields of the Go
+// source src named field, as Message.field with the registered full name
+// of the message and the proto name of the field, or with their Go names.
+// Each layer overrides the ones before it: the tag of the field before
+// injection, then the global rules, the oneof comments and the comments
+// of the field. ok is false if no field is named field.
+func explainTag(path string, src []byte, opts options, field, key string) (lines []string, ok bool, err error) {
+	opts.Observer = inject.NopObserver{}
+	areas, err := parseSource(path, src, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	injected := map[int]textArea{}
+	for _, area := range areas {
+		injected[area.Start] = area
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), path, src, 0)
+	if err != nil {
+		return nil, false, &inject.FieldError{File: path, Err: fmt.Errorf("%w: %v", inject.ErrParse, err)}
+	}
+	registered := registeredTypes(f)
+	value := func(tag string) (string, bool) {
+		for _, item := range newTagItems(tag) {
+			if item.key == key {
+				if unquoted, err := strconv.Unquote(item.value); err == nil {
+					return unquoted, true
+				}
+				return item.value, true
+			}
+		}
+		return "", false
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		typeSpec, isType := node.(*ast.TypeSpec)
+		if !isType {
+			return true
+		}
+		structDecl, isStruct := typeSpec.Type.(*ast.StructType)
+		if !isStruct {
+			return true
+		}
+		for _, structField := range structDecl.Fields.List {
+			name := typeSpec.Name.Name + "." + fieldName(structField)
+			if fullName, isRegistered := registered[typeSpec.Name.Name]; isRegistered {
+				if pf, isProto := parseProtobufTag(fieldTag(structField)); isProto && pf.Name != "" && fullName+"."+pf.Name == field {
+					name = field
+				}
+			}
+			if name != field {
+				continue
+			}
+			ok = true
+			area, isInjected := injected[int(structField.Pos())]
+			layers := []tagLayer{{Source: "existing tag", Tag: fieldTag(structField)}}
+			if isInjected {
+				layers[0].Tag = area.CurrentTag
+				layers = append(layers, area.Layers...)
+				if len(area.Layers) == 0 {
+					// injected line by line by -lenient
+					layers = append(layers, tagLayer{Source: "comment", Tag: area.InjectTag})
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s %s:", path, name, key))
+			var final *tagLayer
+			for i := range layers {
+				if v, set := value(layers[i].Tag); set {
+					lines = append(lines, fmt.Sprintf("  %s: %s:%q", layers[i].Source, key, v))
+					final = &layers[i]
+				}
+			}
+			if final == nil {
+				lines = append(lines, "  no layer sets "+key)
+			} else {
+				v, _ := value(final.Tag)
+				lines = append(lines, fmt.Sprintf("  final %s:%q, from %s", key, v, final.Source))
+			}
+		}
+		return true
+	})
+	return lines, ok, nil
+}
+
+// runWhy prints which layers set a key of the tag of a field, and the
+// one the final value comes from.
+func runWhy(opts options, args []string) error {
+	fs := flag.NewFlagSet("why", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 3 {
+		return errors.New("usage: why Message.field key file...")
+	}
+	field, key := fs.Arg(0), fs.Arg(1)
+	var found bool
+	for _, path := range fs.Args()[2:] {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines, ok, err := explainTag(path, src, opts, field, key)
+		if err != nil {
+			return err
+		}
+		found = found || ok
+		for _, line := range lines {
+			fmt.Fprintln(os.Stdout, line)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no field %s in the given files", field)
+	}
+	return nil
+}